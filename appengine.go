@@ -0,0 +1,170 @@
+// +build appengine
+
+/*****************************************************************************
+ **
+ ** Gofr
+ ** https://github.com/pokebyte/Gofr
+ ** Copyright (C) 2013-2017 Akop Karapetyan
+ **
+ ** This program is free software; you can redistribute it and/or modify
+ ** it under the terms of the GNU General Public License as published by
+ ** the Free Software Foundation; either version 2 of the License, or
+ ** (at your option) any later version.
+ **
+ ** This program is distributed in the hope that it will be useful,
+ ** but WITHOUT ANY WARRANTY; without even the implied warranty of
+ ** MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ ** GNU General Public License for more details.
+ **
+ ** You should have received a copy of the GNU General Public License
+ ** along with this program; if not, write to the Free Software
+ ** Foundation, Inc., 675 Mass Ave, Cambridge, MA 02139, USA.
+ **
+ ******************************************************************************
+ */
+ 
+package gofr
+
+import (
+	"appengine"
+	"appengine/blobstore"
+	"appengine/channel"
+	"appengine/taskqueue"
+	"appengine/urlfetch"
+	"appengine/user"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"storage"
+	"time"
+)
+
+func init() {
+	// Initialize handlers
+	http.HandleFunc("/", Run)
+
+	registerRoutes()
+	RegisterAuthenticator(googleAuthenticator{})
+}
+
+// appEnginePlatform provides the reader's services using
+// App Engine's APIs
+type appEnginePlatform struct {
+	c appengine.Context
+}
+
+func Run(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+	pfc := PFContext {
+		R: r,
+		C: c,
+		W: w,
+		Platform: &appEnginePlatform { c: c },
+		Storage: storage.NewDatastore(c),
+		LoginURL: loginURL(r.URL.String()),
+	}
+
+	routeRequest(&pfc)
+}
+
+func (p *appEnginePlatform)HTTPClient() *http.Client {
+	return &http.Client {
+		Transport: &urlfetch.Transport {
+			Context: p.c,
+			Deadline: time.Duration(fetchDeadlineSeconds) * time.Second,
+		},
+	}
+}
+
+func (p *appEnginePlatform)AddTask(path string, values url.Values, queueName string) error {
+	task := taskqueue.NewPOSTTask(path, values)
+	if _, err := taskqueue.Add(p.c, task, queueName); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (p *appEnginePlatform)CreateChannel(clientID string) (string, error) {
+	return channel.Create(p.c, clientID)
+}
+
+func (p *appEnginePlatform)SendChannelMessage(clientID string, message interface{}) error {
+	return channel.SendJSON(p.c, clientID, message)
+}
+
+func (p *appEnginePlatform)UploadURL(path string) (string, error) {
+	if uploadURL, err := blobstore.UploadURL(p.c, path, nil); err != nil {
+		return "", err
+	} else {
+		return uploadURL.String(), nil
+	}
+}
+
+func (p *appEnginePlatform)ParseUpload(r *http.Request, field string) (string, url.Values, error) {
+	blobs, other, err := blobstore.ParseUpload(r)
+	if err != nil {
+		return "", nil, err
+	}
+
+	if blobInfos := blobs[field]; len(blobInfos) > 0 {
+		return string(blobInfos[0].BlobKey), other, nil
+	}
+
+	return "", other, nil
+}
+
+func (p *appEnginePlatform)OpenUpload(key string) (io.ReadCloser, error) {
+	return ioutil.NopCloser(blobstore.NewReader(p.c, appengine.BlobKey(key))), nil
+}
+
+func (p *appEnginePlatform)DeleteUpload(key string) error {
+	return blobstore.Delete(p.c, appengine.BlobKey(key))
+}
+
+func (p *appEnginePlatform)BaseURL() string {
+	return "https://" + appengine.DefaultVersionHostname(p.c)
+}
+
+func (p *appEnginePlatform)IsDevServer() bool {
+	return appengine.IsDevAppServer()
+}
+
+// googleAuthenticator signs users in with their Google accounts,
+// through App Engine's Users API
+type googleAuthenticator struct {
+}
+
+func (a googleAuthenticator)Name() string {
+	return "google"
+}
+
+func (a googleAuthenticator)Title() string {
+	return "Google"
+}
+
+func (a googleAuthenticator)HandleLogin(pfc *PFContext) (*Identity, error) {
+	c := pfc.C.(appengine.Context)
+
+	if u := user.Current(c); u != nil {
+		return &Identity {
+			Provider: a.Name(),
+			Subject: u.ID,
+			Email: u.Email,
+		}, nil
+	}
+
+	// Sign in with Google, then come back
+	if url, err := user.LoginURL(c, pfc.R.URL.String()); err != nil {
+		return nil, err
+	} else {
+		http.Redirect(pfc.W, pfc.R, url, http.StatusFound)
+	}
+
+	return nil, nil
+}
+
+func (a googleAuthenticator)LogoutURL(pfc *PFContext, dest string) (string, error) {
+	return user.LogoutURL(pfc.C.(appengine.Context), dest)
+}
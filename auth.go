@@ -0,0 +1,485 @@
+/*****************************************************************************
+ **
+ ** Gofr
+ ** https://github.com/pokebyte/Gofr
+ ** Copyright (C) 2013-2017 Akop Karapetyan
+ **
+ ** This program is free software; you can redistribute it and/or modify
+ ** it under the terms of the GNU General Public License as published by
+ ** the Free Software Foundation; either version 2 of the License, or
+ ** (at your option) any later version.
+ **
+ ** This program is distributed in the hope that it will be useful,
+ ** but WITHOUT ANY WARRANTY; without even the implied warranty of
+ ** MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ ** GNU General Public License for more details.
+ **
+ ** You should have received a copy of the GNU General Public License
+ ** along with this program; if not, write to the Free Software
+ ** Foundation, Inc., 675 Mass Ave, Cambridge, MA 02139, USA.
+ **
+ ******************************************************************************
+ */
+ 
+package gofr
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"html/template"
+	"net/http"
+	"net/url"
+	"storage"
+	"strings"
+	"time"
+)
+
+const (
+	sessionCookieName = "gofr-session"
+	continueCookieName = "gofr-continue"
+	sessionDuration = 30 * 24 * time.Hour
+	continueCookieMaxAge = 600
+
+	loginPath = "/login"
+	logoutPath = "/logout"
+	authPathPrefix = "/auth/"
+
+	// Users created before sign-in was pluggable are keyed by their
+	// Google account ID. The first sign-in through this provider
+	// links the existing account
+	legacyProvider = "google"
+)
+
+// Identity is a user, as identified by a login provider
+type Identity struct {
+	Provider string
+	Subject string
+	Email string
+}
+
+// Authenticator signs users in through a login provider. Each one
+// serves its sign-in pages at /auth/<name>
+type Authenticator interface {
+	// Name identifies the provider. It's recorded with each linked
+	// identity, so it shouldn't change
+	Name() string
+	// Title is shown to the user, e.g. on the sign-in page
+	Title() string
+	// HandleLogin serves a request to the authenticator's sign-in
+	// page. Once the user has proven their identity, it returns
+	// it; until then, it returns nil, having written a response
+	HandleLogin(pfc *PFContext) (*Identity, error)
+}
+
+// LogoutAuthenticator is implemented by authenticators whose provider
+// keeps a session of its own, which should end along with Gofr's
+type LogoutAuthenticator interface {
+	Authenticator
+	LogoutURL(pfc *PFContext, dest string) (string, error)
+}
+
+var authenticators []Authenticator
+
+// RegisterAuthenticator makes a login provider available for
+// signing in and linking accounts
+func RegisterAuthenticator(authenticator Authenticator) {
+	authenticators = append(authenticators, authenticator)
+	RegisterAnonHTMLRoute(authPathPrefix + authenticator.Name(), func(pfc *PFContext) {
+		handleLogin(pfc, authenticator)
+	})
+}
+
+func authenticatorByName(name string) Authenticator {
+	for _, authenticator := range authenticators {
+		if authenticator.Name() == name {
+			return authenticator
+		}
+	}
+
+	return nil
+}
+
+func registerAuth() {
+	RegisterAnonHTMLRoute(loginPath, login)
+	RegisterAnonHTMLRoute(logoutPath, logout)
+	RegisterHTMLRoute("/account", account)
+	RegisterHTMLRoute("/account/unlink", unlinkIdentity)
+}
+
+var loginTemplate = template.Must(template.New("login").Parse(loginTemplateHTML))
+var accountTemplate = template.Must(template.New("account").Parse(accountTemplateHTML))
+
+func loginURL(dest string) string {
+	return loginPath + "?continue=" + url.QueryEscape(dest)
+}
+
+func logoutURL(dest string) string {
+	return logoutPath + "?continue=" + url.QueryEscape(dest)
+}
+
+func randomToken() (string, error) {
+	token := make([]byte, 20)
+	if _, err := rand.Read(token); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(token), nil
+}
+
+// digest returns a hex-encoded SHA-256 digest of the (purpose-prefixed)
+// value. Only digests of session tokens are stored, so that stored
+// sessions can't be used to sign in
+func digest(purpose string, value string) string {
+	sum := sha256.Sum256([]byte(purpose + ":" + value))
+	return hex.EncodeToString(sum[:])
+}
+
+// localPath returns dest if it refers to a path on this server,
+// and "/" otherwise, so that sign-in can't redirect elsewhere
+func localPath(dest string) string {
+	if strings.HasPrefix(dest, "/") && !strings.HasPrefix(dest, "//") && !strings.HasPrefix(dest, "/\\") {
+		return dest
+	}
+
+	return "/"
+}
+
+func isSecure(pfc *PFContext) bool {
+	return strings.HasPrefix(pfc.Platform.BaseURL(), "https://")
+}
+
+// currentSession returns the session the request was made in,
+// or nil if the user isn't signed in
+func currentSession(pfc *PFContext) *storage.Session {
+	cookie, err := pfc.R.Cookie(sessionCookieName)
+	if err != nil || cookie.Value == "" {
+		return nil
+	}
+
+	sessionID := digest("session", cookie.Value)
+	if session, err := pfc.Storage.SessionByID(sessionID); err != nil {
+		pfc.C.Errorf("Error loading session: %s", err)
+		return nil
+	} else if session == nil {
+		return nil
+	} else if time.Now().After(session.Expires) {
+		if err := pfc.Storage.DeleteSession(sessionID); err != nil {
+			pfc.C.Warningf("Error deleting expired session: %s", err)
+		}
+		return nil
+	} else {
+		return session
+	}
+}
+
+// csrfToken returns a token that forms posted within the current
+// session must include
+func csrfToken(pfc *PFContext) string {
+	if cookie, err := pfc.R.Cookie(sessionCookieName); err == nil {
+		return digest("csrf", cookie.Value)
+	}
+
+	return ""
+}
+
+func isValidCSRFToken(pfc *PFContext, token string) bool {
+	expected := csrfToken(pfc)
+	return expected != "" && subtle.ConstantTimeCompare([]byte(token), []byte(expected)) == 1
+}
+
+func startSession(pfc *PFContext, userID storage.UserID, provider string) error {
+	token, err := randomToken()
+	if err != nil {
+		return err
+	}
+
+	session := storage.Session {
+		ID: digest("session", token),
+		UserID: userID,
+		Provider: provider,
+		Expires: time.Now().Add(sessionDuration),
+	}
+	if err := pfc.Storage.SaveSession(session); err != nil {
+		return err
+	}
+
+	http.SetCookie(pfc.W, &http.Cookie {
+		Name: sessionCookieName,
+		Value: token,
+		Path: "/",
+		Expires: session.Expires,
+		HttpOnly: true,
+		Secure: isSecure(pfc),
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	return nil
+}
+
+func endSession(pfc *PFContext, session *storage.Session) {
+	if err := pfc.Storage.DeleteSession(session.ID); err != nil {
+		pfc.C.Warningf("Error deleting session: %s", err)
+	}
+
+	http.SetCookie(pfc.W, &http.Cookie {
+		Name: sessionCookieName,
+		Path: "/",
+		MaxAge: -1,
+	})
+}
+
+func renderLogin(pfc *PFContext, dest string, message string) {
+	content := map[string]interface{} {
+		"Continue": dest,
+		"Authenticators": authenticators,
+		"Error": message,
+	}
+
+	pfc.W.Header().Set("Content-type", "text/html; charset=utf-8")
+	if err := loginTemplate.Execute(pfc.W, content); err != nil {
+		http.Error(pfc.W, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+func login(pfc *PFContext) {
+	dest := localPath(pfc.R.FormValue("continue"))
+
+	if pfc.User != nil {
+		http.Redirect(pfc.W, pfc.R, dest, http.StatusFound)
+		return
+	} else if len(authenticators) == 1 {
+		// Nothing to choose from
+		http.Redirect(pfc.W, pfc.R, authPathPrefix + authenticators[0].Name() + "?continue=" + url.QueryEscape(dest), http.StatusFound)
+		return
+	}
+
+	renderLogin(pfc, dest, "")
+}
+
+func logout(pfc *PFContext) {
+	dest := localPath(pfc.R.FormValue("continue"))
+
+	if session := currentSession(pfc); session != nil {
+		endSession(pfc, session)
+
+		if authenticator, ok := authenticatorByName(session.Provider).(LogoutAuthenticator); ok {
+			if url, err := authenticator.LogoutURL(pfc, dest); err != nil {
+				pfc.C.Warningf("Error signing out of %s: %s", session.Provider, err)
+			} else {
+				dest = url
+			}
+		}
+	}
+
+	http.Redirect(pfc.W, pfc.R, dest, http.StatusFound)
+}
+
+// handleLogin serves the sign-in pages of an authenticator,
+// starting a session once the user is identified
+func handleLogin(pfc *PFContext, authenticator Authenticator) {
+	if dest := pfc.R.FormValue("continue"); dest != "" {
+		// Remember where to go once signed in; sign-in may take
+		// a trip through the provider's site
+		http.SetCookie(pfc.W, &http.Cookie {
+			Name: continueCookieName,
+			Value: localPath(dest),
+			Path: authPathPrefix,
+			MaxAge: continueCookieMaxAge,
+			HttpOnly: true,
+			Secure: isSecure(pfc),
+		})
+	}
+
+	dest := "/reader"
+	if cookie, err := pfc.R.Cookie(continueCookieName); err == nil {
+		dest = localPath(cookie.Value)
+	}
+	if value := pfc.R.FormValue("continue"); value != "" {
+		dest = localPath(value)
+	}
+
+	identity, err := authenticator.HandleLogin(pfc)
+	if err == nil && identity != nil {
+		err = completeLogin(pfc, identity)
+	}
+
+	if err != nil {
+		message := _l("An unexpected error has occurred")
+		if readableError, ok := err.(ReadableError); ok {
+			message = readableError.Error()
+			if readableError.err != nil {
+				pfc.C.Errorf("Sign-in through %s failed: %s", authenticator.Name(), *readableError.err)
+			}
+		} else {
+			pfc.C.Errorf("Sign-in through %s failed: %s", authenticator.Name(), err)
+		}
+
+		renderLogin(pfc, dest, message)
+		return
+	} else if identity == nil {
+		return
+	}
+
+	http.SetCookie(pfc.W, &http.Cookie {
+		Name: continueCookieName,
+		Path: authPathPrefix,
+		MaxAge: -1,
+	})
+	http.Redirect(pfc.W, pfc.R, dest, http.StatusFound)
+}
+
+// completeLogin starts a session for the user an identity belongs
+// to. If the identity is new, it's linked to the signed-in user
+// (or a new user, if no one is signed in)
+func completeLogin(pfc *PFContext, identity *Identity) error {
+	current := currentSession(pfc)
+
+	var userID storage.UserID
+	if linked, err := pfc.Storage.IdentityByLogin(identity.Provider, identity.Subject); err != nil {
+		return err
+	} else if linked != nil {
+		if current != nil && current.UserID != linked.UserID {
+			return NewReadableErrorWithCode(_l("This login is already linked to a different account"), http.StatusConflict, nil)
+		}
+		userID = linked.UserID
+	} else {
+		if current != nil {
+			// Linking a new login to the signed-in user
+			userID = current.UserID
+		} else if newUserID, err := createUser(pfc, identity); err != nil {
+			return err
+		} else {
+			userID = newUserID
+		}
+
+		linked := storage.LoginIdentity {
+			Provider: identity.Provider,
+			Subject: identity.Subject,
+			UserID: userID,
+			Email: identity.Email,
+			Linked: time.Now(),
+		}
+		if err := pfc.Storage.SaveIdentity(linked); err != nil {
+			return err
+		}
+	}
+
+	if current != nil {
+		endSession(pfc, current)
+	}
+
+	return startSession(pfc, userID, identity.Provider)
+}
+
+// createUser creates a user for someone signing in for the first
+// time, unless they have an account that predates login identities
+func createUser(pfc *PFContext, identity *Identity) (storage.UserID, error) {
+	if identity.Provider == legacyProvider {
+		if user, err := pfc.Storage.UserByID(storage.UserID(identity.Subject)); err != nil {
+			return "", err
+		} else if user != nil {
+			return storage.UserID(user.ID), nil
+		}
+	}
+
+	userID, err := randomToken()
+	if err != nil {
+		return "", err
+	}
+
+	user := storage.User {
+		ID: userID,
+		EmailAddress: identity.Email,
+	}
+	if user.EmailAddress == "" {
+		user.EmailAddress = identity.Subject
+	}
+
+	if err := pfc.Storage.SaveUser(user); err != nil {
+		return "", err
+	}
+
+	return storage.UserID(userID), nil
+}
+
+type linkedIdentity struct {
+	storage.LoginIdentity
+	Title string
+}
+
+func account(pfc *PFContext) {
+	renderAccount(pfc, nil)
+}
+
+// renderAccount renders the account page, with any extra content
+func renderAccount(pfc *PFContext, extra map[string]interface{}) {
+	identities, err := pfc.Storage.IdentitiesForUser(pfc.UserID)
+	if err != nil {
+		pfc.C.Errorf("Error loading identities: %s", err)
+		http.Error(pfc.W, _l("An unexpected error has occurred"), http.StatusInternalServerError)
+		return
+	}
+
+	linked := make([]linkedIdentity, len(identities))
+	for i, identity := range identities {
+		linked[i] = linkedIdentity { LoginIdentity: identity, Title: identity.Provider }
+		if authenticator := authenticatorByName(identity.Provider); authenticator != nil {
+			linked[i].Title = authenticator.Title()
+		}
+	}
+
+	content := map[string]interface{} {
+		"UserEmail": pfc.User.EmailAddress,
+		"Identities": linked,
+		"CanUnlink": len(linked) > 1,
+		"Authenticators": authenticators,
+		"CSRFToken": csrfToken(pfc),
+		"LogOutURL": logoutURL("/"),
+		"FeverEnabled": pfc.User.FeverSessionID != "",
+		"GReaderEnabled": pfc.User.GReaderPasswordID != "",
+	}
+	for key, value := range extra {
+		content[key] = value
+	}
+
+	pfc.W.Header().Set("Content-type", "text/html; charset=utf-8")
+	if err := accountTemplate.Execute(pfc.W, content); err != nil {
+		http.Error(pfc.W, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+func unlinkIdentity(pfc *PFContext) {
+	r := pfc.R
+
+	if r.Method != "POST" || !isValidCSRFToken(pfc, r.PostFormValue("token")) {
+		http.Error(pfc.W, _l("Invalid request"), http.StatusBadRequest)
+		return
+	}
+
+	if identities, err := pfc.Storage.IdentitiesForUser(pfc.UserID); err != nil {
+		pfc.C.Errorf("Error loading identities: %s", err)
+		http.Error(pfc.W, _l("An unexpected error has occurred"), http.StatusInternalServerError)
+		return
+	} else if len(identities) < 2 {
+		http.Error(pfc.W, _l("Cannot remove your only login"), http.StatusBadRequest)
+		return
+	}
+
+	provider, subject := r.PostFormValue("provider"), r.PostFormValue("subject")
+	if identity, err := pfc.Storage.IdentityByLogin(provider, subject); err != nil {
+		pfc.C.Errorf("Error loading identity: %s", err)
+		http.Error(pfc.W, _l("An unexpected error has occurred"), http.StatusInternalServerError)
+		return
+	} else if identity == nil || identity.UserID != pfc.UserID {
+		http.Error(pfc.W, _l("Login not found"), http.StatusNotFound)
+		return
+	} else if err := pfc.Storage.DeleteIdentity(*identity); err != nil {
+		pfc.C.Errorf("Error removing identity: %s", err)
+		http.Error(pfc.W, _l("An unexpected error has occurred"), http.StatusInternalServerError)
+		return
+	}
+
+	http.Redirect(pfc.W, pfc.R, "/account", http.StatusFound)
+}
@@ -0,0 +1,167 @@
+/*****************************************************************************
+ **
+ ** Gofr
+ ** https://github.com/pokebyte/Gofr
+ ** Copyright (C) 2013-2017 Akop Karapetyan
+ **
+ ** This program is free software; you can redistribute it and/or modify
+ ** it under the terms of the GNU General Public License as published by
+ ** the Free Software Foundation; either version 2 of the License, or
+ ** (at your option) any later version.
+ **
+ ** This program is distributed in the hope that it will be useful,
+ ** but WITHOUT ANY WARRANTY; without even the implied warranty of
+ ** MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ ** GNU General Public License for more details.
+ **
+ ** You should have received a copy of the GNU General Public License
+ ** along with this program; if not, write to the Free Software
+ ** Foundation, Inc., 675 Mass Ave, Cambridge, MA 02139, USA.
+ **
+ ******************************************************************************
+ */
+ 
+package gofr
+
+import (
+	"golang.org/x/crypto/bcrypt"
+	"html/template"
+	"net/http"
+	"regexp"
+	"storage"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	localProvider = "local"
+	minPasswordLength = 8
+)
+
+var (
+	usernameRe = regexp.MustCompile(`^[A-Za-z0-9._@-]{3,64}$`)
+	localLoginTemplate = template.Must(template.New("localLogin").Parse(localLoginTemplateHTML))
+
+	// Compared against when there's no such account, so that
+	// failed sign-ins take as long either way
+	dummyPasswordHash []byte
+	dummyPasswordHashOnce sync.Once
+)
+
+// LocalAuthenticator signs users in with a username and a
+// bcrypt-hashed password, kept in storage
+type LocalAuthenticator struct {
+	// AllowSignup lets anyone create an account. Signed-in users may
+	// add a username and password to their account regardless
+	AllowSignup bool
+}
+
+func (a *LocalAuthenticator)Name() string {
+	return localProvider
+}
+
+func (a *LocalAuthenticator)Title() string {
+	return _l("Username and password")
+}
+
+func (a *LocalAuthenticator)HandleLogin(pfc *PFContext) (*Identity, error) {
+	r := pfc.R
+	linking := currentSession(pfc) != nil
+	canCreate := linking || a.AllowSignup
+
+	content := map[string]interface{} {
+		"Action": authPathPrefix + a.Name(),
+		"Linking": linking,
+		"CanCreate": canCreate,
+	}
+	if linking {
+		content["CSRFToken"] = csrfToken(pfc)
+	}
+
+	if r.Method == "POST" {
+		// Linking adds a way to sign in to the current account,
+		// so it mustn't be possible from another site
+		if linking && !isValidCSRFToken(pfc, r.PostFormValue("token")) {
+			return nil, NewReadableErrorWithCode(_l("Invalid request"), http.StatusBadRequest, nil)
+		}
+
+		username := strings.TrimSpace(r.PostFormValue("username"))
+		password := r.PostFormValue("password")
+
+		switch r.PostFormValue("action") {
+		case "signin":
+			if identity, err := a.signIn(pfc, username, password); err != nil {
+				return nil, err
+			} else if identity != nil {
+				return identity, nil
+			}
+			content["Error"] = _l("Incorrect username or password")
+		case "create":
+			if !canCreate {
+				return nil, NewReadableErrorWithCode(_l("New accounts cannot be created"), http.StatusForbidden, nil)
+			} else if !usernameRe.MatchString(username) {
+				content["Error"] = _l("Usernames are 3 to 64 letters, digits or any of . _ @ -")
+			} else if len(password) < minPasswordLength {
+				content["Error"] = _l("Passwords must be at least %d characters long", minPasswordLength)
+			} else if password != r.PostFormValue("confirm") {
+				content["Error"] = _l("Passwords do not match")
+			} else if hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost); err != nil {
+				return nil, err
+			} else {
+				account := storage.LocalAccount {
+					Username: username,
+					PasswordHash: hash,
+					Created: time.Now(),
+				}
+
+				if err := pfc.Storage.CreateLocalAccount(account); err == storage.ErrDuplicate {
+					content["Error"] = _l("That username is taken")
+				} else if err != nil {
+					return nil, err
+				} else {
+					return &Identity {
+						Provider: a.Name(),
+						Subject: strings.ToLower(username),
+						Email: strings.TrimSpace(r.PostFormValue("email")),
+					}, nil
+				}
+			}
+		}
+	}
+
+	pfc.W.Header().Set("Content-type", "text/html; charset=utf-8")
+	if err := localLoginTemplate.Execute(pfc.W, content); err != nil {
+		http.Error(pfc.W, err.Error(), http.StatusInternalServerError)
+	}
+
+	return nil, nil
+}
+
+// signIn returns the identity of the account, if the password
+// matches, and nil otherwise
+func (a *LocalAuthenticator)signIn(pfc *PFContext, username string, password string) (*Identity, error) {
+	account, err := pfc.Storage.LocalAccountByUsername(username)
+	if err != nil {
+		return nil, err
+	}
+
+	hash := []byte(nil)
+	if account != nil {
+		hash = account.PasswordHash
+	} else {
+		dummyPasswordHashOnce.Do(func() {
+			dummyPasswordHash, _ = bcrypt.GenerateFromPassword([]byte("password"), bcrypt.DefaultCost)
+		})
+		hash = dummyPasswordHash
+	}
+
+	if bcrypt.CompareHashAndPassword(hash, []byte(password)) != nil || account == nil {
+		return nil, nil
+	}
+
+	return &Identity {
+		Provider: a.Name(),
+		Subject: strings.ToLower(account.Username),
+	}, nil
+}
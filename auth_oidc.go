@@ -0,0 +1,492 @@
+/*****************************************************************************
+ **
+ ** Gofr
+ ** https://github.com/pokebyte/Gofr
+ ** Copyright (C) 2013-2017 Akop Karapetyan
+ **
+ ** This program is free software; you can redistribute it and/or modify
+ ** it under the terms of the GNU General Public License as published by
+ ** the Free Software Foundation; either version 2 of the License, or
+ ** (at your option) any later version.
+ **
+ ** This program is distributed in the hope that it will be useful,
+ ** but WITHOUT ANY WARRANTY; without even the implied warranty of
+ ** MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ ** GNU General Public License for more details.
+ **
+ ** You should have received a copy of the GNU General Public License
+ ** along with this program; if not, write to the Free Software
+ ** Foundation, Inc., 675 Mass Ave, Cambridge, MA 02139, USA.
+ **
+ ******************************************************************************
+ */
+ 
+package gofr
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	oidcStateCookiePrefix = "gofr-oidc-"
+	oidcStateMaxAge = 600
+	oidcScopes = "openid email profile"
+	oidcMaxResponseBytes = 1 << 20
+
+	// Signing keys are refetched when a token is signed with an unknown
+	// key, but no more often than this
+	oidcKeyRefreshInterval = time.Minute
+	oidcClockSkew = 2 * time.Minute
+)
+
+// OIDCAuthenticator signs users in through an OpenID Connect
+// provider, using the authorization code flow. The provider's
+// endpoints and signing keys are discovered from its issuer URL
+type OIDCAuthenticator struct {
+	name string
+	title string
+	issuer string
+	clientID string
+	clientSecret string
+
+	mutex sync.Mutex
+	config *oidcConfiguration
+	keys map[string]crypto.PublicKey
+	keysFetched time.Time
+}
+
+type oidcConfiguration struct {
+	Issuer string                `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint string         `json:"token_endpoint"`
+	JWKSURI string               `json:"jwks_uri"`
+}
+
+type oidcTokenResponse struct {
+	IDToken string          `json:"id_token"`
+	Error string            `json:"error"`
+	ErrorDescription string `json:"error_description"`
+}
+
+type oidcClaims struct {
+	Issuer string               `json:"iss"`
+	Subject string              `json:"sub"`
+	Audience json.RawMessage    `json:"aud"`
+	Expires float64             `json:"exp"`
+	Nonce string                `json:"nonce"`
+	Email string                `json:"email"`
+	EmailVerified interface{}   `json:"email_verified"`
+}
+
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N string   `json:"n"`
+	E string   `json:"e"`
+	Crv string `json:"crv"`
+	X string   `json:"x"`
+	Y string   `json:"y"`
+}
+
+// NewOIDCAuthenticator creates an authenticator for the provider
+// at issuerURL. The client must be registered with the provider,
+// with <base URL>/auth/<name> as its redirect URI
+func NewOIDCAuthenticator(name string, title string, issuerURL string, clientID string, clientSecret string) *OIDCAuthenticator {
+	return &OIDCAuthenticator {
+		name: name,
+		title: title,
+		issuer: strings.TrimSuffix(issuerURL, "/"),
+		clientID: clientID,
+		clientSecret: clientSecret,
+	}
+}
+
+func (a *OIDCAuthenticator)Name() string {
+	return a.name
+}
+
+func (a *OIDCAuthenticator)Title() string {
+	return a.title
+}
+
+func (a *OIDCAuthenticator)redirectURI(pfc *PFContext) string {
+	return pfc.Platform.BaseURL() + authPathPrefix + a.name
+}
+
+func (a *OIDCAuthenticator)HandleLogin(pfc *PFContext) (*Identity, error) {
+	r := pfc.R
+
+	if message := r.FormValue("error"); message != "" {
+		return nil, NewReadableErrorWithCode(_l("%s did not sign you in (%s)", a.title, message), http.StatusUnauthorized, nil)
+	}
+
+	config, err := a.configuration(pfc)
+	if err != nil {
+		return nil, NewReadableError(_l("Error contacting %s", a.title), &err)
+	}
+
+	code := r.FormValue("code")
+	if code == "" {
+		return nil, a.startLogin(pfc, config)
+	}
+
+	// Returning from the provider
+	stateCookieName := oidcStateCookiePrefix + a.name
+	cookie, err := r.Cookie(stateCookieName)
+	if err != nil {
+		return nil, NewReadableErrorWithCode(_l("Sign-in has expired; please try again"), http.StatusBadRequest, nil)
+	}
+
+	http.SetCookie(pfc.W, &http.Cookie {
+		Name: stateCookieName,
+		Path: authPathPrefix + a.name,
+		MaxAge: -1,
+	})
+
+	parts := strings.SplitN(cookie.Value, ".", 2)
+	if len(parts) != 2 || r.FormValue("state") != parts[0] {
+		return nil, NewReadableErrorWithCode(_l("Sign-in has expired; please try again"), http.StatusBadRequest, nil)
+	}
+	nonce := parts[1]
+
+	idToken, err := a.exchange(pfc, config, code)
+	if err != nil {
+		return nil, NewReadableError(_l("Error contacting %s", a.title), &err)
+	}
+
+	claims, err := a.verify(pfc, config, idToken, nonce)
+	if err != nil {
+		return nil, NewReadableErrorWithCode(_l("Could not verify your identity with %s", a.title), http.StatusUnauthorized, &err)
+	}
+
+	identity := &Identity {
+		Provider: a.name,
+		Subject: claims.Subject,
+	}
+	if verified, ok := claims.EmailVerified.(bool); (ok && verified) || claims.EmailVerified == "true" {
+		identity.Email = claims.Email
+	}
+
+	return identity, nil
+}
+
+// startLogin sends the user to the provider to sign in
+func (a *OIDCAuthenticator)startLogin(pfc *PFContext, config *oidcConfiguration) error {
+	state, err := randomToken()
+	if err != nil {
+		return err
+	}
+	nonce, err := randomToken()
+	if err != nil {
+		return err
+	}
+
+	authURL, err := url.Parse(config.AuthorizationEndpoint)
+	if err != nil {
+		return err
+	}
+
+	query := authURL.Query()
+	query.Set("response_type", "code")
+	query.Set("client_id", a.clientID)
+	query.Set("redirect_uri", a.redirectURI(pfc))
+	query.Set("scope", oidcScopes)
+	query.Set("state", state)
+	query.Set("nonce", nonce)
+	authURL.RawQuery = query.Encode()
+
+	http.SetCookie(pfc.W, &http.Cookie {
+		Name: oidcStateCookiePrefix + a.name,
+		Value: state + "." + nonce,
+		Path: authPathPrefix + a.name,
+		MaxAge: oidcStateMaxAge,
+		HttpOnly: true,
+		Secure: isSecure(pfc),
+	})
+	http.Redirect(pfc.W, pfc.R, authURL.String(), http.StatusFound)
+
+	return nil
+}
+
+func getJSON(client *http.Client, url string, v interface{}) error {
+	response, err := client.Get(url)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s: HTTP %d", url, response.StatusCode)
+	}
+
+	return json.NewDecoder(io.LimitReader(response.Body, oidcMaxResponseBytes)).Decode(v)
+}
+
+// configuration returns the provider's endpoints, discovering
+// them on first use
+func (a *OIDCAuthenticator)configuration(pfc *PFContext) (*oidcConfiguration, error) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	if a.config != nil {
+		return a.config, nil
+	}
+
+	config := oidcConfiguration{}
+	if err := getJSON(pfc.Platform.HTTPClient(), a.issuer + "/.well-known/openid-configuration", &config); err != nil {
+		return nil, err
+	} else if strings.TrimSuffix(config.Issuer, "/") != a.issuer {
+		return nil, fmt.Errorf("Issuer mismatch: expected %s; found %s", a.issuer, config.Issuer)
+	} else if config.AuthorizationEndpoint == "" || config.TokenEndpoint == "" || config.JWKSURI == "" {
+		return nil, errors.New("Incomplete provider configuration")
+	}
+
+	a.config = &config
+	return a.config, nil
+}
+
+// exchange trades an authorization code for an ID token
+func (a *OIDCAuthenticator)exchange(pfc *PFContext, config *oidcConfiguration, code string) (string, error) {
+	values := url.Values {
+		"grant_type": { "authorization_code" },
+		"code": { code },
+		"redirect_uri": { a.redirectURI(pfc) },
+	}
+
+	request, err := http.NewRequest("POST", config.TokenEndpoint, strings.NewReader(values.Encode()))
+	if err != nil {
+		return "", err
+	}
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	request.Header.Set("Accept", "application/json")
+	request.SetBasicAuth(url.QueryEscape(a.clientID), url.QueryEscape(a.clientSecret))
+
+	response, err := pfc.Platform.HTTPClient().Do(request)
+	if err != nil {
+		return "", err
+	}
+	defer response.Body.Close()
+
+	tokenResponse := oidcTokenResponse{}
+	if err := json.NewDecoder(io.LimitReader(response.Body, oidcMaxResponseBytes)).Decode(&tokenResponse); err != nil {
+		return "", fmt.Errorf("Error reading token response (HTTP %d): %s", response.StatusCode, err)
+	} else if tokenResponse.Error != "" {
+		return "", fmt.Errorf("Token request failed: %s %s", tokenResponse.Error, tokenResponse.ErrorDescription)
+	} else if tokenResponse.IDToken == "" {
+		return "", errors.New("Token response is missing an ID token")
+	}
+
+	return tokenResponse.IDToken, nil
+}
+
+func decodeSegment(segment string) ([]byte, error) {
+	return base64.RawURLEncoding.DecodeString(strings.TrimRight(segment, "="))
+}
+
+// verify checks the signature and claims of an ID token
+func (a *OIDCAuthenticator)verify(pfc *PFContext, config *oidcConfiguration, idToken string, nonce string) (*oidcClaims, error) {
+	parts := strings.Split(idToken, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("Malformed ID token")
+	}
+
+	header := struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}{}
+	if bytes, err := decodeSegment(parts[0]); err != nil {
+		return nil, err
+	} else if err := json.Unmarshal(bytes, &header); err != nil {
+		return nil, err
+	}
+
+	signature, err := decodeSegment(parts[2])
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := a.key(pfc, config, header.Kid)
+	if err != nil {
+		return nil, err
+	}
+
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	switch header.Alg {
+	case "RS256":
+		if rsaKey, ok := key.(*rsa.PublicKey); !ok {
+			return nil, errors.New("Key type does not match algorithm")
+		} else if err := rsa.VerifyPKCS1v15(rsaKey, crypto.SHA256, digest[:], signature); err != nil {
+			return nil, err
+		}
+	case "ES256":
+		if ecKey, ok := key.(*ecdsa.PublicKey); !ok || len(signature) != 64 {
+			return nil, errors.New("Key type does not match algorithm")
+		} else if !ecdsa.Verify(ecKey, digest[:], new(big.Int).SetBytes(signature[:32]), new(big.Int).SetBytes(signature[32:])) {
+			return nil, errors.New("Invalid signature")
+		}
+	default:
+		return nil, fmt.Errorf("Unsupported signing algorithm: %s", header.Alg)
+	}
+
+	claims := oidcClaims{}
+	if bytes, err := decodeSegment(parts[1]); err != nil {
+		return nil, err
+	} else if err := json.Unmarshal(bytes, &claims); err != nil {
+		return nil, err
+	}
+
+	if strings.TrimSuffix(claims.Issuer, "/") != a.issuer {
+		return nil, fmt.Errorf("Unexpected issuer: %s", claims.Issuer)
+	} else if !a.isAudience(claims.Audience) {
+		return nil, errors.New("Token was not issued to this client")
+	} else if time.Unix(int64(claims.Expires), 0).Add(oidcClockSkew).Before(time.Now()) {
+		return nil, errors.New("Token has expired")
+	} else if claims.Nonce != nonce {
+		return nil, errors.New("Nonce mismatch")
+	} else if claims.Subject == "" {
+		return nil, errors.New("Token is missing a subject")
+	}
+
+	return &claims, nil
+}
+
+// isAudience returns true if the client is among the token's
+// audience (which may be a single value or a list)
+func (a *OIDCAuthenticator)isAudience(audience json.RawMessage) bool {
+	var single string
+	if err := json.Unmarshal(audience, &single); err == nil {
+		return single == a.clientID
+	}
+
+	var list []string
+	if err := json.Unmarshal(audience, &list); err == nil {
+		for _, aud := range list {
+			if aud == a.clientID {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// key returns the provider's signing key with the specified ID,
+// refetching the key set if it's not known
+func (a *OIDCAuthenticator)key(pfc *PFContext, config *oidcConfiguration, keyID string) (crypto.PublicKey, error) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	if key := a.cachedKey(keyID); key != nil {
+		return key, nil
+	} else if time.Since(a.keysFetched) < oidcKeyRefreshInterval {
+		return nil, fmt.Errorf("Unknown signing key: %s", keyID)
+	}
+
+	keySet := struct {
+		Keys []jsonWebKey `json:"keys"`
+	}{}
+	if err := getJSON(pfc.Platform.HTTPClient(), config.JWKSURI, &keySet); err != nil {
+		return nil, err
+	}
+
+	keys := make(map[string]crypto.PublicKey)
+	for _, jwk := range keySet.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+
+		if key, err := jwk.publicKey(); err != nil {
+			pfc.C.Warningf("Skipping signing key %s of %s: %s", jwk.Kid, a.issuer, err)
+		} else {
+			keys[jwk.Kid] = key
+		}
+	}
+
+	a.keys = keys
+	a.keysFetched = time.Now()
+
+	if key := a.cachedKey(keyID); key != nil {
+		return key, nil
+	}
+
+	return nil, fmt.Errorf("Unknown signing key: %s", keyID)
+}
+
+func (a *OIDCAuthenticator)cachedKey(keyID string) crypto.PublicKey {
+	if key, ok := a.keys[keyID]; ok {
+		return key
+	} else if keyID == "" && len(a.keys) == 1 {
+		// Token doesn't say; there's only one candidate
+		for _, key := range a.keys {
+			return key
+		}
+	}
+
+	return nil
+}
+
+func (jwk jsonWebKey)publicKey() (crypto.PublicKey, error) {
+	switch jwk.Kty {
+	case "RSA":
+		n, err := decodeSegment(jwk.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeSegment(jwk.E)
+		if err != nil {
+			return nil, err
+		}
+
+		exponent := new(big.Int).SetBytes(e)
+		if !exponent.IsInt64() || exponent.Int64() > 1 << 31 {
+			return nil, errors.New("Invalid RSA exponent")
+		}
+
+		return &rsa.PublicKey {
+			N: new(big.Int).SetBytes(n),
+			E: int(exponent.Int64()),
+		}, nil
+	case "EC":
+		if jwk.Crv != "P-256" {
+			return nil, fmt.Errorf("Unsupported curve: %s", jwk.Crv)
+		}
+
+		x, err := decodeSegment(jwk.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeSegment(jwk.Y)
+		if err != nil {
+			return nil, err
+		}
+
+		key := &ecdsa.PublicKey {
+			Curve: elliptic.P256(),
+			X: new(big.Int).SetBytes(x),
+			Y: new(big.Int).SetBytes(y),
+		}
+		if !key.Curve.IsOnCurve(key.X, key.Y) {
+			return nil, errors.New("Point is not on the curve")
+		}
+
+		return key, nil
+	}
+
+	return nil, fmt.Errorf("Unsupported key type: %s", jwk.Kty)
+}
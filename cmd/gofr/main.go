@@ -0,0 +1,183 @@
+// +build !appengine
+
+/*****************************************************************************
+ **
+ ** Gofr
+ ** https://github.com/pokebyte/Gofr
+ ** Copyright (C) 2013-2017 Akop Karapetyan
+ **
+ ** This program is free software; you can redistribute it and/or modify
+ ** it under the terms of the GNU General Public License as published by
+ ** the Free Software Foundation; either version 2 of the License, or
+ ** (at your option) any later version.
+ **
+ ** This program is distributed in the hope that it will be useful,
+ ** but WITHOUT ANY WARRANTY; without even the implied warranty of
+ ** MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ ** GNU General Public License for more details.
+ **
+ ** You should have received a copy of the GNU General Public License
+ ** along with this program; if not, write to the Free Software
+ ** Foundation, Inc., 675 Mass Ave, Cambridge, MA 02139, USA.
+ **
+ ******************************************************************************
+ */
+ 
+// Command gofr runs the reader as a self-hosted server, with its
+// data kept in a single BoltDB file
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"gofr"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"storage"
+	"storage/embedded"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	shutdownTimeout = 30 * time.Second
+	day = 24 * time.Hour
+)
+
+// feedRetentionFlag collects -feed-retention overrides, each of the
+// form URL=DAYS or URL=DAYS,MIN_ENTRIES. URL= (with nothing after
+// it) removes the override
+type feedRetentionFlag map[string]*storage.RetentionPolicy
+
+func (f feedRetentionFlag)String() string {
+	return ""
+}
+
+func (f feedRetentionFlag)Set(value string) error {
+	separator := strings.LastIndex(value, "=")
+	if separator < 0 {
+		return errors.New("expecting URL=DAYS[,MIN_ENTRIES]")
+	} else if separator == len(value) - 1 {
+		f[value[:separator]] = nil
+		return nil
+	}
+
+	policy := &storage.RetentionPolicy {
+		MinEntries: gofr.DefaultRetentionPolicy.MinEntries,
+	}
+
+	parts := strings.SplitN(value[separator + 1:], ",", 2)
+	if days, err := strconv.Atoi(parts[0]); err != nil || days < 0 {
+		return errors.New("expecting a number of days")
+	} else {
+		policy.MaxAge = time.Duration(days) * day
+	}
+	if len(parts) > 1 {
+		if minEntries, err := strconv.Atoi(parts[1]); err != nil || minEntries < 0 {
+			return errors.New("expecting a number of entries")
+		} else {
+			policy.MinEntries = minEntries
+		}
+	}
+
+	f[value[:separator]] = policy
+	return nil
+}
+
+func main() {
+	addr := flag.String("addr", ":8080", "Address to listen on")
+	dbPath := flag.String("db", "gofr.db", "Path to the database file")
+	baseURL := flag.String("url", "http://localhost:8080", "Public URL of the server (used for WebSub callbacks)")
+	contentDir := flag.String("content", "content", "Directory containing static content")
+	uploadDir := flag.String("uploads", "", "Directory for pending uploads (defaults to the temporary directory)")
+	devMode := flag.Bool("dev", false, "Run in development mode")
+	localAccounts := flag.Bool("local", true, "Allow signing in with a username and password")
+	signup := flag.Bool("signup", false, "Allow anyone to create a local account")
+	oidcIssuer := flag.String("oidc-issuer", "", "Issuer URL of an OpenID Connect provider to sign in with")
+	oidcName := flag.String("oidc-name", "oidc", "Name identifying the OpenID Connect provider (keep it unchanged once users sign in)")
+	oidcTitle := flag.String("oidc-title", "OpenID Connect", "Name of the OpenID Connect provider, as shown to users")
+	oidcClientID := flag.String("oidc-client-id", "", "OpenID Connect client ID")
+	oidcClientSecret := flag.String("oidc-client-secret", os.Getenv("GOFR_OIDC_CLIENT_SECRET"), "OpenID Connect client secret (defaults to $GOFR_OIDC_CLIENT_SECRET)")
+	retentionDays := flag.Int("retention-days", int(gofr.DefaultRetentionPolicy.MaxAge / day), "Days entries are kept before they're purged (0 keeps them forever)")
+	retentionMinEntries := flag.Int("retention-min-entries", gofr.DefaultRetentionPolicy.MinEntries, "Newest entries of each feed kept regardless of age")
+	feedRetention := feedRetentionFlag {}
+	flag.Var(feedRetention, "feed-retention", "Retention of a feed, as URL=DAYS[,MIN_ENTRIES], or URL= to restore the default (repeatable; saved to the database)")
+	undoWindow := flag.Duration("undo-window", gofr.UndoWindow, "How long unsubscribing, removing folders and tags, and marking as read can be undone")
+	flag.Parse()
+
+	authenticators := []gofr.Authenticator {}
+	if *localAccounts {
+		authenticators = append(authenticators, &gofr.LocalAuthenticator { AllowSignup: *signup })
+	}
+	if *oidcIssuer != "" {
+		if *oidcClientID == "" {
+			log.Fatalf("-oidc-client-id is required with -oidc-issuer")
+		}
+		authenticators = append(authenticators, gofr.NewOIDCAuthenticator(*oidcName, *oidcTitle,
+			*oidcIssuer, *oidcClientID, *oidcClientSecret))
+	}
+	if len(authenticators) == 0 {
+		log.Fatalf("No way to sign in: enable local accounts or configure an OpenID Connect provider")
+	}
+
+	store, err := embedded.Open(*dbPath)
+	if err != nil {
+		log.Fatalf("Error opening database %s: %s", *dbPath, err)
+	}
+	defer store.Close()
+
+	server := gofr.NewServer(gofr.ServerConfig {
+		Storage: store,
+		BaseURL: *baseURL,
+		ContentDir: *contentDir,
+		UploadDir: *uploadDir,
+		Authenticators: authenticators,
+		DevMode: *devMode,
+		Retention: &storage.RetentionPolicy {
+			MaxAge: time.Duration(*retentionDays) * day,
+			MinEntries: *retentionMinEntries,
+		},
+		FeedRetention: feedRetention,
+		UndoWindow: *undoWindow,
+	})
+
+	httpServer := &http.Server {
+		Addr: *addr,
+		Handler: server,
+	}
+
+	server.Start()
+
+	done := make(chan bool)
+	go func() {
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+		<-signals
+
+		log.Printf("Shutting down")
+
+		// Stop background work first - this also ends any
+		// push connections, which would hold up Shutdown
+		server.Stop()
+
+		ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		if err := httpServer.Shutdown(ctx); err != nil {
+			log.Printf("Error shutting down: %s", err)
+		}
+
+		close(done)
+	}()
+
+	log.Printf("Listening on %s", *addr)
+	if err := httpServer.ListenAndServe(); err != http.ErrServerClosed {
+		log.Fatalf("Error serving: %s", err)
+	}
+
+	<-done
+}
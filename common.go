@@ -24,19 +24,26 @@
 package gofr
 
 import (
-	"appengine"
-	"appengine/urlfetch"
+	"encoding/base64"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net/http"
 	"net/url"
 	"regexp"
+	"rss"
+	"storage"
 	"strings"
 	"time"
 )
 
 const (
 	fetchDeadlineSeconds = 60
+	maxRedirects = 10
+	// Favicons larger than this are disregarded
+	maxFavIconSize = 65536
+	// Favicons are looked up again after this long
+	favIconRefreshInterval = 7 * 24 * time.Hour
 )
 
 var (
@@ -50,6 +57,15 @@ var (
 		"like":   true,
 	}
 
+	validOrders = map[string]bool {
+		storage.OrderNewest:          true,
+		storage.OrderOldest:          true,
+		storage.OrderPublishedNewest: true,
+		storage.OrderPublishedOldest: true,
+		storage.OrderByFeed:          true,
+		storage.OrderMagic:           true,
+	}
+
 	supportedFavIconMimeTypes = []string {
 		"image/vnd.microsoft.icon",
 		"image/png",
@@ -57,13 +73,95 @@ var (
 	}
 )
 
-func createHttpClient(context appengine.Context) *http.Client {
-	return &http.Client {
-		Transport: &urlfetch.Transport {
-			Context: context,
-			Deadline: time.Duration(fetchDeadlineSeconds) * time.Second,
-		},
+func createHttpClient(pfc *PFContext) *http.Client {
+	return pfc.Platform.HTTPClient()
+}
+
+// redirectTracker follows redirects on behalf of an http.Client,
+// recording the destination of any permanent (301/308) redirects.
+// Once a temporary redirect is encountered, subsequent permanent
+// redirects are no longer considered
+type redirectTracker struct {
+	PermanentURL string
+	temporary bool
+}
+
+func (tracker *redirectTracker) checkRedirect(req *http.Request, via []*http.Request) error {
+	if len(via) >= maxRedirects {
+		return fmt.Errorf("Stopped after %d redirects", maxRedirects)
+	}
+
+	if tracker.temporary {
+		// Already went through a temporary redirect
+	} else if req.Response != nil && (req.Response.StatusCode == http.StatusMovedPermanently ||
+		req.Response.StatusCode == http.StatusPermanentRedirect) {
+		tracker.PermanentURL = req.URL.String()
+	} else {
+		tracker.temporary = true
+	}
+
+	return nil
+}
+
+// conditionalGet issues a GET request for a feed, passing along any
+// cache validators stored during the previous fetch. The caller is
+// expected to check for http.StatusNotModified
+func conditionalGet(client *http.Client, url string, feedMeta *storage.FeedMeta) (*http.Response, error) {
+	request, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	if feedMeta != nil {
+		if feedMeta.ETag != "" {
+			request.Header.Set("If-None-Match", feedMeta.ETag)
+		}
+		if feedMeta.LastModified != "" {
+			request.Header.Set("If-Modified-Since", feedMeta.LastModified)
+		}
+	}
+
+	return client.Do(request)
+}
+
+// fetchInfoFromResponse extracts the cache validators from the
+// response, so that they can be stored with the feed
+func fetchInfoFromResponse(response *http.Response) storage.FetchInfo {
+	return storage.FetchInfo {
+		ETag: response.Header.Get("ETag"),
+		LastModified: response.Header.Get("Last-Modified"),
+		StatusCode: response.StatusCode,
+	}
+}
+
+// discoverFeeds returns feeds advertised by an HTML document. If the
+// document doesn't advertise any, well-known feed locations are
+// probed, and the first valid feed is returned
+func discoverFeeds(pfc *PFContext, sourceURL string, html string) ([]rss.FeedLink, error) {
+	candidates, err := rss.DiscoverFeeds(sourceURL, strings.NewReader(html))
+	if err != nil {
+		pfc.C.Warningf("Error parsing HTML (URL %s): %s", sourceURL, err)
+	}
+
+	if len(candidates) > 0 {
+		return candidates, nil
 	}
+
+	client := createHttpClient(pfc)
+	for _, candidateURL := range rss.WellKnownFeedURLs(sourceURL) {
+		if response, err := client.Get(candidateURL); err != nil {
+			continue
+		} else {
+			feed, err := rss.UnmarshalStream(candidateURL, response.Body)
+			response.Body.Close()
+
+			if err == nil && response.StatusCode == http.StatusOK {
+				return []rss.FeedLink { { URL: candidateURL, Title: feed.Title } }, nil
+			}
+		}
+	}
+
+	return nil, err
 }
 
 // resolveURL accepts two URLs and returns the partialURL resolved
@@ -107,69 +205,74 @@ func extractLinks(html string) []map[string]string {
 	return links
 }
 
-// locateFavIconURL attempts to determine the "favicon" URL for a particular
-// site URL. It does this by checking the source document for explicit icon
-// directives (in the LINK tags), as well as by attempting to fetch favicon.ico
-func locateFavIconURL(context appengine.Context, feedHomeURL string) (string, error) {
+// locateFavIcon attempts to find the "favicon" for a particular site
+// URL. It does this by checking the source document for explicit icon
+// directives (in the LINK tags), as well as by attempting to fetch
+// favicon.ico. If there's none, the icon returned has no URL
+func locateFavIcon(pfc *PFContext, feedHomeURL string) (*storage.FavIcon, error) {
 	if feedHomeURL != "" {
 		// Attempt to extract the favicon from the source document
-		if favIconURL, err := extractFavIconURL(context, feedHomeURL); err != nil {
-			context.Warningf("FavIcon extraction failed for %s: %s", feedHomeURL, err)
+		if favIconURL, err := extractFavIconURL(pfc, feedHomeURL); err != nil {
+			pfc.C.Warningf("FavIcon extraction failed for %s: %s", feedHomeURL, err)
 		} else if favIconURL != "" {
-			if contains, err := containsFavIcon(context, favIconURL); err != nil {
-				context.Warningf("FavIcon lookup failed for %s: %s", feedHomeURL, err)
-			} else if contains {
-				return favIconURL, nil
+			if data, err := downloadFavIcon(pfc, favIconURL); err != nil {
+				pfc.C.Warningf("FavIcon lookup failed for %s: %s", feedHomeURL, err)
+			} else if data != "" {
+				return &storage.FavIcon { URL: favIconURL, Data: data }, nil
 			}
 		}
 
 		// If that fails, try the usual location (/favicon.ico)
 		if url, err := url.Parse(feedHomeURL); err != nil {
-			return "", err
+			return nil, err
 		} else {
 			attemptURL := fmt.Sprintf("%s://%s/favicon.ico", url.Scheme, url.Host)
-			if contains, err := containsFavIcon(context, attemptURL); err != nil {
-				return "", err
-			} else if contains {
-				return attemptURL, nil
+			if data, err := downloadFavIcon(pfc, attemptURL); err != nil {
+				return nil, err
+			} else if data != "" {
+				return &storage.FavIcon { URL: attemptURL, Data: data }, nil
 			}
 		}
 	}
 
-	return "", nil
+	return &storage.FavIcon{}, nil
 }
 
-// containsFavIcon return true if a URL contains a valid "favicon".
-// A valid favicon has one of the supported MIME types.
-func containsFavIcon(c appengine.Context, favIconURL string) (bool, error) {
-	client := createHttpClient(c)
-	if response, err := client.Get(favIconURL); err == nil {
-		defer response.Body.Close()
+// downloadFavIcon returns the "favicon" at a URL, encoded as a data
+// URI without the "data:" prefix - or nothing, if the URL doesn't
+// contain a valid one. A valid favicon has one of the supported
+// MIME types, and is no larger than maxFavIconSize
+func downloadFavIcon(pfc *PFContext, favIconURL string) (string, error) {
+	client := createHttpClient(pfc)
+	response, err := client.Get(favIconURL)
+	if err != nil {
+		return "", err
+	}
+	defer response.Body.Close()
 
-		bytes, err := ioutil.ReadAll(response.Body)
-		if err != nil {
-			return false, err
-		}
+	data, err := ioutil.ReadAll(&io.LimitedReader { R: response.Body, N: maxFavIconSize + 1 })
+	if err != nil {
+		return "", err
+	} else if response.StatusCode != http.StatusOK || len(data) > maxFavIconSize {
+		return "", nil
+	}
 
-		mimeType := http.DetectContentType(bytes)
-		for _, acceptedMimeType := range supportedFavIconMimeTypes {
-			if mimeType == acceptedMimeType {
-				return true, nil
-			}
+	mimeType := http.DetectContentType(data)
+	for _, acceptedMimeType := range supportedFavIconMimeTypes {
+		if mimeType == acceptedMimeType {
+			return mimeType + ";base64," + base64.StdEncoding.EncodeToString(data), nil
 		}
-	} else {
-		return false, err
 	}
 
-	return false, nil
+	return "", nil
 }
 
 // extractFavIconURL parses an HTML document and extracts an explicit
 // "favicon" URL specified by the LINK tag. If an icon is found
-// a call to containsFavIcon is made to make sure the URL is actually
+// a call to downloadFavIcon is made to make sure the URL is actually
 // valid.
-func extractFavIconURL(context appengine.Context, sourceURL string) (string, error) {
-	client := createHttpClient(context)
+func extractFavIconURL(pfc *PFContext, sourceURL string) (string, error) {
+	client := createHttpClient(pfc)
 	if response, err := client.Get(sourceURL); err != nil {
 		return "", err
 	} else {
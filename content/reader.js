@@ -91,6 +91,17 @@ $().ready(function() {
 		return dateTimeFormatter(date, sameDay);
 	};
 
+	var formatDuration = function(seconds) {
+		var hours = Math.floor(seconds / 3600);
+		var minutes = Math.floor((seconds % 3600) / 60);
+		var secs = seconds % 60;
+
+		if (hours > 0)
+			return sprintf("%d:%02d:%02d", hours, minutes, secs);
+
+		return sprintf("%d:%02d", minutes, secs);
+	};
+
 	// Automatic pager
 
 	$('.gofr-entries-container').scroll(function() {
@@ -474,6 +485,7 @@ $().ready(function() {
 			return null;
 		},
 		'subscribe': function(url) {
+			var folder = this;
 			var params = {
 				'url': url,
 				'client': clientId,
@@ -482,6 +494,12 @@ $().ready(function() {
 				params['folder'] = this.id;
 
 			$.post('subscribe', params, function(response) {
+				if (response.candidates) {
+					// More than one feed available
+					ui.showChooseFeedModal(folder, response.candidates);
+					return;
+				}
+
 				resetSubscriptionDom(response, false);
 			}, 'json');
 		},
@@ -810,15 +828,46 @@ $().ready(function() {
 			});
 
 			// Add any media
+			var $mediaContainer = $content.find('.gofr-media-container');
+			if (details.image)
+				$mediaContainer.append($('<img />', { 'class': 'gofr-media-artwork', 'src': details.image }));
+
 			if (entry.media) {
-				var $mediaContainer = $content.find('.gofr-media-container');
 				$.each(entry.media, function() {
 					var media = this;
-					var $audio = $('<audio />', { 'controls': 'controls' })
-						.append($('<source />', { 'src': media.url, 'type': media.type }))
-						.append($('<embed />', { 'class': 'gofr-embedded-media', 'src': media.url }));
+					var type = media.type || '';
+					var $source = $('<source />', { 'src': media.url });
+
+					// Media RSS may only specify the medium (e.g. 'video/*')
+					if (type && type.indexOf('*') < 0)
+						$source.attr('type', type);
+
+					var $media;
+					if (type.indexOf('image/') == 0) {
+						$media = $('<img />', { 'class': 'gofr-media-image', 'src': media.url });
+					} else if (type.indexOf('video/') == 0) {
+						$media = $('<video />', { 'controls': 'controls', 'preload': 'none' })
+							.append($source);
+						if (media.thumbnail)
+							$media.attr('poster', media.thumbnail);
+					} else {
+						$media = $('<audio />', { 'controls': 'controls', 'preload': 'none' })
+							.append($source)
+							.append($('<embed />', { 'class': 'gofr-embedded-media', 'src': media.url }));
+					}
+
+					var $item = $('<div />', { 'class': 'gofr-media' });
+					if (media.thumbnail && !details.image && type.indexOf('video/') != 0 && type.indexOf('image/') != 0)
+						$item.append($('<img />', { 'class': 'gofr-media-thumbnail', 'src': media.thumbnail }));
+					if (media.title)
+						$item.append($('<div />', { 'class': 'gofr-media-title' }).text(media.title));
 
-					$mediaContainer.append($audio);
+					$item.append($media);
+					if (media.duration)
+						$item.append($('<span />', { 'class': 'gofr-media-duration' })
+							.text(formatDuration(media.duration)));
+
+					$mediaContainer.append($item);
 				});
 			}
 
@@ -865,8 +914,12 @@ $().ready(function() {
 			ui.toggleSidebar(e.isChecked);
 		} else if ($item.is('.menu-import-subscriptions')) {
 			ui.showImportSubscriptionsModal();
+		} else if ($item.is('.menu-import-report')) {
+			ui.showImportReportModal();
 		} else if ($item.is('.menu-export-subscriptions')) {
 			ui.exportSubscriptions();
+		} else if ($item.is('.menu-account')) {
+			window.location.href = '/account';
 		} else if ($item.is('.menu-show-all-subs')) {
 			ui.toggleReadSubscriptions(e.isChecked);
 		} else if ($item.is('.menu-create-folder')) {
@@ -992,8 +1045,10 @@ $().ready(function() {
 					.append($('<li />', { 'class': 'menu-new-items group-filter', 'data-value': 'unread' }).text(_l("New items"))))
 				.append($('<ul />', { 'id': 'menu-user-options', 'class': 'menu' })
 					.append($('<li />', { 'class': 'menu-import-subscriptions' }).text(_l("Import subscriptions…")))
+					.append($('<li />', { 'class': 'menu-import-report' }).text(_l("Last import report…")))
 					.append($('<li />', { 'class': 'menu-export-subscriptions' }).text(_l("Export subscriptions")))
 					.append($('<li />', { 'class': 'divider' }))
+					.append($('<li />', { 'class': 'menu-account' }).text(_l("Linked logins…")))
 					.append($('<li />', { 'class': 'menu-sign-out' }).text(_l("Sign out"))))
 				.append($('<ul />', { 'id': 'menu-folder', 'class': 'menu' })
 					.append($('<li />', { 'class': 'menu-subscribe' }).text(_l("Subscribe…")))
@@ -1208,6 +1263,112 @@ $().ready(function() {
 		'exportSubscriptions': function() {
 			window.location.href = '/export';
 		},
+		'showChooseFeedModal': function(folder, candidates) {
+			var $modal = $('#choose-feed');
+			var $list = $modal.find('.feed-candidates').empty();
+
+			$.each(candidates, function(index) {
+				var candidate = this;
+				$list.append($('<li />')
+					.append($('<label />')
+						.append($('<input />', {
+							'type': 'radio',
+							'name': 'feed',
+							'value': candidate.url,
+							'checked': index == 0,
+						}))
+						.append($('<span />', { 'class': 'feed-candidate-title' })
+							.text(candidate.title || candidate.url))
+						.append($('<span />', { 'class': 'feed-candidate-url' })
+							.text(candidate.url))));
+			});
+
+			$modal.find('.modal-ok')
+				.unbind('click')
+				.click(function() {
+					var url = $list.find('input:checked').val();
+					$modal.showModal(false);
+
+					if (url)
+						folder.subscribe(url);
+				});
+
+			$modal.showModal(true);
+		},
+		'showImportReportModal': function(jobId) {
+			var $modal = $('#import-report');
+			var outcomes = {
+				'pending': _l("Waiting"),
+				'subscribed': _l("Subscribed"),
+				'duplicate': _l("Already subscribed"),
+				'redirected': _l("Subscribed (moved)"),
+				'skipped': _l("Skipped"),
+				'downloadError': _l("Download error"),
+				'parseError': _l("Not a valid feed"),
+				'error': _l("Error"),
+			};
+			var isFailure = function(outcome) {
+				return outcome == 'downloadError'
+					|| outcome == 'parseError'
+					|| outcome == 'error';
+			};
+
+			$.getJSON('importJob', {
+				'job': jobId || '',
+			})
+			.success(function(response) {
+				var job = response.job;
+				var $list = $modal.find('.import-results').empty();
+
+				$modal.find('.import-summary').text(job.done
+					? _l("%1$s of %2$s subscriptions imported", [job.total - job.failed, job.total])
+					: _l("Importing: %1$s of %2$s done", [job.completed, job.total]));
+
+				$.each(response.results || [], function() {
+					var result = this;
+					var $item = $('<li />', { 'class': result.outcome })
+						.append($('<span />', { 'class': 'import-result-title' })
+							.text(result.title || result.url || _l("(untitled)")))
+						.append($('<span />', { 'class': 'import-result-outcome' })
+							.text(outcomes[result.outcome] || result.outcome));
+
+					if (result.message || result.redirectedTo)
+						$item.append($('<span />', { 'class': 'import-result-message' })
+							.text(result.redirectedTo || result.message));
+
+					if (job.done && isFailure(result.outcome))
+						$item.append($('<a />', { 'href': '#', 'class': 'import-result-retry' })
+							.text(_l("Retry"))
+							.click(function() {
+								ui.retryImport(job.id, result.id);
+								$modal.showModal(false);
+								return false;
+							}));
+
+					$list.append($item);
+				});
+
+				$modal.find('.modal-ok')
+					.unbind('click')
+					.toggle(job.done && job.failed > 0)
+					.click(function() {
+						ui.retryImport(job.id);
+						$modal.showModal(false);
+					});
+
+				$modal.showModal(true);
+			});
+		},
+		'retryImport': function(jobId, resultId) {
+			$.post('retryImport', {
+				'client': clientId,
+				'job': jobId,
+				'result': resultId || '',
+			},
+			function(response) {
+				ui.showToast(response.message, false);
+			}, 'json');
+		},
 		'showAbout': function() {
 			$('#about').showModal(true);
 		},
@@ -1707,6 +1868,25 @@ $().ready(function() {
 					$subscription.find('.subscription-icon').addClass('no-favicon');
 				}
 
+				// Feed health
+				if (subscription.status) {
+					var status = subscription.status;
+					var days = Math.floor((new Date() - new Date(status.failingSince)) / 86400000);
+					var message;
+
+					if (days > 0)
+						message = _l("This feed has been broken for %d day(s)", [days]);
+					else
+						message = _l("This feed failed to update");
+					if (status.lastError)
+						message += " (" + status.lastError + ")";
+
+					$subscription.toggleClass('broken', true)
+						.toggleClass('dead', !!status.dead)
+						.find('.subscription-item')
+							.attr('title', subscription.title + " - " + message);
+				}
+
 				// Drag-and-drop code
 				$subscription
 					.mousedown(function(e) {
@@ -1971,6 +2151,8 @@ $().ready(function() {
 				else {
 					if (obj.message)
 						ui.showToast(obj.message, false);
+					if (obj.progress && obj.progress.done && obj.progress.failed > 0)
+						ui.showImportReportModal(obj.progress.id);
 					if (obj.refresh)
 						refresh(true);
 					if (obj.subscriptions)
@@ -24,31 +24,170 @@
 package gofr
 
 import (
-	"appengine"
-	"appengine/datastore"
+	"errors"
+	"net/http"
+	"net/url"
 	"rss"
 	"storage"
+	"strconv"
+	"strings"
 	"time"
 )
 
+const (
+	feedUpdateWorkers = 20
+	feedUpdateWorkersPerHost = 2
+	unreadCountWorkers = 20
+	purgeWorkers = 5
+	reconcileWorkers = 10
+)
+
+// DefaultRetentionPolicy applies to feeds without a policy of their
+// own: entries are kept for 180 days, and the newest 100 entries of
+// each feed are kept regardless of age
+var DefaultRetentionPolicy = storage.RetentionPolicy {
+	MaxAge: 180 * 24 * time.Hour,
+	MinEntries: 100,
+}
+
+// retentionPolicy returns the feed's own retention policy, or the
+// default if it has none
+func retentionPolicy(pfc *PFContext, feedURL string) (storage.RetentionPolicy, error) {
+	if policy, err := pfc.Storage.FeedRetentionPolicy(feedURL); err != nil {
+		return storage.RetentionPolicy{}, err
+	} else if policy != nil {
+		return *policy, nil
+	}
+
+	return DefaultRetentionPolicy, nil
+}
+
 func registerCron() {
 	RegisterCronRoute("/cron/updateFeeds", updateFeedsJob)
 	RegisterCronRoute("/cron/updateUnreadCounts", updateUnreadCountsJob)
+	RegisterCronRoute("/cron/purgeEntries", purgeEntriesJob)
+	RegisterCronRoute("/cron/reconcileArticleCounts", reconcileArticleCountsJob)
+
+	// Continuations of the above, when they run out of time
+	RegisterTaskRoute("/tasks/updateFeeds", updateFeedsTask)
+	RegisterTaskRoute("/tasks/updateUnreadCounts", updateUnreadCountsTask)
+	RegisterTaskRoute("/tasks/purgeEntries", purgeEntriesTask)
+	RegisterTaskRoute("/tasks/reconcileArticleCounts", reconcileArticleCountsTask)
+
+	// Posted by administrators (on App Engine, only they can reach
+	// /tasks/)
+	RegisterTaskRoute("/tasks/setFeedRetention", setFeedRetentionTask)
 }
 
-func updateFeed(c appengine.Context, ch chan<- *storage.FeedMeta, url string, feedMeta *storage.FeedMeta) {
-	client := createHttpClient(c)
-	if response, err := client.Get(url); err != nil {
+// migrateToSelfLink checks whether the feed's self link has moved
+// away from the URL the feed is being fetched from. If so, and the
+// new location serves a valid feed that agrees on its self link,
+// the feed is migrated and the copy from the new location returned
+func migrateToSelfLink(pfc *PFContext, url string, parsedFeed *rss.Feed) (*rss.Feed, *http.Response) {
+	c := pfc.C
+	selfURL := parsedFeed.Topic
+	if selfURL == "" || selfURL == url {
+		return nil, nil
+	} else if !strings.HasPrefix(selfURL, "http://") && !strings.HasPrefix(selfURL, "https://") {
+		return nil, nil
+	}
+
+	// Only consider a change of self link - many feeds publish
+	// a self link that never matched the subscribed URL
+	if feed, err := pfc.Storage.FeedByURL(url); err != nil || feed == nil || feed.Topic != url {
+		return nil, nil
+	}
+
+	client := createHttpClient(pfc)
+	response, err := client.Get(selfURL)
+	if err != nil {
+		c.Warningf("Self link of %s (%s) is not reachable: %s", url, selfURL, err)
+		return nil, nil
+	}
+
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		response.Body.Close()
+		return nil, nil
+	}
+
+	if movedFeed, err := rss.UnmarshalStream(selfURL, response.Body); err != nil || movedFeed.Topic != selfURL {
+		response.Body.Close()
+		return nil, nil
+	} else if err := pfc.Storage.MigrateFeed(url, selfURL); err != nil {
+		c.Errorf("Error migrating feed %s to %s: %s", url, selfURL, err)
+		response.Body.Close()
+		return nil, nil
+	} else {
+		return movedFeed, response
+	}
+}
+
+func updateFeed(pfc *PFContext, ch chan<- *storage.FeedMeta, url string, feedMeta *storage.FeedMeta) {
+	c := pfc.C
+	client := createHttpClient(pfc)
+	tracker := redirectTracker{}
+	client.CheckRedirect = tracker.checkRedirect
+
+	if response, err := conditionalGet(client, url, feedMeta); err != nil {
 		c.Errorf("Error downloading feed %s: %s", url, err)
+		pfc.Storage.RecordFeedFailure(url, time.Now(), 0, err)
 		goto done
 	} else {
 		defer response.Body.Close()
-		if parsedFeed, err := rss.UnmarshalStream(url, response.Body); err != nil {
-			c.Errorf("Error reading RSS content (%s): %s", url, err)
+
+		if tracker.PermanentURL != "" && tracker.PermanentURL != url {
+			// Feed has moved permanently
+			if err := pfc.Storage.MigrateFeed(url, tracker.PermanentURL); err != nil {
+				c.Errorf("Error migrating feed %s to %s: %s", url, tracker.PermanentURL, err)
+			} else {
+				url = tracker.PermanentURL
+			}
+		}
+
+		if response.StatusCode == http.StatusNotModified {
+			// Nothing new since last fetch
+			if err := pfc.Storage.MarkFeedUnchanged(url, time.Now()); err != nil {
+				c.Errorf("Error updating feed: %s", err)
+			}
+			goto done
+		} else if response.StatusCode < 200 || response.StatusCode > 299 {
+			c.Errorf("Error downloading feed %s: HTTP %d", url, response.StatusCode)
+			pfc.Storage.RecordFeedFailure(url, time.Now(), response.StatusCode, nil)
 			goto done
-		} else if err := storage.UpdateFeed(c, parsedFeed, "", time.Now()); err != nil {
-			c.Errorf("Error updating feed: %s", err)
+		} else if parsedFeed, err := rss.UnmarshalStream(url, response.Body); err != nil {
+			c.Errorf("Error reading RSS content (%s): %s", url, err)
+			pfc.Storage.RecordFeedFailure(url, time.Now(), response.StatusCode, err)
 			goto done
+		} else {
+			if movedFeed, movedResponse := migrateToSelfLink(pfc, url, parsedFeed); movedFeed != nil {
+				defer movedResponse.Body.Close()
+				parsedFeed, response = movedFeed, movedResponse
+			}
+
+			// Look up the site's icon again every so often
+			var favIcon *storage.FavIcon
+			if parsedFeed.WWWURL != "" && time.Since(feedMeta.FavIconChecked) > favIconRefreshInterval {
+				if icon, err := locateFavIcon(pfc, parsedFeed.WWWURL); err != nil {
+					c.Warningf("FavIcon retrieval error: %s", err)
+				} else {
+					favIcon = icon
+				}
+			}
+
+			if err := pfc.Storage.UpdateFeed(parsedFeed, favIcon, time.Now(), fetchInfoFromResponse(response)); err == storage.ErrLeaseHeld {
+				// Still being updated elsewhere (e.g. when subscribing)
+				c.Infof("Feed %s already being updated", url)
+				goto done
+			} else if err != nil {
+				c.Errorf("Error updating feed: %s", err)
+				goto done
+			}
+
+			if parsedFeed.HubURL != "" {
+				if err := subscribeToHub(pfc, parsedFeed.URL); err != nil {
+					c.Warningf("Error subscribing to hub for %s: %s", parsedFeed.URL, err)
+				}
+			}
 		}
 	}
 
@@ -57,59 +196,152 @@ done:
 }
 
 func updateFeedsJob(pfc *PFContext) error {
-	c := pfc.C
-	importing := 0
-	started := time.Now()
 	fetchTime := time.Now()
-	doneChannel := make(chan *storage.FeedMeta)
-	var jobError error
-
-	if appengine.IsDevAppServer() {
+	if pfc.Platform.IsDevServer() {
 		// On dev server, disregard next update limitations 
 		// (by "forwarding the clock")
 		fetchTime = fetchTime.Add(time.Duration(24) * time.Hour)
 	}
+
+	return updateFeeds(pfc, fetchTime, "")
+}
+
+func updateFeedsTask(pfc *PFContext) (TaskMessage, error) {
+	r := pfc.R
+
+	// A cursor only resumes the query it came from, which includes
+	// the time the feeds were due by
+	cursor := r.PostFormValue("cursor")
+	fetchTime := time.Now()
+	if nanos, err := strconv.ParseInt(r.PostFormValue("fetchTime"), 10, 64); err == nil {
+		fetchTime = time.Unix(0, nanos)
+	} else {
+		cursor = ""
+	}
+
+	return TaskMessage { Silent: true }, updateFeeds(pfc, fetchTime, cursor)
+}
+
+func updateFeeds(pfc *PFContext, fetchTime time.Time, cursor string) error {
+	c := pfc.C
+	importing := 0
+	started := time.Now()
+	doneChannel := make(chan *storage.FeedMeta, feedUpdateWorkers)
+	pool := newWorkPool(c, feedUpdateWorkers, feedUpdateWorkersPerHost, started)
+	var jobError error
+
+	go func() {
+		// Drain completions as they arrive
+		for _ = range doneChannel {
+		}
+	}()
 	
-	q := datastore.NewQuery("FeedMeta").Filter("NextFetch <", fetchTime)
-	for t := q.Run(c); ; {
-		feedMeta := new(storage.FeedMeta)
-		var feedMetaKey *datastore.Key
+	t, err := pfc.Storage.FeedsDue(fetchTime, cursor)
+	if err != nil {
+		return err
+	}
+
+	continueFrom := func(cursor string) {
+		values := url.Values {
+			"cursor": { cursor },
+			"fetchTime": { strconv.FormatInt(fetchTime.UnixNano(), 10) },
+		}
+		if err := enqueueContinuation(pfc, "/tasks/updateFeeds", values, refreshQueue); err != nil {
+			c.Errorf("Error queueing continuation: %s", err)
+			jobError = err
+		}
+	}
 
-		if key, err := t.Next(feedMeta); err == datastore.Done {
+	for {
+		// Taken before each feed, so that a feed cut off before it
+		// could start is where the continuation resumes
+		current, err := t.Cursor()
+		if err != nil {
+			c.Errorf("Error reading cursor: %s", err)
+			jobError = err
 			break
-		} else if err == nil || storage.IsFieldMismatch(err) {
-			feedMetaKey = key
-		} else {
+		}
+
+		if pool.Expired() {
+			// Out of time - continue in a separate task
+			continueFrom(current)
+			break
+		}
+
+		feedURL, feedMeta, err := t.Next()
+		if err == storage.Done {
+			break
+		} else if err != nil {
 			c.Errorf("Error fetching feed record: %s", err)
 			jobError = err
 			break
 		}
 
-		go updateFeed(pfc.C, doneChannel, feedMetaKey.StringID(), feedMeta)
+		if !pool.Submit(hostOf(feedURL), func() { updateFeed(pfc, doneChannel, feedURL, feedMeta) }) {
+			continueFrom(current)
+			break
+		}
 		importing++
 	}
 
-	for i := 0; i < importing; i++ {
-		<-doneChannel;
-	}
+	pool.Wait()
+	close(doneChannel)
 
 	c.Infof("%d feeds completed in %s", importing, time.Since(started))
 
 	return jobError
 }
 
+func updateUnreadCount(pfc *PFContext, ch chan<- storage.SubscriptionRef, ref storage.SubscriptionRef) {
+	if err := pfc.Storage.UpdateUnreadCount(ref); err != nil {
+		pfc.C.Errorf("Error updating unread count of %s: %s", ref.SubscriptionID, err)
+	}
+
+	ch<- ref
+}
+
 func updateUnreadCountsJob(pfc *PFContext) error {
+	return updateUnreadCounts(pfc, "")
+}
+
+func updateUnreadCountsTask(pfc *PFContext) (TaskMessage, error) {
+	return TaskMessage { Silent: true }, updateUnreadCounts(pfc, pfc.R.PostFormValue("cursor"))
+}
+
+func updateUnreadCounts(pfc *PFContext, cursor string) error {
 	c := pfc.C
 	routines := 0
 	started := time.Now()
-	doneChannel := make(chan storage.Subscription)
-	subscription := storage.Subscription{}
+	doneChannel := make(chan storage.SubscriptionRef, unreadCountWorkers)
+	pool := newWorkPool(c, unreadCountWorkers, 0, started)
 	var jobError error
 
-	q := datastore.NewQuery("Subscription")
-	for t := q.Run(c); ; {
-		subscriptionKey, err := t.Next(&subscription)
-		if err == datastore.Done {
+	go func() {
+		// Drain completions as they arrive
+		for _ = range doneChannel {
+		}
+	}()
+
+	t, err := pfc.Storage.Subscriptions(cursor)
+	if err != nil {
+		return err
+	}
+
+	for {
+		if pool.Expired() {
+			// Out of time - continue in a separate task
+			if next, err := t.Cursor(); err != nil {
+				c.Errorf("Error reading cursor: %s", err)
+				jobError = err
+			} else if err := enqueueContinuation(pfc, "/tasks/updateUnreadCounts", url.Values { "cursor": { next } }, refreshQueue); err != nil {
+				c.Errorf("Error queueing continuation: %s", err)
+				jobError = err
+			}
+			break
+		}
+
+		ref, err := t.Next()
+		if err == storage.Done {
 			break
 		} else if err != nil {
 			c.Errorf("Error fetching subscription: %s", err)
@@ -117,15 +349,219 @@ func updateUnreadCountsJob(pfc *PFContext) error {
 			break
 		}
 
-		go storage.UpdateUnreadCounts(pfc.C, doneChannel, subscriptionKey, subscription)
+		if !pool.Submit("", func() { updateUnreadCount(pfc, doneChannel, ref) }) {
+			continue // Recounted on the next scheduled run
+		}
 		routines++
 	}
 
-	for i := 0; i < routines; i++ {
-		<-doneChannel;
-	}
+	pool.Wait()
+	close(doneChannel)
 
 	c.Infof("%d subscriptions scanned in %s", routines, time.Since(started))
 
 	return jobError
 }
+
+func reconcileArticleCounts(pfc *PFContext, ch chan<- bool, userID storage.UserID) {
+	repaired, err := pfc.Storage.ReconcileArticleCounts(userID)
+	if err != nil {
+		pfc.C.Errorf("Error reconciling article counts of %s: %s", userID, err)
+	} else if repaired {
+		pfc.C.Warningf("Article counts of %s had drifted", userID)
+	}
+
+	ch<- repaired
+}
+
+func reconcileArticleCountsJob(pfc *PFContext) error {
+	return reconcileAllArticleCounts(pfc, "")
+}
+
+func reconcileArticleCountsTask(pfc *PFContext) (TaskMessage, error) {
+	return TaskMessage { Silent: true }, reconcileAllArticleCounts(pfc, pfc.R.PostFormValue("cursor"))
+}
+
+// reconcileAllArticleCounts recounts the articles of every user,
+// repairing the unread and starred counters that have drifted
+func reconcileAllArticleCounts(pfc *PFContext, cursor string) error {
+	c := pfc.C
+	users := 0
+	started := time.Now()
+	doneChannel := make(chan bool, reconcileWorkers)
+	pool := newWorkPool(c, reconcileWorkers, 0, started)
+	var jobError error
+
+	repaired := 0
+	drained := make(chan bool)
+	go func() {
+		// Tally completions as they arrive
+		for drifted := range doneChannel {
+			if drifted {
+				repaired++
+			}
+		}
+		close(drained)
+	}()
+
+	t, err := pfc.Storage.Users(cursor)
+	if err != nil {
+		return err
+	}
+
+	for {
+		if pool.Expired() {
+			// Out of time - continue in a separate task
+			if next, err := t.Cursor(); err != nil {
+				c.Errorf("Error reading cursor: %s", err)
+				jobError = err
+			} else if err := enqueueContinuation(pfc, "/tasks/reconcileArticleCounts", url.Values { "cursor": { next } }, refreshQueue); err != nil {
+				c.Errorf("Error queueing continuation: %s", err)
+				jobError = err
+			}
+			break
+		}
+
+		userID, err := t.Next()
+		if err == storage.Done {
+			break
+		} else if err != nil {
+			c.Errorf("Error fetching user: %s", err)
+			jobError = err
+			break
+		}
+
+		if !pool.Submit("", func() { reconcileArticleCounts(pfc, doneChannel, userID) }) {
+			continue // Reconciled on the next scheduled run
+		}
+		users++
+	}
+
+	pool.Wait()
+	close(doneChannel)
+	<-drained
+
+	c.Infof("%d users reconciled (%d repaired) in %s", users, repaired, time.Since(started))
+
+	return jobError
+}
+
+func purgeFeed(pfc *PFContext, ch chan<- storage.PurgeReport, url string) {
+	report := storage.PurgeReport{}
+	if policy, err := retentionPolicy(pfc, url); err != nil {
+		pfc.C.Errorf("Error loading retention policy of %s: %s", url, err)
+	} else if report, err = pfc.Storage.PurgeFeed(url, policy); err != nil {
+		pfc.C.Errorf("Error purging entries of %s: %s", url, err)
+	}
+
+	ch<- report
+}
+
+// setFeedRetentionTask overrides the retention policy of the feed at
+// "url" with one that keeps entries for "days" (0 keeps them forever)
+// and the newest "minEntries" regardless of age. Without "days", the
+// feed reverts to the default policy
+func setFeedRetentionTask(pfc *PFContext) (TaskMessage, error) {
+	r := pfc.R
+	feedURL := strings.TrimSpace(r.PostFormValue("url"))
+	if feedURL == "" {
+		return TaskMessage { Silent: true }, errors.New("Missing feed URL")
+	}
+
+	var policy *storage.RetentionPolicy
+	if days := r.PostFormValue("days"); days != "" {
+		policy = &storage.RetentionPolicy {
+			MinEntries: DefaultRetentionPolicy.MinEntries,
+		}
+		if n, err := strconv.Atoi(days); err != nil || n < 0 {
+			return TaskMessage { Silent: true }, errors.New("Expecting a number of days")
+		} else {
+			policy.MaxAge = time.Duration(n) * 24 * time.Hour
+		}
+		if minEntries := r.PostFormValue("minEntries"); minEntries != "" {
+			if n, err := strconv.Atoi(minEntries); err != nil || n < 0 {
+				return TaskMessage { Silent: true }, errors.New("Expecting a number of entries")
+			} else {
+				policy.MinEntries = n
+			}
+		}
+	}
+
+	if err := pfc.Storage.SetFeedRetentionPolicy(feedURL, policy); err != nil {
+		return TaskMessage { Silent: true }, err
+	}
+
+	pfc.C.Infof("Retention policy of %s set to %+v", feedURL, policy)
+	return TaskMessage { Silent: true }, nil
+}
+
+func purgeEntriesJob(pfc *PFContext) error {
+	return purgeEntries(pfc, "")
+}
+
+func purgeEntriesTask(pfc *PFContext) (TaskMessage, error) {
+	return TaskMessage { Silent: true }, purgeEntries(pfc, pfc.R.PostFormValue("cursor"))
+}
+
+// purgeEntries removes expired articles and entries from every
+// feed, according to the feeds' retention policies
+func purgeEntries(pfc *PFContext, cursor string) error {
+	c := pfc.C
+	feeds := 0
+	started := time.Now()
+	doneChannel := make(chan storage.PurgeReport, purgeWorkers)
+	pool := newWorkPool(c, purgeWorkers, 0, started)
+	var jobError error
+
+	total := storage.PurgeReport{}
+	drained := make(chan bool)
+	go func() {
+		// Tally completions as they arrive
+		for report := range doneChannel {
+			total.Add(report)
+		}
+		close(drained)
+	}()
+
+	t, err := pfc.Storage.Feeds(cursor)
+	if err != nil {
+		return err
+	}
+
+	for {
+		if pool.Expired() {
+			// Out of time - continue in a separate task
+			if next, err := t.Cursor(); err != nil {
+				c.Errorf("Error reading cursor: %s", err)
+				jobError = err
+			} else if err := enqueueContinuation(pfc, "/tasks/purgeEntries", url.Values { "cursor": { next } }, refreshQueue); err != nil {
+				c.Errorf("Error queueing continuation: %s", err)
+				jobError = err
+			}
+			break
+		}
+
+		feedURL, _, err := t.Next()
+		if err == storage.Done {
+			break
+		} else if err != nil {
+			c.Errorf("Error fetching feed record: %s", err)
+			jobError = err
+			break
+		}
+
+		if !pool.Submit("", func() { purgeFeed(pfc, doneChannel, feedURL) }) {
+			continue // Purged on the next scheduled run
+		}
+		feeds++
+	}
+
+	pool.Wait()
+	close(doneChannel)
+	<-drained
+
+	c.Infof("%d feeds purged in %s: removed %d articles, %d entries, %d entry metadata and %d media",
+		feeds, time.Since(started), total.Articles, total.Entries, total.EntryMetas, total.EntryMedia)
+
+	return jobError
+}
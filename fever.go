@@ -0,0 +1,697 @@
+/*****************************************************************************
+ **
+ ** Gofr
+ ** https://github.com/pokebyte/Gofr
+ ** Copyright (C) 2013-2017 Akop Karapetyan
+ **
+ ** This program is free software; you can redistribute it and/or modify
+ ** it under the terms of the GNU General Public License as published by
+ ** the Free Software Foundation; either version 2 of the License, or
+ ** (at your option) any later version.
+ **
+ ** This program is distributed in the hope that it will be useful,
+ ** but WITHOUT ANY WARRANTY; without even the implied warranty of
+ ** MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ ** GNU General Public License for more details.
+ **
+ ** You should have received a copy of the GNU General Public License
+ ** along with this program; if not, write to the Free Software
+ ** Foundation, Inc., 675 Mass Ave, Cambridge, MA 02139, USA.
+ **
+ ******************************************************************************
+ */
+ 
+package gofr
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"hash/fnv"
+	"net/http"
+	"sort"
+	"storage"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Fever API, for clients that don't speak the Google Reader API.
+// Clients authenticate with md5("<email>:<password>"), where both
+// are chosen by the user on the account page
+
+const (
+	feverAPIVersion = 3
+	feverProvider = "fever"
+	feverKeyDuration = 10 * 365 * 24 * time.Hour
+
+	// Items are numbered by fetch time (in seconds), times the
+	// spread, plus a hash of the article - so that newer articles
+	// have larger IDs, as clients expect
+	feverIDSpread = 1000000
+	// Number of items returned per request
+	feverPageSize = 50
+	// Clients see at most this many of the newest items
+	feverMaxItems = 1000
+)
+
+type feverRequestHandler struct {
+	RouteHandler func(pfc *PFContext, response map[string]interface{}) error
+}
+
+type feverGroup struct {
+	ID int64     `json:"id"`
+	Title string `json:"title"`
+}
+
+type feverFeedsGroup struct {
+	GroupID int64    `json:"group_id"`
+	FeedIDs string   `json:"feed_ids"`
+}
+
+type feverFeed struct {
+	ID int64                 `json:"id"`
+	FavIconID int64          `json:"favicon_id"`
+	Title string             `json:"title"`
+	URL string               `json:"url"`
+	SiteURL string           `json:"site_url"`
+	IsSpark int              `json:"is_spark"`
+	LastUpdatedOnTime int64  `json:"last_updated_on_time"`
+}
+
+type feverFavIcon struct {
+	ID int64     `json:"id"`
+	Data string  `json:"data"`
+}
+
+type feverItem struct {
+	ID int64              `json:"id"`
+	FeedID int64          `json:"feed_id"`
+	Title string          `json:"title"`
+	Author string         `json:"author"`
+	HTML string           `json:"html"`
+	URL string            `json:"url"`
+	IsSaved int           `json:"is_saved"`
+	IsRead int            `json:"is_read"`
+	CreatedOnTime int64   `json:"created_on_time"`
+}
+
+// feverArticle is an article, along with its item ID
+type feverArticle struct {
+	storage.Article
+	ItemID int64
+}
+
+type feverArticlesByID []feverArticle
+
+func (articles feverArticlesByID)Len() int {
+	return len(articles)
+}
+
+func (articles feverArticlesByID)Swap(i, j int) {
+	articles[i], articles[j] = articles[j], articles[i]
+}
+
+func (articles feverArticlesByID)Less(i, j int) bool {
+	return articles[i].ItemID < articles[j].ItemID
+}
+
+func registerFever() {
+	handler := feverRequestHandler { RouteHandler: fever }
+	routes = append(routes, route { Pattern: "/fever", Handler: handler })
+	routes = append(routes, route { Pattern: "/fever/", Handler: handler })
+
+	RegisterHTMLRoute("/account/fever", setFeverKey)
+}
+
+func (handler feverRequestHandler)handleRequest(pfc *PFContext) {
+	w := pfc.W
+	c := pfc.C
+
+	pfc.R.ParseForm()
+	response := map[string]interface{} {
+		"api_version": feverAPIVersion,
+		"auth": 0,
+	}
+
+	if session := feverSession(pfc); session != nil {
+		pfc.UserID = session.UserID
+		if user, err := loadUser(pfc); err != nil {
+			c.Errorf("Error loading user: %s", err)
+			http.Error(w, "Unexpected error", http.StatusInternalServerError)
+			return
+		} else {
+			pfc.User = user
+		}
+
+		response["auth"] = 1
+		if err := handler.RouteHandler(pfc, response); err != nil {
+			c.Errorf("Error: %s", err)
+			if readableError, ok := err.(ReadableError); ok && readableError.err != nil {
+				c.Errorf("Source: %s", *readableError.err)
+			}
+
+			http.Error(w, "Unexpected error", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	bf, _ := json.Marshal(response)
+	w.Header().Set("Content-type", "application/json; charset=utf-8")
+	w.Write(bf)
+}
+
+func feverKey(email string, password string) string {
+	sum := md5.Sum([]byte(email + ":" + password))
+	return hex.EncodeToString(sum[:])
+}
+
+func feverSession(pfc *PFContext) *storage.Session {
+	apiKey := strings.ToLower(strings.TrimSpace(pfc.R.PostFormValue("api_key")))
+	if apiKey == "" {
+		return nil
+	}
+
+	if session, err := pfc.Storage.SessionByID(digest(feverProvider, apiKey)); err != nil {
+		pfc.C.Errorf("Error loading Fever session: %s", err)
+		return nil
+	} else if session == nil || time.Now().After(session.Expires) {
+		return nil
+	} else {
+		return session
+	}
+}
+
+// setFeverKey sets (or, given no password, removes) the user's
+// Fever API key
+func setFeverKey(pfc *PFContext) {
+	r := pfc.R
+	w := pfc.W
+
+	if r.Method != "POST" || !isValidCSRFToken(pfc, r.PostFormValue("token")) {
+		http.Error(w, _l("Invalid request"), http.StatusBadRequest)
+		return
+	}
+
+	email := strings.TrimSpace(r.PostFormValue("email"))
+	password := r.PostFormValue("password")
+	if password != "" {
+		if email == "" {
+			http.Error(w, _l("Missing email address"), http.StatusBadRequest)
+			return
+		} else if len(password) < minPasswordLength {
+			http.Error(w, _l("Passwords must be at least %d characters long", minPasswordLength), http.StatusBadRequest)
+			return
+		} else if password != r.PostFormValue("confirm") {
+			http.Error(w, _l("Passwords do not match"), http.StatusBadRequest)
+			return
+		}
+	}
+
+	// Keys depend on the credentials alone, and can't be shared
+	sessionID := ""
+	if password != "" {
+		sessionID = digest(feverProvider, feverKey(email, password))
+		if existing, err := pfc.Storage.SessionByID(sessionID); err != nil {
+			pfc.C.Errorf("Error loading Fever session: %s", err)
+			http.Error(w, _l("An unexpected error has occurred"), http.StatusInternalServerError)
+			return
+		} else if existing != nil && existing.UserID != pfc.UserID {
+			http.Error(w, _l("These credentials are already in use - choose another email address or password"), http.StatusBadRequest)
+			return
+		}
+	}
+
+	user := *pfc.User
+	if user.FeverSessionID != "" {
+		if err := pfc.Storage.DeleteSession(user.FeverSessionID); err != nil {
+			pfc.C.Errorf("Error removing Fever session: %s", err)
+			http.Error(w, _l("An unexpected error has occurred"), http.StatusInternalServerError)
+			return
+		}
+		user.FeverSessionID = ""
+	}
+
+	if password != "" {
+		session := storage.Session {
+			ID: sessionID,
+			UserID: pfc.UserID,
+			Provider: feverProvider,
+			Expires: time.Now().Add(feverKeyDuration),
+		}
+		if err := pfc.Storage.SaveSession(session); err != nil {
+			pfc.C.Errorf("Error saving Fever session: %s", err)
+			http.Error(w, _l("An unexpected error has occurred"), http.StatusInternalServerError)
+			return
+		}
+		user.FeverSessionID = session.ID
+	}
+
+	if err := pfc.Storage.SaveUser(user); err != nil {
+		pfc.C.Errorf("Error saving user: %s", err)
+		http.Error(w, _l("An unexpected error has occurred"), http.StatusInternalServerError)
+		return
+	}
+
+	http.Redirect(w, r, "/account", http.StatusFound)
+}
+
+// feverID returns a numeric ID for a folder, subscription or
+// favicon, small enough for clients that store IDs as doubles
+func feverID(id string) int64 {
+	h := fnv.New64a()
+	h.Write([]byte(id))
+
+	feverID := int64(h.Sum64() & (1 << 52 - 1))
+	if feverID == 0 {
+		feverID = 1
+	}
+
+	return feverID
+}
+
+// assignFeverItemIDs numbers articles. An article's number is
+// derived from its fetch time; if another article already holds
+// it, the next free one is taken. Numbers are recorded as item
+// aliases, which also resolve them
+func assignFeverItemIDs(pfc *PFContext, articles []storage.Article) ([]feverArticle, error) {
+	numbered := make([]feverArticle, len(articles))
+	pending := make([]int, len(articles))
+	for i, article := range articles {
+		numbered[i] = feverArticle {
+			Article: article,
+			ItemID: article.Fetched.Unix() * feverIDSpread + greaderItemID(article.Source, article.ID) % feverIDSpread,
+		}
+		pending[i] = i
+	}
+
+	for len(pending) > 0 {
+		ids := make([]int64, len(pending))
+		for i, index := range pending {
+			ids[i] = numbered[index].ItemID
+		}
+
+		aliases, err := pfc.Storage.ItemAliases(pfc.UserID, ids)
+		if err != nil {
+			return nil, err
+		}
+
+		taken := make(map[int64]storage.ItemAlias)
+		for _, alias := range aliases {
+			taken[alias.ID] = alias
+		}
+
+		claimed := make([]storage.ItemAlias, 0)
+		collided := make([]int, 0)
+		for _, index := range pending {
+			article := &numbered[index]
+			if alias, ok := taken[article.ItemID]; ok {
+				if alias.SubscriptionID == article.Source && alias.ArticleID == article.ID {
+					continue
+				}
+
+				article.ItemID++
+				collided = append(collided, index)
+			} else {
+				alias := storage.ItemAlias {
+					ID: article.ItemID,
+					SubscriptionID: article.Source,
+					ArticleID: article.ID,
+				}
+				taken[alias.ID] = alias
+				claimed = append(claimed, alias)
+			}
+		}
+
+		if len(claimed) > 0 {
+			if err := pfc.Storage.SaveItemAliases(pfc.UserID, claimed); err != nil {
+				return nil, err
+			}
+		}
+
+		pending = collided
+	}
+
+	return numbered, nil
+}
+
+// feverArticles returns up to feverMaxItems of the newest articles
+// matching the filter, stopping at the first fetched before since
+func feverArticles(pfc *PFContext, filter storage.ArticleFilter, since time.Time) ([]storage.Article, error) {
+	articles := make([]storage.Article, 0)
+	start := ""
+
+	for {
+		page, err := pfc.Storage.NewArticlePage(filter, start)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, article := range page.Articles {
+			if article.Fetched.Before(since) || len(articles) >= feverMaxItems {
+				return articles, nil
+			}
+			articles = append(articles, article)
+		}
+
+		if page.Continue == "" {
+			return articles, nil
+		}
+		start = page.Continue
+	}
+}
+
+func feverFilter(pfc *PFContext, property string) storage.ArticleFilter {
+	return storage.ArticleFilter {
+		ArticleScope: storage.ArticleScope {
+			FolderRef: storage.FolderRef {
+				UserID: pfc.UserID,
+			},
+		},
+		Property: property,
+	}
+}
+
+func formValueInt64(pfc *PFContext, name string) (int64, bool) {
+	if value, err := strconv.ParseInt(pfc.R.FormValue(name), 10, 64); err == nil {
+		return value, true
+	}
+
+	return 0, false
+}
+
+func fever(pfc *PFContext, response map[string]interface{}) error {
+	r := pfc.R
+	subs, err := pfc.Storage.NewUserSubscriptions(pfc.UserID)
+	if err != nil {
+		return err
+	}
+
+	lastRefreshed := int64(0)
+	for _, subscription := range subs.Subscriptions {
+		if updated := subscription.Updated.Unix(); !subscription.Updated.IsZero() && updated > lastRefreshed {
+			lastRefreshed = updated
+		}
+	}
+	response["last_refreshed_on_time"] = lastRefreshed
+
+	if r.FormValue("mark") != "" {
+		if err := feverMark(pfc, subs); err != nil {
+			return err
+		}
+	}
+
+	if _, ok := r.Form["groups"]; ok {
+		groups := make([]feverGroup, len(subs.Folders))
+		for i, folder := range subs.Folders {
+			groups[i] = feverGroup { ID: feverID(folder.ID), Title: folder.Title }
+		}
+		response["groups"] = groups
+		response["feeds_groups"] = feverFeedsGroups(subs)
+	}
+
+	if _, ok := r.Form["feeds"]; ok {
+		feeds := make([]feverFeed, len(subs.Subscriptions))
+		for i, subscription := range subs.Subscriptions {
+			feeds[i] = feverFeed {
+				ID: feverID(subscription.ID),
+				Title: subscription.Title,
+				URL: subscription.ID,
+				SiteURL: subscription.Link,
+				LastUpdatedOnTime: subscription.Updated.Unix(),
+			}
+			if subscription.FavIconURL != "" {
+				feeds[i].FavIconID = feverID(subscription.FavIconURL)
+			}
+		}
+		response["feeds"] = feeds
+		response["feeds_groups"] = feverFeedsGroups(subs)
+	}
+
+	if _, ok := r.Form["favicons"]; ok {
+		response["favicons"] = feverFavIcons(pfc, subs)
+	}
+
+	if _, ok := r.Form["items"]; ok {
+		if err := feverItems(pfc, subs, response); err != nil {
+			return err
+		}
+	}
+
+	if _, ok := r.Form["links"]; ok {
+		response["links"] = []interface{}{}
+	}
+
+	for name, property := range map[string]string { "unread_item_ids": "unread", "saved_item_ids": "star" } {
+		if _, ok := r.Form[name]; !ok {
+			continue
+		}
+
+		articles, err := feverArticles(pfc, feverFilter(pfc, property), time.Time{})
+		if err != nil {
+			return err
+		}
+
+		numbered, err := assignFeverItemIDs(pfc, articles)
+		if err != nil {
+			return err
+		}
+
+		ids := make([]string, len(numbered))
+		for i, article := range numbered {
+			ids[i] = strconv.FormatInt(article.ItemID, 10)
+		}
+		response[name] = strings.Join(ids, ",")
+	}
+
+	return nil
+}
+
+func feverFeedsGroups(subs *storage.UserSubscriptions) []feverFeedsGroup {
+	feedIDs := make(map[string][]string)
+	for _, subscription := range subs.Subscriptions {
+		if subscription.Parent != "" {
+			feedIDs[subscription.Parent] = append(feedIDs[subscription.Parent], strconv.FormatInt(feverID(subscription.ID), 10))
+		}
+	}
+
+	feedsGroups := make([]feverFeedsGroup, 0, len(subs.Folders))
+	for _, folder := range subs.Folders {
+		if ids, ok := feedIDs[folder.ID]; ok {
+			feedsGroups = append(feedsGroups, feverFeedsGroup {
+				GroupID: feverID(folder.ID),
+				FeedIDs: strings.Join(ids, ","),
+			})
+		}
+	}
+
+	return feedsGroups
+}
+
+// feverFavIcons returns the favicons stored for the user's
+// subscriptions. Feeds whose icons haven't been fetched yet are
+// left out
+func feverFavIcons(pfc *PFContext, subs *storage.UserSubscriptions) []feverFavIcon {
+	seen := make(map[string]bool)
+	favIcons := make([]feverFavIcon, 0)
+
+	for _, subscription := range subs.Subscriptions {
+		favIconURL := subscription.FavIconURL
+		if favIconURL == "" || subscription.FavIcon == "" || seen[favIconURL] {
+			continue
+		}
+		seen[favIconURL] = true
+
+		favIcons = append(favIcons, feverFavIcon {
+			ID: feverID(favIconURL),
+			Data: subscription.FavIcon,
+		})
+	}
+
+	return favIcons
+}
+
+func feverItems(pfc *PFContext, subs *storage.UserSubscriptions, response map[string]interface{}) error {
+	r := pfc.R
+
+	var articles []storage.Article
+	var err error
+	sinceID, hasSinceID := formValueInt64(pfc, "since_id")
+	maxID, hasMaxID := formValueInt64(pfc, "max_id")
+
+	if withIDs := r.FormValue("with_ids"); withIDs != "" {
+		ids := strings.Split(withIDs, ",")
+		if len(ids) > feverPageSize {
+			ids = ids[:feverPageSize]
+		}
+
+		refs, err := resolveItems(pfc, subs, ids)
+		if err != nil {
+			return err
+		}
+		if articles, err = pfc.Storage.Articles(refs); err != nil {
+			return err
+		}
+	} else if hasSinceID {
+		articles, err = feverArticles(pfc, feverFilter(pfc, ""), time.Unix(sinceID / feverIDSpread, 0))
+	} else {
+		articles, err = feverArticles(pfc, feverFilter(pfc, ""), time.Time{})
+	}
+
+	if err != nil {
+		return err
+	}
+
+	numbered, err := assignFeverItemIDs(pfc, articles)
+	if err != nil {
+		return err
+	}
+
+	// Since an ID, items come oldest first; otherwise newest first
+	selected := make([]feverArticle, 0, feverPageSize)
+	if hasSinceID && r.FormValue("with_ids") == "" {
+		sort.Sort(feverArticlesByID(numbered))
+		for _, article := range numbered {
+			if article.ItemID > sinceID && len(selected) < feverPageSize {
+				selected = append(selected, article)
+			}
+		}
+	} else {
+		sort.Sort(sort.Reverse(feverArticlesByID(numbered)))
+		for _, article := range numbered {
+			if (!hasMaxID || article.ItemID < maxID) && len(selected) < feverPageSize {
+				selected = append(selected, article)
+			}
+		}
+	}
+
+	items := make([]feverItem, len(selected))
+	for i, article := range selected {
+		item := feverItem {
+			ID: article.ItemID,
+			FeedID: feverID(article.Source),
+			CreatedOnTime: article.Published.Unix(),
+		}
+		if article.HasProperty("star") {
+			item.IsSaved = 1
+		}
+		if !article.IsUnread() {
+			item.IsRead = 1
+		}
+		if details := article.Details; details != nil {
+			item.Title = details.Title
+			item.Author = details.Author
+			item.URL = details.Link
+			if details.Content != "" {
+				item.HTML = details.Content
+			} else {
+				item.HTML = details.Summary
+			}
+		}
+		items[i] = item
+	}
+
+	response["items"] = items
+	response["total_items"] = len(numbered)
+
+	return nil
+}
+
+// feverMark marks an item as read, unread, saved or unsaved, or a
+// feed or group as read. Feeds and groups are marked up to the
+// "before" time, so that items the client hasn't seen stay unread
+func feverMark(pfc *PFContext, subs *storage.UserSubscriptions) error {
+	r := pfc.R
+	as := r.FormValue("as")
+	id := r.FormValue("id")
+
+	switch r.FormValue("mark") {
+	case "item":
+		property, set := "", true
+		switch as {
+		case "read":
+			property = "read"
+		case "unread":
+			property, set = "read", false
+		case "saved":
+			property = "star"
+		case "unsaved":
+			property, set = "star", false
+		default:
+			return nil
+		}
+
+		refs, err := resolveItems(pfc, subs, []string { id })
+		if err != nil {
+			return err
+		}
+
+		for _, ref := range refs {
+			if _, err := pfc.Storage.SetProperty(ref, property, set); err != nil {
+				return NewReadableError(_l("Error updating article"), &err)
+			}
+		}
+	case "feed", "group":
+		if as != "read" {
+			return nil
+		}
+
+		numericID, err := strconv.ParseInt(id, 10, 64)
+		if err != nil {
+			return nil
+		}
+
+		scope := storage.ArticleScope {
+			FolderRef: storage.FolderRef {
+				UserID: pfc.UserID,
+			},
+		}
+
+		if r.FormValue("mark") == "feed" {
+			found := false
+			for _, subscription := range subs.Subscriptions {
+				if feverID(subscription.ID) == numericID {
+					scope.FolderID, scope.SubscriptionID = subscription.Parent, subscription.ID
+					found = true
+					break
+				}
+			}
+			if !found {
+				return nil
+			}
+		} else if numericID != 0 {
+			// Group 0 is everything
+			found := false
+			for _, folder := range subs.Folders {
+				if feverID(folder.ID) == numericID {
+					scope.FolderID = folder.ID
+					found = true
+					break
+				}
+			}
+			if !found {
+				return nil
+			}
+		}
+
+		before := time.Now()
+		if timestamp, ok := formValueInt64(pfc, "before"); ok {
+			before = time.Unix(timestamp, 0)
+		}
+
+		return feverMarkAsRead(pfc, scope, before)
+	}
+
+	return nil
+}
+
+// feverMarkAsRead marks the unread articles within the scope that
+// were fetched before the specified time as read
+func feverMarkAsRead(pfc *PFContext, scope storage.ArticleScope, before time.Time) error {
+	readRange := storage.ReadRange {
+		Marked: time.Now(),
+		Before: storage.ArticlePosition { Fetched: before },
+	}
+
+	return markAsRead(pfc, scope, readRange)
+}
@@ -0,0 +1,1202 @@
+/*****************************************************************************
+ **
+ ** Gofr
+ ** https://github.com/pokebyte/Gofr
+ ** Copyright (C) 2013-2017 Akop Karapetyan
+ **
+ ** This program is free software; you can redistribute it and/or modify
+ ** it under the terms of the GNU General Public License as published by
+ ** the Free Software Foundation; either version 2 of the License, or
+ ** (at your option) any later version.
+ **
+ ** This program is distributed in the hope that it will be useful,
+ ** but WITHOUT ANY WARRANTY; without even the implied warranty of
+ ** MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ ** GNU General Public License for more details.
+ **
+ ** You should have received a copy of the GNU General Public License
+ ** along with this program; if not, write to the Free Software
+ ** Foundation, Inc., 675 Mass Ave, Cambridge, MA 02139, USA.
+ **
+ ******************************************************************************
+ */
+ 
+package gofr
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"net/http"
+	"net/url"
+	"storage"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Google Reader-compatible API, for third-party clients (Reeder,
+// FeedMe, NetNewsWire, etc.). Clients sign in through ClientLogin
+// with the user's email address and a password generated on the
+// account page, then send the token they're given in an
+// "Authorization: GoogleLogin auth=..." header
+
+const (
+	greaderProvider = "greader"
+	greaderPasswordProvider = "greader-password"
+	greaderPasswordDuration = 10 * 365 * 24 * time.Hour
+	// Accounts are locked out of ClientLogin for the rest of the
+	// window, after this many failed attempts within it
+	greaderMaxLoginFailures = 10
+	greaderLoginFailureWindow = 15 * time.Minute
+
+	greaderAPIPath = "/reader/api/0/"
+	greaderItemPrefix = "tag:google.com,2005:reader/item/"
+
+	greaderReadingList = "user/-/state/com.google/reading-list"
+	greaderRead = "user/-/state/com.google/read"
+	greaderKeptUnread = "user/-/state/com.google/kept-unread"
+	greaderStarred = "user/-/state/com.google/starred"
+	greaderLike = "user/-/state/com.google/like"
+	greaderLabelPrefix = "user/-/label/"
+	greaderFeedPrefix = "feed/"
+
+	greaderDefaultCount = 20
+	greaderMaxCount = 1000
+)
+
+// greaderStates maps the states clients can read and set to
+// article properties
+var greaderStates = map[string]string {
+	greaderRead: "read",
+	greaderStarred: "star",
+	greaderLike: "like",
+}
+
+type GReaderRouteHandler func(pfc *PFContext) (interface{}, error)
+
+type greaderRequestHandler struct {
+	RouteHandler GReaderRouteHandler
+	LoginRequired bool
+}
+
+type greaderItemRef struct {
+	ID string                 `json:"id"`
+	DirectStreamIDs []string  `json:"directStreamIds"`
+	TimestampUsec string      `json:"timestampUsec"`
+}
+
+type greaderLink struct {
+	Href string    `json:"href"`
+	Type string    `json:"type,omitempty"`
+	Length string  `json:"length,omitempty"`
+}
+
+type greaderContent struct {
+	Direction string  `json:"direction"`
+	Content string    `json:"content"`
+}
+
+type greaderOrigin struct {
+	StreamID string  `json:"streamId"`
+	Title string     `json:"title"`
+	HTMLURL string   `json:"htmlUrl"`
+}
+
+type greaderItem struct {
+	ID string                 `json:"id"`
+	CrawlTimeMsec string      `json:"crawlTimeMsec"`
+	TimestampUsec string      `json:"timestampUsec"`
+	Published int64           `json:"published"`
+	Updated int64             `json:"updated"`
+	Title string              `json:"title"`
+	Author string             `json:"author,omitempty"`
+	Canonical []greaderLink   `json:"canonical"`
+	Alternate []greaderLink   `json:"alternate"`
+	Enclosure []greaderLink   `json:"enclosure,omitempty"`
+	Summary greaderContent    `json:"summary"`
+	Categories []string       `json:"categories"`
+	Origin greaderOrigin      `json:"origin"`
+}
+
+// greaderStream is a stream ID, resolved against the user's
+// subscriptions
+type greaderStream struct {
+	ID string
+	Title string
+	Filter storage.ArticleFilter
+}
+
+func registerGReader() {
+	RegisterGReaderRoute("/accounts/ClientLogin", false, greaderClientLogin)
+	RegisterHTMLRoute("/account/greader", setGReaderPassword)
+
+	RegisterGReaderRoute(greaderAPIPath + "token", true, greaderToken)
+	RegisterGReaderRoute(greaderAPIPath + "user-info", true, greaderUserInfo)
+	RegisterGReaderRoute(greaderAPIPath + "subscription/list", true, greaderSubscriptionList)
+	RegisterGReaderRoute(greaderAPIPath + "subscription/edit", true, greaderEditSubscription)
+	RegisterGReaderRoute(greaderAPIPath + "subscription/quickadd", true, greaderQuickAdd)
+	RegisterGReaderRoute(greaderAPIPath + "tag/list", true, greaderTagList)
+	RegisterGReaderRoute(greaderAPIPath + "unread-count", true, greaderUnreadCount)
+	RegisterGReaderRoute(greaderAPIPath + "stream/contents/", true, greaderStreamContents)
+	RegisterGReaderRoute(greaderAPIPath + "stream/contents", true, greaderStreamContents)
+	RegisterGReaderRoute(greaderAPIPath + "stream/items/ids", true, greaderStreamItemIDs)
+	RegisterGReaderRoute(greaderAPIPath + "stream/items/contents", true, greaderStreamItemContents)
+	RegisterGReaderRoute(greaderAPIPath + "edit-tag", true, greaderEditTag)
+	RegisterGReaderRoute(greaderAPIPath + "mark-all-as-read", true, greaderMarkAllAsRead)
+}
+
+func RegisterGReaderRoute(pattern string, loginRequired bool, handler GReaderRouteHandler) {
+	route := route {
+		Pattern: pattern,
+		Handler: greaderRequestHandler {
+			RouteHandler: handler,
+			LoginRequired: loginRequired,
+		},
+	}
+
+	routes = append(routes, route)
+}
+
+func (handler greaderRequestHandler)handleRequest(pfc *PFContext) {
+	w := pfc.W
+	c := pfc.C
+
+	if handler.LoginRequired {
+		session := greaderSession(pfc)
+		if session == nil {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		pfc.UserID = session.UserID
+		if user, err := loadUser(pfc); err != nil {
+			c.Errorf("Error loading user: %s", err)
+			http.Error(w, "Unexpected error", http.StatusInternalServerError)
+			return
+		} else if user.GReaderPasswordID == "" || session.IssuedBy != user.GReaderPasswordID {
+			// Password since replaced or removed
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		} else {
+			pfc.User = user
+		}
+	}
+
+	returnValue, err := handler.RouteHandler(pfc)
+	if err != nil {
+		message := _l("An unexpected error has occurred")
+		httpCode := http.StatusInternalServerError
+
+		c.Errorf("Error: %s", err)
+
+		if readableError, ok := err.(ReadableError); ok {
+			message = err.Error()
+			httpCode = readableError.httpCode
+
+			if readableError.err != nil {
+				c.Errorf("Source: %s", *readableError.err)
+			}
+		}
+
+		http.Error(w, message, httpCode)
+	} else if text, ok := returnValue.(string); ok {
+		w.Header().Set("Content-type", "text/plain; charset=utf-8")
+		w.Write([]byte(text))
+	} else {
+		bf, _ := json.Marshal(returnValue)
+		w.Header().Set("Content-type", "application/json; charset=utf-8")
+		w.Write(bf)
+	}
+}
+
+// greaderSession returns the session of the token in the request's
+// Authorization header, if it's valid
+func greaderSession(pfc *PFContext) *storage.Session {
+	const scheme = "GoogleLogin auth="
+	header := pfc.R.Header.Get("Authorization")
+	if !strings.HasPrefix(header, scheme) {
+		return nil
+	}
+
+	token := strings.TrimSpace(header[len(scheme):])
+	if token == "" {
+		return nil
+	}
+
+	sessionID := digest(greaderProvider, token)
+	if session, err := pfc.Storage.SessionByID(sessionID); err != nil {
+		pfc.C.Errorf("Error loading API session: %s", err)
+		return nil
+	} else if session == nil {
+		return nil
+	} else if time.Now().After(session.Expires) {
+		if err := pfc.Storage.DeleteSession(sessionID); err != nil {
+			pfc.C.Warningf("Error deleting expired API session: %s", err)
+		}
+		return nil
+	} else {
+		return session
+	}
+}
+
+func greaderClientLogin(pfc *PFContext) (interface{}, error) {
+	r := pfc.R
+	badAuthentication := NewReadableErrorWithCode("Error=BadAuthentication", http.StatusForbidden, nil)
+
+	email := strings.TrimSpace(r.FormValue("Email"))
+	password := strings.TrimSpace(r.FormValue("Passwd"))
+	if email == "" || password == "" {
+		return nil, badAuthentication
+	}
+
+	failures, err := pfc.Storage.LoginFailures(email)
+	if err != nil {
+		return nil, err
+	} else if failures != nil && failures.Exceeded(time.Now(), greaderMaxLoginFailures, greaderLoginFailureWindow) {
+		return nil, NewReadableErrorWithCode("Error=BadAuthentication", http.StatusTooManyRequests, nil)
+	}
+
+	passwordSession, err := greaderPasswordSession(pfc, email, password)
+	if err != nil {
+		return nil, err
+	} else if passwordSession == nil {
+		if _, err := pfc.Storage.RecordLoginFailure(email, greaderLoginFailureWindow); err != nil {
+			pfc.C.Warningf("Error recording failed sign-in: %s", err)
+		}
+		return nil, badAuthentication
+	} else if failures != nil {
+		if err := pfc.Storage.ClearLoginFailures(email); err != nil {
+			pfc.C.Warningf("Error clearing failed sign-ins: %s", err)
+		}
+	}
+
+	token, err := randomToken()
+	if err != nil {
+		return nil, err
+	}
+
+	session := storage.Session {
+		ID: digest(greaderProvider, token),
+		UserID: passwordSession.UserID,
+		Provider: greaderProvider,
+		Expires: time.Now().Add(sessionDuration),
+		IssuedBy: passwordSession.ID,
+	}
+	if err := pfc.Storage.SaveSession(session); err != nil {
+		return nil, err
+	}
+
+	return fmt.Sprintf("SID=%s\nLSID=%s\nAuth=%s\n", token, token, token), nil
+}
+
+// greaderPasswordSession returns the session standing in for the
+// API password, if it's the current password of the user with the
+// email address
+func greaderPasswordSession(pfc *PFContext, email string, password string) (*storage.Session, error) {
+	session, err := pfc.Storage.SessionByID(digest(greaderPasswordProvider, password))
+	if err != nil {
+		return nil, err
+	} else if session == nil || session.Provider != greaderPasswordProvider || time.Now().After(session.Expires) {
+		return nil, nil
+	}
+
+	user, err := pfc.Storage.UserByID(session.UserID)
+	if err != nil {
+		return nil, err
+	} else if user == nil || user.GReaderPasswordID != session.ID || !strings.EqualFold(user.EmailAddress, email) {
+		return nil, nil
+	}
+
+	return session, nil
+}
+
+// setGReaderPassword generates a new Google Reader API password for
+// the user, replacing any other, and shows it once. Without
+// "generate", it removes the password instead
+func setGReaderPassword(pfc *PFContext) {
+	r := pfc.R
+	w := pfc.W
+
+	if r.Method != "POST" || !isValidCSRFToken(pfc, r.PostFormValue("token")) {
+		http.Error(w, _l("Invalid request"), http.StatusBadRequest)
+		return
+	}
+
+	user := *pfc.User
+	if user.GReaderPasswordID != "" {
+		if err := pfc.Storage.DeleteSession(user.GReaderPasswordID); err != nil {
+			pfc.C.Errorf("Error removing Google Reader API password: %s", err)
+			http.Error(w, _l("An unexpected error has occurred"), http.StatusInternalServerError)
+			return
+		}
+		user.GReaderPasswordID = ""
+	}
+
+	password := ""
+	if r.PostFormValue("generate") != "" {
+		var err error
+		if password, err = randomToken(); err != nil {
+			pfc.C.Errorf("Error generating password: %s", err)
+			http.Error(w, _l("An unexpected error has occurred"), http.StatusInternalServerError)
+			return
+		}
+
+		session := storage.Session {
+			ID: digest(greaderPasswordProvider, password),
+			UserID: pfc.UserID,
+			Provider: greaderPasswordProvider,
+			Expires: time.Now().Add(greaderPasswordDuration),
+		}
+		if err := pfc.Storage.SaveSession(session); err != nil {
+			pfc.C.Errorf("Error saving Google Reader API password: %s", err)
+			http.Error(w, _l("An unexpected error has occurred"), http.StatusInternalServerError)
+			return
+		}
+		user.GReaderPasswordID = session.ID
+	}
+
+	if err := pfc.Storage.SaveUser(user); err != nil {
+		pfc.C.Errorf("Error saving user: %s", err)
+		http.Error(w, _l("An unexpected error has occurred"), http.StatusInternalServerError)
+		return
+	}
+
+	if password == "" {
+		http.Redirect(w, r, "/account", http.StatusFound)
+		return
+	}
+
+	pfc.User = &user
+	renderAccount(pfc, map[string]interface{} {
+		"GReaderPassword": password,
+	})
+}
+
+// greaderToken returns the token clients send along with edits.
+// It isn't checked: requests are authenticated by a header, which
+// browsers won't send on a forger's behalf
+func greaderToken(pfc *PFContext) (interface{}, error) {
+	return digest("greader-edit", string(pfc.UserID)), nil
+}
+
+func greaderUserInfo(pfc *PFContext) (interface{}, error) {
+	return map[string]string {
+		"userId": pfc.User.ID,
+		"userName": pfc.User.EmailAddress,
+		"userProfileId": pfc.User.ID,
+		"userEmail": pfc.User.EmailAddress,
+	}, nil
+}
+
+// greaderItemID returns the numeric ID clients know the article by
+func greaderItemID(subscriptionID string, articleID string) int64 {
+	h := fnv.New64a()
+	h.Write([]byte(subscriptionID + "\x00" + articleID))
+
+	id := int64(h.Sum64() & 0x7fffffffffffffff)
+	if id == 0 {
+		id = 1
+	}
+
+	return id
+}
+
+// parseGReaderItemID accepts both the long (hex, prefixed) and the
+// short (decimal) forms of an item ID
+func parseGReaderItemID(id string) (int64, error) {
+	if strings.HasPrefix(id, greaderItemPrefix) {
+		hexID, err := strconv.ParseUint(id[len(greaderItemPrefix):], 16, 64)
+		return int64(hexID), err
+	}
+
+	return strconv.ParseInt(id, 10, 64)
+}
+
+func greaderLabel(title string) string {
+	return greaderLabelPrefix + title
+}
+
+func greaderFeed(subscriptionID string) string {
+	return greaderFeedPrefix + subscriptionID
+}
+
+func folderTitles(subs *storage.UserSubscriptions) map[string]string {
+	titles := make(map[string]string)
+	for _, folder := range subs.Folders {
+		titles[folder.ID] = folder.Title
+	}
+
+	return titles
+}
+
+func subscriptionByID(subs *storage.UserSubscriptions, subscriptionID string) *storage.Subscription {
+	for i, _ := range subs.Subscriptions {
+		if subs.Subscriptions[i].ID == subscriptionID {
+			return &subs.Subscriptions[i]
+		}
+	}
+
+	return nil
+}
+
+func folderByTitle(subs *storage.UserSubscriptions, title string) *storage.Folder {
+	for i, _ := range subs.Folders {
+		if subs.Folders[i].Title == title {
+			return &subs.Folders[i]
+		}
+	}
+
+	return nil
+}
+
+// normalizeStreamID replaces the user ID in a stream ID with "-",
+// which is what clients usually send anyway
+func normalizeStreamID(streamID string) string {
+	if strings.HasPrefix(streamID, "user/") {
+		if parts := strings.SplitN(streamID, "/", 3); len(parts) == 3 {
+			return "user/-/" + parts[2]
+		}
+	}
+
+	return streamID
+}
+
+func resolveStream(pfc *PFContext, subs *storage.UserSubscriptions, streamID string) (*greaderStream, error) {
+	streamID = normalizeStreamID(streamID)
+	stream := &greaderStream {
+		ID: streamID,
+		Filter: storage.ArticleFilter {
+			ArticleScope: storage.ArticleScope {
+				FolderRef: storage.FolderRef {
+					UserID: pfc.UserID,
+				},
+			},
+		},
+	}
+
+	if streamID == "" || streamID == greaderReadingList {
+		stream.ID, stream.Title = greaderReadingList, _l("All items")
+	} else if property, ok := greaderStates[streamID]; ok {
+		stream.Filter.Property = property
+	} else if strings.HasPrefix(streamID, greaderLabelPrefix) {
+		title := streamID[len(greaderLabelPrefix):]
+		if folder := folderByTitle(subs, title); folder != nil {
+			stream.Filter.FolderID = folder.ID
+		} else {
+			stream.Filter.Tag = title
+		}
+		stream.Title = title
+	} else if strings.HasPrefix(streamID, greaderFeedPrefix) {
+		subscription := subscriptionByID(subs, streamID[len(greaderFeedPrefix):])
+		if subscription == nil {
+			return nil, NewReadableErrorWithCode(_l("Subscription not found"), http.StatusNotFound, nil)
+		}
+
+		stream.Filter.FolderID = subscription.Parent
+		stream.Filter.SubscriptionID = subscription.ID
+		stream.Title = subscription.Title
+	} else {
+		return nil, NewReadableErrorWithCode(_l("Stream not found"), http.StatusNotFound, nil)
+	}
+
+	return stream, nil
+}
+
+// greaderStreamID returns the stream ID, which comes either as part
+// of the path or as the "s" parameter
+func greaderStreamID(r *http.Request) string {
+	prefix := greaderAPIPath + "stream/contents/"
+	if strings.HasPrefix(r.URL.Path, prefix) {
+		if streamID, err := url.PathUnescape(r.URL.EscapedPath()[len(prefix):]); err == nil {
+			return streamID
+		}
+	}
+
+	return r.FormValue("s")
+}
+
+// streamArticles reads up to n articles of the stream, subject to
+// the request's exclusions and time range. The continuation is
+// the offset into a page of storage results, along with that page
+func streamArticles(pfc *PFContext, stream *greaderStream) ([]storage.Article, string, error) {
+	r := pfc.R
+
+	count := greaderDefaultCount
+	if n, err := strconv.Atoi(r.FormValue("n")); err == nil && n > 0 {
+		count = n
+	}
+	if count > greaderMaxCount {
+		count = greaderMaxCount
+	}
+
+	filter := stream.Filter
+	for _, target := range r.Form["xt"] {
+		if normalizeStreamID(target) != greaderRead {
+			continue
+		} else if len(filter.RequiredProperties()) == 0 && len(filter.RequiredTags()) == 0 {
+			// Indexed, unlike exclusions
+			filter.Property = "unread"
+		} else {
+			filter.ExcludedProperties = append(filter.ExcludedProperties, "read")
+		}
+	}
+
+	if r.FormValue("r") == "o" {
+		filter.Order = storage.OrderOldest
+	}
+
+	if ot, err := strconv.ParseInt(r.FormValue("ot"), 10, 64); err == nil {
+		filter.FetchedAfter = time.Unix(ot, 0)
+	}
+	if nt, err := strconv.ParseInt(r.FormValue("nt"), 10, 64); err == nil {
+		filter.FetchedBefore = time.Unix(nt + 1, 0)
+	}
+
+	skip := 0
+	start := ""
+	if continuation := r.FormValue("c"); continuation != "" {
+		parts := strings.SplitN(continuation, ":", 2)
+		if s, err := strconv.Atoi(parts[0]); err != nil || len(parts) != 2 {
+			return nil, "", NewReadableErrorWithCode(_l("Continuation not valid"), http.StatusBadRequest, nil)
+		} else {
+			skip, start = s, parts[1]
+		}
+	}
+
+	articles := make([]storage.Article, 0, count)
+	for {
+		page, err := pfc.Storage.NewArticlePage(filter, start)
+		if err != nil {
+			return nil, "", err
+		}
+
+		for i := skip; i < len(page.Articles); i++ {
+			articles = append(articles, page.Articles[i])
+			if len(articles) >= count {
+				if i + 1 < len(page.Articles) {
+					return articles, strconv.Itoa(i + 1) + ":" + start, nil
+				} else if page.Continue != "" {
+					return articles, "0:" + page.Continue, nil
+				}
+
+				return articles, "", nil
+			}
+		}
+
+		if page.Continue == "" {
+			return articles, "", nil
+		}
+
+		start, skip = page.Continue, 0
+	}
+}
+
+// saveItemAliases records the item IDs of articles, so that they
+// can be resolved when clients refer to them
+func saveItemAliases(pfc *PFContext, articles []storage.Article) error {
+	if len(articles) == 0 {
+		return nil
+	}
+
+	aliases := make([]storage.ItemAlias, len(articles))
+	for i, article := range articles {
+		aliases[i] = storage.ItemAlias {
+			ID: greaderItemID(article.Source, article.ID),
+			SubscriptionID: article.Source,
+			ArticleID: article.ID,
+		}
+	}
+
+	return pfc.Storage.SaveItemAliases(pfc.UserID, aliases)
+}
+
+// resolveItems returns references to the articles with the
+// specified item IDs. Unknown IDs are skipped
+func resolveItems(pfc *PFContext, subs *storage.UserSubscriptions, itemIDs []string) ([]storage.ArticleRef, error) {
+	ids := make([]int64, 0, len(itemIDs))
+	for _, itemID := range itemIDs {
+		if id, err := parseGReaderItemID(itemID); err != nil {
+			return nil, NewReadableErrorWithCode(_l("Item ID not valid"), http.StatusBadRequest, &err)
+		} else {
+			ids = append(ids, id)
+		}
+	}
+
+	aliases, err := pfc.Storage.ItemAliases(pfc.UserID, ids)
+	if err != nil {
+		return nil, err
+	}
+
+	refs := make([]storage.ArticleRef, 0, len(aliases))
+	for _, alias := range aliases {
+		subscription := subscriptionByID(subs, alias.SubscriptionID)
+		if subscription == nil {
+			continue
+		}
+
+		refs = append(refs, storage.ArticleRef {
+			SubscriptionRef: storage.SubscriptionRef {
+				FolderRef: storage.FolderRef {
+					UserID: pfc.UserID,
+					FolderID: subscription.Parent,
+				},
+				SubscriptionID: subscription.ID,
+			},
+			ArticleID: alias.ArticleID,
+		})
+	}
+
+	return refs, nil
+}
+
+func newGReaderItem(article storage.Article, subs *storage.UserSubscriptions, titles map[string]string) greaderItem {
+	item := greaderItem {
+		ID: fmt.Sprintf("%s%016x", greaderItemPrefix, greaderItemID(article.Source, article.ID)),
+		CrawlTimeMsec: strconv.FormatInt(article.Fetched.UnixNano() / int64(time.Millisecond), 10),
+		TimestampUsec: strconv.FormatInt(article.Fetched.UnixNano() / int64(time.Microsecond), 10),
+		Published: article.Published.Unix(),
+		Updated: article.Published.Unix(),
+		Canonical: []greaderLink{},
+		Alternate: []greaderLink{},
+		Summary: greaderContent { Direction: "ltr" },
+		Categories: []string { greaderReadingList },
+		Origin: greaderOrigin { StreamID: greaderFeed(article.Source) },
+	}
+
+	if details := article.Details; details != nil {
+		item.Title = details.Title
+		item.Author = details.Author
+		if !details.Updated.IsZero() {
+			item.Updated = details.Updated.Unix()
+		}
+		if details.Link != "" {
+			item.Canonical = append(item.Canonical, greaderLink { Href: details.Link })
+			item.Alternate = append(item.Alternate, greaderLink { Href: details.Link, Type: "text/html" })
+		}
+		if details.Content != "" {
+			item.Summary.Content = details.Content
+		} else {
+			item.Summary.Content = details.Summary
+		}
+	}
+
+	for _, media := range article.Media {
+		enclosure := greaderLink { Href: media.URL, Type: media.Type }
+		if media.Size > 0 {
+			enclosure.Length = strconv.FormatInt(media.Size, 10)
+		}
+		item.Enclosure = append(item.Enclosure, enclosure)
+	}
+
+	for streamID, property := range greaderStates {
+		if article.HasProperty(property) {
+			item.Categories = append(item.Categories, streamID)
+		}
+	}
+	for _, tag := range article.Tags {
+		item.Categories = append(item.Categories, greaderLabel(tag))
+	}
+
+	if subscription := subscriptionByID(subs, article.Source); subscription != nil {
+		item.Origin.Title = subscription.Title
+		item.Origin.HTMLURL = subscription.Link
+		if title, ok := titles[subscription.Parent]; ok {
+			item.Categories = append(item.Categories, greaderLabel(title))
+		}
+	}
+
+	return item
+}
+
+func newGReaderItems(articles []storage.Article, subs *storage.UserSubscriptions) []greaderItem {
+	titles := folderTitles(subs)
+	items := make([]greaderItem, len(articles))
+	for i, article := range articles {
+		items[i] = newGReaderItem(article, subs, titles)
+	}
+
+	return items
+}
+
+func greaderSubscriptionList(pfc *PFContext) (interface{}, error) {
+	subs, err := pfc.Storage.NewUserSubscriptions(pfc.UserID)
+	if err != nil {
+		return nil, err
+	}
+
+	titles := folderTitles(subs)
+	subscriptions := make([]map[string]interface{}, len(subs.Subscriptions))
+	for i, subscription := range subs.Subscriptions {
+		categories := make([]map[string]string, 0, 1)
+		if title, ok := titles[subscription.Parent]; ok {
+			categories = append(categories, map[string]string {
+				"id": greaderLabel(title),
+				"label": title,
+			})
+		}
+
+		subscriptions[i] = map[string]interface{} {
+			"id": greaderFeed(subscription.ID),
+			"title": subscription.Title,
+			"categories": categories,
+			"url": subscription.ID,
+			"htmlUrl": subscription.Link,
+			"iconUrl": subscription.FavIconURL,
+			"firstitemmsec": strconv.FormatInt(subscription.Subscribed.UnixNano() / int64(time.Millisecond), 10),
+		}
+	}
+
+	return map[string]interface{} {
+		"subscriptions": subscriptions,
+	}, nil
+}
+
+func greaderTagList(pfc *PFContext) (interface{}, error) {
+	subs, err := pfc.Storage.NewUserSubscriptions(pfc.UserID)
+	if err != nil {
+		return nil, err
+	}
+
+	tags := []map[string]string {
+		{ "id": greaderStarred },
+	}
+	for _, folder := range subs.Folders {
+		tags = append(tags, map[string]string {
+			"id": greaderLabel(folder.Title),
+			"type": "folder",
+		})
+	}
+	for _, tag := range subs.Tags {
+		tags = append(tags, map[string]string {
+			"id": greaderLabel(tag.Title),
+			"type": "tag",
+		})
+	}
+
+	return map[string]interface{} {
+		"tags": tags,
+	}, nil
+}
+
+func greaderUnreadCount(pfc *PFContext) (interface{}, error) {
+	subs, err := pfc.Storage.NewUserSubscriptions(pfc.UserID)
+	if err != nil {
+		return nil, err
+	}
+
+	type unreadCount struct {
+		ID string                       `json:"id"`
+		Count int                       `json:"count"`
+		NewestItemTimestampUsec string  `json:"newestItemTimestampUsec"`
+	}
+
+	titles := folderTitles(subs)
+	folderCounts := make(map[string]int)
+	counts := make([]unreadCount, 0, len(subs.Subscriptions) + len(subs.Folders) + len(subs.Tags) + 1)
+	total := 0
+
+	for _, subscription := range subs.Subscriptions {
+		counts = append(counts, unreadCount {
+			ID: greaderFeed(subscription.ID),
+			Count: subscription.UnreadCount,
+			NewestItemTimestampUsec: strconv.FormatInt(subscription.Updated.UnixNano() / int64(time.Microsecond), 10),
+		})
+		if _, ok := titles[subscription.Parent]; ok {
+			folderCounts[subscription.Parent] += subscription.UnreadCount
+		}
+		total += subscription.UnreadCount
+	}
+
+	now := strconv.FormatInt(time.Now().UnixNano() / int64(time.Microsecond), 10)
+	for _, folder := range subs.Folders {
+		counts = append(counts, unreadCount {
+			ID: greaderLabel(folder.Title),
+			Count: folderCounts[folder.ID],
+			NewestItemTimestampUsec: now,
+		})
+	}
+	labels := make(map[string]bool)
+	for _, title := range titles {
+		labels[title] = true
+	}
+	for _, tag := range subs.Tags {
+		if labels[tag.Title] {
+			continue
+		}
+		counts = append(counts, unreadCount {
+			ID: greaderLabel(tag.Title),
+			Count: tag.Unread,
+			NewestItemTimestampUsec: now,
+		})
+	}
+	counts = append(counts, unreadCount {
+		ID: greaderReadingList,
+		Count: total,
+		NewestItemTimestampUsec: now,
+	})
+
+	return map[string]interface{} {
+		"max": greaderMaxCount,
+		"unreadcounts": counts,
+	}, nil
+}
+
+func greaderStreamContents(pfc *PFContext) (interface{}, error) {
+	subs, err := pfc.Storage.NewUserSubscriptions(pfc.UserID)
+	if err != nil {
+		return nil, err
+	}
+
+	stream, err := resolveStream(pfc, subs, greaderStreamID(pfc.R))
+	if err != nil {
+		return nil, err
+	}
+
+	articles, continuation, err := streamArticles(pfc, stream)
+	if err != nil {
+		return nil, err
+	} else if err := saveItemAliases(pfc, articles); err != nil {
+		return nil, err
+	}
+
+	response := map[string]interface{} {
+		"direction": "ltr",
+		"id": stream.ID,
+		"title": stream.Title,
+		"updated": time.Now().Unix(),
+		"items": newGReaderItems(articles, subs),
+	}
+	if continuation != "" {
+		response["continuation"] = continuation
+	}
+
+	return response, nil
+}
+
+func greaderStreamItemIDs(pfc *PFContext) (interface{}, error) {
+	subs, err := pfc.Storage.NewUserSubscriptions(pfc.UserID)
+	if err != nil {
+		return nil, err
+	}
+
+	stream, err := resolveStream(pfc, subs, pfc.R.FormValue("s"))
+	if err != nil {
+		return nil, err
+	}
+
+	articles, continuation, err := streamArticles(pfc, stream)
+	if err != nil {
+		return nil, err
+	} else if err := saveItemAliases(pfc, articles); err != nil {
+		return nil, err
+	}
+
+	itemRefs := make([]greaderItemRef, len(articles))
+	for i, article := range articles {
+		itemRefs[i] = greaderItemRef {
+			ID: strconv.FormatInt(greaderItemID(article.Source, article.ID), 10),
+			DirectStreamIDs: []string { greaderFeed(article.Source) },
+			TimestampUsec: strconv.FormatInt(article.Fetched.UnixNano() / int64(time.Microsecond), 10),
+		}
+	}
+
+	response := map[string]interface{} {
+		"itemRefs": itemRefs,
+	}
+	if continuation != "" {
+		response["continuation"] = continuation
+	}
+
+	return response, nil
+}
+
+func greaderStreamItemContents(pfc *PFContext) (interface{}, error) {
+	r := pfc.R
+	subs, err := pfc.Storage.NewUserSubscriptions(pfc.UserID)
+	if err != nil {
+		return nil, err
+	}
+
+	r.ParseForm()
+	refs, err := resolveItems(pfc, subs, r.Form["i"])
+	if err != nil {
+		return nil, err
+	}
+
+	articles, err := pfc.Storage.Articles(refs)
+	if err != nil {
+		return nil, err
+	}
+
+	return map[string]interface{} {
+		"direction": "ltr",
+		"id": greaderReadingList,
+		"updated": time.Now().Unix(),
+		"items": newGReaderItems(articles, subs),
+	}, nil
+}
+
+// greaderEdit is a change requested by edit-tag: a property to set
+// or clear, or a tag to add or remove
+type greaderEdit struct {
+	Property string
+	Tag string
+	Set bool
+}
+
+func parseGReaderEdits(streamIDs []string, set bool) []greaderEdit {
+	edits := make([]greaderEdit, 0, len(streamIDs))
+	for _, streamID := range streamIDs {
+		streamID = normalizeStreamID(streamID)
+		if property, ok := greaderStates[streamID]; ok {
+			edits = append(edits, greaderEdit { Property: property, Set: set })
+		} else if streamID == greaderKeptUnread {
+			edits = append(edits, greaderEdit { Property: "unread", Set: set })
+		} else if strings.HasPrefix(streamID, greaderLabelPrefix) {
+			if tag := strings.TrimSpace(streamID[len(greaderLabelPrefix):]); tag != "" {
+				edits = append(edits, greaderEdit { Tag: tag, Set: set })
+			}
+		}
+	}
+
+	return edits
+}
+
+func greaderEditTag(pfc *PFContext) (interface{}, error) {
+	r := pfc.R
+	if r.Method != "POST" {
+		return nil, NewReadableErrorWithCode(_l("Method not allowed"), http.StatusMethodNotAllowed, nil)
+	}
+
+	subs, err := pfc.Storage.NewUserSubscriptions(pfc.UserID)
+	if err != nil {
+		return nil, err
+	}
+
+	r.ParseForm()
+	refs, err := resolveItems(pfc, subs, r.Form["i"])
+	if err != nil {
+		return nil, err
+	}
+
+	edits := append(parseGReaderEdits(r.Form["a"], true), parseGReaderEdits(r.Form["r"], false)...)
+	tagsChanged := false
+	for _, edit := range edits {
+		if edit.Tag != "" {
+			tagsChanged = true
+		}
+	}
+
+	var articles []storage.Article
+	if tagsChanged {
+		if articles, err = pfc.Storage.Articles(refs); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, ref := range refs {
+		for _, edit := range edits {
+			if edit.Property == "" {
+				continue
+			}
+			if _, err := pfc.Storage.SetProperty(ref, edit.Property, edit.Set); err != nil {
+				return nil, NewReadableError(_l("Error updating article"), &err)
+			}
+		}
+	}
+
+	for _, article := range articles {
+		for _, edit := range edits {
+			if edit.Tag != "" {
+				article.SetTag(edit.Tag, edit.Set)
+			}
+		}
+
+		for _, ref := range refs {
+			if ref.SubscriptionID == article.Source && ref.ArticleID == article.ID {
+				if _, err := pfc.Storage.SetTags(ref, article.Tags); err != nil {
+					return nil, NewReadableError(_l("Error updating article"), &err)
+				}
+				break
+			}
+		}
+	}
+
+	return "OK", nil
+}
+
+func greaderMarkAllAsRead(pfc *PFContext) (interface{}, error) {
+	r := pfc.R
+	if r.Method != "POST" {
+		return nil, NewReadableErrorWithCode(_l("Method not allowed"), http.StatusMethodNotAllowed, nil)
+	}
+
+	subs, err := pfc.Storage.NewUserSubscriptions(pfc.UserID)
+	if err != nil {
+		return nil, err
+	}
+
+	stream, err := resolveStream(pfc, subs, r.FormValue("s"))
+	if err != nil {
+		return nil, err
+	} else if stream.Filter.Property != "" || stream.Filter.Tag != "" {
+		return nil, NewReadableErrorWithCode(_l("Only folders and subscriptions can be marked as read"), http.StatusBadRequest, nil)
+	}
+
+	// Only articles older than ts (in microseconds), if specified
+	readRange := storage.ReadRange { Marked: time.Now() }
+	if ts, err := strconv.ParseInt(r.FormValue("ts"), 10, 64); err == nil && ts > 0 {
+		readRange.Before.Fetched = time.Unix(0, ts * int64(time.Microsecond))
+	}
+
+	if err := markAsRead(pfc, stream.Filter.ArticleScope, readRange); err != nil {
+		return nil, err
+	}
+
+	return "OK", nil
+}
+
+// greaderFolder returns the folder with the title in the label,
+// creating it if necessary
+func greaderFolder(pfc *PFContext, subs *storage.UserSubscriptions, label string) (storage.FolderRef, error) {
+	title := strings.TrimSpace(strings.TrimPrefix(normalizeStreamID(label), greaderLabelPrefix))
+	if title == "" {
+		return storage.FolderRef { UserID: pfc.UserID }, nil
+	} else if folder := folderByTitle(subs, title); folder != nil {
+		return storage.FolderRef { UserID: pfc.UserID, FolderID: folder.ID }, nil
+	}
+
+	return pfc.Storage.CreateFolder(storage.FolderRef { UserID: pfc.UserID }, title)
+}
+
+func greaderEditSubscription(pfc *PFContext) (interface{}, error) {
+	r := pfc.R
+	if r.Method != "POST" {
+		return nil, NewReadableErrorWithCode(_l("Method not allowed"), http.StatusMethodNotAllowed, nil)
+	}
+
+	subs, err := pfc.Storage.NewUserSubscriptions(pfc.UserID)
+	if err != nil {
+		return nil, err
+	}
+
+	r.ParseForm()
+	streamID := r.FormValue("s")
+	if !strings.HasPrefix(streamID, greaderFeedPrefix) {
+		return nil, NewReadableErrorWithCode(_l("Subscription not found"), http.StatusNotFound, nil)
+	}
+
+	subscriptionURL := streamID[len(greaderFeedPrefix):]
+	subscription := subscriptionByID(subs, subscriptionURL)
+
+	switch r.FormValue("ac") {
+	case "subscribe":
+		if subscription != nil {
+			return "OK", nil
+		} else if _, err := url.ParseRequestURI(subscriptionURL); err != nil {
+			return nil, NewReadableErrorWithCode(_l("URL is not valid"), http.StatusBadRequest, &err)
+		}
+
+		folderRef, err := greaderFolder(pfc, subs, r.FormValue("a"))
+		if err != nil {
+			return nil, err
+		}
+
+		if _, candidates, err := subscribeToURL(pfc, subscriptionURL, folderRef); err != nil {
+			return nil, err
+		} else if len(candidates) > 0 {
+			return nil, NewReadableErrorWithCode(_l("The page links to more than one feed"), http.StatusBadRequest, nil)
+		}
+	case "unsubscribe":
+		if subscription == nil {
+			return nil, NewReadableErrorWithCode(_l("Subscription not found"), http.StatusNotFound, nil)
+		}
+
+		ref := storage.SubscriptionRef {
+			FolderRef: storage.FolderRef {
+				UserID: pfc.UserID,
+				FolderID: subscription.Parent,
+			},
+			SubscriptionID: subscription.ID,
+		}
+		// Articles are deleted once the undo window expires
+		if err := pfc.Storage.Unsubscribe(ref); err != nil {
+			return nil, err
+		}
+	case "edit":
+		if subscription == nil {
+			return nil, NewReadableErrorWithCode(_l("Subscription not found"), http.StatusNotFound, nil)
+		}
+
+		ref := storage.SubscriptionRef {
+			FolderRef: storage.FolderRef {
+				UserID: pfc.UserID,
+				FolderID: subscription.Parent,
+			},
+			SubscriptionID: subscription.ID,
+		}
+
+		if title := strings.TrimSpace(r.FormValue("t")); title != "" && title != subscription.Title {
+			if err := pfc.Storage.RenameSubscription(ref, title); err != nil {
+				return nil, err
+			}
+		}
+
+		var destination *storage.FolderRef
+		if label := r.FormValue("a"); label != "" {
+			if folderRef, err := greaderFolder(pfc, subs, label); err != nil {
+				return nil, err
+			} else {
+				destination = &folderRef
+			}
+		} else if r.FormValue("r") != "" {
+			destination = &storage.FolderRef { UserID: pfc.UserID }
+		}
+
+		if destination != nil && destination.FolderID != subscription.Parent {
+			if err := pfc.Storage.MoveSubscription(ref, *destination); err != nil {
+				return nil, err
+			}
+
+			params := taskParams {
+				"subscriptionID": subscription.ID,
+				"folderID":       subscription.Parent,
+				"destinationID":  destination.FolderID,
+			}
+			if err := startTask(pfc, "moveSubscription", params, modificationQueue); err != nil {
+				return nil, err
+			}
+		}
+	default:
+		return nil, NewReadableErrorWithCode(_l("Action not valid"), http.StatusBadRequest, nil)
+	}
+
+	return "OK", nil
+}
+
+func greaderQuickAdd(pfc *PFContext) (interface{}, error) {
+	r := pfc.R
+	if r.Method != "POST" {
+		return nil, NewReadableErrorWithCode(_l("Method not allowed"), http.StatusMethodNotAllowed, nil)
+	}
+
+	subscriptionURL := strings.TrimSpace(r.FormValue("quickadd"))
+	subscriptionURL = strings.TrimPrefix(subscriptionURL, greaderFeedPrefix)
+	if _, err := url.ParseRequestURI(subscriptionURL); err != nil {
+		return nil, NewReadableErrorWithCode(_l("URL is not valid"), http.StatusBadRequest, &err)
+	}
+
+	feedURL, candidates, err := subscribeToURL(pfc, subscriptionURL, storage.FolderRef { UserID: pfc.UserID })
+	if err != nil {
+		return nil, err
+	} else if len(candidates) > 0 {
+		return nil, NewReadableErrorWithCode(_l("The page links to more than one feed"), http.StatusBadRequest, nil)
+	}
+
+	return map[string]interface{} {
+		"numResults": 1,
+		"query": subscriptionURL,
+		"streamId": greaderFeed(feedURL),
+	}, nil
+}
@@ -0,0 +1,152 @@
+// +build !appengine
+
+/*****************************************************************************
+ **
+ ** Gofr
+ ** https://github.com/pokebyte/Gofr
+ ** Copyright (C) 2013-2017 Akop Karapetyan
+ **
+ ** This program is free software; you can redistribute it and/or modify
+ ** it under the terms of the GNU General Public License as published by
+ ** the Free Software Foundation; either version 2 of the License, or
+ ** (at your option) any later version.
+ **
+ ** This program is distributed in the hope that it will be useful,
+ ** but WITHOUT ANY WARRANTY; without even the implied warranty of
+ ** MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ ** GNU General Public License for more details.
+ **
+ ** You should have received a copy of the GNU General Public License
+ ** along with this program; if not, write to the Free Software
+ ** Foundation, Inc., 675 Mass Ave, Cambridge, MA 02139, USA.
+ **
+ ******************************************************************************
+ */
+ 
+package gofr
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"storage"
+	"strings"
+	"testing"
+	"time"
+)
+
+// clientLogin signs in through ClientLogin, returning the status
+// and, on success, the token issued
+func clientLogin(server *Server, email string, password string) (int, string) {
+	form := url.Values { "Email": { email }, "Passwd": { password } }
+	r, _ := http.NewRequest("POST", "/accounts/ClientLogin", strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+
+	greaderRequestHandler { RouteHandler: greaderClientLogin }.handleRequest(testPFContext(server, w, r))
+
+	token := ""
+	for _, line := range strings.Split(w.Body.String(), "\n") {
+		if strings.HasPrefix(line, "Auth=") {
+			token = line[len("Auth="):]
+		}
+	}
+
+	return w.Code, token
+}
+
+// greaderUserInfoStatus returns the status of an API call made with
+// the token
+func greaderUserInfoStatus(server *Server, token string) int {
+	r, _ := http.NewRequest("GET", greaderAPIPath + "user-info", nil)
+	r.Header.Set("Authorization", "GoogleLogin auth=" + token)
+	w := httptest.NewRecorder()
+
+	greaderRequestHandler { RouteHandler: greaderUserInfo, LoginRequired: true }.handleRequest(testPFContext(server, w, r))
+
+	return w.Code
+}
+
+// setTestGReaderPassword replaces the user's API password
+func setTestGReaderPassword(t *testing.T, store storage.Repository, user storage.User, password string) storage.User {
+	if user.GReaderPasswordID != "" {
+		if err := store.DeleteSession(user.GReaderPasswordID); err != nil {
+			t.Fatalf("Error removing password: %s", err)
+		}
+	}
+
+	session := storage.Session {
+		ID: digest(greaderPasswordProvider, password),
+		UserID: storage.UserID(user.ID),
+		Provider: greaderPasswordProvider,
+		Expires: time.Now().Add(greaderPasswordDuration),
+	}
+	if err := store.SaveSession(session); err != nil {
+		t.Fatalf("Error saving password: %s", err)
+	}
+
+	user.GReaderPasswordID = session.ID
+	if err := store.SaveUser(user); err != nil {
+		t.Fatalf("Error saving user: %s", err)
+	}
+
+	return user
+}
+
+func TestGReaderClientLogin(t *testing.T) {
+	server, done := openTestServer(t)
+	defer done()
+
+	store := server.config.Storage
+	user := setTestGReaderPassword(t, store, storage.User { ID: "tester", EmailAddress: "tester@example.com" }, "secret")
+
+	if code, _ := clientLogin(server, "tester@example.com", "wrong"); code != http.StatusForbidden {
+		t.Errorf("Wrong password: expected %d, got %d", http.StatusForbidden, code)
+	}
+	if code, _ := clientLogin(server, "other@example.com", "secret"); code != http.StatusForbidden {
+		t.Errorf("Wrong email address: expected %d, got %d", http.StatusForbidden, code)
+	}
+
+	code, token := clientLogin(server, "Tester@Example.com", "secret")
+	if code != http.StatusOK || token == "" {
+		t.Fatalf("Expected to sign in, got %d", code)
+	} else if code := greaderUserInfoStatus(server, token); code != http.StatusOK {
+		t.Errorf("Expected the token to be accepted, got %d", code)
+	}
+
+	// Replacing the password signs out its clients
+	user = setTestGReaderPassword(t, store, user, "another secret")
+	if code := greaderUserInfoStatus(server, token); code != http.StatusUnauthorized {
+		t.Errorf("Expected the token to be rejected, got %d", code)
+	}
+	if code, _ := clientLogin(server, "tester@example.com", "secret"); code != http.StatusForbidden {
+		t.Errorf("Replaced password: expected %d, got %d", http.StatusForbidden, code)
+	}
+}
+
+func TestGReaderClientLoginThrottling(t *testing.T) {
+	server, done := openTestServer(t)
+	defer done()
+
+	setTestGReaderPassword(t, server.config.Storage, storage.User { ID: "tester", EmailAddress: "tester@example.com" }, "secret")
+
+	// Success clears earlier failures
+	for i := 0; i < greaderMaxLoginFailures - 1; i++ {
+		clientLogin(server, "tester@example.com", "wrong")
+	}
+	if code, _ := clientLogin(server, "tester@example.com", "secret"); code != http.StatusOK {
+		t.Fatalf("Expected to sign in, got %d", code)
+	}
+
+	for i := 0; i < greaderMaxLoginFailures; i++ {
+		if code, _ := clientLogin(server, "tester@example.com", "wrong"); code != http.StatusForbidden {
+			t.Errorf("Attempt %d: expected %d, got %d", i, http.StatusForbidden, code)
+		}
+	}
+	if code, _ := clientLogin(server, "tester@example.com", "secret"); code != http.StatusTooManyRequests {
+		t.Errorf("Expected to be locked out, got %d", code)
+	}
+	if code, _ := clientLogin(server, "other@example.com", "wrong"); code != http.StatusForbidden {
+		t.Errorf("Other account: expected %d, got %d", http.StatusForbidden, code)
+	}
+}
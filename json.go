@@ -24,14 +24,13 @@
 package gofr
 
 import (
-	"appengine"
-	"appengine/blobstore"
-	"appengine/channel"
 	"io/ioutil"
+	"net/http"
 	"net/url"
 	"regexp"
 	"rss"
 	"storage"
+	"strconv"
 	"strings"
 	"time"
 	"unicode/utf8"
@@ -50,6 +49,7 @@ func registerJson() {
 	RegisterJSONRoute("/syncFeeds",     syncFeeds)
 	RegisterJSONRoute("/subscriptions", subscriptions)
 	RegisterJSONRoute("/articles",      articles)
+	RegisterJSONRoute("/search",        searchArticles)
 	RegisterJSONRoute("/articleExtras", articleExtras)
 	RegisterJSONRoute("/createFolder",  createFolder)
 	RegisterJSONRoute("/rename",        rename)
@@ -59,8 +59,11 @@ func registerJson() {
 	RegisterJSONRoute("/unsubscribe",   unsubscribe)
 	RegisterJSONRoute("/markAllAsRead", markAllAsRead)
 	RegisterJSONRoute("/moveSubscription", moveSubscription)
+	RegisterJSONRoute("/moveFolder",    moveFolder)
 	RegisterJSONRoute("/removeFolder",  removeFolder);
 	RegisterJSONRoute("/removeTag",     removeTag);
+	RegisterJSONRoute("/importJob",     importJob)
+	RegisterJSONRoute("/retryImport",   retryImport)
 
 	RegisterJSONRoute("/authUpload",    authUpload)
 	RegisterJSONRoute("/initChannel",   initChannel)
@@ -72,35 +75,35 @@ func registerJson() {
 }
 
 func subscriptions(pfc *PFContext) (interface{}, error) {
-	return storage.NewUserSubscriptions(pfc.C, pfc.UserID)
+	return pfc.Storage.NewUserSubscriptions(pfc.UserID)
 }
 
 func syncFeeds(pfc *PFContext) (interface{}, error) {
 	c := pfc.C
 
 	staleDuration := time.Duration(subscriptionStalePeriodInMinutes) * time.Minute
-	if appengine.IsDevAppServer() {
+	if pfc.Platform.IsDevServer() {
 		// On dev server, stale period is 1 minute
 		staleDuration = time.Duration(1) * time.Minute
 	}
 
-	userSubscriptions, err := storage.NewUserSubscriptions(c, pfc.UserID)
+	userSubscriptions, err := pfc.Storage.NewUserSubscriptions(pfc.UserID)
 	if err != nil {
 		return nil, err
 	}
 
 	if time.Since(pfc.User.LastSubscriptionUpdate) > staleDuration {
 		pfc.User.LastSubscriptionUpdate = time.Now()
-		if err := pfc.User.Save(c); err != nil {
+		if err := pfc.Storage.SaveUser(*pfc.User); err != nil {
 			c.Warningf("Could not write user object back to store: %s", err)
 		} else {
 			started := time.Now()
 
 			// Determine if new feeds are available
-			if needRefresh, err := storage.AreNewEntriesAvailable(c, userSubscriptions.Subscriptions); err != nil {
+			if needRefresh, err := pfc.Storage.AreNewEntriesAvailable(userSubscriptions.Subscriptions); err != nil {
 				c.Warningf("Could not determine if new entries are available: %s", err)
 			} else if needRefresh {
-				if appengine.IsDevAppServer() {
+				if pfc.Platform.IsDevServer() {
 					c.Debugf("Subscriptions need update; initiating a refresh (took %s)", time.Since(started))
 				}
 
@@ -108,7 +111,7 @@ func syncFeeds(pfc *PFContext) (interface{}, error) {
 					c.Warningf("Could not initiate the refresh task: %s", err)
 				}
 			} else {
-				if appengine.IsDevAppServer() {
+				if pfc.Platform.IsDevServer() {
 					c.Debugf("Subscriptions are up to date (took %s)", time.Since(started))
 				}
 			}
@@ -129,8 +132,39 @@ func articles(pfc *PFContext) (interface{}, error) {
 	if !validProperties[filter.Property] {
 		filter.Property = ""
 	}
+	filter.Properties = onlyValidProperties(filter.Properties)
+	filter.ExcludedProperties = onlyValidProperties(filter.ExcludedProperties)
 
-	return storage.NewArticlePage(pfc.C, filter, r.FormValue("continue"))
+	if order := r.FormValue("sort"); order != "" {
+		if !validOrders[order] {
+			return nil, NewReadableErrorWithCode(_l("Sort order not valid"), http.StatusBadRequest, nil)
+		}
+		filter.Order = order
+	}
+
+	return pfc.Storage.NewArticlePage(filter, r.FormValue("continue"))
+}
+
+func onlyValidProperties(properties []string) []string {
+	valid := make([]string, 0, len(properties))
+	for _, property := range properties {
+		if validProperties[property] {
+			valid = append(valid, property)
+		}
+	}
+
+	return valid
+}
+
+func searchArticles(pfc *PFContext) (interface{}, error) {
+	r := pfc.R
+
+	query, err := storage.ParseSearchQuery(pfc.UserID, r.FormValue("q"))
+	if err != nil {
+		return nil, NewReadableErrorWithCode(_l("Search query not valid: %s", err), http.StatusBadRequest, nil)
+	}
+
+	return pfc.Storage.SearchArticles(query, r.FormValue("continue"))
 }
 
 func articleExtras(pfc *PFContext) (interface{}, error) {
@@ -155,7 +189,7 @@ func articleExtras(pfc *PFContext) (interface{}, error) {
 		ArticleID: articleID,
 	}
 
-	return storage.LoadArticleExtras(pfc.C, ref)
+	return pfc.Storage.LoadArticleExtras(ref)
 }
 
 func createFolder(pfc *PFContext) (interface{}, error) {
@@ -170,17 +204,31 @@ func createFolder(pfc *PFContext) (interface{}, error) {
 		return nil, NewReadableError(_l("Folder name is too long"), nil)
 	}
 
-	if exists, err := storage.IsFolderDuplicate(pfc.C, pfc.UserID, title); err != nil {
+	// Folders are created at the top level, unless a parent is given
+	parent := storage.FolderRef {
+		UserID: pfc.UserID,
+		FolderID: r.PostFormValue("parent"),
+	}
+
+	if parent.FolderID != "" {
+		if exists, err := pfc.Storage.FolderExists(parent); err != nil {
+			return nil, err
+		} else if !exists {
+			return nil, NewReadableError(_l("Folder not found"), nil)
+		}
+	}
+
+	if exists, err := pfc.Storage.IsFolderDuplicate(parent, title); err != nil {
 		return nil, err
 	} else if exists {
 		return nil, NewReadableError(_l("A folder with that name already exists"), nil)
 	}
 
-	if _, err := storage.CreateFolder(pfc.C, pfc.UserID, title); err != nil {
+	if _, err := pfc.Storage.CreateFolder(parent, title); err != nil {
 		return nil, NewReadableError(_l("An error occurred while adding the new folder"), &err)
 	}
 
-	return storage.NewUserSubscriptions(pfc.C, pfc.UserID)
+	return pfc.Storage.NewUserSubscriptions(pfc.UserID)
 }
 
 func rename(pfc *PFContext) (interface{}, error) {
@@ -197,34 +245,39 @@ func rename(pfc *PFContext) (interface{}, error) {
 	}
 
 	if ref.IsSubscriptionExplicit() {
-		if exists, err := storage.SubscriptionExists(pfc.C, ref); err != nil {
+		if exists, err := pfc.Storage.SubscriptionExists(ref); err != nil {
 			return nil, err
 		} else if !exists {
 			return nil, NewReadableError(_l("Subscription not found"), nil)
 		}
 
-		if err := storage.RenameSubscription(pfc.C, ref, title); err != nil {
+		if err := pfc.Storage.RenameSubscription(ref, title); err != nil {
 			return nil, NewReadableError(_l("Error renaming subscription"), &err)
 		}
 	} else {
-		if exists, err := storage.FolderExists(pfc.C, ref.FolderRef); err != nil {
+		if exists, err := pfc.Storage.FolderExists(ref.FolderRef); err != nil {
 			return nil, err
 		} else if !exists {
 			return nil, NewReadableError(_l("Folder not found"), nil)
 		}
 
-		if isDupe, err := storage.IsFolderDuplicate(pfc.C, pfc.UserID, title); err != nil {
+		parent, err := folderParent(pfc, ref.FolderRef)
+		if err != nil {
+			return nil, err
+		}
+
+		if isDupe, err := pfc.Storage.IsFolderDuplicate(parent, title); err != nil {
 			return nil, err
 		} else if isDupe {
 			return nil, NewReadableError(_l("A folder with that name already exists"), nil)
 		}
 
-		if err := storage.RenameFolder(pfc.C, ref.FolderRef, title); err != nil {
+		if err := pfc.Storage.RenameFolder(ref.FolderRef, title); err != nil {
 			return nil, NewReadableError(_l("Error renaming folder"), &err)
 		}
 	}
 
-	return storage.NewUserSubscriptions(pfc.C, pfc.UserID)
+	return pfc.Storage.NewUserSubscriptions(pfc.UserID)
 }
 
 func setProperty(pfc *PFContext) (interface{}, error) {
@@ -255,7 +308,7 @@ func setProperty(pfc *PFContext) (interface{}, error) {
 		ArticleID: articleID,
 	}
 
-	if properties, err := storage.SetProperty(pfc.C, ref, propertyName, propertyValue); err != nil {
+	if properties, err := pfc.Storage.SetProperty(ref, propertyName, propertyValue); err != nil {
 		return nil, NewReadableError(_l("Error updating article"), &err)
 	} else {
 		return properties, nil
@@ -299,10 +352,10 @@ OuterLoop:
 		ArticleID: articleID,
 	}
 
-	if updatedTags, err := storage.SetTags(pfc.C, ref, tags); err != nil {
+	if updatedTags, err := pfc.Storage.SetTags(ref, tags); err != nil {
 		return nil, NewReadableError(_l("Error updating article"), &err)
 	} else {
-		subs, err := storage.NewUserSubscriptions(pfc.C, pfc.UserID)
+		subs, err := pfc.Storage.NewUserSubscriptions(pfc.UserID)
 		return map[string]interface{} {
 			"tags": updatedTags,
 			"subscriptions": subs,
@@ -311,7 +364,6 @@ OuterLoop:
 }
 
 func subscribe(pfc *PFContext) (interface{}, error) {
-	c := pfc.C
 	r := pfc.R
 
 	subscriptionURL := r.PostFormValue("url")
@@ -329,22 +381,41 @@ func subscribe(pfc *PFContext) (interface{}, error) {
 	}
 
 	if folderId != "" {
-		if exists, err := storage.FolderExists(pfc.C, folderRef); err != nil {
+		if exists, err := pfc.Storage.FolderExists(folderRef); err != nil {
 			return nil, err
 		} else if !exists {
 			return nil, NewReadableError(_l("Folder not found"), nil)
 		}
 	}
 
+	if _, candidates, err := subscribeToURL(pfc, subscriptionURL, folderRef); err != nil {
+		return nil, err
+	} else if len(candidates) > 0 {
+		// Let the user choose
+		return map[string]interface{} {
+			"message": _l("Multiple feeds found - please choose one"),
+			"candidates": candidates,
+		}, nil
+	}
+
+	return pfc.Storage.NewUserSubscriptions(pfc.UserID)
+}
+
+// subscribeToURL subscribes to the feed at subscriptionURL - or, if
+// it's a web page, the feed it links to - returning the URL of the
+// feed. If the page links to several feeds, they're returned
+// instead, for the user to choose from
+func subscribeToURL(pfc *PFContext, subscriptionURL string, folderRef storage.FolderRef) (string, []rss.FeedLink, error) {
+	c := pfc.C
 	feedTitle := _l("New Subscription")
 
-	if exists, err := storage.IsFeedAvailable(pfc.C, subscriptionURL); err != nil {
-		return nil, err
+	if exists, err := pfc.Storage.IsFeedAvailable(subscriptionURL); err != nil {
+		return "", nil, err
 	} else if !exists {
 		// Not a known feed URL
 		// Match it against a list of known WWW links
-		if feedURL, err := storage.WebToFeedURL(pfc.C, subscriptionURL, &feedTitle); err != nil {
-			return nil, err
+		if feedURL, err := pfc.Storage.WebToFeedURL(subscriptionURL, &feedTitle); err != nil {
+			return "", nil, err
 		} else if feedURL != "" {
 			subscriptionURL = feedURL
 		} else {
@@ -358,38 +429,38 @@ func subscribe(pfc *PFContext) (interface{}, error) {
 				modifiedURL = re.ReplaceAllString(subscriptionURL, "://www.")
 			}
 
-			if feedURL, err := storage.WebToFeedURL(pfc.C, modifiedURL, &feedTitle); err != nil {
-				return nil, err
+			if feedURL, err := pfc.Storage.WebToFeedURL(modifiedURL, &feedTitle); err != nil {
+				return "", nil, err
 			} else if feedURL != "" {
 				subscriptionURL = feedURL
 			}
 		}
-	} else if feed, err := storage.FeedByURL(pfc.C, subscriptionURL); err == nil {
+	} else if feed, err := pfc.Storage.FeedByURL(subscriptionURL); err == nil {
 		if feed.Title != "" {
 			feedTitle = feed.Title
 		}
 	}
 
-	if subscribed, err := storage.IsSubscriptionDuplicate(pfc.C, pfc.UserID, subscriptionURL); err != nil {
-		return nil, err
+	if subscribed, err := pfc.Storage.IsSubscriptionDuplicate(pfc.UserID, subscriptionURL); err != nil {
+		return "", nil, err
 	} else if subscribed {
-		return nil, NewReadableError(_l("You are already subscribed to %s", feedTitle), nil)
+		return "", nil, NewReadableError(_l("You are already subscribed to %s", feedTitle), nil)
 	}
 
 	// At this point, the URL may have been re-written, so we check again
-	if exists, err := storage.IsFeedAvailable(pfc.C, subscriptionURL); err != nil {
-		return nil, err
+	if exists, err := pfc.Storage.IsFeedAvailable(subscriptionURL); err != nil {
+		return "", nil, err
 	} else if !exists {
 		// Don't have the feed locally - fetch it
-		client := createHttpClient(c)
+		client := createHttpClient(pfc)
 		if response, err := client.Get(subscriptionURL); err != nil {
-			return nil, NewReadableError(_l("An error occurred while downloading the feed"), &err)
+			return "", nil, NewReadableError(_l("An error occurred while downloading the feed"), &err)
 		} else {
 			defer response.Body.Close()
 			
 			var body string
 			if bytes, err := ioutil.ReadAll(response.Body); err != nil {
-				return nil, NewReadableError(_l("An error occurred while reading the feed"), &err)
+				return "", nil, NewReadableError(_l("An error occurred while reading the feed"), &err)
 			} else {
 				body = string(bytes)
 			}
@@ -399,18 +470,22 @@ func subscribe(pfc *PFContext) (interface{}, error) {
 				c.Warningf("Error parsing RSS (URL %s): %s", subscriptionURL, err)
 
 				// Parse failed. Assume it's an HTML document and 
-				// try to pull out an RSS <link />
-				if linkURL, err := rss.ExtractRSSLink(c, subscriptionURL, body); linkURL == "" || err != nil {
-					return nil, NewReadableError(_l("RSS content not found (and no RSS links to follow)"), &err)
+				// look for links to feeds
+				if candidates, err := discoverFeeds(pfc, subscriptionURL, body); len(candidates) == 0 || err != nil {
+					return "", nil, NewReadableError(_l("RSS content not found (and no RSS links to follow)"), &err)
+				} else if len(candidates) > 1 {
+					return "", candidates, nil
 				} else {
+					linkURL := candidates[0].URL
+
 					// Validate the RSS file
 					if response, err := client.Get(linkURL); err != nil {
-						return nil, NewReadableError(_l("An error occurred while downloading the feed"), &err)
+						return "", nil, NewReadableError(_l("An error occurred while downloading the feed"), &err)
 					} else {
 						defer response.Body.Close()
 
 						if feed, err := rss.UnmarshalStream(linkURL, response.Body); err != nil {
-							return nil, NewReadableError(_l("RSS content not found"), &err)
+							return "", nil, NewReadableError(_l("RSS content not found"), &err)
 						} else {
 							feedTitle = feed.Title
 						}
@@ -422,26 +497,26 @@ func subscribe(pfc *PFContext) (interface{}, error) {
 				feedTitle = feed.Title
 			}
 		}
-	} else if feed, err := storage.FeedByURL(pfc.C, subscriptionURL); err == nil {
+	} else if feed, err := pfc.Storage.FeedByURL(subscriptionURL); err == nil {
 		if feed.Title != "" {
 			feedTitle = feed.Title
 		}
 	}
 
 	// Create subscription entry
-	if _, err := storage.Subscribe(pfc.C, folderRef, subscriptionURL, feedTitle); err != nil {
-		return nil, NewReadableError(_l("Cannot subscribe"), &err)
+	if _, err := pfc.Storage.Subscribe(folderRef, subscriptionURL, feedTitle); err != nil {
+		return "", nil, NewReadableError(_l("Cannot subscribe"), &err)
 	}
 
 	params := taskParams {
 		"url":      subscriptionURL,
-		"folderID": folderId,
+		"folderID": folderRef.FolderID,
 	}
 	if err := startTask(pfc, "subscribe", params, subscriptionQueue); err != nil {
-		return nil, NewReadableError(_l("Cannot subscribe - too busy"), &err)
+		return "", nil, NewReadableError(_l("Cannot subscribe - too busy"), &err)
 	}
 
-	return storage.NewUserSubscriptions(c, pfc.UserID)
+	return subscriptionURL, nil, nil
 }
 
 func unsubscribe(pfc *PFContext) (interface{}, error) {
@@ -459,69 +534,139 @@ func unsubscribe(pfc *PFContext) (interface{}, error) {
 		SubscriptionID: subscriptionID,
 	}
 
-	if exists, err := storage.SubscriptionExists(pfc.C, ref); err != nil {
+	if exists, err := pfc.Storage.SubscriptionExists(ref); err != nil {
 		return nil, err
 	} else if !exists {
 		return nil, NewReadableError(_l("Subscription not found"), nil)
 	}
 
-	if err := storage.Unsubscribe(pfc.C, ref); err != nil {
+	// Articles are deleted once the undo window expires
+	if err := pfc.Storage.Unsubscribe(ref); err != nil {
 		return nil, err
 	}
 
-	params := taskParams {
-		"subscriptionID": subscriptionID,
-		"folderID": folderID,
-	}
-	if err := startTask(pfc, "unsubscribe", params, modificationQueue); err != nil {
-		return nil, NewReadableError(_l("Cannot unsubscribe - too busy"), &err)
-	}
-
-	return storage.NewUserSubscriptions(pfc.C, pfc.UserID)
+	return pfc.Storage.NewUserSubscriptions(pfc.UserID)
 }
 
 func importOPML(pfc *PFContext) (interface{}, error) {
 	c := pfc.C
 	r := pfc.R
 
-	blobs, other, err := blobstore.ParseUpload(r)
+	parseMode := rss.ParseLenient
+	uploadKey, other, err := pfc.Platform.ParseUpload(r, "opml")
 	if err != nil {
 		return nil, NewReadableError(_l("Error receiving file"), &err)
-	} else if len(other["client"]) > 0 {
-		if clientID := other["client"][0]; clientID != "" {
-			pfc.ChannelID = string(pfc.UserID) + "," + clientID
+	} else {
+		if len(other["client"]) > 0 {
+			if clientID := other["client"][0]; clientID != "" {
+				pfc.ChannelID = string(pfc.UserID) + "," + clientID
+			}
+		}
+		if len(other["strict"]) > 0 && other["strict"][0] == "true" {
+			parseMode = rss.ParseStrict
 		}
 	}
 
-	var blobKey appengine.BlobKey
-	if blobInfos := blobs["opml"]; len(blobInfos) == 0 {
+	if uploadKey == "" {
 		return nil, NewReadableError(_l("File not uploaded"), nil)
+	} else if reader, err := pfc.Platform.OpenUpload(uploadKey); err != nil {
+		return nil, NewReadableError(_l("Error receiving file"), &err)
 	} else {
-		blobKey = blobInfos[0].BlobKey
-		reader := blobstore.NewReader(c, blobKey)
+		_, _, err := rss.ParseOPMLWithMode(reader, parseMode)
+		reader.Close()
 
-		if _, err := rss.ParseOPML(reader); err != nil {
-			if err := blobstore.Delete(c, blobKey); err != nil {
-				c.Warningf("Error deleting blob (key %s): %s", blobKey, err)
+		if err != nil {
+			if err := pfc.Platform.DeleteUpload(uploadKey); err != nil {
+				c.Warningf("Error deleting upload (key %s): %s", uploadKey, err)
 			}
 
 			return nil, NewReadableError(_l("Error reading OPML file"), &err)
 		}
 	}
 
+	job, err := pfc.Storage.NewImportJob(pfc.UserID)
+	if err != nil {
+		if err := pfc.Platform.DeleteUpload(uploadKey); err != nil {
+			c.Warningf("Error deleting upload (key %s): %s", uploadKey, err)
+		}
+
+		return nil, err
+	}
+
 	params := taskParams {
-		"opmlBlobKey": string(blobKey),
+		"opmlBlobKey": uploadKey,
+		"jobID": job.ID,
+	}
+	if parseMode == rss.ParseStrict {
+		params["strict"] = "true"
 	}
 	if err := startTask(pfc, "import", params, importQueue); err != nil {
-		// Remove the blob
-		if err := blobstore.Delete(c, blobKey); err != nil {
-			c.Warningf("Error deleting blob (key %s): %s", blobKey, err)
+		// Remove the upload
+		if err := pfc.Platform.DeleteUpload(uploadKey); err != nil {
+			c.Warningf("Error deleting upload (key %s): %s", uploadKey, err)
+		}
+
+		return nil, NewReadableError(_l("Cannot import - too busy"), &err)
+	}
+
+	return map[string]interface{} {
+		"message": _l("Importing, please wait…"),
+		"job": job,
+	}, nil
+}
+
+func importJob(pfc *PFContext) (interface{}, error) {
+	var job *storage.ImportJob
+	if jobID := pfc.R.FormValue("job"); jobID != "" {
+		if j, err := pfc.Storage.ImportJobByID(pfc.UserID, jobID); err != nil {
+			return nil, err
+		} else {
+			job = j
 		}
+	} else if jobs, err := pfc.Storage.RecentImportJobs(pfc.UserID); err != nil {
+		return nil, err
+	} else if len(jobs) > 0 {
+		job = &jobs[0]
+	}
+
+	if job == nil {
+		return nil, NewReadableError(_l("Import not found"), nil)
+	}
+
+	results, err := pfc.Storage.ImportResults(*job)
+	if err != nil {
+		return nil, err
+	}
+
+	return map[string]interface{} {
+		"job": job,
+		"results": results,
+	}, nil
+}
+
+func retryImport(pfc *PFContext) (interface{}, error) {
+	jobID := pfc.R.PostFormValue("job")
+	if jobID == "" {
+		return nil, NewReadableError(_l("Import not found"), nil)
+	}
+
+	if job, err := pfc.Storage.ImportJobByID(pfc.UserID, jobID); err != nil {
+		return nil, err
+	} else if job == nil {
+		return nil, NewReadableError(_l("Import not found"), nil)
+	} else if !job.Done {
+		return nil, NewReadableError(_l("Import is still in progress"), nil)
+	}
 
+	params := taskParams {
+		"jobID": jobID,
+		"resultID": pfc.R.PostFormValue("result"),
+	}
+	if err := startTask(pfc, "retryImport", params, importQueue); err != nil {
 		return nil, NewReadableError(_l("Cannot import - too busy"), &err)
 	}
 
-	return _l("Importing, please wait…"), nil
+	return _l("Retrying, please wait…"), nil
 }
 
 func markAllAsRead(pfc *PFContext) (interface{}, error) {
@@ -538,7 +683,7 @@ func markAllAsRead(pfc *PFContext) (interface{}, error) {
 			},
 			SubscriptionID: subscriptionID,
 		}
-		if exists, err := storage.SubscriptionExists(pfc.C, ref); err != nil {
+		if exists, err := pfc.Storage.SubscriptionExists(ref); err != nil {
 			return nil, err
 		} else if !exists {
 			return nil, NewReadableError(_l("Subscription not found"), nil)
@@ -549,22 +694,82 @@ func markAllAsRead(pfc *PFContext) (interface{}, error) {
 			FolderID: folderID,
 		}
 
-		if exists, err := storage.FolderExists(pfc.C, ref); err != nil {
+		if exists, err := pfc.Storage.FolderExists(ref); err != nil {
 			return nil, err
 		} else if !exists {
 			return nil, NewReadableError(_l("Folder not found"), nil)
 		}
 	}
 
-	params := taskParams {
-		"subscriptionID": subscriptionID,
-		"folderID":       folderID,
+	readRange, err := readRangeFromForm(pfc)
+	if err != nil {
+		return nil, err
+	}
+
+	scope := storage.ArticleScope {
+		FolderRef: storage.FolderRef {
+			UserID: pfc.UserID,
+			FolderID: folderID,
+		},
+		SubscriptionID: subscriptionID,
 	}
-	if err := startTask(pfc, "markAllAsRead", params, modificationQueue); err != nil {
+	if err := markAsRead(pfc, scope, readRange); err != nil {
 		return nil, err
 	}
 
-	return _l("Please wait…"), nil
+	return map[string]interface{} {
+		"message": _l("Articles marked as read"),
+		"done": true,
+	}, nil
+}
+
+// readRangeFromForm returns the range of articles to mark read:
+// everything, articles older than a number of days ("olderThan"), or
+// articles listed above one ("above", in the "sort" order)
+func readRangeFromForm(pfc *PFContext) (storage.ReadRange, error) {
+	r := pfc.R
+	now := time.Now()
+	readRange := storage.ReadRange { Marked: now }
+
+	olderThan := r.PostFormValue("olderThan")
+	aboveID := r.PostFormValue("above")
+
+	if olderThan != "" && aboveID != "" {
+		return readRange, NewReadableErrorWithCode(_l("Specify either an age or an article"), http.StatusBadRequest, nil)
+	} else if olderThan != "" {
+		days, err := strconv.Atoi(olderThan)
+		if err != nil || days < 1 {
+			return readRange, NewReadableErrorWithCode(_l("Age not valid"), http.StatusBadRequest, nil)
+		}
+
+		readRange.Before.Fetched = now.Add(-time.Duration(days) * 24 * time.Hour)
+	} else if aboveID != "" {
+		ref := storage.ArticleRef {
+			SubscriptionRef: storage.SubscriptionRef {
+				FolderRef: storage.FolderRef {
+					UserID: pfc.UserID,
+					FolderID: r.PostFormValue("aboveFolder"),
+				},
+				SubscriptionID: r.PostFormValue("aboveSubscription"),
+			},
+			ArticleID: aboveID,
+		}
+
+		if ref.SubscriptionID == "" {
+			return readRange, NewReadableErrorWithCode(_l("Article not found"), http.StatusBadRequest, nil)
+		} else if articles, err := pfc.Storage.Articles([]storage.ArticleRef { ref }); err != nil {
+			return readRange, err
+		} else if len(articles) == 0 {
+			return readRange, NewReadableError(_l("Article not found"), nil)
+		} else if r.PostFormValue("sort") == storage.OrderOldest {
+			// Older articles are listed above
+			readRange.Before = articles[0].Position()
+		} else {
+			readRange.After = articles[0].Position()
+		}
+	}
+
+	return readRange, nil
 }
 
 func moveSubscription(pfc *PFContext) (interface{}, error) {
@@ -580,7 +785,7 @@ func moveSubscription(pfc *PFContext) (interface{}, error) {
 	}
 	
 	if destinationID != "" {
-		if exists, err := storage.FolderExists(pfc.C, destination); err != nil {
+		if exists, err := pfc.Storage.FolderExists(destination); err != nil {
 			return nil, err
 		} else if !exists {
 			return nil, NewReadableError(_l("Folder not found"), nil)
@@ -595,13 +800,13 @@ func moveSubscription(pfc *PFContext) (interface{}, error) {
 		SubscriptionID: subscriptionID,
 	}
 
-	if exists, err := storage.SubscriptionExists(pfc.C, ref); err != nil {
+	if exists, err := pfc.Storage.SubscriptionExists(ref); err != nil {
 		return nil, err
 	} else if !exists {
 		return nil, NewReadableError(_l("Subscription not found"), nil)
 	}
 
-	if err := storage.MoveSubscription(pfc.C, ref, destination); err != nil {
+	if err := pfc.Storage.MoveSubscription(ref, destination); err != nil {
 		return nil, err
 	}
 
@@ -615,16 +820,91 @@ func moveSubscription(pfc *PFContext) (interface{}, error) {
 		return nil, err
 	}
 
-	return storage.NewUserSubscriptions(pfc.C, pfc.UserID)
+	return pfc.Storage.NewUserSubscriptions(pfc.UserID)
 }
 
-func authUpload(pfc *PFContext) (interface{}, error) {
-	c := pfc.C
+func moveFolder(pfc *PFContext) (interface{}, error) {
+	r := pfc.R
+
+	folderID := r.PostFormValue("folder")
+	if folderID == "" {
+		return nil, NewReadableError(_l("Folder not found"), nil)
+	}
+
+	ref := storage.FolderRef {
+		UserID: pfc.UserID,
+		FolderID: folderID,
+	}
+
+	// An empty destination moves the folder to the top level
+	destination := storage.FolderRef {
+		UserID: pfc.UserID,
+		FolderID: r.PostFormValue("destination"),
+	}
+
+	subs, err := pfc.Storage.NewUserSubscriptions(pfc.UserID)
+	if err != nil {
+		return nil, err
+	}
+
+	var folder *storage.Folder
+	destinationFound := destination.FolderID == ""
+	for i, _ := range subs.Folders {
+		if subs.Folders[i].ID == ref.FolderID {
+			folder = &subs.Folders[i]
+		}
+		if subs.Folders[i].ID == destination.FolderID {
+			destinationFound = true
+		}
+	}
+
+	if folder == nil || !destinationFound {
+		return nil, NewReadableError(_l("Folder not found"), nil)
+	} else if folder.Parent == destination.FolderID {
+		return subs, nil // Already there
+	}
+
+	if isDupe, err := pfc.Storage.IsFolderDuplicate(destination, folder.Title); err != nil {
+		return nil, err
+	} else if isDupe {
+		return nil, NewReadableError(_l("A folder with that name already exists"), nil)
+	}
+
+	if err := pfc.Storage.MoveFolder(ref, destination); err == storage.ErrFolderCycle {
+		return nil, NewReadableError(_l("A folder can't be moved into one of its subfolders"), nil)
+	} else if err != nil {
+		return nil, NewReadableError(_l("Error moving folder"), &err)
+	}
+
+	return pfc.Storage.NewUserSubscriptions(pfc.UserID)
+}
+
+// folderParent returns the folder enclosing the folder; its folder
+// ID is empty at the top level
+func folderParent(pfc *PFContext, ref storage.FolderRef) (storage.FolderRef, error) {
+	parent := storage.FolderRef {
+		UserID: ref.UserID,
+	}
+
+	subs, err := pfc.Storage.NewUserSubscriptions(ref.UserID)
+	if err != nil {
+		return parent, err
+	}
+
+	for _, folder := range subs.Folders {
+		if folder.ID == ref.FolderID {
+			parent.FolderID = folder.Parent
+		}
+	}
+
+	return parent, nil
+}
 
-	if uploadURL, err := blobstore.UploadURL(c, "/import", nil); err != nil {
+func authUpload(pfc *PFContext) (interface{}, error) {
+	if uploadURL, err := pfc.Platform.UploadURL("/import"); err != nil {
 		return nil, err
 	} else {
-		return map[string]string { "uploadUrl": uploadURL.String() }, nil
+		return map[string]string { "uploadUrl": uploadURL }, nil
 	}
 }
 
@@ -633,7 +913,7 @@ func initChannel(pfc *PFContext) (interface{}, error) {
 		return nil, NewReadableError(_l("Missing Client ID"), nil)
 	}
 
-	if token, err := channel.Create(pfc.C, pfc.ChannelID); err != nil {
+	if token, err := pfc.Platform.CreateChannel(pfc.ChannelID); err != nil {
 		return nil, NewReadableError(_l("Error initializing channel"), &err)
 	} else {
 		return map[string]string { "token": token }, nil
@@ -653,26 +933,19 @@ func removeFolder(pfc *PFContext) (interface{}, error) {
 		FolderID: folderID,
 	}
 
-	if exists, err := storage.FolderExists(pfc.C, folderRef); err != nil {
+	if exists, err := pfc.Storage.FolderExists(folderRef); err != nil {
 		return nil, err
 	} else if !exists {
 		return nil, NewReadableError(_l("Folder not found"), nil)
 	}
 
-	// Delete the folder and subscriptions
-	if err := storage.DeleteFolder(pfc.C, folderRef); err != nil {
+	// Delete the folder and subscriptions. Articles are deleted
+	// once the undo window expires
+	if err := pfc.Storage.DeleteFolder(folderRef); err != nil {
 		return nil, err
 	}
 
-	// Start a task to purge the articles
-	params := taskParams {
-		"folderID": folderID,
-	}
-	if err := startTask(pfc, "removeFolder", params, modificationQueue); err != nil {
-		return nil, NewReadableError(_l("Cannot unsubscribe - too busy"), &err)
-	}
-
-	return storage.NewUserSubscriptions(pfc.C, pfc.UserID)
+	return pfc.Storage.NewUserSubscriptions(pfc.UserID)
 }
 
 func removeTag(pfc *PFContext) (interface{}, error) {
@@ -683,24 +956,17 @@ func removeTag(pfc *PFContext) (interface{}, error) {
 		return nil, NewReadableError(_l("Tag not found"), nil)
 	}
 
-	if exists, err := storage.TagExists(pfc.C, pfc.UserID, tagID); err != nil {
+	if exists, err := pfc.Storage.TagExists(pfc.UserID, tagID); err != nil {
 		return nil, err
 	} else if !exists {
 		return nil, NewReadableError(_l("Tag not found"), nil)
 	}
 
-	// Delete the tag
-	if err := storage.DeleteTag(pfc.C, pfc.UserID, tagID); err != nil {
+	// Delete the tag. Articles keep it until the undo window
+	// expires
+	if err := pfc.Storage.DeleteTag(pfc.UserID, tagID); err != nil {
 		return nil, err
 	}
 
-	// Start a task to remove existing tag
-	params := taskParams {
-		"tagID": tagID,
-	}
-	if err := startTask(pfc, "removeTag", params, modificationQueue); err != nil {
-		return nil, NewReadableError(_l("Cannot remove tag - too busy"), &err)
-	}
-
-	return storage.NewUserSubscriptions(pfc.C, pfc.UserID)
+	return pfc.Storage.NewUserSubscriptions(pfc.UserID)
 }
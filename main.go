@@ -24,49 +24,33 @@
 package gofr
 
 import (
-	"appengine"
-	"appengine/user"
 	"net/http"
 	"storage"
 )
 
-func init() {
-	// Initialize handlers
-	http.HandleFunc("/", Run)
-
+// registerRoutes registers the handlers for all of the reader's
+// routes. Called once by the platform-specific entry point
+func registerRoutes() {
 	registerJson()
 	registerTasks()
 	registerCron()
 	registerWeb()
+	registerWebSub()
+	registerAuth()
+	registerGReader()
+	registerFever()
+	registerFilterRules()
+	registerUndo()
 }
 
 type PFContext struct {
 	R *http.Request
-	C appengine.Context
+	C Context
 	W http.ResponseWriter
+	Platform Platform
+	Storage storage.Repository
 	ChannelID string
 	UserID storage.UserID
 	User *storage.User
 	LoginURL string
 }
-
-func Run(w http.ResponseWriter, r *http.Request) {
-	c := appengine.NewContext(r)
-
-	loginURL := ""
-	if url, err := user.LoginURL(c, r.URL.String()); err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
-	} else {
-		loginURL = url
-	}
-
-	pfc := PFContext {
-		R: r,
-		C: c,
-		W: w,
-		LoginURL: loginURL,
-	}
-
-	routeRequest(&pfc)
-}
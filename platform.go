@@ -0,0 +1,75 @@
+/*****************************************************************************
+ **
+ ** Gofr
+ ** https://github.com/pokebyte/Gofr
+ ** Copyright (C) 2013-2017 Akop Karapetyan
+ **
+ ** This program is free software; you can redistribute it and/or modify
+ ** it under the terms of the GNU General Public License as published by
+ ** the Free Software Foundation; either version 2 of the License, or
+ ** (at your option) any later version.
+ **
+ ** This program is distributed in the hope that it will be useful,
+ ** but WITHOUT ANY WARRANTY; without even the implied warranty of
+ ** MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ ** GNU General Public License for more details.
+ **
+ ** You should have received a copy of the GNU General Public License
+ ** along with this program; if not, write to the Free Software
+ ** Foundation, Inc., 675 Mass Ave, Cambridge, MA 02139, USA.
+ **
+ ******************************************************************************
+ */
+ 
+package gofr
+
+import (
+	"io"
+	"net/http"
+	"net/url"
+)
+
+// Context logs messages on behalf of a request. appengine.Context
+// satisfies it
+type Context interface {
+	Debugf(format string, args ...interface{})
+	Infof(format string, args ...interface{})
+	Warningf(format string, args ...interface{})
+	Errorf(format string, args ...interface{})
+	Criticalf(format string, args ...interface{})
+}
+
+// Platform provides the services the reader depends on, and that
+// vary depending on where it's running. A Platform is bound to the
+// request being served
+type Platform interface {
+	// HTTPClient returns a new client for fetching remote content
+	HTTPClient() *http.Client
+
+	// AddTask queues a POST request to path, for processing in
+	// the background
+	AddTask(path string, values url.Values, queueName string) error
+
+	// CreateChannel opens a push channel to a client, returning the
+	// token the client uses to connect
+	CreateChannel(clientID string) (string, error)
+	// SendChannelMessage pushes a JSON-encoded message to a client
+	SendChannelMessage(clientID string, message interface{}) error
+
+	// UploadURL returns the URL that a file upload should be posted
+	// to, in order for it to reach path
+	UploadURL(path string) (string, error)
+	// ParseUpload stores the file uploaded in field, returning its key
+	// ("" if no file was uploaded) and the remaining form values
+	ParseUpload(r *http.Request, field string) (string, url.Values, error)
+	// OpenUpload returns a reader for a stored upload
+	OpenUpload(key string) (io.ReadCloser, error)
+	// DeleteUpload removes a stored upload
+	DeleteUpload(key string) error
+
+	// BaseURL returns the public URL of the server, without the
+	// trailing slash
+	BaseURL() string
+	// IsDevServer returns true when running in development mode
+	IsDevServer() bool
+}
@@ -0,0 +1,210 @@
+/*****************************************************************************
+ **
+ ** Gofr
+ ** https://github.com/pokebyte/Gofr
+ ** Copyright (C) 2013-2017 Akop Karapetyan
+ **
+ ** This program is free software; you can redistribute it and/or modify
+ ** it under the terms of the GNU General Public License as published by
+ ** the Free Software Foundation; either version 2 of the License, or
+ ** (at your option) any later version.
+ **
+ ** This program is distributed in the hope that it will be useful,
+ ** but WITHOUT ANY WARRANTY; without even the implied warranty of
+ ** MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ ** GNU General Public License for more details.
+ **
+ ** You should have received a copy of the GNU General Public License
+ ** along with this program; if not, write to the Free Software
+ ** Foundation, Inc., 675 Mass Ave, Cambridge, MA 02139, USA.
+ **
+ ******************************************************************************
+ */
+ 
+package gofr
+
+import (
+	"net/url"
+	"sync"
+	"time"
+)
+
+const (
+	// Time after which pools stop scheduling new work. Leaves enough
+	// of the 10-minute task/cron deadline for work in flight to
+	// complete (fetches time out after fetchDeadlineSeconds)
+	workDeadline = 8 * time.Minute
+)
+
+// workPool runs jobs on a bounded number of goroutines, limiting
+// the number of jobs running concurrently against the same host.
+// Jobs for a host that's at its limit wait in a queue of their own,
+// rather than for a worker, so they don't hold up other hosts
+type workPool struct {
+	c Context
+	deadline time.Time
+	perHost int
+
+	slots chan bool
+	hosts map[string]*hostJobs
+	dropped int
+	mutex sync.Mutex
+	waitGroup sync.WaitGroup
+}
+
+// hostJobs counts the jobs running against a host, and holds those
+// waiting for one of them to finish
+type hostJobs struct {
+	running int
+	queued []func()
+}
+
+// newWorkPool creates a pool that runs up to `workers` jobs at once,
+// up to `perHost` of them against a single host (0 for no limit).
+// The pool stops accepting work once workDeadline has elapsed since
+// `started`
+func newWorkPool(c Context, workers int, perHost int, started time.Time) *workPool {
+	return &workPool {
+		c: c,
+		deadline: started.Add(workDeadline),
+		perHost: perHost,
+		slots: make(chan bool, workers),
+		hosts: make(map[string]*hostJobs),
+	}
+}
+
+// Expired returns true if the pool is no longer accepting work
+func (pool *workPool)Expired() bool {
+	return time.Now().After(pool.deadline)
+}
+
+// acquire takes a worker, blocking until one is free. Returns false
+// if the deadline passes first
+func (pool *workPool)acquire() bool {
+	if pool.Expired() {
+		return false
+	}
+
+	timer := time.NewTimer(pool.deadline.Sub(time.Now()))
+	defer timer.Stop()
+
+	select {
+	case pool.slots <- true:
+		return true
+	case <-timer.C:
+		return false
+	}
+}
+
+// Submit schedules a job, blocking until a worker is available. A
+// job for a host already running perHost jobs is queued instead,
+// without blocking, and runs once one of them is done. Returns
+// false, without running the job, if the deadline is reached first
+// and the caller should defer the remaining work
+func (pool *workPool)Submit(host string, job func()) bool {
+	if pool.Expired() {
+		return false
+	}
+
+	if pool.perHost <= 0 {
+		host = ""
+	} else if host != "" {
+		pool.mutex.Lock()
+		jobs, ok := pool.hosts[host]
+		if !ok {
+			jobs = &hostJobs{}
+			pool.hosts[host] = jobs
+		}
+
+		if jobs.running >= pool.perHost {
+			jobs.queued = append(jobs.queued, job)
+			pool.waitGroup.Add(1)
+			pool.mutex.Unlock()
+			return true
+		}
+
+		jobs.running++
+		pool.mutex.Unlock()
+	}
+
+	pool.waitGroup.Add(1)
+	if !pool.acquire() {
+		// Give up the host, to any job queued for it
+		if next := pool.next(host); next != nil {
+			go pool.run(host, next)
+		}
+		return false
+	}
+
+	go pool.run(host, job)
+	return true
+}
+
+// run runs the job on the worker it was given, then each job queued
+// for its host in turn
+func (pool *workPool)run(host string, job func()) {
+	for ; job != nil; job = pool.next(host) {
+		job()
+		<-pool.slots
+	}
+}
+
+// next finishes a job against the host, returning the next one
+// queued for it once there's a worker for it, or nil. Queued jobs
+// are dropped once the deadline passes
+func (pool *workPool)next(host string) func() {
+	defer pool.waitGroup.Done()
+	if host == "" {
+		return nil
+	}
+
+	for {
+		pool.mutex.Lock()
+		jobs := pool.hosts[host]
+		if len(jobs.queued) == 0 {
+			jobs.running--
+			pool.mutex.Unlock()
+			return nil
+		}
+
+		job := jobs.queued[0]
+		jobs.queued = jobs.queued[1:]
+		pool.mutex.Unlock()
+
+		if pool.acquire() {
+			return job
+		}
+
+		pool.mutex.Lock()
+		pool.dropped++
+		pool.mutex.Unlock()
+		pool.waitGroup.Done()
+	}
+}
+
+// Wait blocks until all submitted jobs have completed. Returns false
+// if any of them were queued, but dropped at the deadline
+func (pool *workPool)Wait() bool {
+	pool.waitGroup.Wait()
+
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+
+	return pool.dropped == 0
+}
+
+// hostOf returns the host of a URL, for the purpose of
+// per-host limits
+func hostOf(rawURL string) string {
+	if parsedURL, err := url.Parse(rawURL); err == nil {
+		return parsedURL.Host
+	}
+
+	return ""
+}
+
+// enqueueContinuation starts a task to pick up where a job that ran
+// out of time left off
+func enqueueContinuation(pfc *PFContext, path string, values url.Values, queueName string) error {
+	return pfc.Platform.AddTask(path, values, queueName)
+}
@@ -0,0 +1,102 @@
+/*****************************************************************************
+ **
+ ** Gofr
+ ** https://github.com/pokebyte/Gofr
+ ** Copyright (C) 2013-2017 Akop Karapetyan
+ **
+ ** This program is free software; you can redistribute it and/or modify
+ ** it under the terms of the GNU General Public License as published by
+ ** the Free Software Foundation; either version 2 of the License, or
+ ** (at your option) any later version.
+ **
+ ** This program is distributed in the hope that it will be useful,
+ ** but WITHOUT ANY WARRANTY; without even the implied warranty of
+ ** MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ ** GNU General Public License for more details.
+ **
+ ** You should have received a copy of the GNU General Public License
+ ** along with this program; if not, write to the Free Software
+ ** Foundation, Inc., 675 Mass Ave, Cambridge, MA 02139, USA.
+ **
+ ******************************************************************************
+ */
+ 
+package gofr
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestWorkPoolHostLimit(t *testing.T) {
+	pool := newWorkPool(nil, 2, 1, time.Now())
+
+	release := make(chan bool)
+	var mutex sync.Mutex
+	var order []string
+	record := func(job string) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		order = append(order, job)
+	}
+
+	// The second job for a busy host is queued, without holding up
+	// the job for another host
+	if !pool.Submit("a.example.com", func() { <-release; record("a1") }) {
+		t.Fatalf("Expected the first job submitted")
+	} else if !pool.Submit("a.example.com", func() { record("a2") }) {
+		t.Fatalf("Expected the second job queued")
+	}
+
+	done := make(chan bool)
+	if !pool.Submit("b.example.com", func() { record("b1"); done <- true }) {
+		t.Fatalf("Expected the job for another host submitted")
+	}
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatalf("Job for another host held up by a busy host")
+	}
+
+	close(release)
+	if !pool.Wait() {
+		t.Errorf("Expected every job run")
+	}
+
+	if len(order) != 3 || order[1] != "a1" || order[2] != "a2" {
+		t.Errorf("Unexpected order: %v", order)
+	}
+}
+
+func TestWorkPoolDeadline(t *testing.T) {
+	// Past the deadline, nothing is accepted
+	pool := newWorkPool(nil, 1, 1, time.Now().Add(-workDeadline))
+	if pool.Submit("a.example.com", func() { t.Errorf("Expected the job not run") }) {
+		t.Errorf("Expected the job refused")
+	}
+
+	// Jobs still queued at the deadline are dropped
+	pool = newWorkPool(nil, 1, 1, time.Now().Add(50 * time.Millisecond - workDeadline))
+	ran := false
+	if !pool.Submit("a.example.com", func() { time.Sleep(100 * time.Millisecond) }) {
+		t.Fatalf("Expected the first job submitted")
+	} else if !pool.Submit("a.example.com", func() { ran = true }) {
+		t.Fatalf("Expected the second job queued")
+	}
+
+	if pool.Wait() {
+		t.Errorf("Expected the queued job dropped")
+	} else if ran {
+		t.Errorf("Expected the queued job not run")
+	}
+
+	// Waiting for a worker gives up at the deadline
+	pool = newWorkPool(nil, 1, 0, time.Now().Add(50 * time.Millisecond - workDeadline))
+	pool.Submit("", func() { time.Sleep(100 * time.Millisecond) })
+	if pool.Submit("", func() { t.Errorf("Expected the job not run") }) {
+		t.Errorf("Expected the job refused")
+	}
+	pool.Wait()
+}
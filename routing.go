@@ -24,12 +24,11 @@
 package gofr
 
 import (
-	"appengine"
-	"appengine/channel"
-	"appengine/user"
 	"encoding/json"
+	"errors"
 	"net/http"
 	"storage"
+	"strings"
 )
 
 type requestHandler interface {
@@ -71,6 +70,7 @@ type TaskMessage struct {
 	Silent bool      `json:"-"`
 	Code int         `json:"code,omitempty"`
 	Subscriptions interface{} `json:"subscriptions,omitempty"`
+	Progress interface{} `json:"progress,omitempty"`
 }
 
 var routes []route = make([]route, 0, 100)
@@ -78,14 +78,14 @@ var routes []route = make([]route, 0, 100)
 func (handler htmlRequestHandler)handleRequest(pfc *PFContext) {
 	w := pfc.W
 
-	aeUser := user.Current(pfc.C)
-	if handler.LoginRequired && aeUser == nil {
+	session := currentSession(pfc)
+	if handler.LoginRequired && session == nil {
 		w.Header().Set("Location", pfc.LoginURL)
 		w.WriteHeader(http.StatusFound)
 		return
-	} else if aeUser != nil {
-		pfc.UserID = storage.UserID(aeUser.ID)
-		if user, err := loadUser(pfc.C, aeUser); err != nil {
+	} else if session != nil {
+		pfc.UserID = session.UserID
+		if user, err := loadUser(pfc); err != nil {
 			pfc.C.Errorf("Error loading user: %s", err)
 			http.Error(w, "Unexpected error", http.StatusInternalServerError)
 			return
@@ -101,23 +101,23 @@ func (handler jsonRequestHandler)handleRequest(pfc *PFContext) {
 	w := pfc.W
 	c := pfc.C
 
-	aeUser := user.Current(pfc.C)
-	if handler.LoginRequired && aeUser == nil {
+	session := currentSession(pfc)
+	if handler.LoginRequired && session == nil {
 		jsonObj := map[string]string { "errorMessage": _l("Please sign in") }
 		bf, _ := json.Marshal(jsonObj)
 
 		w.Header().Set("Content-type", "application/json; charset=utf-8")
 		http.Error(w, string(bf), 401)
 		return
-	} else if aeUser != nil {
-		pfc.UserID = storage.UserID(aeUser.ID)
+	} else if session != nil {
+		pfc.UserID = session.UserID
 		if !handler.NoFormPreparse {
 			if clientID := pfc.R.PostFormValue("client"); clientID != "" {
-				pfc.ChannelID = aeUser.ID + "," + clientID
+				pfc.ChannelID = string(session.UserID) + "," + clientID
 			}
 		}
 
-		if user, err := loadUser(pfc.C, aeUser); err != nil {
+		if user, err := loadUser(pfc); err != nil {
 			c.Errorf("Error loading user: %s", err)
 			http.Error(w, "Unexpected error", http.StatusInternalServerError)
 			return
@@ -167,7 +167,7 @@ func (handler taskRequestHandler)handleRequest(pfc *PFContext) {
 			pfc.ChannelID = channelID
 		}
 
-		if user, err := storage.UserByID(pfc.C, pfc.UserID); err != nil {
+		if user, err := pfc.Storage.UserByID(pfc.UserID); err != nil {
 			pfc.C.Errorf("Error loading user: %s", err)
 			http.Error(pfc.W, "Unexpected error", http.StatusInternalServerError)
 			return
@@ -188,7 +188,7 @@ func (handler taskRequestHandler)handleRequest(pfc *PFContext) {
 
 	if !taskMessage.Silent {
 		if channelID := pfc.R.PostFormValue("channelID"); channelID != "" {
-			if err := channel.SendJSON(pfc.C, channelID, response); err != nil {
+			if err := pfc.Platform.SendChannelMessage(channelID, response); err != nil {
 				pfc.C.Criticalf("Error writing to channel: %s", err)
 			}
 		} else {
@@ -197,6 +197,18 @@ func (handler taskRequestHandler)handleRequest(pfc *PFContext) {
 	}
 }
 
+// sendChannelMessage notifies the client while a task is
+// still running
+func sendChannelMessage(pfc *PFContext, message TaskMessage) {
+	if pfc.ChannelID == "" {
+		return
+	}
+
+	if err := pfc.Platform.SendChannelMessage(pfc.ChannelID, message); err != nil {
+		pfc.C.Warningf("Error writing to channel: %s", err)
+	}
+}
+
 func (handler cronRequestHandler)handleRequest(pfc *PFContext) {
 	err := handler.RouteHandler(pfc)
 	if err != nil {
@@ -213,7 +225,16 @@ func routeRequest(pfc *PFContext) {
 		}
 	}
 
-	if appengine.IsDevAppServer() {
+	// Patterns ending in a slash (other than the root) match
+	// any path beneath them
+	for _, route := range routes {
+		if route.Pattern != "/" && strings.HasSuffix(route.Pattern, "/") && strings.HasPrefix(pfc.R.URL.Path, route.Pattern) {
+			route.Handler.handleRequest(pfc)
+			return
+		}
+	}
+
+	if pfc.Platform.IsDevServer() {
 		pfc.C.Warningf("Error routing %s: no destination", pfc.R.URL.Path)
 	}
 }
@@ -288,21 +309,12 @@ func RegisterCronRoute(pattern string, handler CronRouteHandler) {
 	routes = append(routes, route)
 }
 
-func loadUser(c appengine.Context, user *user.User) (*storage.User, error) {
-	if u, err := storage.UserByID(c, storage.UserID(user.ID)); err != nil {
+func loadUser(pfc *PFContext) (*storage.User, error) {
+	if user, err := pfc.Storage.UserByID(pfc.UserID); err != nil {
 		return nil, err
-	} else if u == nil {
-		// New user
-		newUser := storage.User {
-			ID: user.ID,
-			EmailAddress: user.Email,
-		}
-		if err := newUser.Save(c); err != nil {
-			return nil, err
-		}
-
-		return &newUser, nil
+	} else if user == nil {
+		return nil, errors.New("User not found: " + string(pfc.UserID))
 	} else {
-		return u, nil
+		return user, nil
 	}
 }
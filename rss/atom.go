@@ -49,6 +49,7 @@ type atomLink struct {
 	Rel string   `xml:"rel,attr"`
 	Href string  `xml:"href,attr"`
 	Title string `xml:"title,attr"`
+	Length int64 `xml:"length,attr"`
 }
 
 type atomAuthor struct {
@@ -65,6 +66,7 @@ type atomEntry struct {
 	Content atomText `xml:"content"`
 	Summary atomText `xml:"summary"`
 	Author atomAuthor `xml:"author"`
+	mediaExtensions
 }
 
 type atomText struct {
@@ -163,11 +165,15 @@ func (nativeEntry *atomEntry) Marshal() (entry *Entry, err error) {
 				URL: link.Href,
 				Type: link.Type,
 				Title: link.Title,
+				Size: link.Length,
 			}
 
 			entry.Media = append(entry.Media, media)
 		}
 	}
 
+	entry.Media = nativeEntry.mergeMedia(entry.Media)
+	entry.ImageURL = nativeEntry.image()
+
 	return entry, err
 }
@@ -61,11 +61,15 @@ type (
 		Published time.Time
 		Updated time.Time
 		Media []Media
+		ImageURL string
 	}
 	Media struct {
 		URL string
 		Type string
 		Title string
+		ThumbnailURL string
+		Duration time.Duration
+		Size int64
 	}
 	SortableTimes []time.Time
 )
@@ -221,6 +225,15 @@ func UnmarshalStream(url string, reader io.Reader) (feed *Feed, err error) {
 	var contentReader *bytes.Reader
 	var content []byte
 	if content, err = ioutil.ReadAll(reader); err == nil {
+		if isJSONFeed(content) {
+			// Not XML - JSON Feed (application/feed+json)
+			if feed, err = unmarshalJSONFeed(content); err == nil {
+				feed.URL = url
+			}
+
+			return
+		}
+
 		contentReader = bytes.NewReader(content)
 
 		genericFeed := GenericFeed{}
@@ -24,48 +24,138 @@
 package rss
 
 import (
-	"appengine"
-	"strings"
-	"regexp"
+	"golang.org/x/net/html"
+	"io"
 	"net/url"
+	"strings"
+)
+
+type FeedLink struct {
+	URL string   `json:"url"`
+	Title string `json:"title,omitempty"`
+	Type string  `json:"type,omitempty"`
+}
+
+var (
+	// MIME types advertised by rel="alternate" links to feeds
+	feedLinkTypes = map[string]bool {
+		"application/rss+xml": true,
+		"application/atom+xml": true,
+		"application/rdf+xml": true,
+		"application/feed+json": true,
+	}
+
+	// Paths to try when a document doesn't advertise any feeds
+	wellKnownFeedPaths = []string {
+		"/feed",
+		"/rss.xml",
+		"/atom.xml",
+		"/index.xml",
+	}
 )
 
-func ExtractRSSLink(c appengine.Context, sourceURL string, html string) (string, error) {
-	tagRe := regexp.MustCompile(`<link(?:\s+\w+\s*=\s*(?:"[^"]*"|'[^']'))+\s*/?>`)
-	attrRe := regexp.MustCompile(`\b(?P<key>\w+)\s*=\s*(?:"(?P<value>[^"]*)"|'(?P<value>[^'])')`)
-
-	linkURL := ""
-	for _, linkTag := range tagRe.FindAllString(html, -1) {
-		link := make(map[string]string)
-		for _, attr := range attrRe.FindAllStringSubmatch(linkTag, -1) {
-			key := strings.ToLower(attr[1])
-			if attr[2] != "" {
-				link[key] = attr[2]
-			} else if attr[3] != "" {
-				link[key] = attr[3]
+func hasToken(list string, token string) bool {
+	for _, t := range strings.Fields(list) {
+		if strings.EqualFold(t, token) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func resolveLink(baseURL *url.URL, href string) (string, error) {
+	refURL, err := url.Parse(strings.TrimSpace(href))
+	if err != nil {
+		return "", err
+	} else if baseURL == nil || refURL.IsAbs() {
+		return refURL.String(), nil
+	}
+
+	return baseURL.ResolveReference(refURL).String(), nil
+}
+
+// DiscoverFeeds parses an HTML document and returns all feeds
+// advertised via <link rel="alternate"> tags, in document order.
+// Relative links are resolved in terms of the document's <base>,
+// or sourceURL if there isn't one
+func DiscoverFeeds(sourceURL string, reader io.Reader) ([]FeedLink, error) {
+	baseURL, err := url.Parse(sourceURL)
+	if err != nil {
+		return nil, err
+	}
+
+	links := make([]FeedLink, 0, 4)
+	seen := make(map[string]bool)
+	tokenizer := html.NewTokenizer(reader)
+
+	for {
+		tokenType := tokenizer.Next()
+		if tokenType == html.ErrorToken {
+			if err := tokenizer.Err(); err != io.EOF {
+				return links, err
 			}
+			break
+		} else if tokenType != html.StartTagToken && tokenType != html.SelfClosingTagToken {
+			continue
+		}
+
+		token := tokenizer.Token()
+		if token.Data == "body" {
+			break // Feed links only appear in the head
+		} else if token.Data != "link" && token.Data != "base" {
+			continue
 		}
 
-		if link["rel"] == "alternate" {
-			if link["type"] == "application/rss+xml" || link["type"] == "application/atom+xml" {
-				linkURL = link["href"]
-				break
+		attrs := make(map[string]string)
+		for _, attr := range token.Attr {
+			attrs[strings.ToLower(attr.Key)] = attr.Val
+		}
+
+		if token.Data == "base" {
+			if href := attrs["href"]; href != "" {
+				if resolved, err := resolveLink(baseURL, href); err == nil {
+					baseURL, _ = url.Parse(resolved)
+				}
 			}
+			continue
+		}
+
+		mimeType := strings.ToLower(strings.TrimSpace(strings.SplitN(attrs["type"], ";", 2)[0]))
+		if !hasToken(attrs["rel"], "alternate") || !feedLinkTypes[mimeType] || attrs["href"] == "" {
+			continue
 		}
+
+		linkURL, err := resolveLink(baseURL, attrs["href"])
+		if err != nil || seen[linkURL] {
+			continue
+		}
+
+		seen[linkURL] = true
+		links = append(links, FeedLink {
+			URL: linkURL,
+			Title: strings.TrimSpace(attrs["title"]),
+			Type: mimeType,
+		})
 	}
 
-	if linkURL != "" {
-		if refURL, err := url.Parse(linkURL); err != nil {
-			return "", err
-		} else if !refURL.IsAbs() {
-			// URL is not absolute. Resolve it.
-			if asURL, err := url.Parse(sourceURL); err != nil {
-				return "", err
-			} else {
-				linkURL = asURL.ResolveReference(refURL).String()
-			}
+	return links, nil
+}
+
+// WellKnownFeedURLs returns a list of URLs commonly used by sites
+// to host their feeds, resolved in terms of sourceURL
+func WellKnownFeedURLs(sourceURL string) []string {
+	baseURL, err := url.Parse(sourceURL)
+	if err != nil {
+		return nil
+	}
+
+	urls := make([]string, 0, len(wellKnownFeedPaths))
+	for _, path := range wellKnownFeedPaths {
+		if resolved, err := resolveLink(baseURL, path); err == nil && resolved != sourceURL {
+			urls = append(urls, resolved)
 		}
 	}
 
-	return linkURL, nil
+	return urls
 }
@@ -0,0 +1,75 @@
+/*****************************************************************************
+ **
+ ** Gofr
+ ** https://github.com/pokebyte/Gofr
+ ** Copyright (C) 2013-2017 Akop Karapetyan
+ **
+ ** This program is free software; you can redistribute it and/or modify
+ ** it under the terms of the GNU General Public License as published by
+ ** the Free Software Foundation; either version 2 of the License, or
+ ** (at your option) any later version.
+ **
+ ** This program is distributed in the hope that it will be useful,
+ ** but WITHOUT ANY WARRANTY; without even the implied warranty of
+ ** MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ ** GNU General Public License for more details.
+ **
+ ** You should have received a copy of the GNU General Public License
+ ** along with this program; if not, write to the Free Software
+ ** Foundation, Inc., 675 Mass Ave, Cambridge, MA 02139, USA.
+ **
+ ******************************************************************************
+ */
+ 
+package rss
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestDiscoverFeeds(t *testing.T) {
+	content := `<!DOCTYPE html>
+<html>
+	<head>
+		<base href="https://cdn.example.com/blog/">
+		<link rel="stylesheet" href="style.css">
+		<link rel="alternate" type="application/rss+xml; charset=utf-8" title=" Posts " href="feed.xml">
+		<link rel="Alternate home" type="application/atom+xml" href="/atom.xml">
+		<link rel="alternate" type="application/feed+json" href="https://example.com/feed.json">
+		<link rel="alternate" type="text/html" href="/other.html">
+		<link rel="alternate" type="application/rss+xml" href="feed.xml">
+	</head>
+	<body>
+		<link rel="alternate" type="application/rss+xml" href="/body.xml">
+	</body>
+</html>`
+
+	links, err := DiscoverFeeds("https://example.com/blog/", strings.NewReader(content))
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	expected := []FeedLink {
+		{ URL: "https://cdn.example.com/blog/feed.xml", Title: "Posts", Type: "application/rss+xml" },
+		{ URL: "https://cdn.example.com/atom.xml", Type: "application/atom+xml" },
+		{ URL: "https://example.com/feed.json", Type: "application/feed+json" },
+	}
+	if !reflect.DeepEqual(links, expected) {
+		t.Errorf("Expected %+v, got %+v", expected, links)
+	}
+}
+
+func TestWellKnownFeedURLs(t *testing.T) {
+	urls := WellKnownFeedURLs("https://example.com/feed")
+	expected := []string {
+		"https://example.com/rss.xml",
+		"https://example.com/atom.xml",
+		"https://example.com/index.xml",
+	}
+
+	if !reflect.DeepEqual(urls, expected) {
+		t.Errorf("Expected %v, got %v", expected, urls)
+	}
+}
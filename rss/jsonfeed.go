@@ -0,0 +1,257 @@
+/*****************************************************************************
+ **
+ ** Gofr
+ ** https://github.com/pokebyte/Gofr
+ ** Copyright (C) 2013-2017 Akop Karapetyan
+ **
+ ** This program is free software; you can redistribute it and/or modify
+ ** it under the terms of the GNU General Public License as published by
+ ** the Free Software Foundation; either version 2 of the License, or
+ ** (at your option) any later version.
+ **
+ ** This program is distributed in the hope that it will be useful,
+ ** but WITHOUT ANY WARRANTY; without even the implied warranty of
+ ** MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ ** GNU General Public License for more details.
+ **
+ ** You should have received a copy of the GNU General Public License
+ ** along with this program; if not, write to the Free Software
+ ** Foundation, Inc., 675 Mass Ave, Cambridge, MA 02139, USA.
+ **
+ ******************************************************************************
+ */
+ 
+package rss
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"html"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var supportedJSONFeedTimeFormats = []string {
+	"2006-01-02T15:04:05Z07:00",
+	"2006-01-02T15:04:05",
+	"2006-01-02",
+}
+
+const jsonFeedVersionPrefix = "https://jsonfeed.org/version/"
+
+type jsonFeed struct {
+	Version string `json:"version"`
+	Title string `json:"title"`
+	HomePageURL string `json:"home_page_url"`
+	FeedURL string `json:"feed_url"`
+	Description string `json:"description"`
+	Author *jsonFeedAuthor `json:"author"`
+	Authors []jsonFeedAuthor `json:"authors"`
+	Hubs []jsonFeedHub `json:"hubs"`
+	Items []*jsonFeedItem `json:"items"`
+}
+
+type jsonFeedAuthor struct {
+	Name string `json:"name"`
+	URL string `json:"url"`
+	Avatar string `json:"avatar"`
+}
+
+type jsonFeedHub struct {
+	Type string `json:"type"`
+	URL string `json:"url"`
+}
+
+type jsonFeedAttachment struct {
+	URL string `json:"url"`
+	MimeType string `json:"mime_type"`
+	Title string `json:"title"`
+	SizeInBytes int64 `json:"size_in_bytes"`
+	DurationInSeconds float64 `json:"duration_in_seconds"`
+}
+
+type jsonFeedItem struct {
+	Id jsonFeedID `json:"id"`
+	URL string `json:"url"`
+	ExternalURL string `json:"external_url"`
+	Title string `json:"title"`
+	ContentHTML string `json:"content_html"`
+	ContentText string `json:"content_text"`
+	Summary string `json:"summary"`
+	Image string `json:"image"`
+	Published string `json:"date_published"`
+	Modified string `json:"date_modified"`
+	Author *jsonFeedAuthor `json:"author"`
+	Authors []jsonFeedAuthor `json:"authors"`
+	Attachments []jsonFeedAttachment `json:"attachments"`
+}
+
+// The spec requires item IDs to be strings, but some publishers
+// emit them as numbers - accept both
+type jsonFeedID string
+
+func (id *jsonFeedID) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err == nil {
+		*id = jsonFeedID(s)
+		return nil
+	}
+
+	var n json.Number
+	if err := json.Unmarshal(data, &n); err != nil {
+		return err
+	}
+
+	*id = jsonFeedID(n.String())
+	return nil
+}
+
+func isJSONFeed(content []byte) bool {
+	for _, b := range content {
+		switch b {
+		case ' ', '\t', '\r', '\n', 0xef, 0xbb, 0xbf: // Whitespace, BOM
+			continue
+		case '{':
+			return true
+		default:
+			return false
+		}
+	}
+
+	return false
+}
+
+func authorName(author *jsonFeedAuthor, authors []jsonFeedAuthor) string {
+	// 1.1 deprecates "author" in favor of "authors"
+	names := make([]string, 0, len(authors))
+	for _, a := range authors {
+		if a.Name != "" {
+			names = append(names, a.Name)
+		}
+	}
+
+	if len(names) == 0 && author != nil {
+		return author.Name
+	}
+
+	return strings.Join(names, ", ")
+}
+
+func (nativeFeed *jsonFeed) Marshal() (feed *Feed, err error) {
+	hubURL := ""
+	for _, hub := range nativeFeed.Hubs {
+		if strings.EqualFold(hub.Type, "WebSub") || hubURL == "" {
+			hubURL = hub.URL
+		}
+	}
+
+	feed = &Feed {
+		Title: nativeFeed.Title,
+		Description: nativeFeed.Description,
+		WWWURL: nativeFeed.HomePageURL,
+		Format: "JSONFeed",
+		HubURL: hubURL,
+		Topic: nativeFeed.FeedURL,
+	}
+
+	feedAuthor := authorName(nativeFeed.Author, nativeFeed.Authors)
+
+	if nativeFeed.Items != nil {
+		feed.Entries = make([]*Entry, 0, len(nativeFeed.Items))
+		for _, v := range nativeFeed.Items {
+			if v == nil {
+				// "null" in place of an item
+				continue
+			}
+
+			entry, entryError := v.Marshal()
+			if entry.Author == "" {
+				entry.Author = feedAuthor
+			}
+			if latest := entry.LatestModification(); latest.After(feed.Updated) {
+				feed.Updated = latest
+			}
+
+			if entryError != nil && err == nil {
+				err = entryError
+			}
+
+			feed.Entries = append(feed.Entries, entry)
+		}
+	}
+
+	return feed, err
+}
+
+func (nativeEntry *jsonFeedItem) Marshal() (entry *Entry, err error) {
+	content := nativeEntry.ContentHTML
+	if content == "" && nativeEntry.ContentText != "" {
+		content = strings.Replace(html.EscapeString(nativeEntry.ContentText), "\n", "<br/>", -1)
+	}
+	if content == "" {
+		content = html.EscapeString(nativeEntry.Summary)
+	}
+
+	link := nativeEntry.URL
+	if link == "" {
+		link = nativeEntry.ExternalURL
+	}
+
+	published := time.Time {}
+	if nativeEntry.Published != "" {
+		published, err = parseTime(supportedJSONFeedTimeFormats, nativeEntry.Published)
+	}
+
+	updated := published
+	if nativeEntry.Modified != "" {
+		var updateErr error
+		if updated, updateErr = parseTime(supportedJSONFeedTimeFormats, nativeEntry.Modified); updateErr != nil && err == nil {
+			err = updateErr
+		}
+		if published.IsZero() {
+			published = updated
+		}
+	}
+
+	entry = &Entry {
+		GUID: string(nativeEntry.Id),
+		Author: authorName(nativeEntry.Author, nativeEntry.Authors),
+		Title: nativeEntry.Title,
+		Content: content,
+		Published: published,
+		Updated: updated,
+		WWWURL: link,
+		Media: make([]Media, len(nativeEntry.Attachments)),
+		ImageURL: nativeEntry.Image,
+	}
+
+	for i, attachment := range nativeEntry.Attachments {
+		media := Media {
+			URL: attachment.URL,
+			Type: attachment.MimeType,
+			Title: attachment.Title,
+			Size: attachment.SizeInBytes,
+			Duration: time.Duration(attachment.DurationInSeconds * float64(time.Second)),
+		}
+
+		entry.Media[i] = media
+	}
+
+	return entry, err
+}
+
+func unmarshalJSONFeed(content []byte) (*Feed, error) {
+	nativeFeed := jsonFeed{}
+	content = bytes.TrimPrefix(bytes.TrimSpace(content), []byte("\xef\xbb\xbf"))
+	if err := json.Unmarshal(content, &nativeFeed); err != nil {
+		return nil, err
+	}
+
+	if !strings.HasPrefix(nativeFeed.Version, jsonFeedVersionPrefix) {
+		return nil, errors.New("Unsupported type of feed (JSON: " + strconv.Quote(nativeFeed.Version) + ")")
+	}
+
+	return nativeFeed.Marshal()
+}
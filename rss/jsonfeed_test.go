@@ -0,0 +1,108 @@
+/*****************************************************************************
+ **
+ ** Gofr
+ ** https://github.com/pokebyte/Gofr
+ ** Copyright (C) 2013-2017 Akop Karapetyan
+ **
+ ** This program is free software; you can redistribute it and/or modify
+ ** it under the terms of the GNU General Public License as published by
+ ** the Free Software Foundation; either version 2 of the License, or
+ ** (at your option) any later version.
+ **
+ ** This program is distributed in the hope that it will be useful,
+ ** but WITHOUT ANY WARRANTY; without even the implied warranty of
+ ** MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ ** GNU General Public License for more details.
+ **
+ ** You should have received a copy of the GNU General Public License
+ ** along with this program; if not, write to the Free Software
+ ** Foundation, Inc., 675 Mass Ave, Cambridge, MA 02139, USA.
+ **
+ ******************************************************************************
+ */
+ 
+package rss
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestJSONFeed(t *testing.T) {
+	content := `{
+		"version": "https://jsonfeed.org/version/1.1",
+		"title": "Example",
+		"home_page_url": "https://example.com/",
+		"feed_url": "https://example.com/feed.json",
+		"authors": [ { "name": "Jane" } ],
+		"hubs": [ { "type": "rssCloud", "url": "https://cloud.example.com/" }, { "type": "WebSub", "url": "https://hub.example.com/" } ],
+		"items": [
+			{
+				"id": 42,
+				"url": "https://example.com/42",
+				"title": "First",
+				"content_text": "Line one\nLine <two>",
+				"date_published": "2017-03-01T10:00:00Z",
+				"date_modified": "2017-03-02T10:00:00Z",
+				"attachments": [ { "url": "https://example.com/42.mp3", "mime_type": "audio/mpeg", "size_in_bytes": 1024, "duration_in_seconds": 90 } ]
+			},
+			{
+				"id": "second",
+				"external_url": "https://elsewhere.com/",
+				"summary": "Just a summary",
+				"author": { "name": "Joe" }
+			}
+		]
+	}`
+
+	feed, err := UnmarshalStream("https://example.com/feed.json", strings.NewReader(content))
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	if feed.Format != "JSONFeed" || feed.Title != "Example" || feed.WWWURL != "https://example.com/" {
+		t.Errorf("Unexpected feed: %+v", feed)
+	}
+	if feed.HubURL != "https://hub.example.com/" {
+		t.Errorf("Expected the WebSub hub, got %q", feed.HubURL)
+	}
+	if len(feed.Entries) != 2 {
+		t.Fatalf("Expected 2 entries, got %d", len(feed.Entries))
+	}
+
+	first := feed.Entries[0]
+	if first.GUID != "42" {
+		t.Errorf("Expected a numeric ID as a string, got %q", first.GUID)
+	}
+	if first.Content != "Line one<br/>Line &lt;two&gt;" {
+		t.Errorf("Unexpected content: %q", first.Content)
+	}
+	if first.Author != "Jane" {
+		t.Errorf("Expected the feed's author, got %q", first.Author)
+	}
+	if expected := time.Date(2017, 3, 2, 10, 0, 0, 0, time.UTC); !first.Updated.Equal(expected) || !feed.Updated.Equal(expected) {
+		t.Errorf("Unexpected update times: %s, %s", first.Updated, feed.Updated)
+	}
+	if len(first.Media) != 1 || first.Media[0].Size != 1024 || first.Media[0].Duration != 90 * time.Second {
+		t.Errorf("Unexpected media: %+v", first.Media)
+	}
+
+	second := feed.Entries[1]
+	if second.WWWURL != "https://elsewhere.com/" || second.Content != "Just a summary" || second.Author != "Joe" {
+		t.Errorf("Unexpected entry: %+v", second)
+	}
+}
+
+func TestJSONFeedNullItems(t *testing.T) {
+	content := `{ "version": "https://jsonfeed.org/version/1", "title": "Nulls", "items": [ null, { "id": "1", "content_html": "<p>Hi</p>" }, null ] }`
+
+	feed, err := UnmarshalStream("https://example.com/feed.json", strings.NewReader(content))
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	if len(feed.Entries) != 1 || feed.Entries[0].GUID != "1" {
+		t.Errorf("Expected the one item, got %+v", feed.Entries)
+	}
+}
@@ -0,0 +1,192 @@
+/*****************************************************************************
+ **
+ ** Gofr
+ ** https://github.com/pokebyte/Gofr
+ ** Copyright (C) 2013-2017 Akop Karapetyan
+ **
+ ** This program is free software; you can redistribute it and/or modify
+ ** it under the terms of the GNU General Public License as published by
+ ** the Free Software Foundation; either version 2 of the License, or
+ ** (at your option) any later version.
+ **
+ ** This program is distributed in the hope that it will be useful,
+ ** but WITHOUT ANY WARRANTY; without even the implied warranty of
+ ** MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ ** GNU General Public License for more details.
+ **
+ ** You should have received a copy of the GNU General Public License
+ ** along with this program; if not, write to the Free Software
+ ** Foundation, Inc., 675 Mass Ave, Cambridge, MA 02139, USA.
+ **
+ ******************************************************************************
+ */
+ 
+package rss
+
+import (
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Media RSS (http://www.rssboard.org/media-rss) and iTunes podcast
+// extensions. mediaExtensions is embedded in RSS1, RSS2 and Atom entries
+
+type mediaThumbnail struct {
+	URL string `xml:"url,attr"`
+}
+
+type mediaContent struct {
+	URL string `xml:"url,attr"`
+	Type string `xml:"type,attr"`
+	Medium string `xml:"medium,attr"`
+	FileSize int64 `xml:"fileSize,attr"`
+	Duration string `xml:"duration,attr"`
+	Title string `xml:"http://search.yahoo.com/mrss/ title"`
+	Thumbnails []mediaThumbnail `xml:"http://search.yahoo.com/mrss/ thumbnail"`
+}
+
+type mediaGroup struct {
+	Contents []mediaContent `xml:"http://search.yahoo.com/mrss/ content"`
+	Title string `xml:"http://search.yahoo.com/mrss/ title"`
+	Thumbnails []mediaThumbnail `xml:"http://search.yahoo.com/mrss/ thumbnail"`
+}
+
+type iTunesImage struct {
+	Href string `xml:"href,attr"`
+}
+
+type mediaExtensions struct {
+	MediaContents []mediaContent `xml:"http://search.yahoo.com/mrss/ content"`
+	MediaGroups []mediaGroup `xml:"http://search.yahoo.com/mrss/ group"`
+	MediaThumbnails []mediaThumbnail `xml:"http://search.yahoo.com/mrss/ thumbnail"`
+	ITunesDuration string `xml:"http://www.itunes.com/dtds/podcast-1.0.dtd duration"`
+	ITunesImage iTunesImage `xml:"http://www.itunes.com/dtds/podcast-1.0.dtd image"`
+}
+
+// parseDuration parses durations in the formats used by the iTunes
+// and Media RSS extensions: seconds ("3600", "3600.5"), "MM:SS" and
+// "HH:MM:SS"
+func parseDuration(spec string) time.Duration {
+	spec = strings.TrimSpace(spec)
+	if spec == "" {
+		return 0
+	}
+
+	seconds := 0.0
+	for _, part := range strings.Split(spec, ":") {
+		value, err := strconv.ParseFloat(part, 64)
+		if err != nil || value < 0 {
+			return 0
+		}
+		seconds = seconds * 60 + value
+	}
+
+	return time.Duration(seconds * float64(time.Second))
+}
+
+func (content mediaContent) marshal(title string, thumbnails []mediaThumbnail) Media {
+	media := Media {
+		URL: content.URL,
+		Type: content.Type,
+		Title: content.Title,
+		Size: content.FileSize,
+		Duration: parseDuration(content.Duration),
+	}
+
+	if media.Type == "" && content.Medium != "" {
+		// Type not specified, but the medium ("image", "audio",
+		// "video", etc.) may be
+		media.Type = content.Medium + "/*"
+	}
+	if media.Title == "" {
+		media.Title = title
+	}
+	if len(content.Thumbnails) > 0 {
+		media.ThumbnailURL = content.Thumbnails[0].URL
+	} else if len(thumbnails) > 0 {
+		media.ThumbnailURL = thumbnails[0].URL
+	}
+
+	return media
+}
+
+// image returns the URL of the artwork associated with the entry,
+// if any
+func (ext mediaExtensions) image() string {
+	if ext.ITunesImage.Href != "" {
+		return ext.ITunesImage.Href
+	} else if len(ext.MediaThumbnails) > 0 {
+		return ext.MediaThumbnails[0].URL
+	}
+
+	for _, group := range ext.MediaGroups {
+		if len(group.Thumbnails) > 0 {
+			return group.Thumbnails[0].URL
+		}
+	}
+
+	return ""
+}
+
+// mergeMedia combines media specified via extensions with media
+// already extracted from the entry (enclosures). Entries with
+// identical URLs are consolidated, with missing details filled in
+// from the extensions
+func (ext mediaExtensions) mergeMedia(media []Media) []Media {
+	extMedia := make([]Media, 0, len(ext.MediaContents))
+	for _, content := range ext.MediaContents {
+		extMedia = append(extMedia, content.marshal("", ext.MediaThumbnails))
+	}
+	for _, group := range ext.MediaGroups {
+		thumbnails := group.Thumbnails
+		if len(thumbnails) == 0 {
+			thumbnails = ext.MediaThumbnails
+		}
+
+		for _, content := range group.Contents {
+			extMedia = append(extMedia, content.marshal(group.Title, thumbnails))
+		}
+	}
+
+OuterLoop:
+	for _, em := range extMedia {
+		if em.URL == "" {
+			continue
+		}
+
+		for i := range media {
+			if m := &media[i]; m.URL == em.URL {
+				if m.Type == "" {
+					m.Type = em.Type
+				}
+				if m.Title == "" {
+					m.Title = em.Title
+				}
+				if m.Size == 0 {
+					m.Size = em.Size
+				}
+				if m.Duration == 0 {
+					m.Duration = em.Duration
+				}
+				if m.ThumbnailURL == "" {
+					m.ThumbnailURL = em.ThumbnailURL
+				}
+				continue OuterLoop
+			}
+		}
+
+		media = append(media, em)
+	}
+
+	// iTunes duration applies to the episode's enclosure
+	if duration := parseDuration(ext.ITunesDuration); duration > 0 {
+		for i := range media {
+			if media[i].Duration == 0 {
+				media[i].Duration = duration
+			}
+		}
+	}
+
+	return media
+}
@@ -0,0 +1,113 @@
+/*****************************************************************************
+ **
+ ** Gofr
+ ** https://github.com/pokebyte/Gofr
+ ** Copyright (C) 2013-2017 Akop Karapetyan
+ **
+ ** This program is free software; you can redistribute it and/or modify
+ ** it under the terms of the GNU General Public License as published by
+ ** the Free Software Foundation; either version 2 of the License, or
+ ** (at your option) any later version.
+ **
+ ** This program is distributed in the hope that it will be useful,
+ ** but WITHOUT ANY WARRANTY; without even the implied warranty of
+ ** MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ ** GNU General Public License for more details.
+ **
+ ** You should have received a copy of the GNU General Public License
+ ** along with this program; if not, write to the Free Software
+ ** Foundation, Inc., 675 Mass Ave, Cambridge, MA 02139, USA.
+ **
+ ******************************************************************************
+ */
+ 
+package rss
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseDuration(t *testing.T) {
+	cases := []struct {
+		Spec string
+		Expected time.Duration
+	} {
+		{ "", 0 },
+		{ "90", 90 * time.Second },
+		{ "1.5", 1500 * time.Millisecond },
+		{ "02:30", 150 * time.Second },
+		{ "1:02:03", time.Hour + 2 * time.Minute + 3 * time.Second },
+		{ "-5", 0 },
+		{ "abc", 0 },
+	}
+
+	for _, c := range cases {
+		if duration := parseDuration(c.Spec); duration != c.Expected {
+			t.Errorf("parseDuration(%q): expected %s, got %s", c.Spec, c.Expected, duration)
+		}
+	}
+}
+
+func TestMediaRSS(t *testing.T) {
+	content := `<?xml version="1.0"?>
+<rss version="2.0" xmlns:media="http://search.yahoo.com/mrss/" xmlns:itunes="http://www.itunes.com/dtds/podcast-1.0.dtd">
+	<channel>
+		<title>Podcast</title>
+		<link>https://example.com/</link>
+		<item>
+			<guid>episode-1</guid>
+			<title>Episode 1</title>
+			<enclosure url="https://example.com/1.mp3" length="2048" type="audio/mpeg"/>
+			<media:content url="https://example.com/1.mp3" medium="audio">
+				<media:title>The Episode</media:title>
+			</media:content>
+			<media:group>
+				<media:title>Video</media:title>
+				<media:thumbnail url="https://example.com/1-video.jpg"/>
+				<media:content url="https://example.com/1.mp4" type="video/mp4" fileSize="4096" duration="120"/>
+			</media:group>
+			<media:thumbnail url="https://example.com/1.jpg"/>
+			<itunes:duration>10:00</itunes:duration>
+		</item>
+		<item>
+			<guid>episode-2</guid>
+			<title>Episode 2</title>
+			<itunes:image href="https://example.com/2.jpg"/>
+		</item>
+	</channel>
+</rss>`
+
+	feed, err := UnmarshalStream("https://example.com/feed.xml", strings.NewReader(content))
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	} else if len(feed.Entries) != 2 {
+		t.Fatalf("Expected 2 entries, got %d", len(feed.Entries))
+	}
+
+	first := feed.Entries[0]
+	if first.ImageURL != "https://example.com/1.jpg" {
+		t.Errorf("Unexpected image: %q", first.ImageURL)
+	}
+	if len(first.Media) != 2 {
+		t.Fatalf("Expected the enclosure and the group's content, got %+v", first.Media)
+	}
+
+	// The enclosure, with the details it lacks filled in
+	audio := first.Media[0]
+	if audio.Type != "audio/mpeg" || audio.Size != 2048 || audio.Title != "The Episode" ||
+		audio.ThumbnailURL != "https://example.com/1.jpg" || audio.Duration != 10 * time.Minute {
+		t.Errorf("Unexpected audio: %+v", audio)
+	}
+
+	video := first.Media[1]
+	if video.Type != "video/mp4" || video.Size != 4096 || video.Title != "Video" ||
+		video.ThumbnailURL != "https://example.com/1-video.jpg" || video.Duration != 2 * time.Minute {
+		t.Errorf("Unexpected video: %+v", video)
+	}
+
+	if second := feed.Entries[1]; second.ImageURL != "https://example.com/2.jpg" || len(second.Media) != 0 {
+		t.Errorf("Unexpected entry: %+v", second)
+	}
+}
@@ -25,9 +25,26 @@ package rss
 
 import (
 	"encoding/xml"
+	"errors"
+	"github.com/paulrosania/go-charset/charset"
 	"io"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
 )
 
+type ParseMode int
+
+const (
+	// Fail on the first malformed outline
+	ParseStrict ParseMode = iota
+	// Skip malformed outlines and report them
+	ParseLenient
+)
+
+const opmlDocsURL = "http://opml.org/spec2.opml"
+
 type OPML struct {
 	XMLName xml.Name `xml:"opml"`
 	Version string `xml:"version,attr,omitempty"`
@@ -37,6 +54,11 @@ type OPML struct {
 
 type head struct {
 	Title string `xml:"title"`
+	DateCreated string `xml:"dateCreated,omitempty"`
+	DateModified string `xml:"dateModified,omitempty"`
+	OwnerName string `xml:"ownerName,omitempty"`
+	OwnerEmail string `xml:"ownerEmail,omitempty"`
+	Docs string `xml:"docs,omitempty"`
 }
 
 type opmlBody struct {
@@ -49,9 +71,20 @@ type Outline struct {
 	Type string `xml:"type,attr,omitempty"`
 	FeedURL string `xml:"xmlUrl,attr,omitempty"`
 	WebURL string `xml:"htmlUrl,attr,omitempty"`
+	Description string `xml:"description,attr,omitempty"`
+	Language string `xml:"language,attr,omitempty"`
+	Version string `xml:"version,attr,omitempty"`
+	Category string `xml:"category,attr,omitempty"`
+	Created string `xml:"created,attr,omitempty"`
 	Outlines []*Outline `xml:"outline"`
 }
 
+type SkippedOutline struct {
+	Title string `json:"title"`
+	FeedURL string `json:"url,omitempty"`
+	Reason string `json:"reason"`
+}
+
 func (opml *OPML)Title() string {
 	return opml.Head.Title
 }
@@ -60,6 +93,15 @@ func (opml *OPML)SetTitle(title string) {
 	opml.Head.Title = title
 }
 
+func (opml *OPML)SetOwner(name string, email string) {
+	opml.Head.OwnerName = name
+	opml.Head.OwnerEmail = email
+}
+
+func (opml *OPML)SetDateCreated(created time.Time) {
+	opml.Head.DateCreated = created.UTC().Format(time.RFC1123Z)
+}
+
 func (opml *OPML)Outlines() []*Outline {
 	return opml.Body.Outlines
 }
@@ -72,9 +114,47 @@ func (outline Outline)IsSubscription() bool {
 	return outline.FeedURL != ""
 }
 
+// DisplayTitle returns the title as the user last saw it. OPML 2.0
+// makes the text attribute mandatory, and readers (including this
+// one) use it for the user's title of the subscription
+func (outline Outline)DisplayTitle() string {
+	if title := strings.TrimSpace(outline.Text); title != "" {
+		return title
+	}
+
+	return strings.TrimSpace(outline.Title)
+}
+
+// Categories returns the outline's categories, with the
+// surrounding slashes of each category path removed
+func (outline Outline)Categories() []string {
+	categories := make([]string, 0)
+	for _, category := range strings.Split(outline.Category, ",") {
+		if category = strings.Trim(strings.TrimSpace(category), "/"); category != "" {
+			categories = append(categories, category)
+		}
+	}
+
+	return categories
+}
+
+func (outline *Outline)SetCategories(categories []string) {
+	paths := make([]string, 0, len(categories))
+	for _, category := range categories {
+		if category = strings.Trim(category, "/"); category != "" {
+			paths = append(paths, "/" + category)
+		}
+	}
+
+	outline.Category = strings.Join(paths, ",")
+}
+
 func NewOPML() OPML {
 	return OPML {
-		Version: "1.0",
+		Version: "2.0",
+		Head: head {
+			Docs: opmlDocsURL,
+		},
 	}
 }
 
@@ -89,6 +169,7 @@ func NewSubscription(title string, feedURL string, webURL string) *Outline {
 	return &Outline {
 		Text: title,
 		Title: title,
+		Type: "rss",
 		FeedURL: feedURL,
 		WebURL: webURL,
 	}
@@ -103,11 +184,130 @@ func (outline *Outline)Add(child *Outline) {
 }
 
 func ParseOPML(reader io.Reader) (*OPML, error) {
+	opml, _, err := ParseOPMLWithMode(reader, ParseStrict)
+	return opml, err
+}
+
+// ParseOPMLWithMode parses an OPML document. In strict mode, the
+// first malformed outline fails the entire document. In lenient mode,
+// the parser tolerates sloppy markup, and malformed outlines are
+// dropped and returned, along with the reason they were skipped
+func ParseOPMLWithMode(reader io.Reader, mode ParseMode) (*OPML, []SkippedOutline, error) {
 	var opml OPML
+	skipped := make([]SkippedOutline, 0)
+
 	decoder := xml.NewDecoder(reader)
+	decoder.CharsetReader = charset.NewReader
+
+	if mode == ParseLenient {
+		decoder.Strict = false
+		decoder.AutoClose = xml.HTMLAutoClose
+		decoder.Entity = xml.HTMLEntity
+	}
+
 	if err := decoder.Decode(&opml); err != nil {
-		return nil, err
+		if mode == ParseStrict || len(opml.Body.Outlines) < 1 {
+			return nil, nil, err
+		}
+
+		// Keep whatever was read before the error
+		skipped = append(skipped, SkippedOutline {
+			Reason: "Document is incomplete: " + err.Error(),
+		})
+	}
+
+	outlines, err := validOutlines(opml.Body.Outlines, mode, &skipped)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	opml.Body.Outlines = outlines
+
+	return &opml, skipped, nil
+}
+
+func skipOutline(outline *Outline, mode ParseMode, skipped *[]SkippedOutline, reason string) error {
+	if mode == ParseStrict {
+		return errors.New("Invalid outline " + strconv.Quote(outline.DisplayTitle()) + ": " + reason)
+	}
+
+	*skipped = append(*skipped, SkippedOutline {
+		Title: outline.DisplayTitle(),
+		FeedURL: outline.FeedURL,
+		Reason: reason,
+	})
+
+	return nil
+}
+
+func validOutlines(outlines []*Outline, mode ParseMode, skipped *[]SkippedOutline) ([]*Outline, error) {
+	valid := make([]*Outline, 0, len(outlines))
+
+	for _, outline := range outlines {
+		if outline.FeedURL = strings.TrimSpace(outline.FeedURL); outline.IsSubscription() {
+			if feedURL, err := normalizeFeedURL(outline.FeedURL); err != nil {
+				if err := skipOutline(outline, mode, skipped, err.Error()); err != nil {
+					return nil, err
+				}
+				continue
+			} else {
+				outline.FeedURL = feedURL
+			}
+
+			if outline.DisplayTitle() == "" {
+				outline.Text = outline.FeedURL
+			}
+
+			valid = append(valid, outline)
+			continue
+		}
+
+		children, err := validOutlines(outline.Outlines, mode, skipped)
+		if err != nil {
+			return nil, err
+		}
+
+		outline.Outlines = children
+		if len(children) < 1 {
+			if outline.Type != "" && outline.Type != "rss" {
+				// Links, includes, etc. - valid OPML, but not a feed
+				*skipped = append(*skipped, SkippedOutline {
+					Title: outline.DisplayTitle(),
+					Reason: "Unsupported outline type " + strconv.Quote(outline.Type),
+				})
+			}
+			continue // Nothing to import
+		} else if outline.DisplayTitle() == "" {
+			if err := skipOutline(outline, mode, skipped, "Folder has no title"); err != nil {
+				return nil, err
+			}
+
+			// Not nested into anything meaningful - move the
+			// children up a level
+			valid = append(valid, children...)
+			continue
+		}
+
+		valid = append(valid, outline)
+	}
+
+	return valid, nil
+}
+
+func normalizeFeedURL(feedURL string) (string, error) {
+	if strings.HasPrefix(feedURL, "feed://") {
+		feedURL = "http://" + strings.TrimPrefix(feedURL, "feed://")
+	} else if strings.HasPrefix(feedURL, "feed:") {
+		feedURL = strings.TrimPrefix(feedURL, "feed:")
+	}
+
+	if parsedURL, err := url.Parse(feedURL); err != nil {
+		return "", errors.New("Feed URL is malformed")
+	} else if parsedURL.Scheme != "http" && parsedURL.Scheme != "https" {
+		return "", errors.New("Feed URL is not a web address")
+	} else if parsedURL.Host == "" {
+		return "", errors.New("Feed URL has no host")
 	}
 
-	return &opml, nil
+	return feedURL, nil
 }
@@ -0,0 +1,139 @@
+/*****************************************************************************
+ **
+ ** Gofr
+ ** https://github.com/pokebyte/Gofr
+ ** Copyright (C) 2013-2017 Akop Karapetyan
+ **
+ ** This program is free software; you can redistribute it and/or modify
+ ** it under the terms of the GNU General Public License as published by
+ ** the Free Software Foundation; either version 2 of the License, or
+ ** (at your option) any later version.
+ **
+ ** This program is distributed in the hope that it will be useful,
+ ** but WITHOUT ANY WARRANTY; without even the implied warranty of
+ ** MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ ** GNU General Public License for more details.
+ **
+ ** You should have received a copy of the GNU General Public License
+ ** along with this program; if not, write to the Free Software
+ ** Foundation, Inc., 675 Mass Ave, Cambridge, MA 02139, USA.
+ **
+ ******************************************************************************
+ */
+ 
+package rss
+
+import (
+	"bytes"
+	"encoding/xml"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const testOPML = `<?xml version="1.0" encoding="UTF-8"?>
+<opml version="2.0">
+	<head><title>Subscriptions</title></head>
+	<body>
+		<outline text="Top" type="rss" xmlUrl=" feed://example.com/top.xml " category="/news/,/tech"/>
+		<outline text="Blogs">
+			<outline title="Friends">
+				<outline text="" xmlUrl="https://friend.example.com/feed"/>
+			</outline>
+			<outline text="Bad" xmlUrl="ftp://example.com/feed"/>
+		</outline>
+		<outline text="">
+			<outline text="Orphan" xmlUrl="https://orphan.example.com/feed"/>
+		</outline>
+		<outline text="Empty"/>
+		<outline text="A link" type="link" url="https://example.com/"/>
+	</body>
+</opml>`
+
+func TestParseOPMLStrict(t *testing.T) {
+	if _, err := ParseOPML(strings.NewReader(testOPML)); err == nil {
+		t.Errorf("Expected the malformed outline to fail the document")
+	}
+}
+
+func TestParseOPMLLenient(t *testing.T) {
+	opml, skipped, err := ParseOPMLWithMode(strings.NewReader(testOPML), ParseLenient)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	if opml.Title() != "Subscriptions" {
+		t.Errorf("Unexpected title: %q", opml.Title())
+	}
+
+	outlines := opml.Outlines()
+	if len(outlines) != 3 {
+		t.Fatalf("Expected 3 outlines, got %d", len(outlines))
+	}
+
+	top := outlines[0]
+	if !top.IsSubscription() || top.FeedURL != "http://example.com/top.xml" {
+		t.Errorf("Unexpected subscription: %+v", top)
+	}
+	if categories := top.Categories(); !reflect.DeepEqual(categories, []string { "news", "tech" }) {
+		t.Errorf("Unexpected categories: %v", categories)
+	}
+
+	// Nested folders are kept, and untitled subscriptions go by URL
+	blogs := outlines[1]
+	if !blogs.IsFolder() || len(blogs.Outlines) != 1 {
+		t.Fatalf("Unexpected folder: %+v", blogs)
+	}
+	if friends := blogs.Outlines[0]; friends.DisplayTitle() != "Friends" || len(friends.Outlines) != 1 ||
+		friends.Outlines[0].DisplayTitle() != "https://friend.example.com/feed" {
+		t.Errorf("Unexpected subfolder: %+v", friends)
+	}
+
+	// The children of an untitled folder move up
+	if orphan := outlines[2]; orphan.DisplayTitle() != "Orphan" {
+		t.Errorf("Unexpected outline: %+v", orphan)
+	}
+
+	reasons := make([]string, 0, len(skipped))
+	for _, s := range skipped {
+		reasons = append(reasons, s.Title + ": " + s.Reason)
+	}
+	expected := []string {
+		"Bad: Feed URL is not a web address",
+		": Folder has no title",
+		"A link: Unsupported outline type \"link\"",
+	}
+	if !reflect.DeepEqual(reasons, expected) {
+		t.Errorf("Expected %q, got %q", expected, reasons)
+	}
+}
+
+func TestOPMLRoundTrip(t *testing.T) {
+	opml := NewOPML()
+	opml.SetTitle("Export")
+
+	folder := NewFolder("News")
+	subscription := NewSubscription("Example", "https://example.com/feed", "https://example.com/")
+	subscription.SetCategories([]string { "starred", "/later/" })
+	folder.Add(subscription)
+	opml.Add(folder)
+
+	var buf bytes.Buffer
+	if err := xml.NewEncoder(&buf).Encode(opml); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	parsed, err := ParseOPML(&buf)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	if len(parsed.Outlines()) != 1 || len(parsed.Outlines()[0].Outlines) != 1 {
+		t.Fatalf("Unexpected outlines: %+v", parsed.Outlines())
+	}
+
+	parsedSubscription := parsed.Outlines()[0].Outlines[0]
+	if parsedSubscription.FeedURL != subscription.FeedURL || parsedSubscription.Category != "/starred,/later" {
+		t.Errorf("Unexpected subscription: %+v", parsedSubscription)
+	}
+}
@@ -59,6 +59,7 @@ type rss1Entry struct {
 	Author string `xml:"http://purl.org/dc/elements/1.1/ creator"`
 	EncodedContent string `xml:"http://purl.org/rss/1.0/modules/content/ encoded"`
 	Content string `xml:"description"`
+	mediaExtensions
 }
 
 func (nativeFeed *rss1Feed) Marshal() (feed *Feed, err error) {
@@ -116,6 +117,8 @@ func (nativeEntry *rss1Entry) Marshal() (entry *Entry, err error) {
 		Content: content,
 		Published: published,
 		WWWURL: nativeEntry.Link,
+		Media: nativeEntry.mergeMedia(nil),
+		ImageURL: nativeEntry.image(),
 	}
 
 	return entry, err
@@ -51,10 +51,11 @@ type (
 		EncodedContent string `xml:"http://purl.org/rss/1.0/modules/content/ encoded"`
 		Content string `xml:"description"`
 		Enclosures []rss2Enclosure `xml:"enclosure"`
+		mediaExtensions
 	}
 	rss2Enclosure struct {
 		URL string `xml:"url,attr"`
-		Length int `xml:"length,attr"`
+		Length int64 `xml:"length,attr"`
 		Type string `xml:"type,attr"`
 	}
 	timezone struct {
@@ -227,11 +228,15 @@ func (nativeEntry *rss2Entry) Marshal() (entry *Entry, err error) {
 		media := Media {
 			URL: enclosure.URL,
 			Type: enclosure.Type,
+			Size: enclosure.Length,
 		}
 
 		entry.Media[i] = media
 	}
 
+	entry.Media = nativeEntry.mergeMedia(entry.Media)
+	entry.ImageURL = nativeEntry.image()
+
 	return entry, err
 }
 
@@ -0,0 +1,169 @@
+/*****************************************************************************
+ **
+ ** Gofr
+ ** https://github.com/pokebyte/Gofr
+ ** Copyright (C) 2013-2017 Akop Karapetyan
+ **
+ ** This program is free software; you can redistribute it and/or modify
+ ** it under the terms of the GNU General Public License as published by
+ ** the Free Software Foundation; either version 2 of the License, or
+ ** (at your option) any later version.
+ **
+ ** This program is distributed in the hope that it will be useful,
+ ** but WITHOUT ANY WARRANTY; without even the implied warranty of
+ ** MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ ** GNU General Public License for more details.
+ **
+ ** You should have received a copy of the GNU General Public License
+ ** along with this program; if not, write to the Free Software
+ ** Foundation, Inc., 675 Mass Ave, Cambridge, MA 02139, USA.
+ **
+ ******************************************************************************
+ */
+ 
+ 
+package gofr
+
+import (
+	"encoding/json"
+	"net/http"
+	"storage"
+	"unicode/utf8"
+)
+
+const (
+	// Articles a rule is tried against in a dry run
+	filterRulePreviewSize = 500
+	maxFilterRuleTitleLength = 200
+)
+
+type filterRulePreview struct {
+	Scanned int                `json:"scanned"`
+	Matches []storage.Article  `json:"matches"`
+}
+
+func registerFilterRules() {
+	RegisterJSONRoute("/filterRules",       filterRules)
+	RegisterJSONRoute("/saveFilterRule",    saveFilterRule)
+	RegisterJSONRoute("/removeFilterRule",  removeFilterRule)
+	RegisterJSONRoute("/previewFilterRule", previewFilterRule)
+}
+
+func filterRules(pfc *PFContext) (interface{}, error) {
+	return pfc.Storage.FilterRules(pfc.UserID)
+}
+
+// saveFilterRule creates a rule (or replaces one, if the rule has
+// an ID). Rules only act on articles that arrive after they're saved
+func saveFilterRule(pfc *PFContext) (interface{}, error) {
+	rule, err := filterRuleFromRequest(pfc)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := pfc.Storage.SaveFilterRule(&rule); err != nil {
+		return nil, NewReadableError(_l("An error occurred while saving the rule"), &err)
+	}
+
+	return pfc.Storage.FilterRules(pfc.UserID)
+}
+
+func removeFilterRule(pfc *PFContext) (interface{}, error) {
+	ruleID := pfc.R.PostFormValue("rule")
+	if ruleID == "" {
+		return nil, NewReadableError(_l("Rule not found"), nil)
+	}
+
+	if err := pfc.Storage.DeleteFilterRule(pfc.UserID, ruleID); err != nil {
+		return nil, NewReadableError(_l("An error occurred while removing the rule"), &err)
+	}
+
+	return pfc.Storage.FilterRules(pfc.UserID)
+}
+
+// previewFilterRule is a dry run of a rule against the user's most
+// recent articles. Nothing is changed; the articles the rule would
+// have acted on are returned
+func previewFilterRule(pfc *PFContext) (interface{}, error) {
+	rule, err := filterRuleFromRequest(pfc)
+	if err != nil {
+		return nil, err
+	}
+
+	userSubscriptions, err := pfc.Storage.NewUserSubscriptions(pfc.UserID)
+	if err != nil {
+		return nil, err
+	}
+
+	folderIDs := make(map[string]string)
+	for _, subscription := range userSubscriptions.Subscriptions {
+		folderIDs[subscription.ID] = subscription.Parent
+	}
+
+	rules := storage.NewFilterRuleSet([]storage.FilterRule { rule }, userSubscriptions.Folders)
+	preview := filterRulePreview {
+		Matches: make([]storage.Article, 0),
+	}
+
+	filter := storage.ArticleFilter {
+		ArticleScope: storage.ArticleScope {
+			FolderRef: storage.FolderRef {
+				UserID: pfc.UserID,
+			},
+		},
+	}
+
+	for start := ""; preview.Scanned < filterRulePreviewSize; {
+		page, err := pfc.Storage.NewArticlePage(filter, start)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, article := range page.Articles {
+			if preview.Scanned >= filterRulePreviewSize {
+				break
+			}
+
+			preview.Scanned++
+			if !rules.Covers(folderIDs[article.Source], article.Source) || article.Details == nil {
+				continue
+			} else if len(rules.Matching(article.Details, article.Media)) > 0 {
+				preview.Matches = append(preview.Matches, article)
+			}
+		}
+
+		if start = page.Continue; start == "" {
+			break
+		}
+	}
+
+	return preview, nil
+}
+
+func filterRuleFromRequest(pfc *PFContext) (storage.FilterRule, error) {
+	rule := storage.FilterRule{}
+	if err := json.Unmarshal([]byte(pfc.R.PostFormValue("rule")), &rule); err != nil {
+		return rule, NewReadableErrorWithCode(_l("Rule not valid"), http.StatusBadRequest, &err)
+	}
+
+	rule.UserID = pfc.UserID
+	if err := rule.Validate(); err != nil {
+		return rule, NewReadableErrorWithCode(_l("Rule not valid: %s", err), http.StatusBadRequest, nil)
+	} else if utf8.RuneCountInString(rule.Title) > maxFilterRuleTitleLength {
+		return rule, NewReadableErrorWithCode(_l("Rule name is too long"), http.StatusBadRequest, nil)
+	}
+
+	if rule.FolderID != "" {
+		folderRef := storage.FolderRef {
+			UserID: pfc.UserID,
+			FolderID: rule.FolderID,
+		}
+		if exists, err := pfc.Storage.FolderExists(folderRef); err != nil {
+			return rule, err
+		} else if !exists {
+			return rule, NewReadableError(_l("Folder not found"), nil)
+		}
+	}
+
+	return rule, nil
+}
@@ -0,0 +1,313 @@
+// +build !appengine
+
+/*****************************************************************************
+ **
+ ** Gofr
+ ** https://github.com/pokebyte/Gofr
+ ** Copyright (C) 2013-2017 Akop Karapetyan
+ **
+ ** This program is free software; you can redistribute it and/or modify
+ ** it under the terms of the GNU General Public License as published by
+ ** the Free Software Foundation; either version 2 of the License, or
+ ** (at your option) any later version.
+ **
+ ** This program is distributed in the hope that it will be useful,
+ ** but WITHOUT ANY WARRANTY; without even the implied warranty of
+ ** MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ ** GNU General Public License for more details.
+ **
+ ** You should have received a copy of the GNU General Public License
+ ** along with this program; if not, write to the Free Software
+ ** Foundation, Inc., 675 Mass Ave, Cambridge, MA 02139, USA.
+ **
+ ******************************************************************************
+ */
+ 
+package gofr
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"storage"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	maxUploadBytes = 32 << 20
+	uploadPrefix = "gofr-upload-"
+)
+
+var (
+	errInvalidUploadKey = errors.New("Invalid upload key")
+)
+
+// ServerConfig configures a standalone server
+type ServerConfig struct {
+	// Storage holds the reader's data
+	Storage storage.Repository
+	// BaseURL is the public URL of the server, used to build
+	// WebSub callbacks
+	BaseURL string
+	// ContentDir is the directory static content is served from
+	ContentDir string
+	// UploadDir is where uploaded files are kept until processed.
+	// Defaults to the system's temporary directory
+	UploadDir string
+	// Authenticators are the login providers users can sign in
+	// with. Defaults to local accounts, open to sign-up
+	Authenticators []Authenticator
+	// DevMode relaxes update limits, as on the App Engine dev server
+	DevMode bool
+	// Retention is the retention policy of feeds without one of
+	// their own. Defaults to DefaultRetentionPolicy
+	Retention *storage.RetentionPolicy
+	// FeedRetention overrides the retention policy of feeds, by URL.
+	// The overrides are saved when the server is created, and last
+	// until replaced; a nil policy removes one
+	FeedRetention map[string]*storage.RetentionPolicy
+	// UndoWindow is how long destructive operations can be undone.
+	// Defaults to UndoWindow
+	UndoWindow time.Duration
+	// Logger receives log output. Defaults to the standard logger
+	Logger *log.Logger
+}
+
+// Server runs the reader on net/http, replacing App Engine's
+// services with in-process equivalents: the standard HTTP client, in-process task queues, a cron scheduler and
+// server-sent events for push. Users sign in through the
+// configured Authenticators
+type Server struct {
+	config ServerConfig
+	content http.Handler
+	transport http.RoundTripper
+
+	queues map[string]*taskQueue
+	channels *channelHub
+	stop chan bool
+	waitGroup sync.WaitGroup
+}
+
+var routeRegistration sync.Once
+
+// NewServer creates a standalone server. Call Start to begin
+// processing background tasks and scheduled jobs
+func NewServer(config ServerConfig) *Server {
+	if config.Authenticators == nil {
+		config.Authenticators = []Authenticator { &LocalAuthenticator { AllowSignup: true } }
+	}
+
+	routeRegistration.Do(func() {
+		registerRoutes()
+		for _, authenticator := range config.Authenticators {
+			RegisterAuthenticator(authenticator)
+		}
+	})
+
+	if config.Retention != nil {
+		DefaultRetentionPolicy = *config.Retention
+	}
+	if config.UndoWindow > 0 {
+		UndoWindow = config.UndoWindow
+	}
+
+	if config.ContentDir == "" {
+		config.ContentDir = "content"
+	}
+	if config.UploadDir == "" {
+		config.UploadDir = os.TempDir()
+	}
+	if config.Logger == nil {
+		config.Logger = log.New(os.Stderr, "", log.LstdFlags)
+	}
+	config.BaseURL = strings.TrimSuffix(config.BaseURL, "/")
+
+	for feedURL, policy := range config.FeedRetention {
+		if err := config.Storage.SetFeedRetentionPolicy(feedURL, policy); err != nil {
+			config.Logger.Printf("Error saving retention policy of %s: %s", feedURL, err)
+		}
+	}
+
+	server := &Server {
+		config: config,
+		content: http.StripPrefix("/content/", http.FileServer(http.Dir(config.ContentDir))),
+		transport: http.DefaultTransport,
+		queues: make(map[string]*taskQueue),
+		channels: newChannelHub(),
+		stop: make(chan bool),
+	}
+
+	for _, queueName := range []string { subscriptionQueue, importQueue, refreshQueue, modificationQueue } {
+		server.queues[queueName] = newTaskQueue(server, queueName)
+	}
+
+	return server
+}
+
+func (s *Server)ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch path := r.URL.Path; {
+	case strings.HasPrefix(path, "/content/"):
+		s.content.ServeHTTP(w, r)
+	case path == "/favicon.ico":
+		http.ServeFile(w, r, filepath.Join(s.config.ContentDir, "favicon.ico"))
+	case path == channelScriptPath:
+		s.channelScript(w, r)
+	case path == channelEventsPath:
+		s.channelEvents(w, r)
+	case strings.HasPrefix(path, "/tasks/"), strings.HasPrefix(path, "/cron/"):
+		// Only reachable through the task queue and scheduler
+		http.Error(w, "Forbidden", http.StatusForbidden)
+	default:
+		s.serve(w, r)
+	}
+}
+
+// serve routes a request to the reader's handlers
+func (s *Server)serve(w http.ResponseWriter, r *http.Request) {
+	platform := &standalonePlatform {
+		server: s,
+		r: r,
+	}
+
+	pfc := PFContext {
+		R: r,
+		C: serverContext { s.config.Logger },
+		W: w,
+		Platform: platform,
+		Storage: s.config.Storage,
+		LoginURL: loginURL(r.URL.String()),
+	}
+
+	routeRequest(&pfc)
+}
+
+// serverContext logs through the server's logger
+type serverContext struct {
+	logger *log.Logger
+}
+
+func (c serverContext)logf(level string, format string, args ...interface{}) {
+	c.logger.Printf(level + ": " + format, args...)
+}
+
+func (c serverContext)Debugf(format string, args ...interface{}) {
+	c.logf("DEBUG", format, args...)
+}
+
+func (c serverContext)Infof(format string, args ...interface{}) {
+	c.logf("INFO", format, args...)
+}
+
+func (c serverContext)Warningf(format string, args ...interface{}) {
+	c.logf("WARNING", format, args...)
+}
+
+func (c serverContext)Errorf(format string, args ...interface{}) {
+	c.logf("ERROR", format, args...)
+}
+
+func (c serverContext)Criticalf(format string, args ...interface{}) {
+	c.logf("CRITICAL", format, args...)
+}
+
+// standalonePlatform provides the reader's services for a request
+// served by a standalone Server
+type standalonePlatform struct {
+	server *Server
+	r *http.Request
+}
+
+func (p *standalonePlatform)HTTPClient() *http.Client {
+	return &http.Client {
+		Transport: p.server.transport,
+		Timeout: time.Duration(fetchDeadlineSeconds) * time.Second,
+	}
+}
+
+func (p *standalonePlatform)AddTask(path string, values url.Values, queueName string) error {
+	if queue, ok := p.server.queues[queueName]; !ok {
+		return fmt.Errorf("Unknown task queue: %s", queueName)
+	} else {
+		return queue.Add(path, values)
+	}
+}
+
+func (p *standalonePlatform)CreateChannel(clientID string) (string, error) {
+	return p.server.channels.Create(clientID)
+}
+
+func (p *standalonePlatform)SendChannelMessage(clientID string, message interface{}) error {
+	return p.server.channels.Send(clientID, message)
+}
+
+func (p *standalonePlatform)UploadURL(path string) (string, error) {
+	return path, nil
+}
+
+func (p *standalonePlatform)ParseUpload(r *http.Request, field string) (string, url.Values, error) {
+	if err := r.ParseMultipartForm(maxUploadBytes); err != nil {
+		return "", nil, err
+	}
+
+	other := url.Values(r.MultipartForm.Value)
+	file, _, err := r.FormFile(field)
+	if err == http.ErrMissingFile {
+		return "", other, nil
+	} else if err != nil {
+		return "", nil, err
+	}
+	defer file.Close()
+
+	upload, err := ioutil.TempFile(p.server.config.UploadDir, uploadPrefix)
+	if err != nil {
+		return "", nil, err
+	}
+	defer upload.Close()
+
+	if _, err := io.Copy(upload, file); err != nil {
+		os.Remove(upload.Name())
+		return "", nil, err
+	}
+
+	return filepath.Base(upload.Name()), other, nil
+}
+
+func (p *standalonePlatform)uploadPath(key string) (string, error) {
+	if !strings.HasPrefix(key, uploadPrefix) || filepath.Base(key) != key {
+		return "", errInvalidUploadKey
+	}
+
+	return filepath.Join(p.server.config.UploadDir, key), nil
+}
+
+func (p *standalonePlatform)OpenUpload(key string) (io.ReadCloser, error) {
+	if path, err := p.uploadPath(key); err != nil {
+		return nil, err
+	} else {
+		return os.Open(path)
+	}
+}
+
+func (p *standalonePlatform)DeleteUpload(key string) error {
+	if path, err := p.uploadPath(key); err != nil {
+		return err
+	} else {
+		return os.Remove(path)
+	}
+}
+
+func (p *standalonePlatform)BaseURL() string {
+	return p.server.config.BaseURL
+}
+
+func (p *standalonePlatform)IsDevServer() bool {
+	return p.server.config.DevMode
+}
@@ -0,0 +1,412 @@
+// +build !appengine
+
+/*****************************************************************************
+ **
+ ** Gofr
+ ** https://github.com/pokebyte/Gofr
+ ** Copyright (C) 2013-2017 Akop Karapetyan
+ **
+ ** This program is free software; you can redistribute it and/or modify
+ ** it under the terms of the GNU General Public License as published by
+ ** the Free Software Foundation; either version 2 of the License, or
+ ** (at your option) any later version.
+ **
+ ** This program is distributed in the hope that it will be useful,
+ ** but WITHOUT ANY WARRANTY; without even the implied warranty of
+ ** MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ ** GNU General Public License for more details.
+ **
+ ** You should have received a copy of the GNU General Public License
+ ** along with this program; if not, write to the Free Software
+ ** Foundation, Inc., 675 Mass Ave, Cambridge, MA 02139, USA.
+ **
+ ******************************************************************************
+ */
+ 
+package gofr
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// Mirror the limits in queue.yaml
+	taskQueueRate = 10
+	taskQueueWorkers = 10
+	taskQueueCapacity = 1000
+
+	// Failed tasks are retried up to taskRetryLimit times, waiting
+	// taskMinBackoff before the first retry, twice as long before
+	// each one after
+	taskRetryLimit = 5
+	taskMinBackoff = time.Second
+
+	channelScriptPath = "/_ah/channel/jsapi"
+	channelEventsPath = "/_ah/channel/events"
+	channelBufferSize = 16
+	channelKeepAlive = 30 * time.Second
+	channelTokenLifetime = 2 * time.Hour
+)
+
+// cronJobs mirrors the schedule in cron.yaml
+var cronJobs = []struct {
+	Path string
+	Interval time.Duration
+} {
+	{ "/cron/updateFeeds", 10 * time.Minute },
+	{ "/cron/renewHubSubscriptions", 6 * time.Hour },
+	{ "/cron/updateUnreadCounts", 12 * time.Hour },
+	{ "/cron/reconcileArticleCounts", 12 * time.Hour },
+	{ "/cron/purgeEntries", 24 * time.Hour },
+	{ "/cron/sweepUndoRecords", time.Hour },
+}
+
+// Start begins processing queued tasks and running scheduled jobs
+func (s *Server)Start() {
+	for _, queue := range s.queues {
+		s.waitGroup.Add(1)
+		go queue.run()
+	}
+
+	for _, job := range cronJobs {
+		s.waitGroup.Add(1)
+		go s.runCronJob(job.Path, job.Interval)
+	}
+}
+
+// Stop waits for running tasks and jobs to complete, and disconnects
+// push clients. Tasks still in the queue are discarded
+func (s *Server)Stop() {
+	close(s.stop)
+	s.waitGroup.Wait()
+}
+
+func (s *Server)runCronJob(path string, interval time.Duration) {
+	defer s.waitGroup.Done()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-ticker.C:
+			s.dispatch("GET", path, nil)
+		}
+	}
+}
+
+// taskResponseWriter collects the status of a task or job, whose
+// output would otherwise go to App Engine's logs
+type taskResponseWriter struct {
+	header http.Header
+	status int
+}
+
+func (w *taskResponseWriter)Header() http.Header {
+	return w.header
+}
+
+func (w *taskResponseWriter)Write(bytes []byte) (int, error) {
+	return len(bytes), nil
+}
+
+func (w *taskResponseWriter)WriteHeader(status int) {
+	w.status = status
+}
+
+// dispatch runs a task or job by routing a request to its handler
+// directly, bypassing ServeHTTP (which refuses outside requests).
+// Returns false if it failed
+func (s *Server)dispatch(method string, path string, values url.Values) bool {
+	r, err := http.NewRequest(method, path, strings.NewReader(values.Encode()))
+	if err != nil {
+		s.config.Logger.Printf("ERROR: Cannot create request for %s: %s", path, err)
+		return false
+	}
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	w := &taskResponseWriter {
+		header: make(http.Header),
+		status: http.StatusOK,
+	}
+
+	s.serve(w, r)
+	if w.status >= 400 {
+		s.config.Logger.Printf("ERROR: %s failed (HTTP %d)", path, w.status)
+		return false
+	}
+
+	return true
+}
+
+type queuedTask struct {
+	Path string
+	Values url.Values
+	Retries int
+}
+
+// taskQueue runs tasks in the background, at a limited rate. Failed
+// tasks (those responding with an error status) are retried with
+// exponential backoff, up to taskRetryLimit times
+type taskQueue struct {
+	server *Server
+	name string
+	tasks chan queuedTask
+}
+
+func newTaskQueue(server *Server, name string) *taskQueue {
+	return &taskQueue {
+		server: server,
+		name: name,
+		tasks: make(chan queuedTask, taskQueueCapacity),
+	}
+}
+
+// Add queues a task, failing if the queue is full
+func (queue *taskQueue)Add(path string, values url.Values) error {
+	return queue.enqueue(queuedTask { Path: path, Values: values })
+}
+
+func (queue *taskQueue)enqueue(task queuedTask) error {
+	select {
+	case queue.tasks <- task:
+		return nil
+	default:
+		return fmt.Errorf("Task queue %s is full", queue.name)
+	}
+}
+
+// retry queues a failed task again once its backoff has elapsed,
+// unless it's out of retries or the server has stopped by then
+func (queue *taskQueue)retry(task queuedTask) {
+	logger := queue.server.config.Logger
+	if task.Retries >= taskRetryLimit {
+		logger.Printf("ERROR: %s failed %d times - giving up", task.Path, task.Retries + 1)
+		return
+	}
+
+	backoff := taskMinBackoff << uint(task.Retries)
+	task.Retries++
+
+	time.AfterFunc(backoff, func() {
+		select {
+		case <-queue.server.stop:
+			return
+		default:
+		}
+
+		if err := queue.enqueue(task); err != nil {
+			logger.Printf("ERROR: Cannot retry %s: %s", task.Path, err)
+		}
+	})
+}
+
+func (queue *taskQueue)run() {
+	defer queue.server.waitGroup.Done()
+
+	ticker := time.NewTicker(time.Second / taskQueueRate)
+	defer ticker.Stop()
+
+	slots := make(chan bool, taskQueueWorkers)
+	var running sync.WaitGroup
+	defer running.Wait()
+
+	for {
+		select {
+		case <-queue.server.stop:
+			return
+		case task := <-queue.tasks:
+			<-ticker.C
+			slots <- true
+
+			running.Add(1)
+			go func() {
+				defer func() {
+					<-slots
+					running.Done()
+				}()
+
+				if !queue.server.dispatch("POST", task.Path, task.Values) {
+					queue.retry(task)
+				}
+			}()
+		}
+	}
+}
+
+type channelToken struct {
+	ClientID string
+	Expires time.Time
+}
+
+// channelHub delivers push messages to clients connected over
+// server-sent events
+type channelHub struct {
+	tokens map[string]channelToken
+	clients map[string]chan []byte
+	mutex sync.Mutex
+}
+
+func newChannelHub() *channelHub {
+	return &channelHub {
+		tokens: make(map[string]channelToken),
+		clients: make(map[string]chan []byte),
+	}
+}
+
+// Create returns a single-use token that connects a client to
+// its channel
+func (hub *channelHub)Create(clientID string) (string, error) {
+	token, err := randomToken()
+	if err != nil {
+		return "", err
+	}
+
+	hub.mutex.Lock()
+	defer hub.mutex.Unlock()
+
+	now := time.Now()
+	for t, channelToken := range hub.tokens {
+		if now.After(channelToken.Expires) {
+			delete(hub.tokens, t)
+		}
+	}
+
+	hub.tokens[token] = channelToken {
+		ClientID: clientID,
+		Expires: now.Add(channelTokenLifetime),
+	}
+
+	return token, nil
+}
+
+// Send pushes a message to a client. Messages to clients that
+// aren't connected are dropped
+func (hub *channelHub)Send(clientID string, message interface{}) error {
+	bf, err := json.Marshal(message)
+	if err != nil {
+		return err
+	}
+
+	hub.mutex.Lock()
+	defer hub.mutex.Unlock()
+
+	if messages, ok := hub.clients[clientID]; ok {
+		select {
+		case messages <- bf:
+		default:
+			return fmt.Errorf("Channel %s is full", clientID)
+		}
+	}
+
+	return nil
+}
+
+func (hub *channelHub)connect(token string) (string, chan []byte, bool) {
+	hub.mutex.Lock()
+	defer hub.mutex.Unlock()
+
+	channelToken, ok := hub.tokens[token]
+	if !ok || time.Now().After(channelToken.Expires) {
+		return "", nil, false
+	}
+	delete(hub.tokens, token)
+
+	messages := make(chan []byte, channelBufferSize)
+	hub.clients[channelToken.ClientID] = messages
+
+	return channelToken.ClientID, messages, true
+}
+
+func (hub *channelHub)disconnect(clientID string, messages chan []byte) {
+	hub.mutex.Lock()
+	defer hub.mutex.Unlock()
+
+	if hub.clients[clientID] == messages {
+		delete(hub.clients, clientID)
+	}
+}
+
+func (s *Server)channelEvents(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming not supported", http.StatusInternalServerError)
+		return
+	}
+
+	clientID, messages, ok := s.channels.connect(r.FormValue("token"))
+	if !ok {
+		http.Error(w, "Invalid token", http.StatusForbidden)
+		return
+	}
+	defer s.channels.disconnect(clientID, messages)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(channelKeepAlive)
+	defer keepAlive.Stop()
+
+	for {
+		select {
+		case message := <-messages:
+			fmt.Fprintf(w, "data: %s\n\n", message)
+		case <-keepAlive.C:
+			io.WriteString(w, ": keep-alive\n\n")
+		case <-r.Context().Done():
+			return
+		case <-s.stop:
+			return
+		}
+
+		flusher.Flush()
+	}
+}
+
+// channelScript stands in for App Engine's Channel JavaScript API,
+// implementing goog.appengine.Channel on top of EventSource
+const channelScript = `var goog = goog || {};
+goog.appengine = goog.appengine || {};
+goog.appengine.Channel = function(token) {
+	this.token = token;
+};
+goog.appengine.Channel.prototype.open = function() {
+	var socket = {};
+	var source = new EventSource('` + channelEventsPath + `?token=' + encodeURIComponent(this.token));
+	source.onopen = function() {
+		if (socket.onopen)
+			socket.onopen();
+	};
+	source.onmessage = function(e) {
+		if (socket.onmessage)
+			socket.onmessage({ data: e.data });
+	};
+	source.onerror = function(e) {
+		source.close();
+		if (socket.onerror)
+			socket.onerror(e);
+		if (socket.onclose)
+			socket.onclose();
+	};
+	socket.close = function() {
+		source.close();
+	};
+	return socket;
+};
+`
+
+func (s *Server)channelScript(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-type", "application/javascript; charset=utf-8")
+	io.WriteString(w, channelScript)
+}
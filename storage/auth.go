@@ -0,0 +1,221 @@
+// +build appengine
+
+/*****************************************************************************
+ **
+ ** Gofr
+ ** https://github.com/pokebyte/Gofr
+ ** Copyright (C) 2013-2017 Akop Karapetyan
+ **
+ ** This program is free software; you can redistribute it and/or modify
+ ** it under the terms of the GNU General Public License as published by
+ ** the Free Software Foundation; either version 2 of the License, or
+ ** (at your option) any later version.
+ **
+ ** This program is distributed in the hope that it will be useful,
+ ** but WITHOUT ANY WARRANTY; without even the implied warranty of
+ ** MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ ** GNU General Public License for more details.
+ **
+ ** You should have received a copy of the GNU General Public License
+ ** along with this program; if not, write to the Free Software
+ ** Foundation, Inc., 675 Mass Ave, Cambridge, MA 02139, USA.
+ **
+ ******************************************************************************
+ */
+ 
+package storage
+
+import (
+	"appengine"
+	"appengine/datastore"
+	"strings"
+	"time"
+)
+
+func (identity LoginIdentity)key(c appengine.Context) *datastore.Key {
+	return datastore.NewKey(c, "LoginIdentity", identity.Provider + ":" + identity.Subject, 0, nil)
+}
+
+func (account LocalAccount)key(c appengine.Context) *datastore.Key {
+	return datastore.NewKey(c, "LocalAccount", strings.ToLower(account.Username), 0, nil)
+}
+
+func sessionKey(c appengine.Context, sessionID string) *datastore.Key {
+	return datastore.NewKey(c, "Session", sessionID, 0, nil)
+}
+
+func loginFailuresKey(c appengine.Context, account string) *datastore.Key {
+	return datastore.NewKey(c, "LoginFailures", strings.ToLower(account), 0, nil)
+}
+
+func (ds *Datastore)IdentityByLogin(provider string, subject string) (*LoginIdentity, error) {
+	c := ds.c
+	identity := LoginIdentity {
+		Provider: provider,
+		Subject: subject,
+	}
+
+	if err := datastore.Get(c, identity.key(c), &identity); err == nil || IsFieldMismatch(err) {
+		return &identity, nil
+	} else if err != datastore.ErrNoSuchEntity {
+		return nil, err
+	}
+
+	return nil, nil
+}
+
+func (ds *Datastore)IdentitiesForUser(userID UserID) ([]LoginIdentity, error) {
+	c := ds.c
+	var identities []LoginIdentity
+
+	q := datastore.NewQuery("LoginIdentity").Filter("UserID =", string(userID))
+	keys, err := q.GetAll(c, &identities)
+	if err != nil && !IsFieldMismatch(err) {
+		return nil, err
+	}
+
+	for i, key := range keys {
+		if parts := strings.SplitN(key.StringID(), ":", 2); len(parts) == 2 {
+			identities[i].Provider, identities[i].Subject = parts[0], parts[1]
+		}
+	}
+
+	return identities, nil
+}
+
+func (ds *Datastore)SaveIdentity(identity LoginIdentity) error {
+	c := ds.c
+	if _, err := datastore.Put(c, identity.key(c), &identity); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (ds *Datastore)DeleteIdentity(identity LoginIdentity) error {
+	c := ds.c
+	return datastore.Delete(c, identity.key(c))
+}
+
+func (ds *Datastore)LocalAccountByUsername(username string) (*LocalAccount, error) {
+	c := ds.c
+	account := LocalAccount {
+		Username: username,
+	}
+
+	if err := datastore.Get(c, account.key(c), &account); err == nil || IsFieldMismatch(err) {
+		return &account, nil
+	} else if err != datastore.ErrNoSuchEntity {
+		return nil, err
+	}
+
+	return nil, nil
+}
+
+func (ds *Datastore)CreateLocalAccount(account LocalAccount) error {
+	c := ds.c
+	key := account.key(c)
+
+	return datastore.RunInTransaction(c, func(c appengine.Context) error {
+		existing := LocalAccount{}
+		if err := datastore.Get(c, key, &existing); err == nil || IsFieldMismatch(err) {
+			return ErrDuplicate
+		} else if err != datastore.ErrNoSuchEntity {
+			return err
+		}
+
+		if _, err := datastore.Put(c, key, &account); err != nil {
+			return err
+		}
+
+		return nil
+	}, nil)
+}
+
+func (ds *Datastore)SessionByID(sessionID string) (*Session, error) {
+	c := ds.c
+	session := Session {
+		ID: sessionID,
+	}
+
+	if err := datastore.Get(c, sessionKey(c, sessionID), &session); err == nil || IsFieldMismatch(err) {
+		return &session, nil
+	} else if err != datastore.ErrNoSuchEntity {
+		return nil, err
+	}
+
+	return nil, nil
+}
+
+func (ds *Datastore)SaveSession(session Session) error {
+	c := ds.c
+	if _, err := datastore.Put(c, sessionKey(c, session.ID), &session); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (ds *Datastore)DeleteSession(sessionID string) error {
+	c := ds.c
+	if err := datastore.Delete(c, sessionKey(c, sessionID)); err != nil && err != datastore.ErrNoSuchEntity {
+		return err
+	}
+
+	return nil
+}
+
+func (ds *Datastore)LoginFailures(account string) (*LoginFailures, error) {
+	c := ds.c
+	failures := LoginFailures {
+		Account: account,
+	}
+
+	if err := datastore.Get(c, loginFailuresKey(c, account), &failures); err == nil || IsFieldMismatch(err) {
+		return &failures, nil
+	} else if err != datastore.ErrNoSuchEntity {
+		return nil, err
+	}
+
+	return nil, nil
+}
+
+// RecordLoginFailure counts a failed attempt to sign in to the
+// account. Once the window has passed since the first one counted,
+// counting starts over
+func (ds *Datastore)RecordLoginFailure(account string, window time.Duration) (*LoginFailures, error) {
+	c := ds.c
+	key := loginFailuresKey(c, account)
+	failures := LoginFailures{}
+
+	err := datastore.RunInTransaction(c, func(c appengine.Context) error {
+		failures = LoginFailures {
+			Account: account,
+		}
+		if err := datastore.Get(c, key, &failures); err != nil && err != datastore.ErrNoSuchEntity && !IsFieldMismatch(err) {
+			return err
+		}
+
+		failures.Record(time.Now(), window)
+		if _, err := datastore.Put(c, key, &failures); err != nil {
+			return err
+		}
+
+		return nil
+	}, nil)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &failures, nil
+}
+
+func (ds *Datastore)ClearLoginFailures(account string) error {
+	c := ds.c
+	if err := datastore.Delete(c, loginFailuresKey(c, account)); err != nil && err != datastore.ErrNoSuchEntity {
+		return err
+	}
+
+	return nil
+}
@@ -1,3 +1,5 @@
+// +build appengine
+
 /*****************************************************************************
  **
  ** Gofr
@@ -113,3 +115,97 @@ func (writer *BatchWriter)Close() error {
 func (writer BatchWriter)Written() int {
 	return writer.written
 }
+
+// articleWriter writes a user's articles in batches, each in a
+// (cross-group) transaction along with its share of the changes to
+// article counts, and a check of the lease on the user
+type articleWriter struct {
+	c appengine.Context
+	lease Lease
+	userKey *datastore.Key
+	keys []*datastore.Key
+	articles []*articleEntity
+	deleted []*datastore.Key
+	written int
+
+	// Deltas collects the changes to article counts due to the
+	// articles enqueued since the last flush
+	Deltas ArticleCountDeltas
+}
+
+func newArticleWriter(c appengine.Context, lease Lease, userKey *datastore.Key) *articleWriter {
+	return &articleWriter {
+		c: c,
+		lease: lease,
+		userKey: userKey,
+		keys: make([]*datastore.Key, 0, defaultBatchSize),
+		articles: make([]*articleEntity, 0, defaultBatchSize),
+		Deltas: ArticleCountDeltas{},
+	}
+}
+
+func (writer *articleWriter)Enqueue(key *datastore.Key, article *articleEntity) error {
+	writer.keys = append(writer.keys, key)
+	writer.articles = append(writer.articles, article)
+
+	return writer.flushIfFull()
+}
+
+// EnqueueMove writes the article under a new key, deleting the old
+// one in the same batch
+func (writer *articleWriter)EnqueueMove(from *datastore.Key, to *datastore.Key, article *articleEntity) error {
+	writer.deleted = append(writer.deleted, from)
+	writer.keys = append(writer.keys, to)
+	writer.articles = append(writer.articles, article)
+
+	return writer.flushIfFull()
+}
+
+func (writer *articleWriter)flushIfFull() error {
+	if len(writer.keys) + len(writer.deleted) >= defaultBatchSize {
+		return writer.Flush()
+	}
+
+	return nil
+}
+
+func (writer *articleWriter)Flush() error {
+	if len(writer.keys) == 0 && len(writer.deleted) == 0 && len(writer.Deltas) == 0 {
+		return nil
+	}
+
+	var remaining ArticleCountDeltas
+	err := datastore.RunInTransaction(writer.c, func(c appengine.Context) error {
+		if err := checkLease(c, writer.lease); err != nil {
+			return err
+		} else if _, err := datastore.PutMulti(c, writer.keys, writer.articles); err != nil {
+			return err
+		} else if err := datastore.DeleteMulti(c, writer.deleted); err != nil {
+			return err
+		}
+
+		var err error
+		remaining, err = addToArticleCounts(c, writer.userKey, writer.Deltas)
+		return err
+	}, &datastore.TransactionOptions { XG: true })
+
+	if err != nil {
+		return err
+	}
+
+	if err := updateArticleCounts(writer.c, writer.userKey, remaining); err != nil {
+		writer.c.Warningf("Error updating article counts: %s", err)
+	}
+
+	writer.written += len(writer.keys)
+	writer.keys = writer.keys[:0]
+	writer.articles = writer.articles[:0]
+	writer.deleted = writer.deleted[:0]
+	writer.Deltas = ArticleCountDeltas{}
+
+	return nil
+}
+
+func (writer articleWriter)Written() int {
+	return writer.written
+}
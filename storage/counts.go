@@ -0,0 +1,317 @@
+// +build appengine
+
+/*****************************************************************************
+ **
+ ** Gofr
+ ** https://github.com/pokebyte/Gofr
+ ** Copyright (C) 2013-2017 Akop Karapetyan
+ **
+ ** This program is free software; you can redistribute it and/or modify
+ ** it under the terms of the GNU General Public License as published by
+ ** the Free Software Foundation; either version 2 of the License, or
+ ** (at your option) any later version.
+ **
+ ** This program is distributed in the hope that it will be useful,
+ ** but WITHOUT ANY WARRANTY; without even the implied warranty of
+ ** MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ ** GNU General Public License for more details.
+ **
+ ** You should have received a copy of the GNU General Public License
+ ** along with this program; if not, write to the Free Software
+ ** Foundation, Inc., 675 Mass Ave, Cambridge, MA 02139, USA.
+ **
+ ******************************************************************************
+ */
+ 
+package storage
+
+import (
+	"appengine"
+	"appengine/datastore"
+	"fmt"
+	"math/rand"
+)
+
+// Article counts are kept on sharded counters, like like counts.
+// They follow the articles as stored - articles covered by a read
+// range count as unread until the range is applied. The articles of
+// removed subscriptions (kept until their undo record is discarded)
+// don't count
+
+// userKeyOf returns the key of the user the entity belongs to
+func userKeyOf(key *datastore.Key) *datastore.Key {
+	for key.Parent() != nil {
+		key = key.Parent()
+	}
+
+	return key
+}
+
+func articleCountShardKey(c appengine.Context, userKey *datastore.Key, counter string, shard int) *datastore.Key {
+	shardName := fmt.Sprintf("%s#%s#%d", userKey.StringID(), counter, shard)
+	return datastore.NewKey(c, "ArticleCountShard", shardName, 0, nil)
+}
+
+// Counters changed within a cross-group transaction, at most. Each
+// shard is an entity group of its own, and a transaction spans up to
+// 25 - the rest are left for the one making the change
+const maxCountersPerTransaction = 23
+
+// addToArticleCount applies the delta to a random shard of the
+// counter. Within a transaction, the shard is updated as part of it
+func addToArticleCount(c appengine.Context, userKey *datastore.Key, counter string, delta ArticleCounts) error {
+	key := articleCountShardKey(c, userKey, counter, rand.Intn(articleCountShards))
+
+	var shard articleCountShard
+	if err := datastore.Get(c, key, &shard); err == datastore.ErrNoSuchEntity {
+		shard.User = userKey
+		shard.Counter = counter
+	} else if err != nil && !IsFieldMismatch(err) {
+		return err
+	}
+
+	shard.Unread += delta.Unread
+	shard.Starred += delta.Starred
+	_, err := datastore.Put(c, key, &shard)
+
+	return err
+}
+
+// addToArticleCounts applies the deltas as part of the current
+// (cross-group) transaction, up to maxCountersPerTransaction of
+// them. Deltas that didn't fit are returned
+func addToArticleCounts(c appengine.Context, userKey *datastore.Key, deltas ArticleCountDeltas) (ArticleCountDeltas, error) {
+	remaining := ArticleCountDeltas{}
+	applied := 0
+
+	for counter, delta := range deltas {
+		if delta.IsZero() {
+			continue
+		} else if applied >= maxCountersPerTransaction {
+			remaining[counter] = delta
+			continue
+		}
+
+		if err := addToArticleCount(c, userKey, counter, delta); err != nil {
+			return nil, err
+		}
+
+		applied++
+	}
+
+	return remaining, nil
+}
+
+// updateArticleCounts applies each of the deltas to a random shard
+// of its counter, one transaction per counter
+func updateArticleCounts(c appengine.Context, userKey *datastore.Key, deltas ArticleCountDeltas) error {
+	for counter, delta := range deltas {
+		if delta.IsZero() {
+			continue
+		}
+
+		counter, delta := counter, delta
+		err := datastore.RunInTransaction(c, func(c appengine.Context) error {
+			return addToArticleCount(c, userKey, counter, delta)
+		}, nil)
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// countArticles tallies each unread or starred article of the
+// subscription, in its folder (e.g. with the Add or Remove of a set
+// of deltas). Other articles don't count towards any counter
+func countArticles(c appengine.Context, subscriptionKey *datastore.Key, tally func(folderID string, article Article)) error {
+	folderID := newSubscriptionRef(subscriptionKey).FolderID
+
+	// Starred articles that are also unread are counted with the
+	// unread ones
+	for _, property := range []string { "unread", "star" } {
+		q := datastore.NewQuery("Article").Ancestor(subscriptionKey).Filter("Properties =", property)
+		for t := q.Run(c); ; {
+			entity := new(articleEntity)
+			if _, err := t.Next(entity); err == datastore.Done {
+				break
+			} else if err != nil && !IsFieldMismatch(err) {
+				return err
+			}
+
+			if property == "star" && entity.IsUnread() {
+				continue
+			}
+
+			tally(folderID, entity.Article)
+		}
+	}
+
+	return nil
+}
+
+// uncountArticles takes the articles of removed subscriptions off
+// the counters
+func uncountArticles(c appengine.Context, subscriptionKeys []*datastore.Key) error {
+	if len(subscriptionKeys) == 0 {
+		return nil
+	}
+
+	deltas := ArticleCountDeltas{}
+	for _, subscriptionKey := range subscriptionKeys {
+		if err := countArticles(c, subscriptionKey, deltas.Remove); err != nil {
+			return err
+		}
+	}
+
+	return updateArticleCounts(c, userKeyOf(subscriptionKeys[0]), deltas)
+}
+
+// articleCounts sums the shards of all of the user's counters. The
+// shards are queried, so the latest changes may be missing
+func articleCounts(c appengine.Context, userKey *datastore.Key) (map[string]ArticleCounts, error) {
+	counts := make(map[string]ArticleCounts)
+
+	q := datastore.NewQuery("ArticleCountShard").Filter("User =", userKey)
+	for t := q.Run(c); ; {
+		var shard articleCountShard
+		if _, err := t.Next(&shard); err == datastore.Done {
+			break
+		} else if err != nil && !IsFieldMismatch(err) {
+			return nil, err
+		}
+
+		sum := counts[shard.Counter]
+		sum.Unread += shard.Unread
+		sum.Starred += shard.Starred
+		counts[shard.Counter] = sum
+	}
+
+	return counts, nil
+}
+
+// storedArticleCounts sums the shards of the specified counters,
+// reading them by key
+func storedArticleCounts(c appengine.Context, userKey *datastore.Key, counters []string) (map[string]ArticleCounts, error) {
+	keys := make([]*datastore.Key, 0, len(counters) * articleCountShards)
+	for _, counter := range counters {
+		for i := 0; i < articleCountShards; i++ {
+			keys = append(keys, articleCountShardKey(c, userKey, counter, i))
+		}
+	}
+
+	counts := make(map[string]ArticleCounts)
+	for start := 0; start < len(keys); start += defaultBatchSize {
+		end := start + defaultBatchSize
+		if end > len(keys) {
+			end = len(keys)
+		}
+
+		shards := make([]articleCountShard, end - start)
+		if err := datastore.GetMulti(c, keys[start:end], shards); err != nil {
+			if multiError, ok := err.(appengine.MultiError); ok {
+				for _, err := range multiError {
+					if err != nil && err != datastore.ErrNoSuchEntity && !IsFieldMismatch(err) {
+						return nil, err
+					}
+				}
+			} else {
+				return nil, err
+			}
+		}
+
+		for i, shard := range shards {
+			counter := counters[(start + i) / articleCountShards]
+			sum := counts[counter]
+			sum.Unread += shard.Unread
+			sum.Starred += shard.Starred
+			counts[counter] = sum
+		}
+	}
+
+	return counts, nil
+}
+
+// ReconcileArticleCounts recounts the unread and starred articles
+// of the user, and corrects the counters that have drifted. It
+// returns true if any had
+func (ds *Datastore)ReconcileArticleCounts(userID UserID) (bool, error) {
+	c := ds.c
+	userKey, err := userID.key(c)
+	if err != nil {
+		return false, err
+	}
+
+	repaired := false
+	err = withLease(c, userLeaseResource(userID), func(lease Lease) error {
+		subscriptionKeys, _, err := subscriptionsWithin(c, userKey)
+		if err != nil {
+			c.Errorf("Error reading subscriptions: %s", err)
+			return err
+		}
+
+		actual := ArticleCountDeltas{}
+		for _, subscriptionKey := range subscriptionKeys {
+			if err := renewLease(c, &lease); err != nil {
+				return err
+			} else if err := countArticles(c, subscriptionKey, actual.Add); err != nil {
+				c.Errorf("Error counting articles: %s", err)
+				return err
+			}
+		}
+
+		// Include counters that should now be zero
+		queried, err := articleCounts(c, userKey)
+		if err != nil {
+			return err
+		}
+
+		counters := make([]string, 0, len(actual) + len(queried))
+		for counter, _ := range actual {
+			counters = append(counters, counter)
+		}
+		for counter, _ := range queried {
+			if _, ok := actual[counter]; !ok {
+				counters = append(counters, counter)
+			}
+		}
+
+		stored, err := storedArticleCounts(c, userKey, counters)
+		if err != nil {
+			return err
+		}
+
+		corrections := ArticleCountDeltas{}
+		for _, counter := range counters {
+			correction := ArticleCounts {
+				Unread: actual[counter].Unread - stored[counter].Unread,
+				Starred: actual[counter].Starred - stored[counter].Starred,
+			}
+
+			if !correction.IsZero() {
+				c.Infof("Article counts of %s corrected to %d unread, %d starred (were: %d, %d)",
+					counter, actual[counter].Unread, actual[counter].Starred,
+					stored[counter].Unread, stored[counter].Starred)
+				corrections[counter] = correction
+			}
+		}
+
+		if len(corrections) > 0 {
+			// Only if the lease is still held - the counts may have
+			// moved on since they were read
+			writer := newArticleWriter(c, lease, userKey)
+			writer.Deltas = corrections
+			if err := writer.Flush(); err != nil {
+				return err
+			}
+
+			repaired = true
+		}
+
+		return nil
+	})
+
+	return repaired, err
+}
@@ -0,0 +1,126 @@
+// +build appengine
+
+/*****************************************************************************
+ **
+ ** Gofr
+ ** https://github.com/pokebyte/Gofr
+ ** Copyright (C) 2013-2017 Akop Karapetyan
+ **
+ ** This program is free software; you can redistribute it and/or modify
+ ** it under the terms of the GNU General Public License as published by
+ ** the Free Software Foundation; either version 2 of the License, or
+ ** (at your option) any later version.
+ **
+ ** This program is distributed in the hope that it will be useful,
+ ** but WITHOUT ANY WARRANTY; without even the implied warranty of
+ ** MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ ** GNU General Public License for more details.
+ **
+ ** You should have received a copy of the GNU General Public License
+ ** along with this program; if not, write to the Free Software
+ ** Foundation, Inc., 675 Mass Ave, Cambridge, MA 02139, USA.
+ **
+ ******************************************************************************
+ */
+ 
+package storage
+
+import (
+	"appengine"
+	"appengine/datastore"
+	"fmt"
+	"testing"
+)
+
+func TestAddToArticleCounts(t *testing.T) {
+	c := newTestContext(t)
+	defer c.Close()
+
+	userKey := datastore.NewKey(c, "User", "tester", 0, nil)
+
+	// More counters than fit in a transaction
+	deltas := ArticleCountDeltas{}
+	counters := make([]string, 0)
+	for i := 0; i < maxCountersPerTransaction + 5; i++ {
+		counter := TagCounter(fmt.Sprintf("tag%d", i))
+		counters = append(counters, counter)
+		deltas[counter] = ArticleCounts { Unread: i + 1, Starred: 1 }
+	}
+
+	var remaining ArticleCountDeltas
+	err := datastore.RunInTransaction(c, func(c appengine.Context) error {
+		var err error
+		remaining, err = addToArticleCounts(c, userKey, deltas)
+		return err
+	}, &datastore.TransactionOptions { XG: true })
+
+	if err != nil {
+		t.Fatalf("Error updating counts: %s", err)
+	} else if len(remaining) != 5 {
+		t.Fatalf("Expected 5 counters left over, got %d", len(remaining))
+	} else if err := updateArticleCounts(c, userKey, remaining); err != nil {
+		t.Fatalf("Error updating remaining counts: %s", err)
+	}
+
+	// Applied twice, across shards
+	if err := updateArticleCounts(c, userKey, deltas); err != nil {
+		t.Fatalf("Error updating counts: %s", err)
+	}
+
+	stored, err := storedArticleCounts(c, userKey, counters)
+	if err != nil {
+		t.Fatalf("Error reading counts: %s", err)
+	}
+	queried, err := articleCounts(c, userKey)
+	if err != nil {
+		t.Fatalf("Error querying counts: %s", err)
+	}
+
+	for counter, delta := range deltas {
+		expected := ArticleCounts { Unread: 2 * delta.Unread, Starred: 2 * delta.Starred }
+		if stored[counter] != expected || queried[counter] != expected {
+			t.Errorf("Counter %s: expected %+v, got %+v (queried: %+v)", counter, expected, stored[counter], queried[counter])
+		}
+	}
+}
+
+func TestCountArticles(t *testing.T) {
+	c := newTestContext(t)
+	defer c.Close()
+
+	userKey := datastore.NewKey(c, "User", "tester", 0, nil)
+	folderKey := datastore.NewKey(c, "Folder", "", 1, userKey)
+	subscriptionKey := datastore.NewKey(c, "Subscription", "http://example.com/feed", 0, folderKey)
+
+	articles := map[string][]string {
+		"unread": { "unread" },
+		"unreadStarred": { "unread", "star" },
+		"starred": { "star" },
+		"read": {},
+	}
+	for id, properties := range articles {
+		article := articleEntity {}
+		article.Properties = properties
+		if _, err := datastore.Put(c, datastore.NewKey(c, "Article", id, 0, subscriptionKey), &article); err != nil {
+			t.Fatalf("Error writing article: %s", err)
+		}
+	}
+
+	tallied := 0
+	deltas := ArticleCountDeltas{}
+	err := countArticles(c, subscriptionKey, func(folderID string, article Article) {
+		tallied++
+		deltas.Add(folderID, article)
+	})
+
+	if err != nil {
+		t.Fatalf("Error counting articles: %s", err)
+	} else if tallied != 3 {
+		t.Errorf("Expected 3 articles tallied, got %d", tallied)
+	}
+
+	expectDeltas(t, deltas, map[string]ArticleCounts {
+		UserCounter: { Unread: 2, Starred: 2 },
+		FolderCounter(FormatId("folder", 1)): { Unread: 2, Starred: 2 },
+	})
+}
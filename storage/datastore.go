@@ -1,3 +1,5 @@
+// +build appengine
+
 /*****************************************************************************
  **
  ** Gofr
@@ -31,15 +33,38 @@ import (
 	"fmt"
 	"html"
 	"math/rand"
+	"net/http"
 	"rss"
+	"sort"
+	"strconv"
+	"strings"
 	"time"
 )
 
 const (
 	articlePageSize = 40
 	defaultBatchSize = 400
+	// Entries written per transaction. Each comes with its metadata,
+	// and a transaction writes 500 entities (and 10MB) at most
+	entryBatchSize = 100
+	// Articles read while filtering a single page, at most. Pages
+	// may come up short when few articles match
+	maxArticlesScanned = 400
+	// Recent articles ranked by the "magic" order
+	magicWindowSize = 100
 )
 
+// Datastore is the App Engine implementation of Repository
+type Datastore struct {
+	c appengine.Context
+}
+
+func NewDatastore(c appengine.Context) *Datastore {
+	return &Datastore {
+		c: c,
+	}
+}
+
 func NewBatchWriter(c appengine.Context, op BatchOp) *BatchWriter {
 	return NewBatchWriterWithSize(c, op, defaultBatchSize)
 }
@@ -49,10 +74,6 @@ func IsFieldMismatch(err error) bool {
 	return ok
 }
 
-func (ref FolderRef)IsZero() bool {
-	return ref.UserID == "" && ref.FolderID == ""
-}
-
 func (userID UserID)key(c appengine.Context) (*datastore.Key, error) {
 	if userID == "" {
 		return nil, errors.New("UserID is empty")
@@ -68,7 +89,7 @@ func (ref FolderRef)key(c appengine.Context) (*datastore.Key, error) {
 	}
 
 	if ref.FolderID != "" {
-		if kind, id, err := unformatId(ref.FolderID); err != nil {
+		if kind, id, err := UnformatId(ref.FolderID); err != nil {
 			return nil, err
 		} else if kind == "folder" {
 			return datastore.NewKey(c, "Folder", "", id, userKey), nil
@@ -127,19 +148,26 @@ func (user User)key(c appengine.Context) (*datastore.Key, error) {
 	return datastore.NewKey(c, "User", user.ID, 0, nil), nil
 }
 
-func NewArticlePage(c appengine.Context, filter ArticleFilter, start string) (*ArticlePage, error) {
+func (ds *Datastore)NewArticlePage(filter ArticleFilter, start string) (*ArticlePage, error) {
+	switch filter.Order {
+	case OrderByFeed:
+		return ds.articlePageByFeed(filter, start)
+	case OrderMagic:
+		return ds.magicArticlePage(filter, start)
+	}
+
+	c := ds.c
 	scopeKey, err := filter.key(c)
 	if err != nil {
 		return nil, err
 	}
 
-	q := datastore.NewQuery("Article").Ancestor(scopeKey).Order("-Fetched").Order("-Published")
-	if filter.Property != "" {
-		q = q.Filter("Properties = ", filter.Property)
-	} else if filter.Tag != "" {
-		q = q.Filter("Tags = ", filter.Tag)
+	ancestorKey, ranges, err := articleAncestor(c, scopeKey)
+	if err != nil {
+		return nil, err
 	}
 
+	q := articleQuery(ancestorKey, filter)
 	if start != "" {
 		if cursor, err := datastore.DecodeCursor(start); err == nil {
 			q = q.Start(cursor)
@@ -148,60 +176,435 @@ func NewArticlePage(c appengine.Context, filter ArticleFilter, start string) (*A
 		}
 	}
 
+	articles, entryKeys, continueFrom, _, err := scanArticles(c, q, filter, ranges, articlePageSize, maxArticlesScanned)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := loadEntries(c, articles, entryKeys); err != nil {
+		return nil, err
+	}
+
+	page := ArticlePage {
+		Articles: articles,
+		Continue: continueFrom,
+	}
+
+	return &page, nil
+}
+
+// articlePageByFeed reads the articles of each subscription in
+// turn, subscriptions sorted by title. The continuation is the
+// subscription ID, followed by the cursor within its articles
+func (ds *Datastore)articlePageByFeed(filter ArticleFilter, start string) (*ArticlePage, error) {
+	c := ds.c
+	scopeKey, err := filter.key(c)
+	if err != nil {
+		return nil, err
+	}
+
+	var subscriptionKeys []*datastore.Key
+	var subscriptions []*subscriptionEntity
+	if scopeKey.Kind() == "Subscription" {
+		subscriptionKeys = []*datastore.Key { scopeKey }
+		subscriptions = []*subscriptionEntity { new(subscriptionEntity) }
+	} else {
+		if subscriptionKeys, subscriptions, err = subscriptionsWithin(c, scopeKey); err != nil {
+			return nil, err
+		}
+		sort.Sort(subscriptionsByTitle { subscriptionKeys, subscriptions })
+	}
+
+	ranges := readRanges{}
+	if scopeKey.Kind() != "Subscription" {
+		for i, subscriptionKey := range subscriptionKeys {
+			ranges[subscriptionKey.Encode()] = &subscriptions[i].ReadRange
+		}
+	}
+
+	startID, cursor := "", ""
+	if start != "" {
+		parts := strings.SplitN(start, "|", 2)
+		if len(parts) != 2 {
+			return nil, errors.New("Continuation not valid")
+		}
+		startID, cursor = parts[0], parts[1]
+	}
+
+	articles := make([]Article, 0, articlePageSize)
+	entryKeys := make([]*datastore.Key, 0, articlePageSize)
+	budget := maxArticlesScanned
+	continueFrom := ""
+
+	for _, subscriptionKey := range subscriptionKeys {
+		if startID != "" {
+			if subscriptionKey.StringID() != startID {
+				continue
+			}
+			startID = ""
+		}
+
+		if len(articles) >= articlePageSize || budget <= 0 {
+			// Pick up with this subscription on the next page
+			continueFrom = subscriptionKey.StringID() + "|"
+			break
+		}
+
+		q := articleQuery(subscriptionKey, filter)
+		if cursor != "" {
+			if decoded, err := datastore.DecodeCursor(cursor); err == nil {
+				q = q.Start(decoded)
+			} else {
+				return nil, err
+			}
+			cursor = ""
+		}
+
+		read, keys, next, scanned, err := scanArticles(c, q, filter, ranges, articlePageSize - len(articles), budget)
+		if err != nil {
+			return nil, err
+		}
+
+		articles = append(articles, read...)
+		entryKeys = append(entryKeys, keys...)
+		budget -= scanned
+
+		if next != "" {
+			continueFrom = subscriptionKey.StringID() + "|" + next
+			break
+		}
+	}
+
+	if err := loadEntries(c, articles, entryKeys); err != nil {
+		return nil, err
+	}
+
+	page := ArticlePage {
+		Articles: articles,
+		Continue: continueFrom,
+	}
+
+	return &page, nil
+}
+
+// magicArticlePage ranks the most recent matching articles by the
+// number of likes of their entries, most liked first. The
+// continuation is the offset into the ranking
+func (ds *Datastore)magicArticlePage(filter ArticleFilter, start string) (*ArticlePage, error) {
+	c := ds.c
+	scopeKey, err := filter.key(c)
+	if err != nil {
+		return nil, err
+	}
+
+	offset := 0
+	if start != "" {
+		if offset, err = strconv.Atoi(start); err != nil {
+			return nil, err
+		}
+	}
+
+	ancestorKey, ranges, err := articleAncestor(c, scopeKey)
+	if err != nil {
+		return nil, err
+	}
+
+	q := articleQuery(ancestorKey, filter)
+	articles, entryKeys, _, _, err := scanArticles(c, q, filter, ranges, magicWindowSize, maxArticlesScanned)
+	if err != nil {
+		return nil, err
+	}
+
+	ranked := articlesByLikes {
+		Articles: articles,
+		EntryKeys: entryKeys,
+		LikeCounts: make([]int, len(articles)),
+	}
+	for i, entryKey := range entryKeys {
+		if ranked.LikeCounts[i], err = likeCount(c, entryKey); err != nil {
+			return nil, err
+		}
+	}
+	sort.Stable(ranked)
+
+	if offset > len(articles) {
+		offset = len(articles)
+	}
+	end := offset + articlePageSize
+	if end > len(articles) {
+		end = len(articles)
+	}
+
+	articles, entryKeys = articles[offset:end], entryKeys[offset:end]
+	if err := loadEntries(c, articles, entryKeys); err != nil {
+		return nil, err
+	}
+
+	page := ArticlePage {
+		Articles: articles,
+	}
+	if end < len(ranked.Articles) {
+		page.Continue = strconv.Itoa(end)
+	}
+
+	return &page, nil
+}
+
+// readRanges caches the read ranges of subscriptions, by key.
+// Removed subscriptions (whose articles are kept until their undo
+// record is discarded) have none
+type readRanges map[string]*ReadRange
+
+// readRangesWithin returns the read ranges of the subscriptions
+// within the scope
+func readRangesWithin(c appengine.Context, scopeKey *datastore.Key) (readRanges, error) {
+	ranges := readRanges{}
+	if scopeKey.Kind() == "Subscription" {
+		// Loaded when first needed
+		return ranges, nil
+	}
+
+	subscriptionKeys, subscriptions, err := subscriptionsWithin(c, scopeKey)
+	if err != nil {
+		return nil, err
+	}
+
+	for i, subscriptionKey := range subscriptionKeys {
+		ranges[subscriptionKey.Encode()] = &subscriptions[i].ReadRange
+	}
+
+	return ranges, nil
+}
+
+// articleAncestor returns the ancestor to query the articles within
+// the scope by, along with the read ranges of its subscriptions.
+// Subfolders aren't descendants of their folder, so the articles of
+// a folder with subfolders are queried by user, and those of the
+// subscriptions outside the folder are ruled out by (nil) ranges
+func articleAncestor(c appengine.Context, scopeKey *datastore.Key) (*datastore.Key, readRanges, error) {
+	ranges, err := readRangesWithin(c, scopeKey)
+	if err != nil {
+		return nil, nil, err
+	} else if scopeKey.Kind() != "Folder" {
+		return scopeKey, ranges, nil
+	}
+
+	if folderKeys, err := folderKeysWithin(c, scopeKey); err != nil {
+		return nil, nil, err
+	} else if len(folderKeys) == 1 {
+		return scopeKey, ranges, nil
+	}
+
+	userKey := scopeKey.Parent()
+	subscriptionKeys, err := datastore.NewQuery("Subscription").Ancestor(userKey).KeysOnly().GetAll(c, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	for _, subscriptionKey := range subscriptionKeys {
+		if _, ok := ranges[subscriptionKey.Encode()]; !ok {
+			ranges[subscriptionKey.Encode()] = nil
+		}
+	}
+
+	return userKey, ranges, nil
+}
+
+// apply marks the article read, if it's covered by the read range
+// of its subscription. It returns false if the subscription was
+// removed
+func (ranges readRanges)apply(c appengine.Context, subscriptionKey *datastore.Key, article *Article) (bool, error) {
+	encoded := subscriptionKey.Encode()
+	readRange, ok := ranges[encoded]
+	if !ok {
+		subscription := subscriptionEntity{}
+		if err := datastore.Get(c, subscriptionKey, &subscription); err == nil || IsFieldMismatch(err) {
+			readRange = &subscription.ReadRange
+		} else if err != datastore.ErrNoSuchEntity {
+			return false, err
+		}
+
+		ranges[encoded] = readRange
+	}
+
+	if readRange == nil {
+		return false, nil
+	}
+
+	readRange.Apply(article)
+	return true, nil
+}
+
+// subscriptionsByTitle sorts subscriptions (along with their keys)
+// by title
+type subscriptionsByTitle struct {
+	Keys []*datastore.Key
+	Subscriptions []*subscriptionEntity
+}
+
+func (s subscriptionsByTitle)Len() int {
+	return len(s.Keys)
+}
+
+func (s subscriptionsByTitle)Swap(i, j int) {
+	s.Keys[i], s.Keys[j] = s.Keys[j], s.Keys[i]
+	s.Subscriptions[i], s.Subscriptions[j] = s.Subscriptions[j], s.Subscriptions[i]
+}
+
+func (s subscriptionsByTitle)Less(i, j int) bool {
+	a, b := strings.ToLower(s.Subscriptions[i].Title), strings.ToLower(s.Subscriptions[j].Title)
+	if a != b {
+		return a < b
+	}
+
+	return s.Keys[i].StringID() < s.Keys[j].StringID()
+}
+
+// articlesByLikes sorts articles (along with the keys of their
+// entries) by like count, most liked first
+type articlesByLikes struct {
+	Articles []Article
+	EntryKeys []*datastore.Key
+	LikeCounts []int
+}
+
+func (a articlesByLikes)Len() int {
+	return len(a.Articles)
+}
+
+func (a articlesByLikes)Swap(i, j int) {
+	a.Articles[i], a.Articles[j] = a.Articles[j], a.Articles[i]
+	a.EntryKeys[i], a.EntryKeys[j] = a.EntryKeys[j], a.EntryKeys[i]
+	a.LikeCounts[i], a.LikeCounts[j] = a.LikeCounts[j], a.LikeCounts[i]
+}
+
+func (a articlesByLikes)Less(i, j int) bool {
+	return a.LikeCounts[i] > a.LikeCounts[j]
+}
+
+// articleQuery returns the query for the articles within the
+// ancestor, in the order of the filter. A single equality filter
+// (and the fetch date range, when sorted by fetch date) are served
+// by the indexes; the rest of the filter is applied to the
+// articles as they're read
+func articleQuery(ancestorKey *datastore.Key, filter ArticleFilter) *datastore.Query {
+	q := datastore.NewQuery("Article").Ancestor(ancestorKey)
+
+	byFetched := true
+	switch filter.Order {
+	case OrderOldest:
+		q = q.Order("Fetched").Order("Published")
+	case OrderPublishedNewest:
+		q = q.Order("-Published").Order("-Fetched")
+		byFetched = false
+	case OrderPublishedOldest:
+		q = q.Order("Published").Order("Fetched")
+		byFetched = false
+	default:
+		q = q.Order("-Fetched").Order("-Published")
+	}
+
+	if properties := filter.RequiredProperties(); len(properties) > 0 {
+		q = q.Filter("Properties = ", properties[0])
+	} else if tags := filter.RequiredTags(); len(tags) > 0 {
+		q = q.Filter("Tags = ", tags[0])
+	}
+
+	if byFetched {
+		if !filter.FetchedAfter.IsZero() {
+			q = q.Filter("Fetched >=", filter.FetchedAfter)
+		}
+		if !filter.FetchedBefore.IsZero() {
+			q = q.Filter("Fetched <", filter.FetchedBefore)
+		}
+	}
+
+	return q
+}
+
+// scanArticles reads up to limit articles that match the filter
+// (once marked read by their subscriptions' read ranges), scanning
+// no more than budget articles. Along with the articles
+// and the keys of their entries, it returns the cursor to continue
+// from (empty once the query runs out) and the number scanned
+func scanArticles(c appengine.Context, q *datastore.Query, filter ArticleFilter, ranges readRanges, limit int, budget int) ([]Article, []*datastore.Key, string, int, error) {
 	t := q.Run(c)
 
-	articles := make([]Article, articlePageSize)
-	entryKeys := make([]*datastore.Key, articlePageSize)
+	articles := make([]Article, 0, limit)
+	entryKeys := make([]*datastore.Key, 0, limit)
 
-	var readCount int
-	for readCount = 0; readCount < articlePageSize; readCount++ {
-		article := &articles[readCount]
+	exhausted := false
+	scanned := 0
+	for ; len(articles) < limit && scanned < budget; scanned++ {
+		entity := articleEntity{}
 
-		if _, err := t.Next(article); err != nil && err == datastore.Done {
+		articleKey, err := t.Next(&entity)
+		if err != nil && err == datastore.Done {
+			exhausted = true
 			break
 		} else if IsFieldMismatch(err) {
 			// Ignore - migration issue
 		} else if err != nil {
-			return nil, err
+			return nil, nil, "", scanned, err
+		}
+
+		// Source is the subscription, which is not necessarily
+		// keyed by the URL of the feed (e.g. migrated feeds)
+		article := entity.article()
+		article.Source = articleKey.Parent().StringID()
+		if subscribed, err := ranges.apply(c, articleKey.Parent(), &article); err != nil {
+			return nil, nil, "", scanned, err
+		} else if !subscribed {
+			continue
 		}
 
-		entryKey := article.Entry
-		
-		article.ID = entryKey.StringID()
-		article.Source = entryKey.Parent().StringID()
+		if !filter.Matches(article) {
+			continue
+		} else if filter.Author != "" {
+			entry := Entry{}
+			if err := datastore.Get(c, entity.Entry, &entry); err != nil && !IsFieldMismatch(err) {
+				return nil, nil, "", scanned, err
+			} else if !filter.MatchesEntry(&entry) {
+				continue
+			}
+		}
 
-		entryKeys[readCount] = entryKey
+		articles = append(articles, article)
+		entryKeys = append(entryKeys, entity.Entry)
 	}
 
 	continueFrom := ""
-	if readCount >= articlePageSize {
+	if !exhausted {
 		if cursor, err := t.Cursor(); err == nil {
 			continueFrom = cursor.String()
 		}
 	}
 
-	articles = articles[:readCount]
-	entryKeys = entryKeys[:readCount]
+	return articles, entryKeys, continueFrom, scanned, nil
+}
 
-	entries := make([]Entry, readCount)
+// loadEntries fills in the details and media of articles from
+// their entries
+func loadEntries(c appengine.Context, articles []Article, entryKeys []*datastore.Key) error {
+	entries := make([]Entry, len(articles))
 	if err := datastore.GetMulti(c, entryKeys, entries); err != nil {
 		if multiError, ok := err.(appengine.MultiError); ok {
 			for _, singleError := range multiError {
 				if singleError != nil {
 					// Safely ignore ErrFieldMismatch
 					if !IsFieldMismatch(singleError) {
-						return nil, err
+						return err
 					}
 				}
 			}
 		} else {
-			return nil, err
+			return err
 		}
 	}
 
 	for i, _ := range articles {
 		if entries[i].HasMedia {
-			if media, err := MediaForEntry(c, entryKeys[i]); err != nil {
+			if media, err := mediaForEntry(c, entryKeys[i]); err != nil {
 				c.Warningf("Error loading media for entry: %s", err)
 			} else {
 				articles[i].Media = media
@@ -213,16 +616,63 @@ func NewArticlePage(c appengine.Context, filter ArticleFilter, start string) (*A
 		}
 	}
 
-	page := ArticlePage {
-		Articles: articles,
-		Continue: continueFrom,
+	return nil
+}
+
+func (ds *Datastore)Articles(refs []ArticleRef) ([]Article, error) {
+	c := ds.c
+	articleKeys := make([]*datastore.Key, len(refs))
+	for i, ref := range refs {
+		if key, err := ref.key(c); err != nil {
+			return nil, err
+		} else {
+			articleKeys[i] = key
+		}
 	}
 
-	return &page, nil
+	entities := make([]articleEntity, len(refs))
+	var multiError appengine.MultiError
+	if err := datastore.GetMulti(c, articleKeys, entities); err != nil {
+		if me, ok := err.(appengine.MultiError); ok {
+			multiError = me
+		} else {
+			return nil, err
+		}
+	}
+
+	articles := make([]Article, 0, len(refs))
+	entryKeys := make([]*datastore.Key, 0, len(refs))
+	ranges := readRanges{}
+	for i, entity := range entities {
+		if multiError != nil && multiError[i] != nil {
+			if multiError[i] == datastore.ErrNoSuchEntity {
+				continue
+			} else if !IsFieldMismatch(multiError[i]) {
+				return nil, multiError[i]
+			}
+		}
+
+		article := entity.article()
+		article.Source = refs[i].SubscriptionID
+		if subscribed, err := ranges.apply(c, articleKeys[i].Parent(), &article); err != nil {
+			return nil, err
+		} else if !subscribed {
+			continue
+		}
+		articles = append(articles, article)
+		entryKeys = append(entryKeys, entity.Entry)
+	}
+
+	if err := loadEntries(c, articles, entryKeys); err != nil {
+		return nil, err
+	}
+
+	return articles, nil
 }
 
-func NewUserSubscriptions(c appengine.Context, userID UserID) (*UserSubscriptions, error) {
-	var subscriptions []Subscription
+func (ds *Datastore)NewUserSubscriptions(userID UserID) (*UserSubscriptions, error) {
+	c := ds.c
+	var entities []subscriptionEntity
 	var subscriptionKeys []*datastore.Key
 
 	userKey, err := userID.key(c)
@@ -231,18 +681,23 @@ func NewUserSubscriptions(c appengine.Context, userID UserID) (*UserSubscription
 	}
 
 	q := datastore.NewQuery("Subscription").Ancestor(userKey).Limit(defaultBatchSize)
-	if subKeys, err := q.GetAll(c, &subscriptions); err != nil {
+	if subKeys, err := q.GetAll(c, &entities); err != nil {
 		return nil, err
-	} else if subscriptions == nil {
-		subscriptions = make([]Subscription, 0)
 	} else {
 		subscriptionKeys = subKeys
 	}
 
+	subscriptions := make([]Subscription, len(entities))
+	for i, _ := range entities {
+		subscriptions[i] = entities[i].subscription()
+	}
+
 	totalUnreadCount := 0
 	feedKeys := make([]*datastore.Key, len(subscriptions))
+	feedMetaKeys := make([]*datastore.Key, len(subscriptions))
 	for i, subscription := range subscriptions {
-		feedKeys[i] = subscription.Feed
+		feedKeys[i] = entities[i].Feed
+		feedMetaKeys[i] = datastore.NewKey(c, "FeedMeta", subscription.FeedURL, 0, nil)
 		totalUnreadCount += subscription.UnreadCount
 	}
 
@@ -265,6 +720,15 @@ func NewUserSubscriptions(c appengine.Context, userID UserID) (*UserSubscription
 		}
 	}
 
+	// Feed health - errors are not critical; we just won't
+	// report the status
+	feedMetas := make([]feedMetaEntity, len(subscriptions))
+	if err := datastore.GetMulti(c, feedMetaKeys, feedMetas); err != nil {
+		if _, ok := err.(appengine.MultiError); !ok {
+			c.Warningf("Error reading feed status: %s", err)
+		}
+	}
+
 	for i, _ := range subscriptions {
 		subscriptionKey := subscriptionKeys[i]
 
@@ -272,28 +736,18 @@ func NewUserSubscriptions(c appengine.Context, userID UserID) (*UserSubscription
 		subscription.ID = subscriptionKey.StringID()
 		subscription.Link = feeds[i].Link
 		subscription.FavIconURL = feeds[i].FavIconURL
+		subscription.FavIcon = feeds[i].FavIcon
+		subscription.Status = feedMetas[i].Status()
 
 		if subscriptionKey.Parent().Kind() == "Folder" {
-			subscription.Parent = formatId("folder", subscriptionKey.Parent().IntID())
+			subscription.Parent = FormatId("folder", subscriptionKey.Parent().IntID())
 		}
 	}
 
 	// Get all folders
-	var folders []Folder
-	var folderKeys []*datastore.Key
-
-	q = datastore.NewQuery("Folder").Ancestor(userKey).Limit(defaultBatchSize)
-	if k, err := q.GetAll(c, &folders); err != nil {
+	folders, err := userFolders(c, userKey)
+	if err != nil {
 		return nil, err
-	} else if folders == nil {
-		folders = make([]Folder, 0)
-	} else {
-		folderKeys = k
-	}
-
-	for i, _ := range folders {
-		folder := &folders[i]
-		folder.ID = formatId("folder", folderKeys[i].IntID())
 	}
 
 	// Get all tags
@@ -311,46 +765,118 @@ func NewUserSubscriptions(c appengine.Context, userID UserID) (*UserSubscription
 		Tags: tags,
 	}
 
+	// Counts are not critical
+	if counts, err := articleCounts(c, userKey); err != nil {
+		c.Warningf("Error reading article counts: %s", err)
+	} else {
+		userSubscriptions.ArticleCounts = counts[UserCounter]
+		for i, folder := range folders {
+			folders[i].ArticleCounts = counts[FolderCounter(folder.ID)]
+		}
+		RollUpFolderCounts(folders)
+		for i, tag := range tags {
+			tags[i].ArticleCounts = counts[TagCounter(tag.Title)]
+		}
+	}
+
 	return &userSubscriptions, nil
 }
 
-func IsFolderDuplicate(c appengine.Context, userID UserID, title string) (bool, error) {
-	userKey, err := userID.key(c)
-	if err != nil {
-		return false, err
+// userFolders returns all of the user's folders
+func userFolders(c appengine.Context, userKey *datastore.Key) ([]Folder, error) {
+	var folders []Folder
+	q := datastore.NewQuery("Folder").Ancestor(userKey).Limit(defaultBatchSize)
+	folderKeys, err := q.GetAll(c, &folders)
+	if err != nil && !IsFieldMismatch(err) {
+		return nil, err
+	} else if folders == nil {
+		return make([]Folder, 0), nil
 	}
 
-	var folders []*Folder
-	q := datastore.NewQuery("Folder").Ancestor(userKey).Filter("Title =", title).Limit(1)
-	if _, err := q.GetAll(c, &folders); err == nil && len(folders) > 0 {
-		return true, nil
-	} else if err != nil {
-		return false, err
+	for i, folderKey := range folderKeys {
+		folders[i].ID = FormatId("folder", folderKey.IntID())
 	}
 
-	return false, nil
+	return folders, nil
 }
 
-func IsSubscriptionDuplicate(c appengine.Context, userID UserID, subscriptionURL string) (bool, error) {
-	userKey, err := userID.key(c)
+// folderKeysWithin returns the keys of the folder and of the
+// folders nested in it
+func folderKeysWithin(c appengine.Context, folderKey *datastore.Key) ([]*datastore.Key, error) {
+	userKey := folderKey.Parent()
+	folders, err := userFolders(c, userKey)
 	if err != nil {
-		return false, err
+		return nil, err
 	}
 
-	feedKey := datastore.NewKey(c, "Feed", subscriptionURL, 0, nil)
-	q := datastore.NewQuery("Subscription").Ancestor(userKey).Filter("Feed =", feedKey).KeysOnly().Limit(1)
-
-	if subKeys, err := q.GetAll(c, nil); err != nil {
-		return false, err
-	} else if len(subKeys) > 0 {
-		return true, nil
+	subtree := FolderSubtree(folders, FormatId("folder", folderKey.IntID()))
+	folderKeys := make([]*datastore.Key, len(subtree))
+	for i, folderID := range subtree {
+		ref := FolderRef {
+			UserID: UserID(userKey.StringID()),
+			FolderID: folderID,
+		}
+		if folderKeys[i], err = ref.key(c); err != nil {
+			return nil, err
+		}
 	}
 
-	return false, nil
+	return folderKeys, nil
 }
 
-func UserByID(c appengine.Context, userID UserID) (*User, error) {
-	userKey := datastore.NewKey(c, "User", string(userID), 0, nil)
+// childFolderByTitle returns the key of the folder with the title,
+// directly within the parent, or nil if there's none
+func childFolderByTitle(c appengine.Context, parent FolderRef, title string) (*datastore.Key, error) {
+	userKey, err := parent.UserID.key(c)
+	if err != nil {
+		return nil, err
+	}
+
+	var folders []Folder
+	q := datastore.NewQuery("Folder").Ancestor(userKey).Filter("Title =", title)
+	folderKeys, err := q.GetAll(c, &folders)
+	if err != nil && !IsFieldMismatch(err) {
+		return nil, err
+	}
+
+	for i, folder := range folders {
+		if folder.Parent == parent.FolderID {
+			return folderKeys[i], nil
+		}
+	}
+
+	return nil, nil
+}
+
+// IsFolderDuplicate returns true if the parent already holds
+// a folder with the title
+func (ds *Datastore)IsFolderDuplicate(parent FolderRef, title string) (bool, error) {
+	folderKey, err := childFolderByTitle(ds.c, parent, title)
+	return folderKey != nil, err
+}
+
+func (ds *Datastore)IsSubscriptionDuplicate(userID UserID, subscriptionURL string) (bool, error) {
+	c := ds.c
+	userKey, err := userID.key(c)
+	if err != nil {
+		return false, err
+	}
+
+	feedKey := datastore.NewKey(c, "Feed", subscriptionURL, 0, nil)
+	q := datastore.NewQuery("Subscription").Ancestor(userKey).Filter("Feed =", feedKey).KeysOnly().Limit(1)
+
+	if subKeys, err := q.GetAll(c, nil); err != nil {
+		return false, err
+	} else if len(subKeys) > 0 {
+		return true, nil
+	}
+
+	return false, nil
+}
+
+func (ds *Datastore)UserByID(userID UserID) (*User, error) {
+	c := ds.c
+	userKey := datastore.NewKey(c, "User", string(userID), 0, nil)
 	user := User{}
 
 	if err := datastore.Get(c, userKey, &user); err == nil {
@@ -362,7 +888,8 @@ func UserByID(c appengine.Context, userID UserID) (*User, error) {
 	return nil, nil
 }
 
-func (user User)Save(c appengine.Context) error {
+func (ds *Datastore)SaveUser(user User) error {
+	c := ds.c
 	userKey, err := UserID(user.ID).key(c)
 	if err != nil {
 		return err
@@ -375,23 +902,20 @@ func (user User)Save(c appengine.Context) error {
 	return nil
 }
 
-func FolderByTitle(c appengine.Context, userID UserID, title string) (FolderRef, error) {
-	userKey, err := userID.key(c)
-	if err != nil {
+// FolderByTitle returns the folder with the title, directly within
+// the parent. The reference is zero if there's none
+func (ds *Datastore)FolderByTitle(parent FolderRef, title string) (FolderRef, error) {
+	if folderKey, err := childFolderByTitle(ds.c, parent, title); err != nil {
 		return FolderRef{}, err
-	}
-	
-	q := datastore.NewQuery("Folder").Ancestor(userKey).Filter("Title =", title).KeysOnly().Limit(1)
-	if folderKeys, err := q.GetAll(c, nil); err != nil {
-		return FolderRef{}, err
-	} else if len(folderKeys) > 0 {
-		return newFolderRef(userID, folderKeys[0]), nil
+	} else if folderKey != nil {
+		return newFolderRef(parent.UserID, folderKey), nil
 	}
 
 	return FolderRef{}, nil
 }
 
-func FolderExists(c appengine.Context, ref FolderRef) (bool, error) {
+func (ds *Datastore)FolderExists(ref FolderRef) (bool, error) {
+	c := ds.c
 	if folderKey, err := ref.key(c); err != nil {
 		return false, err
 	} else {
@@ -406,7 +930,8 @@ func FolderExists(c appengine.Context, ref FolderRef) (bool, error) {
 	return false, nil
 }
 
-func TagExists(c appengine.Context, userID UserID, tagID string) (bool, error) {
+func (ds *Datastore)TagExists(userID UserID, tagID string) (bool, error) {
+	c := ds.c
 	userKey, err := userID.key(c)
 	if err != nil {
 		return false, err
@@ -423,12 +948,13 @@ func TagExists(c appengine.Context, userID UserID, tagID string) (bool, error) {
 	return false, nil
 }
 
-func SubscriptionExists(c appengine.Context, ref SubscriptionRef) (bool, error) {
+func (ds *Datastore)SubscriptionExists(ref SubscriptionRef) (bool, error) {
+	c := ds.c
 	if subscriptionKey, err := ref.key(c); err != nil {
 		return false, err
 	} else {
-		subscription := new(Subscription)
-		if err := datastore.Get(c, subscriptionKey, subscription); err == nil {
+		entity := new(subscriptionEntity)
+		if err := datastore.Get(c, subscriptionKey, entity); err == nil || IsFieldMismatch(err) {
 			return true, nil
 		} else if err != datastore.ErrNoSuchEntity {
 			return false, err
@@ -438,8 +964,9 @@ func SubscriptionExists(c appengine.Context, ref SubscriptionRef) (bool, error)
 	return false, nil
 }
 
-func CreateFolder(c appengine.Context, userID UserID, title string) (FolderRef, error) {
-	userKey, err := userID.key(c)
+func (ds *Datastore)CreateFolder(parent FolderRef, title string) (FolderRef, error) {
+	c := ds.c
+	userKey, err := parent.UserID.key(c)
 	if err != nil {
 		return FolderRef{}, err
 	}
@@ -447,35 +974,38 @@ func CreateFolder(c appengine.Context, userID UserID, title string) (FolderRef,
 	folderKey := datastore.NewIncompleteKey(c, "Folder", userKey)
 	folder := Folder {
 		Title: title,
+		Parent: parent.FolderID,
 	}
 
 	if completeKey, err := datastore.Put(c, folderKey, &folder); err != nil {
 		return FolderRef{}, err
 	} else {
-		return newFolderRef(userID, completeKey), nil
+		return newFolderRef(parent.UserID, completeKey), nil
 	}
 }
 
-func RenameSubscription(c appengine.Context, ref SubscriptionRef, title string) error {
+func (ds *Datastore)RenameSubscription(ref SubscriptionRef, title string) error {
+	c := ds.c
 	subscriptionKey, err := ref.key(c)
 	if err != nil {
 		return err
 	}
 
-	subscription := new(Subscription)
-	if err := datastore.Get(c, subscriptionKey, subscription); err != nil {
+	entity := new(subscriptionEntity)
+	if err := datastore.Get(c, subscriptionKey, entity); err != nil && !IsFieldMismatch(err) {
 		return err
 	}
 
-	subscription.Title = title
-	if _, err := datastore.Put(c, subscriptionKey, subscription); err != nil {
+	entity.Title = title
+	if _, err := datastore.Put(c, subscriptionKey, entity); err != nil {
 		return err
 	}
 
 	return nil
 }
 
-func RenameFolder(c appengine.Context, ref FolderRef, title string) error {
+func (ds *Datastore)RenameFolder(ref FolderRef, title string) error {
+	c := ds.c
 	folderKey, err := ref.key(c)
 	if err != nil {
 		return err
@@ -494,86 +1024,219 @@ func RenameFolder(c appengine.Context, ref FolderRef, title string) error {
 	return nil
 }
 
-func SetProperty(c appengine.Context, ref ArticleRef, propertyName string, propertyValue bool) ([]string, error) {
-	articleKey, err := ref.key(c)
+// MoveFolder nests the folder within another, or moves it to the
+// top level if the destination has no folder ID. Subscriptions are
+// keyed by the folder alone, so they stay where they are
+func (ds *Datastore)MoveFolder(ref FolderRef, destRef FolderRef) error {
+	c := ds.c
+	folderKey, err := ref.key(c)
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	article := new(Article)
-	if err := datastore.Get(c, articleKey, article); err != nil && !IsFieldMismatch(err) {
+	// Moves are serialized, so that concurrent ones can't close
+	// a cycle between them
+	return withLease(c, userLeaseResource(ref.UserID), func(lease Lease) error {
+		folderKeys, err := folderKeysWithin(c, folderKey)
+		if err != nil {
+			return err
+		}
+
+		for _, subfolderKey := range folderKeys {
+			if destRef.FolderID == FormatId("folder", subfolderKey.IntID()) {
+				return ErrFolderCycle
+			}
+		}
+
+		folder := new(Folder)
+		if err := datastore.Get(c, folderKey, folder); err != nil && !IsFieldMismatch(err) {
+			return err
+		}
+
+		folder.Parent = destRef.FolderID
+		_, err = datastore.Put(c, folderKey, folder)
+		return err
+	})
+}
+
+func (ds *Datastore)SetProperty(ref ArticleRef, propertyName string, propertyValue bool) ([]string, error) {
+	c := ds.c
+	articleKey, err := ref.key(c)
+	if err != nil {
 		return nil, err
 	}
 
-	if propertyValue != article.HasProperty(propertyName) {
+	subscriptionKey := articleKey.Parent()
+	userKey := userKeyOf(articleKey)
+	folderID := newSubscriptionRef(subscriptionKey).FolderID
+
+	var properties []string
+	var entryKey *datastore.Key
+	var remaining ArticleCountDeltas
+	likeDelta := 0
+
+	// The article, the unread count of its subscription and the
+	// article counts change together
+	err = datastore.RunInTransaction(c, func(c appengine.Context) error {
+		likeDelta = 0
+		remaining = nil
+
+		entity := new(articleEntity)
+		if err := datastore.Get(c, articleKey, entity); err != nil && !IsFieldMismatch(err) {
+			return err
+		}
+
+		subscription := new(subscriptionEntity)
+		subscribed := true
+		if err := datastore.Get(c, subscriptionKey, subscription); err == datastore.ErrNoSuchEntity {
+			// Removed - its articles don't count
+			subscribed = false
+		} else if err != nil && !IsFieldMismatch(err) {
+			return err
+		}
+
+		deltas := ArticleCountDeltas{}
+		deltas.Remove(folderID, entity.Article)
+
+		// Articles covered by a read range are read, though they may
+		// not have been rewritten yet
+		article := &entity.Article
+		if subscribed {
+			subscription.ReadRange.Apply(article)
+		}
+
+		properties = article.Properties
+		entryKey = entity.Entry
+		if propertyValue == article.HasProperty(propertyName) {
+			return nil
+		}
+
 		wasUnread := article.IsUnread()
 		wasLiked := article.IsLiked()
-		unreadDelta := 0
 
 		article.SetProperty(propertyName, propertyValue)
+		article.Changed = time.Now()
+		properties = article.Properties
 
-		// Update unread counts if necessary
 		if wasUnread != article.IsUnread() {
-			if wasUnread {
-				unreadDelta = -1
-			} else {
-				unreadDelta = 1
-			}
-		}
-
-		if _, err := datastore.Put(c, articleKey, article); err != nil {
-			return nil, err
+			// No longer the read range's doing
+			article.MarkedRead = time.Time{}
 		}
 
 		if wasLiked != article.IsLiked() {
 			if wasLiked {
-				article.updateLikeCount(c, -1)
+				likeDelta = -1
 			} else {
-				article.updateLikeCount(c, 1)
+				likeDelta = 1
 			}
 		}
 
-		if unreadDelta != 0 {
-			// Update unread counts - not critical
-			subscriptionKey := articleKey.Parent()
-			subscription := new(Subscription)
+		if _, err := datastore.Put(c, articleKey, entity); err != nil {
+			return err
+		}
+
+		if !subscribed {
+			return nil
+		}
+
+		// Update unread counts if necessary
+		if wasUnread != article.IsUnread() {
+			unreadDelta := 1
+			if wasUnread {
+				unreadDelta = -1
+			}
 
-			if err := datastore.Get(c, subscriptionKey, subscription); err != nil {
-				c.Warningf("Unread count update failed: subscription read error (%s)", err)
-			} else if subscription.UnreadCount + unreadDelta >= 0 {
+			if subscription.UnreadCount + unreadDelta >= 0 {
 				subscription.UnreadCount += unreadDelta
 				if _, err := datastore.Put(c, subscriptionKey, subscription); err != nil {
-					c.Warningf("Unread count update failed: subscription write error (%s)", err)
+					return err
 				}
 			}
 		}
+
+		deltas.Add(folderID, *article)
+		remaining, err = addToArticleCounts(c, userKey, deltas)
+
+		return err
+	}, &datastore.TransactionOptions { XG: true })
+
+	if err != nil {
+		return nil, err
+	}
+
+	if err := updateArticleCounts(c, userKey, remaining); err != nil {
+		c.Warningf("Error updating article counts: %s", err)
+	}
+
+	if likeDelta != 0 {
+		updateLikeCount(c, entryKey, likeDelta)
 	}
 
-	return article.Properties, nil
+	return properties, nil
 }
 
-func SetTags(c appengine.Context, ref ArticleRef, tags []string) ([]string, error) {
+func (ds *Datastore)SetTags(ref ArticleRef, tags []string) ([]string, error) {
+	c := ds.c
 	articleKey, err := ref.key(c)
 	if err != nil {
 		return nil, err
 	}
 
-	article := new(Article)
-	if err := datastore.Get(c, articleKey, article); err != nil && !IsFieldMismatch(err) {
+	subscriptionKey := articleKey.Parent()
+	userKey := userKeyOf(articleKey)
+	folderID := newSubscriptionRef(subscriptionKey).FolderID
+
+	var remaining ArticleCountDeltas
+
+	// The article and the article counts change together
+	err = datastore.RunInTransaction(c, func(c appengine.Context) error {
+		remaining = nil
+
+		entity := new(articleEntity)
+		if err := datastore.Get(c, articleKey, entity); err != nil && !IsFieldMismatch(err) {
+			return err
+		}
+
+		deltas := ArticleCountDeltas{}
+		deltas.Remove(folderID, entity.Article)
+
+		entity.Tags = tags
+		if _, err := datastore.Put(c, articleKey, entity); err != nil {
+			return err
+		}
+
+		// Removed subscriptions' articles don't count
+		if err := datastore.Get(c, subscriptionKey, new(subscriptionEntity)); err == datastore.ErrNoSuchEntity {
+			return nil
+		} else if err != nil && !IsFieldMismatch(err) {
+			return err
+		}
+
+		deltas.Add(folderID, entity.Article)
+		remaining, err = addToArticleCounts(c, userKey, deltas)
+
+		return err
+	}, &datastore.TransactionOptions { XG: true })
+
+	if err != nil {
 		return nil, err
 	}
 
-	article.Tags = tags
+	if err := updateArticleCounts(c, userKey, remaining); err != nil {
+		c.Warningf("Error updating article counts: %s", err)
+	}
 
-	if _, err := datastore.Put(c, articleKey, article); err != nil {
+	if err := createMissingTags(c, ref.UserID, tags); err != nil {
 		return nil, err
 	}
 
-	var userKey *datastore.Key
-	if key, err := ref.UserID.key(c); err != nil {
-		return nil, err
-	} else {
-		userKey = key
+	return tags, nil
+}
+
+func createMissingTags(c appengine.Context, userID UserID, tags []string) error {
+	userKey, err := userID.key(c)
+	if err != nil {
+		return err
 	}
 
 	batchWriter := NewBatchWriter(c, BatchPut)
@@ -590,34 +1253,230 @@ func SetTags(c appengine.Context, ref ArticleRef, tags []string) ([]string, erro
 
 			if err := batchWriter.Enqueue(tagKey, &tag); err != nil {
 				c.Errorf("Error queueing tag for batch write: %s", err)
-				return nil, err
+				return err
 			}
 		} else {
 			// Some other error
-			return nil, err
+			return err
 		}
 	}
 
 	if err := batchWriter.Flush(); err != nil {
 		c.Errorf("Error flushing batch queue: %s", err)
-		return nil, err
+		return err
+	}
+
+	return nil
+}
+
+// SetSubscriptionTags sets the tags applied to articles as they
+// arrive from the subscription
+func (ds *Datastore)SetSubscriptionTags(ref SubscriptionRef, tags []string) error {
+	c := ds.c
+	subscriptionKey, err := ref.key(c)
+	if err != nil {
+		return err
+	}
+
+	entity := new(subscriptionEntity)
+	if err := datastore.Get(c, subscriptionKey, entity); err != nil && !IsFieldMismatch(err) {
+		return err
+	}
+
+	entity.Tags = tags
+
+	if _, err := datastore.Put(c, subscriptionKey, entity); err != nil {
+		return err
+	}
+
+	return createMissingTags(c, ref.UserID, tags)
+}
+
+// MarkAsRead sets the read range of the subscriptions within the
+// scope. Articles are rewritten by ApplyReadRanges
+func (ds *Datastore)MarkAsRead(scope ArticleScope, readRange ReadRange) error {
+	c := ds.c
+	key, err := scope.key(c)
+	if err != nil {
+		return err
+	}
+
+	subscriptionKeys, subscriptions, err := subscriptionsWithin(c, key)
+	if err != nil {
+		c.Errorf("Error reading subscriptions: %s", err)
+		return err
+	}
+
+	if !readRange.IsUnbounded() {
+		// Bounded ranges can't be merged; rewrite pending ones
+		// first, which takes the lease
+		pending := false
+		for _, subscription := range subscriptions {
+			pending = pending || !subscription.ReadRange.IsZero()
+		}
+
+		if pending {
+			err := withLease(c, userLeaseResource(scope.UserID), func(lease Lease) error {
+				for i, subscription := range subscriptions {
+					if subscription.ReadRange.IsZero() {
+						continue
+					}
+
+					if _, err := applyReadRange(c, lease, subscriptionKeys[i], subscription.ReadRange); err != nil {
+						c.Errorf("Error applying read range: %s", err)
+						return err
+					}
+				}
+
+				return nil
+			})
+
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	// Otherwise, only the subscriptions are written, each as it is
+	// now, in a transaction of their own (in the user's entity
+	// group). There's no need to wait for the lease, which a
+	// background job may hold for a while
+	err = datastore.RunInTransaction(c, func(c appengine.Context) error {
+		for i, subscriptionKey := range subscriptionKeys {
+			current := new(subscriptionEntity)
+			if err := datastore.Get(c, subscriptionKey, current); err == datastore.ErrNoSuchEntity {
+				// Unsubscribed in the meantime
+				continue
+			} else if err != nil && !IsFieldMismatch(err) {
+				return err
+			}
+
+			current.ReadRange = readRange
+			if readRange.IsUnbounded() {
+				current.UnreadCount = 0
+			}
+
+			if _, err := datastore.Put(c, subscriptionKey, current); err != nil {
+				return err
+			}
+
+			subscriptions[i] = current
+		}
+
+		return nil
+	}, nil)
+
+	if err != nil {
+		c.Errorf("Error writing subscriptions: %s", err)
+		return err
+	}
+
+	record := UndoRecord {
+		UserID: scope.UserID,
+		Action: UndoMarkAsRead,
+		FolderID: scope.FolderID,
+		SubscriptionID: scope.SubscriptionID,
+		Marked: readRange.Marked,
+	}
+	if scope.SubscriptionID != "" && len(subscriptions) > 0 {
+		record.Title = subscriptions[0].Title
+	}
+	if err := saveUndoRecord(c, &record, nil, nil); err != nil {
+		c.Errorf("Error writing undo record: %s", err)
+		return err
 	}
 
-	return article.Tags, nil
+	return nil
 }
 
-func MarkAllAsRead(c appengine.Context, scope ArticleScope) (int, error) {
+// ApplyReadRanges marks read the articles covered by the read ranges
+// of the subscriptions within the scope, then clears the ranges.
+// It returns the number of articles marked
+func (ds *Datastore)ApplyReadRanges(scope ArticleScope) (int, error) {
+	c := ds.c
 	key, err := scope.key(c)
 	if err != nil {
 		return 0, err
 	}
 
-	batchWriter := NewBatchWriter(c, BatchPut)
+	marked := 0
+	err = withLease(c, userLeaseResource(scope.UserID), func(lease Lease) error {
+		subscriptionKeys, subscriptions, err := subscriptionsWithin(c, key)
+		if err != nil {
+			c.Errorf("Error reading subscriptions: %s", err)
+			return err
+		}
+
+		for i, subscription := range subscriptions {
+			if subscription.ReadRange.IsZero() {
+				continue
+			} else if err := renewLease(c, &lease); err != nil {
+				return err
+			}
+
+			if written, err := applyReadRange(c, lease, subscriptionKeys[i], subscription.ReadRange); err != nil {
+				c.Errorf("Error applying read range: %s", err)
+				return err
+			} else {
+				marked += written
+			}
+		}
+
+		return nil
+	})
+
+	return marked, err
+}
+
+// subscriptionsWithin returns the subscriptions within the scope,
+// including those of subfolders
+func subscriptionsWithin(c appengine.Context, scopeKey *datastore.Key) ([]*datastore.Key, []*subscriptionEntity, error) {
+	if scopeKey.Kind() == "Subscription" {
+		subscription := new(subscriptionEntity)
+		if err := datastore.Get(c, scopeKey, subscription); err != nil && !IsFieldMismatch(err) {
+			return nil, nil, err
+		}
+
+		return []*datastore.Key { scopeKey }, []*subscriptionEntity { subscription }, nil
+	}
+
+	// Subfolders aren't descendants of their folder
+	ancestorKeys := []*datastore.Key { scopeKey }
+	if scopeKey.Kind() == "Folder" {
+		var err error
+		if ancestorKeys, err = folderKeysWithin(c, scopeKey); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	subscriptionKeys := make([]*datastore.Key, 0)
+	subscriptions := make([]*subscriptionEntity, 0)
+	for _, ancestorKey := range ancestorKeys {
+		var within []*subscriptionEntity
+		q := datastore.NewQuery("Subscription").Ancestor(ancestorKey)
+		keys, err := q.GetAll(c, &within)
+		if err != nil && !IsFieldMismatch(err) {
+			return nil, nil, err
+		}
+
+		subscriptionKeys = append(subscriptionKeys, keys...)
+		subscriptions = append(subscriptions, within...)
+	}
+
+	return subscriptionKeys, subscriptions, nil
+}
+
+// applyReadRange rewrites the articles covered by the range, then
+// clears the range (unless it was replaced in the meantime) and
+// recounts unread articles
+func applyReadRange(c appengine.Context, lease Lease, subscriptionKey *datastore.Key, readRange ReadRange) (int, error) {
+	writer := newArticleWriter(c, lease, userKeyOf(subscriptionKey))
+	folderID := newSubscriptionRef(subscriptionKey).FolderID
 
-	q := datastore.NewQuery("Article").Ancestor(key).Filter("Properties =", "unread")
+	q := datastore.NewQuery("Article").Ancestor(subscriptionKey).Filter("Properties =", "unread")
 	for t := q.Run(c); ; {
-		article := new(Article)
-		articleKey, err := t.Next(article)
+		entity := new(articleEntity)
+		articleKey, err := t.Next(entity)
 
 		if err == datastore.Done {
 			break
@@ -625,54 +1484,64 @@ func MarkAllAsRead(c appengine.Context, scope ArticleScope) (int, error) {
 			// Ignore - migration issue
 		} else if err != nil {
 			c.Errorf("Error reading Article: %s", err)
-			return 0, err
+			return writer.Written(), err
+		}
+
+		previous := entity.Article
+		if !readRange.Apply(&entity.Article) {
+			continue
 		}
 
-		article.SetProperty("read", true)
+		writer.Deltas.Remove(folderID, previous)
+		writer.Deltas.Add(folderID, entity.Article)
 
-		if err := batchWriter.Enqueue(articleKey, article); err != nil {
-			c.Errorf("Error queueing article for batch write: %s", err)
-			return 0, err
+		if err := writer.Enqueue(articleKey, entity); err != nil {
+			c.Errorf("Error writing articles: %s", err)
+			return writer.Written(), err
 		}
 	}
 
-	if err := batchWriter.Flush(); err != nil {
-		c.Errorf("Error flushing batch queue: %s", err)
-		return 0, err
+	if err := writer.Flush(); err != nil {
+		c.Errorf("Error writing articles: %s", err)
+		return writer.Written(), err
 	}
 
-	// Reset unread counters
-	if key.Kind() != "Subscription" {
-		var subscriptions []*Subscription
-		q = datastore.NewQuery("Subscription").Ancestor(key).Limit(defaultBatchSize)
-		
-		if subscriptionKeys, err := q.GetAll(c, &subscriptions); err != nil {
-			return 0, err
-		} else {
-			for _, subscription := range subscriptions {
-				subscription.UnreadCount = 0
-			}
+	count, err := unreadCount(c, subscriptionKey, ReadRange{})
+	if err != nil {
+		c.Errorf("Error getting unread count: %s", err)
+		return writer.Written(), err
+	}
 
-			if _, err := datastore.PutMulti(c, subscriptionKeys, subscriptions); err != nil {
-				return 0, err
-			}
+	err = datastore.RunInTransaction(c, func(c appengine.Context) error {
+		if err := checkLease(c, lease); err != nil {
+			return err
 		}
-	} else {
-		subscription := new(Subscription)
-		if err := datastore.Get(c, key, subscription); err != nil {
-			return 0, err
+
+		subscription := new(subscriptionEntity)
+		if err := datastore.Get(c, subscriptionKey, subscription); err == datastore.ErrNoSuchEntity {
+			// Unsubscribed in the meantime
+			return nil
+		} else if err != nil && !IsFieldMismatch(err) {
+			return err
 		}
 
-		subscription.UnreadCount = 0
-		if _, err := datastore.Put(c, key, subscription); err != nil {
-			return 0, err
+		if !subscription.ReadRange.Marked.Equal(readRange.Marked) {
+			// Marked again; the new range is still pending
+			return nil
 		}
-	}
 
-	return batchWriter.Written(), nil
+		subscription.ReadRange = ReadRange{}
+		subscription.UnreadCount = count
+
+		_, err := datastore.Put(c, subscriptionKey, subscription)
+		return err
+	}, &datastore.TransactionOptions { XG: true })
+
+	return writer.Written(), err
 }
 
-func MoveSubscription(c appengine.Context, subRef SubscriptionRef, destRef FolderRef) error {
+func (ds *Datastore)MoveSubscription(subRef SubscriptionRef, destRef FolderRef) error {
+	c := ds.c
 	currentSubscriptionKey, err := subRef.key(c)
 	if err != nil {
 		return err
@@ -688,8 +1557,8 @@ func MoveSubscription(c appengine.Context, subRef SubscriptionRef, destRef Folde
 		return err
 	}
 
-	subscription := new(Subscription)
-	if err := datastore.Get(c, currentSubscriptionKey, subscription); err != nil {
+	subscription := new(subscriptionEntity)
+	if err := datastore.Get(c, currentSubscriptionKey, subscription); err != nil && !IsFieldMismatch(err) {
 		c.Errorf("Error reading subscription: %s", err)
 		return err
 	}
@@ -707,7 +1576,10 @@ func MoveSubscription(c appengine.Context, subRef SubscriptionRef, destRef Folde
 	return nil
 }
 
-func MoveArticles(c appengine.Context, subRef SubscriptionRef, destRef FolderRef) error {
+// MoveArticles moves the articles of a subscription moved with
+// MoveSubscription, and their share of the folder counts
+func (ds *Datastore)MoveArticles(subRef SubscriptionRef, destRef FolderRef) error {
+	c := ds.c
 	currentSubscriptionKey, err := subRef.key(c)
 	if err != nil {
 		return err
@@ -723,64 +1595,87 @@ func MoveArticles(c appengine.Context, subRef SubscriptionRef, destRef FolderRef
 		return err
 	}
 
-	batchWriter := NewBatchWriter(c, BatchPut)
-	batchDeleter := NewBatchWriter(c, BatchDelete)
+	// Keeps articles from being written under the old key mid-move
+	return withLease(c, userLeaseResource(subRef.UserID), func(lease Lease) error {
+		writer := newArticleWriter(c, lease, userKeyOf(currentSubscriptionKey))
 
-	q := datastore.NewQuery("Article").Ancestor(currentSubscriptionKey)
-	for t := q.Run(c); ; {
-		article := new(Article)
-		currentArticleKey, err := t.Next(article)
+		q := datastore.NewQuery("Article").Ancestor(currentSubscriptionKey)
+		for t := q.Run(c); ; {
+			article := new(articleEntity)
+			currentArticleKey, err := t.Next(article)
 
-		if err == datastore.Done {
-			break
-		} else if IsFieldMismatch(err) {
-			// Safely ignore - migration issue
-		} else if err != nil {
-			c.Errorf("Error reading Article: %s", err)
-			return err
-		}
+			if err == datastore.Done {
+				break
+			} else if IsFieldMismatch(err) {
+				// Safely ignore - migration issue
+			} else if err != nil {
+				c.Errorf("Error reading Article: %s", err)
+				return err
+			}
 
-		newArticleKey := datastore.NewKey(c, "Article", currentArticleKey.StringID(), 0, newSubscriptionKey)
-		if err := batchWriter.Enqueue(newArticleKey, article); err != nil {
-			c.Errorf("Error queueing article for batch write: %s", err)
-			return err
+			newArticleKey := datastore.NewKey(c, "Article", currentArticleKey.StringID(), 0, newSubscriptionKey)
+			writer.Deltas.Remove(subRef.FolderID, article.Article)
+			writer.Deltas.Add(destRef.FolderID, article.Article)
+
+			if err := writer.EnqueueMove(currentArticleKey, newArticleKey, article); err != nil {
+				c.Errorf("Error moving articles: %s", err)
+				return err
+			}
 		}
-		if err := batchDeleter.EnqueueKey(currentArticleKey); err != nil {
-			c.Errorf("Error queueing article for batch delete: %s", err)
+
+		if err := writer.Flush(); err != nil {
+			c.Errorf("Error moving articles: %s", err)
 			return err
 		}
+
+		return nil
+	})
+}
+
+func (ds *Datastore)DeleteFolder(ref FolderRef) error {
+	c := ds.c
+	folderKey, err := ref.key(c)
+	if err != nil {
+		return err
 	}
 
-	if err := batchWriter.Flush(); err != nil {
-		c.Errorf("Error flushing batch write queue: %s", err)
+	// Subfolders are removed along with the folder
+	folderKeys, err := folderKeysWithin(c, folderKey)
+	if err != nil {
 		return err
 	}
 
-	if err := batchDeleter.Flush(); err != nil {
-		c.Errorf("Error flushing batch delete queue: %s", err)
+	folders := make([]Folder, len(folderKeys))
+	if err := datastore.GetMulti(c, folderKeys, folders); err != nil && !IsFieldMismatch(err) {
 		return err
 	}
 
-	return nil
-}
+	for i, subfolderKey := range folderKeys {
+		folders[i].ID = FormatId("folder", subfolderKey.IntID())
+	}
 
-func DeleteFolder(c appengine.Context, ref FolderRef) error {
-	folderKey, err := ref.key(c)
+	// Get a list of relevant subscriptions
+	subscriptionKeys, subscriptions, err := subscriptionsWithin(c, folderKey)
 	if err != nil {
 		return err
 	}
 
-	// Get a list of relevant subscriptions
-	q := datastore.NewQuery("Subscription").Ancestor(folderKey).KeysOnly().Limit(defaultBatchSize)
-	subscriptionKeys, err := q.GetAll(c, nil)
-
-	if err != nil {
+	// Articles are kept until the record is discarded
+	record := UndoRecord {
+		UserID: ref.UserID,
+		Action: UndoRemoveFolder,
+		Title: folders[0].Title,
+		FolderID: ref.FolderID,
+		Folders: folders,
+	}
+	if err := saveUndoRecord(c, &record, subscriptionKeys, subscriptions); err != nil {
+		c.Errorf("Error writing undo record: %s", err)
 		return err
 	}
 
-	// Delete folder & subscriptions
-	if err := datastore.Delete(c, folderKey); err != nil {
-		c.Errorf("Error deleting folder: %s", err)
+	// Delete folders & subscriptions
+	if err := datastore.DeleteMulti(c, folderKeys); err != nil {
+		c.Errorf("Error deleting folders: %s", err)
 		return err
 	}
 
@@ -794,15 +1689,32 @@ func DeleteFolder(c appengine.Context, ref FolderRef) error {
 		return err
 	}
 
+	if err := uncountArticles(c, subscriptionKeys); err != nil {
+		c.Warningf("Error updating article counts: %s", err)
+	}
+
 	return nil
 }
 
-func DeleteTag(c appengine.Context, userID UserID, tagID string) error {
+func (ds *Datastore)DeleteTag(userID UserID, tagID string) error {
+	c := ds.c
 	userKey, err := userID.key(c)
 	if err != nil {
 		return err
 	}
 
+	// Articles keep the tag until the record is discarded
+	record := UndoRecord {
+		UserID: userID,
+		Action: UndoRemoveTag,
+		Title: tagID,
+		Tag: tagID,
+	}
+	if err := saveUndoRecord(c, &record, nil, nil); err != nil {
+		c.Errorf("Error writing undo record: %s", err)
+		return err
+	}
+
 	tagKey := datastore.NewKey(c, "Tag", tagID, 0, userKey)
 	if err := datastore.Delete(c, tagKey); err != nil {
 		c.Errorf("Error deleting tag: %s", err)
@@ -812,7 +1724,8 @@ func DeleteTag(c appengine.Context, userID UserID, tagID string) error {
 	return nil
 }
 
-func FeedByURL(c appengine.Context, url string) (*Feed, error) {
+func (ds *Datastore)FeedByURL(url string) (*Feed, error) {
+	c := ds.c
 	feedKey := datastore.NewKey(c, "Feed", url, 0, nil)
 	feed := new(Feed)
 
@@ -825,7 +1738,8 @@ func FeedByURL(c appengine.Context, url string) (*Feed, error) {
 	return nil, nil
 }
 
-func IsFeedAvailable(c appengine.Context, url string) (bool, error) {
+func (ds *Datastore)IsFeedAvailable(url string) (bool, error) {
+	c := ds.c
 	feedKey := datastore.NewKey(c, "Feed", url, 0, nil)
 	feed := new(Feed)
 
@@ -841,7 +1755,8 @@ func IsFeedAvailable(c appengine.Context, url string) (bool, error) {
 	return false, nil
 }
 
-func WebToFeedURL(c appengine.Context, url string, title *string) (string, error) {
+func (ds *Datastore)WebToFeedURL(url string, title *string) (string, error) {
+	c := ds.c
 	q := datastore.NewQuery("Feed").Filter("Link =", url)
 	t := q.Run(c)
 	
@@ -860,16 +1775,17 @@ func WebToFeedURL(c appengine.Context, url string, title *string) (string, error
 	return "", nil
 }
 
-func Subscribe(c appengine.Context, ref FolderRef, url string, title string) (SubscriptionRef, error) {
+func (ds *Datastore)Subscribe(ref FolderRef, url string, title string) (SubscriptionRef, error) {
+	c := ds.c
 	folderKey, err := ref.key(c)
 	if err != nil {
 		return SubscriptionRef{}, err
 	}
 
-	subscription := new(Subscription)
+	subscription := new(subscriptionEntity)
 	subscriptionKey := datastore.NewKey(c, "Subscription", url, 0, folderKey)
 
-	if err := datastore.Get(c, subscriptionKey, subscription); err == nil {
+	if err := datastore.Get(c, subscriptionKey, subscription); err == nil || IsFieldMismatch(err) {
 		return SubscriptionRef{
 			FolderRef: ref,
 			SubscriptionID: url,
@@ -899,31 +1815,26 @@ func Subscribe(c appengine.Context, ref FolderRef, url string, title string) (Su
 	}, nil
 }
 
-func SubscriptionsAsOPML(c appengine.Context, userID UserID) (*rss.OPML, error) {
+func (ds *Datastore)SubscriptionsAsOPML(userID UserID) (*rss.OPML, error) {
+	c := ds.c
 	userKey, err := userID.key(c)
 	if err != nil {
 		return nil, err
 	}
 
 	opml := rss.NewOPML()
-	folderMap := map[string]*rss.Outline{}
-	q := datastore.NewQuery("Folder").Ancestor(userKey).Limit(defaultBatchSize)
+	opml.SetDateCreated(time.Now())
 
-	var folders []Folder
-	if folderKeys, err := q.GetAll(c, &folders); err != nil {
+	folders, err := userFolders(c, userKey)
+	if err != nil {
 		return nil, err
-	} else if folders != nil {
-		for i, folder := range folders {
-			opmlFolder := rss.NewFolder(folder.Title)
-			folderMap[folderKeys[i].String()] = opmlFolder
-			opml.Add(opmlFolder)
-		}
 	}
 
-	q = datastore.NewQuery("Subscription").Ancestor(userKey).Limit(defaultBatchSize)
+	folderMap := AddFolderOutlines(&opml, folders)
+	q := datastore.NewQuery("Subscription").Ancestor(userKey).Limit(defaultBatchSize)
 
-	var subscriptions []Subscription
-	if subscriptionKeys, err := q.GetAll(c, &subscriptions); err != nil {
+	var subscriptions []subscriptionEntity
+	if subscriptionKeys, err := q.GetAll(c, &subscriptions); err != nil && !IsFieldMismatch(err) {
 		return nil, err
 	} else {
 		feedKeys := make([]*datastore.Key, len(subscriptions))
@@ -946,19 +1857,33 @@ func SubscriptionsAsOPML(c appengine.Context, userID UserID) (*rss.OPML, error)
 			subscriptionKey := subscriptionKeys[i]
 			parentKey := subscriptionKey.Parent()
 
-			opmlSub := rss.NewSubscription(subscription.Title, subscriptionKey.StringID(), "")
+			opmlSub := rss.NewSubscription(subscription.Title, subscription.Feed.StringID(), "")
+			categories := make([]string, 0, len(subscription.Tags) + 1)
 			if parentKey.Kind() != "Folder" {
 				opml.Add(opmlSub)
 			} else {
-				if folder := folderMap[parentKey.String()]; folder != nil {
+				if folder := folderMap[FormatId("folder", parentKey.IntID())]; folder != nil {
 					folder.Add(opmlSub)
+					categories = append(categories, folder.Text)
 				} else {
 					opml.Add(opmlSub) // Orphaned folder
 				}
 			}
 
+			opmlSub.SetCategories(append(categories, subscription.Tags...))
+
 			if multiError == nil || multiError[i] == nil {
-				opmlSub.WebURL = feeds[i].Link
+				feed := feeds[i]
+
+				// Text holds the (possibly renamed) title of the
+				// subscription; title is the one of the feed
+				if feed.Title != "" {
+					opmlSub.Title = feed.Title
+				}
+
+				opmlSub.WebURL = feed.Link
+				opmlSub.Description = feed.Description
+				opmlSub.Version = OPMLVersion(feed.Format)
 			}
 		}
 	}
@@ -966,30 +1891,65 @@ func SubscriptionsAsOPML(c appengine.Context, userID UserID) (*rss.OPML, error)
 	return &opml, nil
 }
 
-func Unsubscribe(c appengine.Context, ref SubscriptionRef) error {
+func (ds *Datastore)Unsubscribe(ref SubscriptionRef) error {
+	c := ds.c
 	subscriptionKey, err := ref.key(c)
 	if err != nil {
 		return err
 	}
 
+	feedURL := ref.SubscriptionID
+	subscription := new(subscriptionEntity)
+	if err := datastore.Get(c, subscriptionKey, subscription); err == nil || IsFieldMismatch(err) {
+		if subscription.Feed != nil {
+			// Feed may have moved since subscribing
+			feedURL = subscription.Feed.StringID()
+		}
+
+		// Articles are kept until the record is discarded
+		record := UndoRecord {
+			UserID: ref.UserID,
+			Action: UndoUnsubscribe,
+			Title: subscription.Title,
+			FolderID: ref.FolderID,
+			SubscriptionID: ref.SubscriptionID,
+		}
+		if err := saveUndoRecord(c, &record, []*datastore.Key { subscriptionKey }, []*subscriptionEntity { subscription }); err != nil {
+			c.Errorf("Error writing undo record: %s", err)
+			return err
+		}
+	}
+
 	if err := datastore.Delete(c, subscriptionKey); err != nil {
 		return err
 	}
 
-	if err := updateSubscriberCount(c, ref.SubscriptionID, -1); err != nil {
+	if err := uncountArticles(c, []*datastore.Key { subscriptionKey }); err != nil {
+		c.Warningf("Error updating article counts: %s", err)
+	}
+
+	if err := updateSubscriberCount(c, feedURL, -1); err != nil {
 		c.Warningf("Error decrementing subscriber count: %s", err)
 	}
 
 	return nil
 }
 
-func DeleteArticlesWithinScope(c appengine.Context, scope ArticleScope) error {
+func (ds *Datastore)DeleteArticlesWithinScope(scope ArticleScope) error {
+	c := ds.c
 	ancestorKey, err := scope.key(c)
 	if err != nil {
 		return err
 	}
 
+	return deleteArticles(c, scope.UserID, ancestorKey)
+}
+
+// deleteArticles removes the articles under the ancestor, along with
+// their search postings
+func deleteArticles(c appengine.Context, userID UserID, ancestorKey *datastore.Key) error {
 	batchWriter := NewBatchWriter(c, BatchDelete)
+	articleKeys := make([]*datastore.Key, 0)
 
 	q := datastore.NewQuery("Article").Ancestor(ancestorKey).KeysOnly()
 	for t := q.Run(c); ; {
@@ -1005,6 +1965,8 @@ func DeleteArticlesWithinScope(c appengine.Context, scope ArticleScope) error {
 			c.Errorf("Error queueing article for batch delete: %s", err)
 			return err
 		}
+
+		articleKeys = append(articleKeys, articleKey)
 	}
 
 	if err := batchWriter.Flush(); err != nil {
@@ -1012,10 +1974,15 @@ func DeleteArticlesWithinScope(c appengine.Context, scope ArticleScope) error {
 		return err
 	}
 
+	if err := unindexArticles(c, userID, articleKeys); err != nil {
+		c.Warningf("Error removing articles from search index: %s", err)
+	}
+
 	return nil
 }
 
-func RemoveTag(c appengine.Context, userID UserID, tag string) error {
+func (ds *Datastore)RemoveTag(userID UserID, tag string) error {
+	c := ds.c
 	userKey, err := userID.key(c)
 	if err != nil {
 		return err
@@ -1025,7 +1992,7 @@ func RemoveTag(c appengine.Context, userID UserID, tag string) error {
 
 	q := datastore.NewQuery("Article").Ancestor(userKey).Filter("Tags = ", tag)
 	for t := q.Run(c); ; {
-		article := new(Article)
+		article := new(articleEntity)
 		articleKey, err := t.Next(article)
 
 		if err == datastore.Done {
@@ -1051,20 +2018,68 @@ func RemoveTag(c appengine.Context, userID UserID, tag string) error {
 		return err
 	}
 
+	// Stop tagging new articles
+	q = datastore.NewQuery("Subscription").Ancestor(userKey).Filter("Tags = ", tag)
+	for t := q.Run(c); ; {
+		subscription := new(subscriptionEntity)
+		subscriptionKey, err := t.Next(subscription)
+
+		if err == datastore.Done {
+			break
+		} else if IsFieldMismatch(err) {
+			// Not a proper error
+		} else if err != nil {
+			return err
+		}
+
+		tags := make([]string, 0, len(subscription.Tags))
+		for _, subscriptionTag := range subscription.Tags {
+			if subscriptionTag != tag {
+				tags = append(tags, subscriptionTag)
+			}
+		}
+		subscription.Tags = tags
+
+		if err := batchWriter.Enqueue(subscriptionKey, subscription); err != nil {
+			c.Errorf("Error queueing subscription for batch untag: %s", err)
+			return err
+		}
+	}
+
+	if err := batchWriter.Flush(); err != nil {
+		c.Errorf("Error flushing batch queue: %s", err)
+		return err
+	}
+
 	return nil
 }
 
-func UpdateFeed(c appengine.Context, parsedFeed *rss.Feed, favIconURL string, fetched time.Time) error {
+// UpdateFeed writes the feed and its entries, holding a lease on the
+// feed while it does. It doesn't wait for the lease - if the feed is
+// being updated elsewhere, it returns ErrLeaseHeld. favIcon is nil
+// unless the site's icon was looked up along with the feed
+func (ds *Datastore)UpdateFeed(parsedFeed *rss.Feed, favIcon *FavIcon, fetched time.Time, fetchInfo FetchInfo) error {
+	c := ds.c
+	return tryWithLease(c, feedLeaseResource(parsedFeed.URL), func(lease Lease) error {
+		return updateFeed(c, lease, parsedFeed, favIcon, fetched, fetchInfo)
+	})
+}
+
+func updateFeed(c appengine.Context, lease Lease, parsedFeed *rss.Feed, favIcon *FavIcon, fetched time.Time, fetchInfo FetchInfo) error {
 	var updateCounter int64
 	var lastFetched time.Time
 
 	feedDigest := parsedFeed.Digest()
-	feedMeta := new(FeedMeta)
+	feedMeta := new(feedMetaEntity)
 	feedMetaKey := datastore.NewKey(c, "FeedMeta", parsedFeed.URL, 0, nil)
 	feedKey := datastore.NewKey(c, "Feed", parsedFeed.URL, 0, nil)
 	updateInfo := false
 
 	err := datastore.RunInTransaction(c, func(c appengine.Context) error {
+		if err := checkLease(c, lease); err != nil {
+			return err
+		}
+
 		if err := datastore.Get(c, feedMetaKey, feedMeta); err == datastore.ErrNoSuchEntity {
 			// New; set defaults
 			feedMeta.Feed = feedKey
@@ -1090,6 +2105,16 @@ func UpdateFeed(c appengine.Context, parsedFeed *rss.Feed, favIconURL string, fe
 		feedMeta.NextFetch = fetched.Add(durationBetweenUpdates)
 		feedMeta.HourlyUpdateFrequency = float32(durationBetweenUpdates.Hours())
 		feedMeta.UpdateCounter += int64(len(parsedFeed.Entries))
+		feedMeta.ETag = fetchInfo.ETag
+		feedMeta.LastModified = fetchInfo.LastModified
+		feedMeta.RecordSuccess(fetched, fetchInfo.StatusCode)
+
+		if favIcon != nil {
+			feedMeta.FavIconChecked = fetched
+			if favIcon.URL != "" {
+				updateInfo = true
+			}
+		}
 
 		updateCounter = feedMeta.UpdateCounter
 
@@ -1100,7 +2125,7 @@ func UpdateFeed(c appengine.Context, parsedFeed *rss.Feed, favIconURL string, fe
 		}
 
 		return nil
-	}, nil)
+	}, &datastore.TransactionOptions { XG: true })
 
 	if err != nil {
 		c.Errorf("Error incrementing entry counter: %s", err)
@@ -1144,9 +2169,11 @@ func UpdateFeed(c appengine.Context, parsedFeed *rss.Feed, favIconURL string, fe
 			return err
 		}
 
-		if favIconURL != "" {
-			// FavIcon URL will not be passed when updating
-			feed.FavIconURL = favIconURL
+		if favIcon != nil && favIcon.URL != "" {
+			// Icons are only looked up every so often; keep the
+			// last one otherwise
+			feed.FavIconURL = favIcon.URL
+			feed.FavIcon = favIcon.Data
 		}
 
 		feed.Title = parsedFeed.Title
@@ -1162,7 +2189,7 @@ func UpdateFeed(c appengine.Context, parsedFeed *rss.Feed, favIconURL string, fe
 		}
 	}
 
-	batchSize := defaultBatchSize
+	batchSize := entryBatchSize
 	elements := len(parsedFeed.Entries)
 
 	entryKeys := make([]*datastore.Key, batchSize)
@@ -1180,28 +2207,45 @@ func UpdateFeed(c appengine.Context, parsedFeed *rss.Feed, favIconURL string, fe
 	for i := 0; ; i++ {
 		if i >= elements || pending + 1 >= batchSize {
 			if pending > 0 {
-				if _, err := datastore.PutMulti(c, entryKeys[:pending], entries[:pending]); err != nil {
-					if multiError, ok := err.(appengine.MultiError); ok {
-						for i, err := range multiError {
-							if err != nil {
-								c.Errorf("entry[%d]: key [%s] failed: %s", i, 
-									entryKeys[i].StringID(), err)
+				// Entries and their metadata share the feed's entity
+				// group, so each batch is written along with a check
+				// of the lease
+				err := datastore.RunInTransaction(c, func(c appengine.Context) error {
+					if err := checkLease(c, lease); err != nil {
+						return err
+					}
+					if _, err := datastore.PutMulti(c, entryKeys[:pending], entries[:pending]); err != nil {
+						if multiError, ok := err.(appengine.MultiError); ok {
+							for i, err := range multiError {
+								if err != nil {
+									c.Errorf("entry[%d]: key [%s] failed: %s", i, 
+										entryKeys[i].StringID(), err)
+								}
 							}
 						}
+						// FIXME: don't stop the entire write simply because a few entries failed
+						return err
 					}
-					// FIXME: don't stop the entire write simply because a few entries failed
-					return err
-				}
-				if _, err := datastore.PutMulti(c, entryMetaKeys[:pending], entryMetas[:pending]); err != nil {
-					if multiError, ok := err.(appengine.MultiError); ok {
-						for i, err := range multiError {
-							if err != nil {
-								c.Errorf("entryMeta[%d]: [%s] failed: %s", i, 
-									entryMetaKeys[i].StringID(), err)
+					if _, err := datastore.PutMulti(c, entryMetaKeys[:pending], entryMetas[:pending]); err != nil {
+						if multiError, ok := err.(appengine.MultiError); ok {
+							for i, err := range multiError {
+								if err != nil {
+									c.Errorf("entryMeta[%d]: [%s] failed: %s", i, 
+										entryMetaKeys[i].StringID(), err)
+								}
 							}
 						}
+						// FIXME: don't stop the entire write simply because a few entries failed
+						return err
 					}
-					// FIXME: don't stop the entire write simply because a few entries failed
+
+					return nil
+				}, &datastore.TransactionOptions { XG: true })
+
+				if err == ErrLeaseExpired {
+					c.Errorf("Lease on %s lost: %s", parsedFeed.URL, err)
+					return err
+				} else if err != nil {
 					return err
 				}
 			}
@@ -1260,10 +2304,11 @@ func UpdateFeed(c appengine.Context, parsedFeed *rss.Feed, favIconURL string, fe
 			Summary: parsedEntry.Summary(),
 			Content: parsedEntry.Content,
 			Updated: parsedEntry.Updated,
+			ImageURL: parsedEntry.ImageURL,
 		}
 
 		if len(parsedEntry.Media) > 0 {
-			if err := UpdateMedia(c, entryKey, parsedEntry); err != nil {
+			if err := updateMedia(c, entryKey, parsedEntry); err != nil {
 				c.Warningf("Error writing media for entry: %s")
 			} else {
 				entry.HasMedia = true
@@ -1285,12 +2330,241 @@ func UpdateFeed(c appengine.Context, parsedFeed *rss.Feed, favIconURL string, fe
 	return nil
 }
 
-func MediaForEntry(c appengine.Context, entryKey *datastore.Key) ([]*EntryMedia, error) {
+// MarkFeedUnchanged records a fetch that returned no new content
+// (e.g. HTTP 304) and schedules the next fetch based on the
+// previously computed update frequency
+func (ds *Datastore)MarkFeedUnchanged(url string, fetched time.Time) error {
+	c := ds.c
+	feedMetaKey := datastore.NewKey(c, "FeedMeta", url, 0, nil)
+
+	err := datastore.RunInTransaction(c, func(c appengine.Context) error {
+		feedMeta := new(feedMetaEntity)
+		if err := datastore.Get(c, feedMetaKey, feedMeta); err != nil && !IsFieldMismatch(err) {
+			return err
+		}
+
+		durationBetweenUpdates := time.Duration(float64(feedMeta.HourlyUpdateFrequency) * float64(time.Hour))
+		if minFrequency := time.Duration(30) * time.Minute; durationBetweenUpdates < minFrequency {
+			durationBetweenUpdates = minFrequency
+		}
+
+		feedMeta.Fetched = fetched
+		feedMeta.NextFetch = fetched.Add(durationBetweenUpdates)
+		feedMeta.RecordSuccess(fetched, http.StatusNotModified)
+
+		_, err := datastore.Put(c, feedMetaKey, feedMeta)
+		return err
+	}, nil)
+
+	if err != nil {
+		c.Errorf("Error rescheduling unchanged feed %s: %s", url, err)
+		return err
+	}
+
+	return nil
+}
+
+// RecordFeedFailure notes a failed attempt to fetch or parse a feed,
+// and backs off the next fetch accordingly. Feeds that fail
+// repeatedly are marked as dead
+func (ds *Datastore)RecordFeedFailure(url string, fetched time.Time, statusCode int, fetchError error) error {
+	c := ds.c
+	feedMetaKey := datastore.NewKey(c, "FeedMeta", url, 0, nil)
+	feedMeta := new(feedMetaEntity)
+
+	message := ""
+	if fetchError != nil {
+		message = fetchError.Error()
+	} else if statusCode != 0 {
+		message = fmt.Sprintf("HTTP %d: %s", statusCode, http.StatusText(statusCode))
+	}
+
+	err := datastore.RunInTransaction(c, func(c appengine.Context) error {
+		if err := datastore.Get(c, feedMetaKey, feedMeta); err != nil && !IsFieldMismatch(err) {
+			return err
+		}
+
+		feedMeta.RecordFailure(fetched, statusCode, message)
+
+		_, err := datastore.Put(c, feedMetaKey, feedMeta)
+		return err
+	}, nil)
+
+	if err != nil {
+		c.Errorf("Error recording failure for feed %s: %s", url, err)
+		return err
+	}
+
+	if feedMeta.Dead {
+		c.Warningf("Feed %s is dead (%d failures since %s): %s", url,
+			feedMeta.FailureCount, feedMeta.FailingSince, message)
+	}
+
+	return nil
+}
+
+// MigrateFeed moves a feed that has permanently relocated to its new
+// URL. The Feed and FeedMeta are copied, subscriptions are pointed at
+// the new feed, and subscriber counts are carried over. Subscriptions
+// (and hence Articles) keep their keys, so read/star/tag state is
+// preserved. The operation is idempotent and can safely be retried
+func (ds *Datastore)MigrateFeed(oldURL string, newURL string) error {
+	c := ds.c
+	oldFeedKey := datastore.NewKey(c, "Feed", oldURL, 0, nil)
+	newFeedKey := datastore.NewKey(c, "Feed", newURL, 0, nil)
+	oldFeedMetaKey := datastore.NewKey(c, "FeedMeta", oldURL, 0, nil)
+	newFeedMetaKey := datastore.NewKey(c, "FeedMeta", newURL, 0, nil)
+
+	// Copy the feed, unless it already exists at the new location
+	feed := new(Feed)
+	if err := datastore.Get(c, newFeedKey, feed); err == datastore.ErrNoSuchEntity {
+		if err := datastore.Get(c, oldFeedKey, feed); err != nil && err != datastore.ErrNoSuchEntity && !IsFieldMismatch(err) {
+			return err
+		}
+
+		feed.URL = newURL
+		if _, err := datastore.Put(c, newFeedKey, feed); err != nil {
+			c.Errorf("Error writing migrated feed: %s", err)
+			return err
+		}
+	} else if err != nil && !IsFieldMismatch(err) {
+		return err
+	}
+
+	feedMeta := new(feedMetaEntity)
+	if err := datastore.Get(c, newFeedMetaKey, feedMeta); err == datastore.ErrNoSuchEntity {
+		if err := datastore.Get(c, oldFeedMetaKey, feedMeta); err != nil && err != datastore.ErrNoSuchEntity && !IsFieldMismatch(err) {
+			return err
+		}
+
+		// Entries under the new key will continue from the old
+		// update counter. Cache validators are no longer valid
+		feedMeta.Feed = newFeedKey
+		feedMeta.ETag = ""
+		feedMeta.LastModified = ""
+		feedMeta.NextFetch = time.Now()
+		feedMeta.RecordSuccess(feedMeta.Fetched, http.StatusMovedPermanently)
+
+		if _, err := datastore.Put(c, newFeedMetaKey, feedMeta); err != nil {
+			c.Errorf("Error writing migrated feed metadata: %s", err)
+			return err
+		}
+	} else if err != nil && !IsFieldMismatch(err) {
+		return err
+	}
+
+	// Keep the feed's retention policy, unless the new location has
+	// one of its own
+	if policy, err := ds.FeedRetentionPolicy(oldURL); err != nil {
+		return err
+	} else if policy != nil {
+		if existing, err := ds.FeedRetentionPolicy(newURL); err != nil {
+			return err
+		} else if existing == nil {
+			if err := ds.SetFeedRetentionPolicy(newURL, policy); err != nil {
+				return err
+			}
+		}
+	}
+
+	// Count subscribers the new feed already has before moving
+	// any over (global queries are eventually consistent, so the
+	// moved subscriptions may not show up immediately)
+	q := datastore.NewQuery("Subscription").Filter("Feed =", newFeedKey).KeysOnly()
+	subscriberCount, err := q.Count(c)
+	if err != nil {
+		return err
+	}
+
+	// Point subscriptions at the new feed. MaxUpdateIndex is reset,
+	// so all entries of the new feed are reconsidered; entries that
+	// already have Articles (by GUID) keep their properties
+	batchWriter := NewBatchWriter(c, BatchPut)
+
+	q = datastore.NewQuery("Subscription").Filter("Feed =", oldFeedKey)
+	for t := q.Run(c); ; {
+		subscription := new(subscriptionEntity)
+		subscriptionKey, err := t.Next(subscription)
+
+		if err == datastore.Done {
+			break
+		} else if IsFieldMismatch(err) {
+			// Ignore - migration issue
+		} else if err != nil {
+			c.Errorf("Error reading Subscription: %s", err)
+			return err
+		}
+
+		subscription.Feed = newFeedKey
+		subscription.MaxUpdateIndex = -1
+
+		if err := batchWriter.Enqueue(subscriptionKey, subscription); err != nil {
+			c.Errorf("Error queueing subscription for batch write: %s", err)
+			return err
+		}
+	}
+
+	if err := batchWriter.Flush(); err != nil {
+		c.Errorf("Error flushing batch queue: %s", err)
+		return err
+	}
+
+	subscriberCount += batchWriter.Written()
+
+	// Rebuild subscriber count shards for both feeds
+	batchDeleter := NewBatchWriter(c, BatchDelete)
+	for _, feedKey := range []*datastore.Key { oldFeedKey, newFeedKey } {
+		q = datastore.NewQuery("SubscriberCountShard").Filter("Feed =", feedKey).KeysOnly()
+		if shardKeys, err := q.GetAll(c, nil); err != nil {
+			return err
+		} else {
+			for _, shardKey := range shardKeys {
+				if err := batchDeleter.EnqueueKey(shardKey); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	if err := batchDeleter.Flush(); err != nil {
+		c.Errorf("Error deleting subscriber count shards: %s", err)
+		return err
+	}
+
+	if err := updateSubscriberCount(c, newURL, subscriberCount); err != nil {
+		c.Warningf("Error writing subscriber count: %s", err)
+	}
+
+	// Finally, remove the old feed so that it's no longer fetched.
+	// Entries stay in place, since existing Articles refer to them
+	oldKeys := []*datastore.Key {
+		oldFeedMetaKey,
+		oldFeedKey,
+		datastore.NewKey(c, "FeedSubscriber", oldURL, 0, nil),
+	}
+	if err := datastore.DeleteMulti(c, oldKeys); err != nil {
+		if multiError, ok := err.(appengine.MultiError); ok {
+			for _, singleError := range multiError {
+				if singleError != nil && singleError != datastore.ErrNoSuchEntity {
+					return err
+				}
+			}
+		} else {
+			return err
+		}
+	}
+
+	c.Infof("Migrated feed %s to %s (%d subscribers)", oldURL, newURL, subscriberCount)
+
+	return nil
+}
+
+func mediaForEntry(c appengine.Context, entryKey *datastore.Key) ([]*EntryMedia, error) {
 	mediaList := make([]*EntryMedia, 0, 40)
 	q := datastore.NewQuery("EntryMedia").Filter("Entry =", entryKey)
 	for t := q.Run(c); ; {
-		entryMedia := new(EntryMedia)
-		_, err := t.Next(entryMedia)
+		entity := new(entryMediaEntity)
+		_, err := t.Next(entity)
 
 		if err == datastore.Done {
 			break
@@ -1300,13 +2574,14 @@ func MediaForEntry(c appengine.Context, entryKey *datastore.Key) ([]*EntryMedia,
 			return []*EntryMedia{}, err
 		}
 
-		mediaList = append(mediaList, entryMedia)
+		entryMedia := entity.EntryMedia
+		mediaList = append(mediaList, &entryMedia)
 	}
 
 	return mediaList, nil
 }
 
-func UpdateMedia(c appengine.Context, entryKey *datastore.Key, entry *rss.Entry) error {
+func updateMedia(c appengine.Context, entryKey *datastore.Key, entry *rss.Entry) error {
 	// Find and remove any existing media
 	q := datastore.NewQuery("EntryMedia").Filter("Entry =", entryKey).KeysOnly().Limit(40)
 	if entryMediaKeys, err := q.GetAll(c, nil); err != nil {
@@ -1322,9 +2597,15 @@ func UpdateMedia(c appengine.Context, entryKey *datastore.Key, entry *rss.Entry)
 	// Add media
 	for _, media := range entry.Media {
 		entryMediaKey := datastore.NewIncompleteKey(c, "EntryMedia", nil)
-		entryMedia := EntryMedia {
-			URL: media.URL,
-			Type: media.Type,
+		entryMedia := entryMediaEntity {
+			EntryMedia: EntryMedia {
+				URL: media.URL,
+				Type: media.Type,
+				Title: media.Title,
+				ThumbnailURL: media.ThumbnailURL,
+				Duration: int64(media.Duration.Seconds()),
+				Size: media.Size,
+			},
 			Entry: entryKey,
 		}
 
@@ -1342,55 +2623,80 @@ func UpdateMedia(c appengine.Context, entryKey *datastore.Key, entry *rss.Entry)
 	return nil
 }
 
-func UpdateSubscription(c appengine.Context, url string, ref SubscriptionRef) (int, error) {
+func (ds *Datastore)UpdateSubscription(url string, ref SubscriptionRef) (int, error) {
+	c := ds.c
 	subscriptionKey, err := ref.key(c)
 	if err != nil {
 		return 0, err
 	}
 
-	subscription := Subscription{}
-	if err := datastore.Get(c, subscriptionKey, &subscription); err != nil {
-		c.Errorf("Error getting subscription: %s", err)
-		return 0, err
-	}
+	written := 0
+	err = withLease(c, userLeaseResource(ref.UserID), func(lease Lease) error {
+		subscription := subscriptionEntity{}
+		if err := datastore.Get(c, subscriptionKey, &subscription); err != nil && !IsFieldMismatch(err) {
+			c.Errorf("Error getting subscription: %s", err)
+			return err
+		}
 
-	return updateSubscriptionByKey(c, subscriptionKey, subscription)
+		var err error
+		written, err = updateSubscriptionByKey(c, lease, subscriptionKey, subscription)
+		return err
+	})
+
+	return written, err
 }
 
-func UpdateAllSubscriptions(c appengine.Context, userID UserID) error {
+func (ds *Datastore)UpdateAllSubscriptions(userID UserID) error {
+	c := ds.c
 	userKey, err := userID.key(c)
 	if err != nil {
 		return err
 	}
 	
-	var subscriptions []Subscription
+	return withLease(c, userLeaseResource(userID), func(lease Lease) error {
+		var subscriptions []subscriptionEntity
 
-	q := datastore.NewQuery("Subscription").Ancestor(userKey).Limit(defaultBatchSize)
-	subscriptionKeys, err := q.GetAll(c, &subscriptions)
-	if err != nil {
-		return err
-	}
+		q := datastore.NewQuery("Subscription").Ancestor(userKey).Limit(defaultBatchSize)
+		subscriptionKeys, err := q.GetAll(c, &subscriptions)
+		if err != nil && !IsFieldMismatch(err) {
+			return err
+		}
 
-	started := time.Now()
-	doneChannel := make(chan Subscription)
-	subscriptionCount := len(subscriptions)
+		started := time.Now()
+		doneChannel := make(chan subscriptionEntity)
+		subscriptionCount := len(subscriptions)
 
-	for i := 0; i < subscriptionCount; i++ {
-		go updateSubscriptionAsync(c, subscriptionKeys[i], subscriptions[i], doneChannel)
-	}
+		for i := 0; i < subscriptionCount; i++ {
+			go updateSubscriptionAsync(c, lease, subscriptionKeys[i], subscriptions[i], doneChannel)
+		}
 
-	for i := 0; i < subscriptionCount; i++ {
-		<-doneChannel;
-	}
+		// The updates write under the lease, renewing it as they go,
+		// but it's kept while waiting on the slowest, too
+		renewal := time.NewTicker(leaseDuration / 4)
+		defer renewal.Stop()
+
+		for pending := subscriptionCount; pending > 0; {
+			select {
+			case <-doneChannel:
+				pending--
+			case <-renewal.C:
+				if err := renewLease(c, &lease); err != nil {
+					c.Warningf("Error renewing lease: %s", err)
+				}
+			}
+		}
 
-	c.Infof("%d subscriptions completed in %s", subscriptionCount, time.Since(started))
+		c.Infof("%d subscriptions completed in %s", subscriptionCount, time.Since(started))
 
-	return nil
+		return nil
+	})
 }
 
-func AreNewEntriesAvailable(c appengine.Context, subscriptions []Subscription) (bool, error) {
+func (ds *Datastore)AreNewEntriesAvailable(subscriptions []Subscription) (bool, error) {
+	c := ds.c
 	for _, subscription := range subscriptions {
-		q := datastore.NewQuery("EntryMeta").Ancestor(subscription.Feed).Filter("UpdateIndex >", subscription.MaxUpdateIndex).KeysOnly().Limit(1)
+		feedKey := datastore.NewKey(c, "Feed", subscription.FeedURL, 0, nil)
+		q := datastore.NewQuery("EntryMeta").Ancestor(feedKey).Filter("UpdateIndex >", subscription.MaxUpdateIndex).KeysOnly().Limit(1)
 		if entryMetaKeys, err := q.GetAll(c, nil); err != nil {
 			return false, err
 		} else if len(entryMetaKeys) > 0 {
@@ -1401,35 +2707,135 @@ func AreNewEntriesAvailable(c appengine.Context, subscriptions []Subscription) (
 	return false, nil
 }
 
-func UpdateUnreadCounts(c appengine.Context, ch chan<- Subscription, subscriptionKey *datastore.Key, subscription Subscription) {
-	originalSubscriptionCount := subscription.UnreadCount
+// UpdateUnreadCount recounts the unread articles of a subscription,
+// correcting the stored count if it has drifted
+func (ds *Datastore)UpdateUnreadCount(ref SubscriptionRef) error {
+	c := ds.c
+	subscriptionKey, err := ref.key(c)
+	if err != nil {
+		return err
+	}
+
+	return withLease(c, userLeaseResource(ref.UserID), func(lease Lease) error {
+		subscription := subscriptionEntity{}
+		if err := datastore.Get(c, subscriptionKey, &subscription); err != nil && !IsFieldMismatch(err) {
+			c.Errorf("Error getting subscription: %s", err)
+			return err
+		}
+
+		originalSubscriptionCount := subscription.UnreadCount
+		count, err := unreadCount(c, subscriptionKey, subscription.ReadRange)
+		if err != nil {
+			c.Errorf("Error getting unread count: %s", err)
+			return err
+		}
+
+		if count != originalSubscriptionCount {
+			subscription.UnreadCount = count
+			err := datastore.RunInTransaction(c, func(c appengine.Context) error {
+				if err := checkLease(c, lease); err != nil {
+					return err
+				}
+
+				_, err := datastore.Put(c, subscriptionKey, &subscription)
+				return err
+			}, &datastore.TransactionOptions { XG: true })
+
+			if err != nil {
+				c.Errorf("Error writing unread count: %s", err)
+				return err
+			}
+
+			c.Infof("Subscription count corrected to %d (was: %d)", 
+				subscription.UnreadCount, originalSubscriptionCount)
+		}
+
+		return nil
+	})
+}
+
+// unreadCount counts the unread articles of a subscription, less
+// those covered by its read range
+func unreadCount(c appengine.Context, subscriptionKey *datastore.Key, readRange ReadRange) (int, error) {
 	q := datastore.NewQuery("Article").Ancestor(subscriptionKey).Filter("Properties =", "unread")
+	if readRange.IsZero() {
+		return q.Count(c)
+	}
 
-	if count, err := q.Count(c); err != nil {
-		c.Errorf("Error getting unread count: %s", err)
-		goto done
-	} else if count != originalSubscriptionCount {
-		subscription.UnreadCount = count
-		if _, err := datastore.Put(c, subscriptionKey, &subscription); err != nil {
-			c.Errorf("Error writing unread count: %s", err)
-			goto done
+	count := 0
+	for t := q.Run(c); ; {
+		entity := new(articleEntity)
+		if _, err := t.Next(entity); err == datastore.Done {
+			break
+		} else if err != nil && !IsFieldMismatch(err) {
+			return 0, err
+		}
+
+		if !readRange.Covers(entity.Article) {
+			count++
 		}
 	}
 
-	if originalSubscriptionCount != subscription.UnreadCount {
-		c.Infof("Subscription count corrected to %d (was: %d)", 
-			subscription.UnreadCount, originalSubscriptionCount)
+	return count, nil
+}
+
+// Users iterates over the IDs of all users, resuming from cursor,
+// if specified
+func (ds *Datastore)Users(cursor string) (UserIterator, error) {
+	c := ds.c
+	q := datastore.NewQuery("User").KeysOnly()
+	if cursor != "" {
+		if decoded, err := datastore.DecodeCursor(cursor); err != nil {
+			return nil, err
+		} else {
+			q = q.Start(decoded)
+		}
 	}
 
-done:
-	if ch != nil {
-		ch<- subscription
+	return &userIterator {
+		t: q.Run(c),
+	}, nil
+}
+
+// Subscriptions iterates over the subscriptions of all users,
+// resuming from cursor, if specified
+func (ds *Datastore)Subscriptions(cursor string) (SubscriptionIterator, error) {
+	c := ds.c
+	q := datastore.NewQuery("Subscription").KeysOnly()
+	if cursor != "" {
+		if decoded, err := datastore.DecodeCursor(cursor); err != nil {
+			return nil, err
+		} else {
+			q = q.Start(decoded)
+		}
+	}
+
+	return &subscriptionIterator {
+		t: q.Run(c),
+	}, nil
+}
+
+// FeedsDue iterates over the feeds scheduled for an update before
+// the specified time, resuming from cursor, if specified
+func (ds *Datastore)FeedsDue(before time.Time, cursor string) (FeedMetaIterator, error) {
+	c := ds.c
+	q := datastore.NewQuery("FeedMeta").Filter("NextFetch <", before)
+	if cursor != "" {
+		if decoded, err := datastore.DecodeCursor(cursor); err != nil {
+			return nil, err
+		} else {
+			q = q.Start(decoded)
+		}
 	}
+
+	return &feedMetaIterator {
+		t: q.Run(c),
+	}, nil
 }
 
-func (article Article) LikeCount(c appengine.Context) (int, error) {
+func likeCount(c appengine.Context, entryKey *datastore.Key) (int, error) {
 	count := 0
-	q := datastore.NewQuery("LikeCountShard").Filter("Entry =", article.Entry)
+	q := datastore.NewQuery("LikeCountShard").Filter("Entry =", entryKey)
 	for t := q.Run(c); ; {
 		var shard likeCountShard
 		if _, err := t.Next(&shard); err == datastore.Done {
@@ -1443,15 +2849,15 @@ func (article Article) LikeCount(c appengine.Context) (int, error) {
 	return count, nil
 }
 
-func (article Article) updateLikeCount(c appengine.Context, delta int) error {
+func updateLikeCount(c appengine.Context, entryKey *datastore.Key, delta int) error {
 	err := datastore.RunInTransaction(c, func(c appengine.Context) error {
 		shardName := fmt.Sprintf("%s#%d", 
-			article.Entry.StringID(), rand.Intn(likeCountShards))
+			entryKey.StringID(), rand.Intn(likeCountShards))
 		key := datastore.NewKey(c, "LikeCountShard", shardName, 0, nil)
 
 		var shard likeCountShard
 		if err := datastore.Get(c, key, &shard); err == datastore.ErrNoSuchEntity {
-			shard.Entry = article.Entry
+			shard.Entry = entryKey
 		} else if err != nil {
 			return err
 		}
@@ -1511,18 +2917,19 @@ func updateSubscriberCount(c appengine.Context, feedURL string, delta int) error
 	return nil
 }
 
-func LoadArticleExtras(c appengine.Context, ref ArticleRef) (ArticleExtras, error) {
+func (ds *Datastore)LoadArticleExtras(ref ArticleRef) (ArticleExtras, error) {
+	c := ds.c
 	articleKey, err := ref.key(c)
 	if err != nil {
 		return ArticleExtras{}, err
 	}
 
-	article := new(Article)
-	if err := datastore.Get(c, articleKey, article); err != nil {
+	article := new(articleEntity)
+	if err := datastore.Get(c, articleKey, article); err != nil && !IsFieldMismatch(err) {
 		return ArticleExtras{}, err
 	}
 
-	if likeCount, err := article.LikeCount(c); err != nil {
+	if likeCount, err := likeCount(c, article.Entry); err != nil {
 		return ArticleExtras{}, err
 	} else {
 		return ArticleExtras {
@@ -1530,3 +2937,154 @@ func LoadArticleExtras(c appengine.Context, ref ArticleRef) (ArticleExtras, erro
 		}, nil
 	}
 }
+
+func (ds *Datastore)ItemAliases(userID UserID, ids []int64) ([]ItemAlias, error) {
+	c := ds.c
+	userKey, err := User{ID: string(userID)}.key(c)
+	if err != nil {
+		return nil, err
+	}
+
+	keys := make([]*datastore.Key, len(ids))
+	for i, id := range ids {
+		keys[i] = datastore.NewKey(c, "ItemAlias", "", id, userKey)
+	}
+
+	aliases := make([]ItemAlias, len(ids))
+	var multiError appengine.MultiError
+	if err := datastore.GetMulti(c, keys, aliases); err != nil {
+		if me, ok := err.(appengine.MultiError); ok {
+			multiError = me
+		} else {
+			return nil, err
+		}
+	}
+
+	found := make([]ItemAlias, 0, len(ids))
+	for i, alias := range aliases {
+		if multiError != nil && multiError[i] != nil {
+			if multiError[i] == datastore.ErrNoSuchEntity {
+				continue
+			} else if !IsFieldMismatch(multiError[i]) {
+				return nil, multiError[i]
+			}
+		}
+
+		alias.ID = ids[i]
+		found = append(found, alias)
+	}
+
+	return found, nil
+}
+
+func (ds *Datastore)SaveItemAliases(userID UserID, aliases []ItemAlias) error {
+	c := ds.c
+	userKey, err := User{ID: string(userID)}.key(c)
+	if err != nil {
+		return err
+	}
+
+	keys := make([]*datastore.Key, len(aliases))
+	for i, alias := range aliases {
+		keys[i] = datastore.NewKey(c, "ItemAlias", "", alias.ID, userKey)
+	}
+
+	if _, err := datastore.PutMulti(c, keys, aliases); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (rule FilterRule)key(c appengine.Context) (*datastore.Key, error) {
+	userKey, err := rule.UserID.key(c)
+	if err != nil {
+		return nil, err
+	}
+
+	if kind, id, err := UnformatId(rule.ID); err != nil {
+		return nil, err
+	} else if kind != "rule" {
+		return nil, errors.New("Expecting rule ID; found: " + kind)
+	} else {
+		return datastore.NewKey(c, "FilterRule", "", id, userKey), nil
+	}
+}
+
+// filterRules returns the rules of the user, oldest first
+func filterRules(c appengine.Context, userKey *datastore.Key) ([]FilterRule, error) {
+	var rules []FilterRule
+
+	q := datastore.NewQuery("FilterRule").Ancestor(userKey).Order("Created")
+	if ruleKeys, err := q.GetAll(c, &rules); err != nil && !IsFieldMismatch(err) {
+		return nil, err
+	} else {
+		for i, ruleKey := range ruleKeys {
+			rules[i].ID = FormatId("rule", ruleKey.IntID())
+			rules[i].UserID = UserID(userKey.StringID())
+		}
+	}
+
+	return rules, nil
+}
+
+func (ds *Datastore)FilterRules(userID UserID) ([]FilterRule, error) {
+	c := ds.c
+	userKey, err := userID.key(c)
+	if err != nil {
+		return nil, err
+	}
+
+	return filterRules(c, userKey)
+}
+
+// SaveFilterRule creates the rule if it has no ID, or replaces it
+func (ds *Datastore)SaveFilterRule(rule *FilterRule) error {
+	c := ds.c
+	var ruleKey *datastore.Key
+	if rule.ID == "" {
+		userKey, err := rule.UserID.key(c)
+		if err != nil {
+			return err
+		}
+
+		rule.Created = time.Now()
+		ruleKey = datastore.NewIncompleteKey(c, "FilterRule", userKey)
+	} else {
+		var err error
+		if ruleKey, err = rule.key(c); err != nil {
+			return err
+		}
+
+		existing := FilterRule{}
+		if err := datastore.Get(c, ruleKey, &existing); err == datastore.ErrNoSuchEntity {
+			return errors.New("Rule not found")
+		} else if err != nil && !IsFieldMismatch(err) {
+			return err
+		}
+		rule.Created = existing.Created
+	}
+
+	if completeKey, err := datastore.Put(c, ruleKey, rule); err != nil {
+		return err
+	} else {
+		rule.ID = FormatId("rule", completeKey.IntID())
+	}
+
+	return nil
+}
+
+func (ds *Datastore)DeleteFilterRule(userID UserID, ruleID string) error {
+	c := ds.c
+	rule := FilterRule {
+		ID: ruleID,
+		UserID: userID,
+	}
+
+	ruleKey, err := rule.key(c)
+	if err != nil {
+		return err
+	}
+
+	return datastore.Delete(c, ruleKey)
+}
@@ -0,0 +1,732 @@
+// +build !appengine
+
+/*****************************************************************************
+ **
+ ** Gofr
+ ** https://github.com/pokebyte/Gofr
+ ** Copyright (C) 2013-2017 Akop Karapetyan
+ **
+ ** This program is free software; you can redistribute it and/or modify
+ ** it under the terms of the GNU General Public License as published by
+ ** the Free Software Foundation; either version 2 of the License, or
+ ** (at your option) any later version.
+ **
+ ** This program is distributed in the hope that it will be useful,
+ ** but WITHOUT ANY WARRANTY; without even the implied warranty of
+ ** MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ ** GNU General Public License for more details.
+ **
+ ** You should have received a copy of the GNU General Public License
+ ** along with this program; if not, write to the Free Software
+ ** Foundation, Inc., 675 Mass Ave, Cambridge, MA 02139, USA.
+ **
+ ******************************************************************************
+ */
+ 
+package embedded
+
+import (
+	"github.com/boltdb/bolt"
+	"sort"
+	"storage"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	articlePageSize = 40
+	// Recent articles ranked by the "magic" order
+	magicWindowSize = 100
+)
+
+// articlesByTime sorts articles the way the Datastore returns
+// them: most recently fetched (then published) first
+type articlesByTime []storage.Article
+
+func (articles articlesByTime)Len() int {
+	return len(articles)
+}
+
+func (articles articlesByTime)Swap(i, j int) {
+	articles[i], articles[j] = articles[j], articles[i]
+}
+
+func (articles articlesByTime)Less(i, j int) bool {
+	if !articles[i].Fetched.Equal(articles[j].Fetched) {
+		return articles[i].Fetched.After(articles[j].Fetched)
+	}
+
+	return articles[i].Published.After(articles[j].Published)
+}
+
+// articlesByPublished sorts articles by publication date, most
+// recent (then most recently fetched) first
+type articlesByPublished []storage.Article
+
+func (articles articlesByPublished)Len() int {
+	return len(articles)
+}
+
+func (articles articlesByPublished)Swap(i, j int) {
+	articles[i], articles[j] = articles[j], articles[i]
+}
+
+func (articles articlesByPublished)Less(i, j int) bool {
+	if !articles[i].Published.Equal(articles[j].Published) {
+		return articles[i].Published.After(articles[j].Published)
+	}
+
+	return articles[i].Fetched.After(articles[j].Fetched)
+}
+
+// articlesByFeed sorts articles by the title of their subscription
+type articlesByFeed struct {
+	Articles []storage.Article
+	Titles map[string]string
+}
+
+func (a articlesByFeed)Len() int {
+	return len(a.Articles)
+}
+
+func (a articlesByFeed)Swap(i, j int) {
+	a.Articles[i], a.Articles[j] = a.Articles[j], a.Articles[i]
+}
+
+func (a articlesByFeed)Less(i, j int) bool {
+	x, y := a.Titles[a.Articles[i].Source], a.Titles[a.Articles[j].Source]
+	if x != y {
+		return x < y
+	}
+
+	return a.Articles[i].Source < a.Articles[j].Source
+}
+
+// articlesByLikes sorts articles by like count, most liked first
+type articlesByLikes struct {
+	Articles []storage.Article
+	LikeCounts map[string]int
+}
+
+func (a articlesByLikes)Len() int {
+	return len(a.Articles)
+}
+
+func (a articlesByLikes)Swap(i, j int) {
+	a.Articles[i], a.Articles[j] = a.Articles[j], a.Articles[i]
+}
+
+func (a articlesByLikes)Less(i, j int) bool {
+	x, y := a.Articles[i], a.Articles[j]
+	return a.LikeCounts[x.Source + "\n" + x.ID] > a.LikeCounts[y.Source + "\n" + y.ID]
+}
+
+// articleBucket returns the bucket holding the articles of a
+// subscription, keyed by entry GUID
+func articleBucket(tx *bolt.Tx, userID storage.UserID, subscriptionID string) (*bolt.Bucket, error) {
+	articles, err := userBucket(tx, userID, articlesBucket)
+	if err != nil {
+		return nil, err
+	}
+
+	return bucket(tx, articles, subscriptionID)
+}
+
+func deleteArticles(tx *bolt.Tx, userID storage.UserID, subscriptionID string) error {
+	if err := unindexArticles(tx, userID, subscriptionID); err != nil {
+		return err
+	}
+
+	articles, err := userBucket(tx, userID, articlesBucket)
+	if err != nil {
+		return err
+	}
+
+	if err := articles.DeleteBucket([]byte(subscriptionID)); err != nil && err != bolt.ErrBucketNotFound {
+		return err
+	}
+
+	return nil
+}
+
+// updateArticles applies update to each article of the
+// subscription, writing back those for which it returns true
+func updateArticles(tx *bolt.Tx, userID storage.UserID, subscriptionID string, update func(article *articleRecord) bool) error {
+	articles, err := articleBucket(tx, userID, subscriptionID)
+	if err != nil {
+		return err
+	}
+
+	updated := make(map[string]*articleRecord)
+	err = articles.ForEach(func(k, v []byte) error {
+		article := new(articleRecord)
+		if err := decode(v, article); err != nil {
+			return err
+		} else if update(article) {
+			updated[string(k)] = article
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return err
+	}
+
+	// Buckets can't be modified while iterating
+	for key, article := range updated {
+		if err := put(articles, key, article); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func containsTag(tags []string, tag string) bool {
+	for _, t := range tags {
+		if t == tag {
+			return true
+		}
+	}
+
+	return false
+}
+
+// loadEntry fills in the details and media of an article from
+// its entry
+func loadEntry(tx *bolt.Tx, article *storage.Article, feedURL string) error {
+	entry := entryRecord{}
+	entries := tx.Bucket(entriesBucket).Bucket([]byte(feedURL))
+	if _, err := get(entries, article.ID, &entry); err != nil {
+		return err
+	}
+
+	if entry.HasMedia {
+		article.Media = make([]*storage.EntryMedia, len(entry.Media))
+		for j, _ := range entry.Media {
+			article.Media[j] = &entry.Media[j]
+		}
+	}
+
+	article.Details = &entry.Entry
+	if article.Tags == nil {
+		article.Tags = make([]string, 0)
+	}
+
+	return nil
+}
+
+func (store *Store)NewArticlePage(filter storage.ArticleFilter, start string) (*storage.ArticlePage, error) {
+	offset := 0
+	if start != "" {
+		if o, err := strconv.Atoi(start); err != nil {
+			return nil, err
+		} else {
+			offset = o
+		}
+	}
+
+	articles := make([]storage.Article, 0)
+	feedURLs := make(map[string]string)
+	titles := make(map[string]string)
+	total := 0
+
+	err := store.db.View(func(tx *bolt.Tx) error {
+		records, err := subscriptionsWithin(tx, filter.ArticleScope)
+		if err != nil {
+			return err
+		}
+
+		for _, record := range records {
+			subscriptionArticles, err := articleBucket(tx, filter.UserID, record.ID)
+			if err != nil {
+				return err
+			} else if subscriptionArticles == nil {
+				continue
+			}
+
+			titles[record.ID] = strings.ToLower(record.Title)
+			err = subscriptionArticles.ForEach(func(k, v []byte) error {
+				article := articleRecord{}
+				if err := decode(v, &article); err != nil {
+					return err
+				}
+
+				// Source is the subscription, which is not necessarily
+				// keyed by the URL of the feed (e.g. migrated feeds)
+				article.Source = record.ID
+				record.ReadRange.Apply(&article.Article)
+
+				if !filter.Matches(article.Article) {
+					return nil
+				} else if filter.Author != "" {
+					entry := entryRecord{}
+					if _, err := get(tx.Bucket(entriesBucket).Bucket([]byte(article.FeedURL)), article.ID, &entry); err != nil {
+						return err
+					} else if !filter.MatchesEntry(&entry.Entry) {
+						return nil
+					}
+				}
+				feedURLs[record.ID + "\n" + article.ID] = article.FeedURL
+				articles = append(articles, article.Article)
+
+				return nil
+			})
+
+			if err != nil {
+				return err
+			}
+		}
+
+		switch filter.Order {
+		case storage.OrderOldest:
+			sort.Sort(sort.Reverse(articlesByTime(articles)))
+		case storage.OrderPublishedNewest:
+			sort.Sort(articlesByPublished(articles))
+		case storage.OrderPublishedOldest:
+			sort.Sort(sort.Reverse(articlesByPublished(articles)))
+		case storage.OrderByFeed:
+			sort.Sort(articlesByTime(articles))
+			sort.Stable(articlesByFeed { articles, titles })
+		case storage.OrderMagic:
+			sort.Sort(articlesByTime(articles))
+			if len(articles) > magicWindowSize {
+				articles = articles[:magicWindowSize]
+			}
+
+			likeCounts := make(map[string]int)
+			for _, article := range articles {
+				key := article.Source + "\n" + article.ID
+				entry := entryRecord{}
+				if _, err := get(tx.Bucket(entriesBucket).Bucket([]byte(feedURLs[key])), article.ID, &entry); err != nil {
+					return err
+				}
+				likeCounts[key] = entry.LikeCount
+			}
+			sort.Stable(articlesByLikes { articles, likeCounts })
+		default:
+			sort.Sort(articlesByTime(articles))
+		}
+
+		total = len(articles)
+		if offset > len(articles) {
+			offset = len(articles)
+		}
+		articles = articles[offset:]
+		if len(articles) > articlePageSize {
+			articles = articles[:articlePageSize]
+		}
+
+		for i, _ := range articles {
+			article := &articles[i]
+			if err := loadEntry(tx, article, feedURLs[article.Source + "\n" + article.ID]); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	page := storage.ArticlePage {
+		Articles: articles,
+	}
+
+	if offset + len(articles) < total {
+		page.Continue = strconv.Itoa(offset + len(articles))
+	}
+
+	return &page, nil
+}
+
+func (store *Store)Articles(refs []storage.ArticleRef) ([]storage.Article, error) {
+	articles := make([]storage.Article, 0, len(refs))
+	err := store.db.View(func(tx *bolt.Tx) error {
+		ranges := readRanges{}
+		for _, ref := range refs {
+			subscriptionArticles, err := articleBucket(tx, ref.UserID, ref.SubscriptionID)
+			if err != nil {
+				return err
+			} else if subscriptionArticles == nil {
+				continue
+			}
+
+			article := articleRecord{}
+			if found, err := get(subscriptionArticles, ref.ArticleID, &article); err != nil {
+				return err
+			} else if !found {
+				continue
+			}
+
+			article.Source = ref.SubscriptionID
+			if subscribed, err := ranges.apply(tx, ref.UserID, ref.SubscriptionID, &article.Article); err != nil {
+				return err
+			} else if !subscribed {
+				continue
+			} else if err := loadEntry(tx, &article.Article, article.FeedURL); err != nil {
+				return err
+			}
+
+			articles = append(articles, article.Article)
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return articles, nil
+}
+
+// updateArticle loads an article, applies a change and writes it
+// back, along with the subscription it belongs to and the article
+// counts
+func (store *Store)updateArticle(ref storage.ArticleRef, update func(tx *bolt.Tx, record *subscriptionRecord, article *articleRecord) error) error {
+	return store.updateSubscriptionRecord(ref.SubscriptionRef, func(tx *bolt.Tx, record *subscriptionRecord) error {
+		articles, err := articleBucket(tx, ref.UserID, record.ID)
+		if err != nil {
+			return err
+		}
+
+		article := new(articleRecord)
+		if found, err := get(articles, ref.ArticleID, article); err != nil {
+			return err
+		} else if !found {
+			return errNotFound
+		}
+
+		deltas := storage.ArticleCountDeltas{}
+		deltas.Remove(record.FolderID, article.Article)
+
+		if err := update(tx, record, article); err != nil {
+			return err
+		}
+
+		deltas.Add(record.FolderID, article.Article)
+		if err := updateArticleCounts(tx, ref.UserID, deltas); err != nil {
+			return err
+		}
+
+		return put(articles, ref.ArticleID, article)
+	})
+}
+
+func (store *Store)SetProperty(ref storage.ArticleRef, propertyName string, propertyValue bool) ([]string, error) {
+	var properties []string
+	err := store.updateArticle(ref, func(tx *bolt.Tx, record *subscriptionRecord, article *articleRecord) error {
+		// Articles covered by a read range are read, though they
+		// may not have been rewritten yet
+		record.ReadRange.Apply(&article.Article)
+
+		properties = article.Properties
+		if propertyValue == article.HasProperty(propertyName) {
+			return nil
+		}
+
+		wasUnread := article.IsUnread()
+		wasLiked := article.IsLiked()
+
+		article.SetProperty(propertyName, propertyValue)
+		article.Changed = time.Now()
+		properties = article.Properties
+
+		if wasUnread != article.IsUnread() {
+			// No longer the read range's doing
+			article.MarkedRead = time.Time{}
+			if wasUnread {
+				record.UnreadCount--
+			} else {
+				record.UnreadCount++
+			}
+
+			if record.UnreadCount < 0 {
+				record.UnreadCount = 0
+			}
+		}
+
+		if wasLiked != article.IsLiked() {
+			delta := 1
+			if wasLiked {
+				delta = -1
+			}
+
+			entries := tx.Bucket(entriesBucket).Bucket([]byte(article.FeedURL))
+			entry := entryRecord{}
+
+			if found, err := get(entries, article.ID, &entry); err != nil {
+				return err
+			} else if found {
+				entry.LikeCount += delta
+				return put(entries, article.ID, entry)
+			}
+		}
+
+		return nil
+	})
+
+	return properties, err
+}
+
+func (store *Store)SetTags(ref storage.ArticleRef, tags []string) ([]string, error) {
+	err := store.updateArticle(ref, func(tx *bolt.Tx, record *subscriptionRecord, article *articleRecord) error {
+		article.Tags = tags
+		return createMissingTags(tx, ref.UserID, tags)
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return tags, nil
+}
+
+// MarkAsRead sets the read range of the subscriptions within the
+// scope. Articles are rewritten by ApplyReadRanges
+func (store *Store)MarkAsRead(scope storage.ArticleScope, readRange storage.ReadRange) error {
+	return store.db.Update(func(tx *bolt.Tx) error {
+		records, err := subscriptionsWithin(tx, scope)
+		if err != nil {
+			return err
+		}
+
+		for _, record := range records {
+			if !record.ReadRange.IsZero() && !readRange.IsUnbounded() {
+				// Bounded ranges can't be merged; rewrite the
+				// pending one first
+				if _, err := applyReadRange(tx, scope.UserID, record); err != nil {
+					return err
+				}
+			}
+
+			record.ReadRange = readRange
+			if readRange.IsUnbounded() {
+				record.UnreadCount = 0
+			}
+
+			if err := saveSubscription(tx, scope.UserID, record); err != nil {
+				return err
+			}
+		}
+
+		undoRecord := storage.UndoRecord {
+			UserID: scope.UserID,
+			Action: storage.UndoMarkAsRead,
+			FolderID: scope.FolderID,
+			SubscriptionID: scope.SubscriptionID,
+			Marked: readRange.Marked,
+		}
+		if scope.SubscriptionID != "" && len(records) > 0 {
+			undoRecord.Title = records[0].Title
+		}
+
+		return saveUndoRecord(tx, &undoRecord)
+	})
+}
+
+// ApplyReadRanges marks read the articles covered by the read ranges
+// of the subscriptions within the scope, then clears the ranges.
+// It returns the number of articles marked
+func (store *Store)ApplyReadRanges(scope storage.ArticleScope) (int, error) {
+	marked := 0
+	err := store.db.Update(func(tx *bolt.Tx) error {
+		records, err := subscriptionsWithin(tx, scope)
+		if err != nil {
+			return err
+		}
+
+		for _, record := range records {
+			if record.ReadRange.IsZero() {
+				continue
+			}
+
+			if written, err := applyReadRange(tx, scope.UserID, record); err != nil {
+				return err
+			} else {
+				marked += written
+			}
+
+			if err := saveSubscription(tx, scope.UserID, record); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+
+	return marked, err
+}
+
+// applyReadRange rewrites the articles covered by the subscription's
+// read range, then clears the range and recounts unread articles.
+// The record is not saved
+func applyReadRange(tx *bolt.Tx, userID storage.UserID, record *subscriptionRecord) (int, error) {
+	marked := 0
+	unread := 0
+	deltas := storage.ArticleCountDeltas{}
+	err := updateArticles(tx, userID, record.ID, func(article *articleRecord) bool {
+		previous := article.Article
+		if record.ReadRange.Apply(&article.Article) {
+			deltas.Remove(record.FolderID, previous)
+			deltas.Add(record.FolderID, article.Article)
+			marked++
+			return true
+		} else if article.IsUnread() {
+			unread++
+		}
+
+		return false
+	})
+
+	if err != nil {
+		return marked, err
+	} else if err := updateArticleCounts(tx, userID, deltas); err != nil {
+		return marked, err
+	}
+
+	record.ReadRange = storage.ReadRange{}
+	record.UnreadCount = unread
+
+	return marked, nil
+}
+
+// readRanges caches the read ranges of subscriptions, by ID.
+// Removed subscriptions (whose articles are kept until their undo
+// record is discarded) have none
+type readRanges map[string]*storage.ReadRange
+
+// apply marks the article read, if it's covered by the read range
+// of its subscription. It returns false if the subscription was
+// removed
+func (ranges readRanges)apply(tx *bolt.Tx, userID storage.UserID, subscriptionID string, article *storage.Article) (bool, error) {
+	readRange, ok := ranges[subscriptionID]
+	if !ok {
+		subscriptions, err := userBucket(tx, userID, subscriptionsBucket)
+		if err != nil {
+			return false, err
+		}
+
+		record := subscriptionRecord{}
+		if found, err := get(subscriptions, subscriptionID, &record); err != nil {
+			return false, err
+		} else if found {
+			readRange = &record.ReadRange
+		}
+
+		ranges[subscriptionID] = readRange
+	}
+
+	if readRange == nil {
+		return false, nil
+	}
+
+	readRange.Apply(article)
+	return true, nil
+}
+
+// DeleteArticlesWithinScope removes the articles of subscriptions
+// falling within scope. Articles of deleted subscriptions are
+// removed along with the subscription, so there's usually nothing
+// left to do by the time this is called
+func (store *Store)DeleteArticlesWithinScope(scope storage.ArticleScope) error {
+	return store.db.Update(func(tx *bolt.Tx) error {
+		records, err := subscriptionsWithin(tx, scope)
+		if err != nil {
+			return err
+		}
+
+		for _, record := range records {
+			if err := deleteArticles(tx, scope.UserID, record.ID); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+func (store *Store)LoadArticleExtras(ref storage.ArticleRef) (storage.ArticleExtras, error) {
+	extras := storage.ArticleExtras{}
+	err := store.db.View(func(tx *bolt.Tx) error {
+		record, err := loadSubscription(tx, ref.SubscriptionRef)
+		if err != nil {
+			return err
+		} else if record == nil {
+			return errNotFound
+		}
+
+		articles, err := articleBucket(tx, ref.UserID, record.ID)
+		if err != nil {
+			return err
+		}
+
+		article := articleRecord{}
+		if found, err := get(articles, ref.ArticleID, &article); err != nil {
+			return err
+		} else if !found {
+			return errNotFound
+		}
+
+		entries := tx.Bucket(entriesBucket).Bucket([]byte(article.FeedURL))
+		entry := entryRecord{}
+
+		if _, err := get(entries, article.ID, &entry); err != nil {
+			return err
+		}
+
+		extras.LikeCount = entry.LikeCount
+		return nil
+	})
+
+	return extras, err
+}
+
+func (store *Store)ItemAliases(userID storage.UserID, ids []int64) ([]storage.ItemAlias, error) {
+	aliases := make([]storage.ItemAlias, 0, len(ids))
+	err := store.db.View(func(tx *bolt.Tx) error {
+		itemAliases, err := userBucket(tx, userID, itemAliasesBucket)
+		if err != nil {
+			return err
+		}
+
+		for _, id := range ids {
+			alias := storage.ItemAlias{}
+			if found, err := get(itemAliases, strconv.FormatInt(id, 10), &alias); err != nil {
+				return err
+			} else if found {
+				aliases = append(aliases, alias)
+			}
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return aliases, nil
+}
+
+func (store *Store)SaveItemAliases(userID storage.UserID, aliases []storage.ItemAlias) error {
+	return store.db.Update(func(tx *bolt.Tx) error {
+		itemAliases, err := userBucket(tx, userID, itemAliasesBucket)
+		if err != nil {
+			return err
+		}
+
+		for _, alias := range aliases {
+			if err := put(itemAliases, strconv.FormatInt(alias.ID, 10), alias); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
@@ -0,0 +1,122 @@
+/*****************************************************************************
+ **
+ ** Gofr
+ ** https://github.com/pokebyte/Gofr
+ ** Copyright (C) 2013-2017 Akop Karapetyan
+ **
+ ** This program is free software; you can redistribute it and/or modify
+ ** it under the terms of the GNU General Public License as published by
+ ** the Free Software Foundation; either version 2 of the License, or
+ ** (at your option) any later version.
+ **
+ ** This program is distributed in the hope that it will be useful,
+ ** but WITHOUT ANY WARRANTY; without even the implied warranty of
+ ** MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ ** GNU General Public License for more details.
+ **
+ ** You should have received a copy of the GNU General Public License
+ ** along with this program; if not, write to the Free Software
+ ** Foundation, Inc., 675 Mass Ave, Cambridge, MA 02139, USA.
+ **
+ ******************************************************************************
+ */
+ 
+package embedded
+
+import (
+	"storage"
+	"testing"
+	"time"
+)
+
+// expectUnread checks which of the articles are unread
+func expectUnread(t *testing.T, articles map[string]storage.Article, expected map[string]bool) {
+	for id, unread := range expected {
+		if article, ok := articles[id]; !ok {
+			t.Errorf("Article %s missing", id)
+		} else if article.IsUnread() != unread {
+			t.Errorf("Article %s: expected unread to be %t", id, unread)
+		}
+	}
+}
+
+func TestReadRange(t *testing.T) {
+	store, done := openTestStore(t)
+	defer done()
+
+	feed := testFeed("http://example.com/feed", "a", "b", "c")
+	ref := subscribeToTestFeed(t, store, storage.FolderRef { UserID: testUserID }, feed, time.Now().Add(-time.Minute))
+	scope := storage.ArticleScope(ref)
+
+	if err := store.MarkAsRead(scope, storage.ReadRange { Marked: time.Now() }); err != nil {
+		t.Fatalf("Error marking read: %s", err)
+	}
+
+	// Read wherever they're loaded, though counted as unread until
+	// the range is applied
+	expectUnread(t, testArticles(t, store, scope), map[string]bool { "a": false, "b": false, "c": false })
+	expectCounts(t, store, map[string]storage.ArticleCounts {
+		storage.UserCounter: { Unread: 3 },
+	})
+
+	// Changed since, and fetched since
+	if _, err := store.SetProperty(storage.ArticleRef { SubscriptionRef: ref, ArticleID: "a" }, "read", false); err != nil {
+		t.Fatalf("Error marking unread: %s", err)
+	}
+
+	feed.Entries = append(testFeed(feed.URL, "d").Entries, feed.Entries...)
+	if err := store.UpdateFeed(feed, nil, time.Now(), storage.FetchInfo { StatusCode: 200 }); err != nil {
+		t.Fatalf("Error updating feed: %s", err)
+	} else if _, err := store.UpdateSubscription(feed.URL, ref); err != nil {
+		t.Fatalf("Error updating subscription: %s", err)
+	}
+
+	if marked, err := store.ApplyReadRanges(scope); err != nil {
+		t.Fatalf("Error applying read ranges: %s", err)
+	} else if marked != 2 {
+		t.Errorf("Expected 2 articles marked, got %d", marked)
+	}
+
+	expectUnread(t, testArticles(t, store, scope), map[string]bool { "a": true, "b": false, "c": false, "d": true })
+	expectCounts(t, store, map[string]storage.ArticleCounts {
+		storage.UserCounter: { Unread: 2 },
+	})
+
+	// Undoing brings back what the range marked, and nothing else
+	if err := store.Undo(latestUndoRecord(t, store)); err != nil {
+		t.Fatalf("Error undoing: %s", err)
+	}
+
+	expectUnread(t, testArticles(t, store, scope), map[string]bool { "a": true, "b": true, "c": true, "d": true })
+	expectCounts(t, store, map[string]storage.ArticleCounts {
+		storage.UserCounter: { Unread: 4 },
+	})
+}
+
+func TestBoundedReadRange(t *testing.T) {
+	store, done := openTestStore(t)
+	defer done()
+
+	ref := subscribeToTestFeed(t, store, storage.FolderRef { UserID: testUserID }, testFeed("http://example.com/feed", "a", "b", "c"), time.Now().Add(-time.Minute))
+	scope := storage.ArticleScope(ref)
+
+	// Older than b
+	readRange := storage.ReadRange {
+		Marked: time.Now(),
+		Before: testArticles(t, store, scope)["b"].Position(),
+	}
+	if err := store.MarkAsRead(scope, readRange); err != nil {
+		t.Fatalf("Error marking read: %s", err)
+	}
+
+	expectUnread(t, testArticles(t, store, scope), map[string]bool { "a": true, "b": true, "c": false })
+
+	if _, err := store.ApplyReadRanges(scope); err != nil {
+		t.Fatalf("Error applying read ranges: %s", err)
+	}
+
+	expectUnread(t, testArticles(t, store, scope), map[string]bool { "a": true, "b": true, "c": false })
+	expectCounts(t, store, map[string]storage.ArticleCounts {
+		storage.UserCounter: { Unread: 2 },
+	})
+}
@@ -0,0 +1,226 @@
+// +build !appengine
+
+/*****************************************************************************
+ **
+ ** Gofr
+ ** https://github.com/pokebyte/Gofr
+ ** Copyright (C) 2013-2017 Akop Karapetyan
+ **
+ ** This program is free software; you can redistribute it and/or modify
+ ** it under the terms of the GNU General Public License as published by
+ ** the Free Software Foundation; either version 2 of the License, or
+ ** (at your option) any later version.
+ **
+ ** This program is distributed in the hope that it will be useful,
+ ** but WITHOUT ANY WARRANTY; without even the implied warranty of
+ ** MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ ** GNU General Public License for more details.
+ **
+ ** You should have received a copy of the GNU General Public License
+ ** along with this program; if not, write to the Free Software
+ ** Foundation, Inc., 675 Mass Ave, Cambridge, MA 02139, USA.
+ **
+ ******************************************************************************
+ */
+ 
+package embedded
+
+import (
+	"github.com/boltdb/bolt"
+	"storage"
+	"strings"
+	"time"
+)
+
+func identityKey(provider string, subject string) string {
+	return provider + ":" + subject
+}
+
+func (store *Store)IdentityByLogin(provider string, subject string) (*storage.LoginIdentity, error) {
+	var identity *storage.LoginIdentity
+	err := store.db.View(func(tx *bolt.Tx) error {
+		i := storage.LoginIdentity{}
+		if found, err := get(tx.Bucket(identitiesBucket), identityKey(provider, subject), &i); err != nil {
+			return err
+		} else if found {
+			identity = &i
+		}
+
+		return nil
+	})
+
+	return identity, err
+}
+
+func (store *Store)IdentitiesForUser(userID storage.UserID) ([]storage.LoginIdentity, error) {
+	identities := make([]storage.LoginIdentity, 0)
+	err := store.db.View(func(tx *bolt.Tx) error {
+		userIdentities, err := userBucket(tx, userID, userIdentitiesBucket)
+		if err != nil || userIdentities == nil {
+			return err
+		}
+
+		all := tx.Bucket(identitiesBucket)
+		return userIdentities.ForEach(func(k, v []byte) error {
+			identity := storage.LoginIdentity{}
+			if found, err := get(all, string(k), &identity); err != nil {
+				return err
+			} else if found {
+				identities = append(identities, identity)
+			}
+
+			return nil
+		})
+	})
+
+	return identities, err
+}
+
+func (store *Store)SaveIdentity(identity storage.LoginIdentity) error {
+	key := identityKey(identity.Provider, identity.Subject)
+	return store.db.Update(func(tx *bolt.Tx) error {
+		all := tx.Bucket(identitiesBucket)
+
+		// Drop the previous owner's reference, if the identity is
+		// changing hands
+		previous := storage.LoginIdentity{}
+		if found, err := get(all, key, &previous); err != nil {
+			return err
+		} else if found && previous.UserID != identity.UserID {
+			if userIdentities, err := userBucket(tx, previous.UserID, userIdentitiesBucket); err != nil {
+				return err
+			} else if err := userIdentities.Delete([]byte(key)); err != nil {
+				return err
+			}
+		}
+
+		if userIdentities, err := userBucket(tx, identity.UserID, userIdentitiesBucket); err != nil {
+			return err
+		} else if err := userIdentities.Put([]byte(key), []byte{}); err != nil {
+			return err
+		}
+
+		return put(all, key, identity)
+	})
+}
+
+func (store *Store)DeleteIdentity(identity storage.LoginIdentity) error {
+	key := identityKey(identity.Provider, identity.Subject)
+	return store.db.Update(func(tx *bolt.Tx) error {
+		all := tx.Bucket(identitiesBucket)
+
+		existing := storage.LoginIdentity{}
+		if found, err := get(all, key, &existing); err != nil || !found {
+			return err
+		}
+
+		if userIdentities, err := userBucket(tx, existing.UserID, userIdentitiesBucket); err != nil {
+			return err
+		} else if err := userIdentities.Delete([]byte(key)); err != nil {
+			return err
+		}
+
+		return all.Delete([]byte(key))
+	})
+}
+
+func (store *Store)LocalAccountByUsername(username string) (*storage.LocalAccount, error) {
+	var account *storage.LocalAccount
+	err := store.db.View(func(tx *bolt.Tx) error {
+		a := storage.LocalAccount{}
+		if found, err := get(tx.Bucket(localAccountsBucket), strings.ToLower(username), &a); err != nil {
+			return err
+		} else if found {
+			account = &a
+		}
+
+		return nil
+	})
+
+	return account, err
+}
+
+func (store *Store)CreateLocalAccount(account storage.LocalAccount) error {
+	key := strings.ToLower(account.Username)
+	return store.db.Update(func(tx *bolt.Tx) error {
+		accounts := tx.Bucket(localAccountsBucket)
+		if accounts.Get([]byte(key)) != nil {
+			return storage.ErrDuplicate
+		}
+
+		return put(accounts, key, account)
+	})
+}
+
+func (store *Store)SessionByID(sessionID string) (*storage.Session, error) {
+	var session *storage.Session
+	err := store.db.View(func(tx *bolt.Tx) error {
+		s := storage.Session{}
+		if found, err := get(tx.Bucket(sessionsBucket), sessionID, &s); err != nil {
+			return err
+		} else if found {
+			session = &s
+		}
+
+		return nil
+	})
+
+	return session, err
+}
+
+func (store *Store)SaveSession(session storage.Session) error {
+	return store.db.Update(func(tx *bolt.Tx) error {
+		return put(tx.Bucket(sessionsBucket), session.ID, session)
+	})
+}
+
+func (store *Store)DeleteSession(sessionID string) error {
+	return store.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(sessionsBucket).Delete([]byte(sessionID))
+	})
+}
+
+func (store *Store)LoginFailures(account string) (*storage.LoginFailures, error) {
+	var failures *storage.LoginFailures
+	err := store.db.View(func(tx *bolt.Tx) error {
+		f := storage.LoginFailures{}
+		if found, err := get(tx.Bucket(loginFailuresBucket), strings.ToLower(account), &f); err != nil {
+			return err
+		} else if found {
+			failures = &f
+		}
+
+		return nil
+	})
+
+	return failures, err
+}
+
+func (store *Store)RecordLoginFailure(account string, window time.Duration) (*storage.LoginFailures, error) {
+	key := strings.ToLower(account)
+	failures := storage.LoginFailures {
+		Account: account,
+	}
+
+	err := store.db.Update(func(tx *bolt.Tx) error {
+		all := tx.Bucket(loginFailuresBucket)
+		if _, err := get(all, key, &failures); err != nil {
+			return err
+		}
+
+		failures.Record(time.Now(), window)
+		return put(all, key, failures)
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &failures, nil
+}
+
+func (store *Store)ClearLoginFailures(account string) error {
+	return store.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(loginFailuresBucket).Delete([]byte(strings.ToLower(account)))
+	})
+}
@@ -0,0 +1,161 @@
+// +build !appengine
+
+/*****************************************************************************
+ **
+ ** Gofr
+ ** https://github.com/pokebyte/Gofr
+ ** Copyright (C) 2013-2017 Akop Karapetyan
+ **
+ ** This program is free software; you can redistribute it and/or modify
+ ** it under the terms of the GNU General Public License as published by
+ ** the Free Software Foundation; either version 2 of the License, or
+ ** (at your option) any later version.
+ **
+ ** This program is distributed in the hope that it will be useful,
+ ** but WITHOUT ANY WARRANTY; without even the implied warranty of
+ ** MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ ** GNU General Public License for more details.
+ **
+ ** You should have received a copy of the GNU General Public License
+ ** along with this program; if not, write to the Free Software
+ ** Foundation, Inc., 675 Mass Ave, Cambridge, MA 02139, USA.
+ **
+ ******************************************************************************
+ */
+ 
+package embedded
+
+import (
+	"github.com/boltdb/bolt"
+	"storage"
+)
+
+// Article counts follow the articles as stored - articles covered
+// by a read range count as unread until the range is applied. The
+// articles of removed subscriptions (kept until their undo record is
+// discarded) don't count
+
+// countArticles tallies each article of the subscription, in its
+// folder (e.g. with the Add or Remove of a set of deltas)
+func countArticles(tx *bolt.Tx, userID storage.UserID, record *subscriptionRecord, tally func(folderID string, article storage.Article)) error {
+	articles, err := articleBucket(tx, userID, record.ID)
+	if err != nil || articles == nil {
+		return err
+	}
+
+	return articles.ForEach(func(k, v []byte) error {
+		article := articleRecord{}
+		if err := decode(v, &article); err != nil {
+			return err
+		}
+
+		tally(record.FolderID, article.Article)
+		return nil
+	})
+}
+
+// updateArticleCounts applies the deltas to the user's counters
+func updateArticleCounts(tx *bolt.Tx, userID storage.UserID, deltas storage.ArticleCountDeltas) error {
+	counters, err := userBucket(tx, userID, articleCountsBucket)
+	if err != nil {
+		return err
+	}
+
+	for counter, delta := range deltas {
+		if delta.IsZero() {
+			continue
+		}
+
+		counts := storage.ArticleCounts{}
+		if _, err := get(counters, counter, &counts); err != nil {
+			return err
+		}
+
+		counts.Unread += delta.Unread
+		counts.Starred += delta.Starred
+
+		if err := put(counters, counter, counts); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// articleCounts returns the user's counters, by name
+func articleCounts(tx *bolt.Tx, userID storage.UserID) (map[string]storage.ArticleCounts, error) {
+	counts := make(map[string]storage.ArticleCounts)
+	counters, err := userBucket(tx, userID, articleCountsBucket)
+	if err != nil || counters == nil {
+		return counts, err
+	}
+
+	err = counters.ForEach(func(k, v []byte) error {
+		counter := storage.ArticleCounts{}
+		if err := decode(v, &counter); err != nil {
+			return err
+		}
+
+		counts[string(k)] = counter
+		return nil
+	})
+
+	return counts, err
+}
+
+// ReconcileArticleCounts recounts the unread and starred articles
+// of the user, and corrects the counters that have drifted. It
+// returns true if any had
+func (store *Store)ReconcileArticleCounts(userID storage.UserID) (bool, error) {
+	repaired := false
+	err := store.db.Update(func(tx *bolt.Tx) error {
+		scope := storage.ArticleScope {
+			FolderRef: storage.FolderRef {
+				UserID: userID,
+			},
+		}
+
+		records, err := subscriptionsWithin(tx, scope)
+		if err != nil {
+			return err
+		}
+
+		actual := storage.ArticleCountDeltas{}
+		for _, record := range records {
+			if err := countArticles(tx, userID, record, actual.Add); err != nil {
+				return err
+			}
+		}
+
+		stored, err := articleCounts(tx, userID)
+		if err != nil {
+			return err
+		}
+
+		corrections := storage.ArticleCountDeltas{}
+		for counter, counts := range actual {
+			corrections[counter] = storage.ArticleCounts {
+				Unread: counts.Unread - stored[counter].Unread,
+				Starred: counts.Starred - stored[counter].Starred,
+			}
+		}
+		for counter, counts := range stored {
+			if _, ok := actual[counter]; !ok {
+				corrections[counter] = storage.ArticleCounts {
+					Unread: -counts.Unread,
+					Starred: -counts.Starred,
+				}
+			}
+		}
+
+		for _, correction := range corrections {
+			if !correction.IsZero() {
+				repaired = true
+			}
+		}
+
+		return updateArticleCounts(tx, userID, corrections)
+	})
+
+	return repaired, err
+}
@@ -0,0 +1,182 @@
+/*****************************************************************************
+ **
+ ** Gofr
+ ** https://github.com/pokebyte/Gofr
+ ** Copyright (C) 2013-2017 Akop Karapetyan
+ **
+ ** This program is free software; you can redistribute it and/or modify
+ ** it under the terms of the GNU General Public License as published by
+ ** the Free Software Foundation; either version 2 of the License, or
+ ** (at your option) any later version.
+ **
+ ** This program is distributed in the hope that it will be useful,
+ ** but WITHOUT ANY WARRANTY; without even the implied warranty of
+ ** MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ ** GNU General Public License for more details.
+ **
+ ** You should have received a copy of the GNU General Public License
+ ** along with this program; if not, write to the Free Software
+ ** Foundation, Inc., 675 Mass Ave, Cambridge, MA 02139, USA.
+ **
+ ******************************************************************************
+ */
+ 
+package embedded
+
+import (
+	"github.com/boltdb/bolt"
+	"storage"
+	"testing"
+	"time"
+)
+
+func TestArticleCounts(t *testing.T) {
+	store, done := openTestStore(t)
+	defer done()
+
+	top := storage.FolderRef { UserID: testUserID }
+	news := createTestFolder(t, store, top, "News")
+	ref := subscribeToTestFeed(t, store, news, testFeed("http://example.com/feed", "a", "b", "c"), time.Now())
+
+	userCounter := storage.UserCounter
+	newsCounter := storage.FolderCounter(news.FolderID)
+	laterCounter := storage.TagCounter("later")
+
+	expectCounts(t, store, map[string]storage.ArticleCounts {
+		userCounter: { Unread: 3 },
+		newsCounter: { Unread: 3 },
+	})
+
+	if _, err := store.SetProperty(storage.ArticleRef { SubscriptionRef: ref, ArticleID: "a" }, "star", true); err != nil {
+		t.Fatalf("Error starring: %s", err)
+	}
+	if _, err := store.SetProperty(storage.ArticleRef { SubscriptionRef: ref, ArticleID: "b" }, "read", true); err != nil {
+		t.Fatalf("Error marking read: %s", err)
+	}
+	if _, err := store.SetTags(storage.ArticleRef { SubscriptionRef: ref, ArticleID: "a" }, []string { "later" }); err != nil {
+		t.Fatalf("Error tagging: %s", err)
+	}
+
+	expectCounts(t, store, map[string]storage.ArticleCounts {
+		userCounter: { Unread: 2, Starred: 1 },
+		newsCounter: { Unread: 2, Starred: 1 },
+		laterCounter: { Unread: 1, Starred: 1 },
+	})
+
+	// Articles of removed subscriptions don't count, until the
+	// removal is undone
+	if err := store.Unsubscribe(ref); err != nil {
+		t.Fatalf("Error unsubscribing: %s", err)
+	}
+
+	expectCounts(t, store, map[string]storage.ArticleCounts {
+		userCounter: {},
+		newsCounter: {},
+		laterCounter: {},
+	})
+
+	if err := store.Undo(latestUndoRecord(t, store)); err != nil {
+		t.Fatalf("Error undoing: %s", err)
+	}
+
+	expectCounts(t, store, map[string]storage.ArticleCounts {
+		userCounter: { Unread: 2, Starred: 1 },
+		newsCounter: { Unread: 2, Starred: 1 },
+		laterCounter: { Unread: 1, Starred: 1 },
+	})
+}
+
+func TestArticleCountsOfNestedFolders(t *testing.T) {
+	store, done := openTestStore(t)
+	defer done()
+
+	top := storage.FolderRef { UserID: testUserID }
+	outer := createTestFolder(t, store, top, "Outer")
+	inner := createTestFolder(t, store, outer, "Inner")
+	subscribeToTestFeed(t, store, outer, testFeed("http://example.com/outer", "a"), time.Now())
+	subscribeToTestFeed(t, store, inner, testFeed("http://example.com/inner", "b", "c"), time.Now())
+
+	// Folders include the articles of their subfolders
+	counts := testCounts(t, store)
+	if unread := counts[storage.FolderCounter(outer.FolderID)].Unread; unread != 3 {
+		t.Errorf("Expected 3 unread in the outer folder, got %d", unread)
+	}
+	if unread := counts[storage.FolderCounter(inner.FolderID)].Unread; unread != 2 {
+		t.Errorf("Expected 2 unread in the inner folder, got %d", unread)
+	}
+
+	// Removing the outer folder takes both off the counters
+	if err := store.DeleteFolder(outer); err != nil {
+		t.Fatalf("Error removing folder: %s", err)
+	}
+
+	expectCounts(t, store, map[string]storage.ArticleCounts {
+		storage.UserCounter: {},
+	})
+}
+
+func TestArticleCountsOfMovedSubscription(t *testing.T) {
+	store, done := openTestStore(t)
+	defer done()
+
+	top := storage.FolderRef { UserID: testUserID }
+	news := createTestFolder(t, store, top, "News")
+	sports := createTestFolder(t, store, top, "Sports")
+	ref := subscribeToTestFeed(t, store, news, testFeed("http://example.com/feed", "a", "b", "c"), time.Now())
+
+	if _, err := store.SetProperty(storage.ArticleRef { SubscriptionRef: ref, ArticleID: "a" }, "read", true); err != nil {
+		t.Fatalf("Error marking read: %s", err)
+	}
+	if _, err := store.SetProperty(storage.ArticleRef { SubscriptionRef: ref, ArticleID: "a" }, "star", true); err != nil {
+		t.Fatalf("Error starring: %s", err)
+	}
+
+	if err := store.MoveSubscription(ref, sports); err != nil {
+		t.Fatalf("Error moving subscription: %s", err)
+	}
+
+	expectCounts(t, store, map[string]storage.ArticleCounts {
+		storage.UserCounter: { Unread: 2, Starred: 1 },
+		storage.FolderCounter(news.FolderID): {},
+		storage.FolderCounter(sports.FolderID): { Unread: 2, Starred: 1 },
+	})
+
+	// To the top level, where there's no folder counter
+	ref.FolderRef = sports
+	if err := store.MoveSubscription(ref, top); err != nil {
+		t.Fatalf("Error moving subscription: %s", err)
+	}
+
+	expectCounts(t, store, map[string]storage.ArticleCounts {
+		storage.UserCounter: { Unread: 2, Starred: 1 },
+		storage.FolderCounter(sports.FolderID): {},
+	})
+}
+
+func TestReconcileArticleCounts(t *testing.T) {
+	store, done := openTestStore(t)
+	defer done()
+
+	subscribeToTestFeed(t, store, storage.FolderRef { UserID: testUserID }, testFeed("http://example.com/feed", "a", "b"), time.Now())
+
+	// Throw the counters off
+	drift := storage.ArticleCountDeltas {
+		storage.UserCounter: { Unread: 5, Starred: -1 },
+		storage.TagCounter("gone"): { Unread: 1 },
+	}
+	if err := store.db.Update(func(tx *bolt.Tx) error {
+		return updateArticleCounts(tx, testUserID, drift)
+	}); err != nil {
+		t.Fatalf("Error updating counts: %s", err)
+	}
+
+	if repaired, err := store.ReconcileArticleCounts(testUserID); err != nil {
+		t.Fatalf("Error reconciling: %s", err)
+	} else if !repaired {
+		t.Errorf("Expected the counters to be repaired")
+	}
+
+	expectCounts(t, store, map[string]storage.ArticleCounts {
+		storage.UserCounter: { Unread: 2 },
+	})
+}
@@ -0,0 +1,506 @@
+// +build !appengine
+
+/*****************************************************************************
+ **
+ ** Gofr
+ ** https://github.com/pokebyte/Gofr
+ ** Copyright (C) 2013-2017 Akop Karapetyan
+ **
+ ** This program is free software; you can redistribute it and/or modify
+ ** it under the terms of the GNU General Public License as published by
+ ** the Free Software Foundation; either version 2 of the License, or
+ ** (at your option) any later version.
+ **
+ ** This program is distributed in the hope that it will be useful,
+ ** but WITHOUT ANY WARRANTY; without even the implied warranty of
+ ** MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ ** GNU General Public License for more details.
+ **
+ ** You should have received a copy of the GNU General Public License
+ ** along with this program; if not, write to the Free Software
+ ** Foundation, Inc., 675 Mass Ave, Cambridge, MA 02139, USA.
+ **
+ ******************************************************************************
+ */
+ 
+package embedded
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/boltdb/bolt"
+	"html"
+	"log"
+	"net/http"
+	"rss"
+	"storage"
+	"time"
+)
+
+func (store *Store)FeedByURL(url string) (*storage.Feed, error) {
+	var feed *storage.Feed
+	err := store.db.View(func(tx *bolt.Tx) error {
+		f := storage.Feed{}
+		if found, err := get(tx.Bucket(feedsBucket), url, &f); err != nil {
+			return err
+		} else if found {
+			feed = &f
+		}
+
+		return nil
+	})
+
+	return feed, err
+}
+
+func (store *Store)IsFeedAvailable(url string) (bool, error) {
+	feed, err := store.FeedByURL(url)
+	return feed != nil, err
+}
+
+func (store *Store)WebToFeedURL(url string, title *string) (string, error) {
+	feedURL := ""
+	err := store.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(feedsBucket).ForEach(func(k, v []byte) error {
+			feed := storage.Feed{}
+			if err := decode(v, &feed); err != nil {
+				return err
+			} else if feed.Link == url && feedURL == "" {
+				if title != nil {
+					*title = feed.Title
+				}
+				feedURL = feed.URL
+			}
+
+			return nil
+		})
+	})
+
+	return feedURL, err
+}
+
+func (store *Store)UpdateFeed(parsedFeed *rss.Feed, favIcon *storage.FavIcon, fetched time.Time, fetchInfo storage.FetchInfo) error {
+	feedDigest := parsedFeed.Digest()
+
+	return store.db.Update(func(tx *bolt.Tx) error {
+		feedMetas := tx.Bucket(feedMetaBucket)
+		feedMeta := storage.FeedMeta{}
+		updateInfo := false
+
+		if found, err := get(feedMetas, parsedFeed.URL, &feedMeta); err != nil {
+			return err
+		} else if !found || !bytes.Equal(feedMeta.InfoDigest, feedDigest) {
+			// New, or the feed information has changed
+			feedMeta.InfoDigest = feedDigest
+			updateInfo = true
+		}
+
+		durationBetweenUpdates := parsedFeed.DurationBetweenUpdates()
+
+		feedMeta.Fetched = fetched
+		feedMeta.NextFetch = fetched.Add(durationBetweenUpdates)
+		feedMeta.HourlyUpdateFrequency = float32(durationBetweenUpdates.Hours())
+		feedMeta.UpdateCounter += int64(len(parsedFeed.Entries))
+		feedMeta.ETag = fetchInfo.ETag
+		feedMeta.LastModified = fetchInfo.LastModified
+		feedMeta.RecordSuccess(fetched, fetchInfo.StatusCode)
+
+		if favIcon != nil {
+			feedMeta.FavIconChecked = fetched
+			if favIcon.URL != "" {
+				updateInfo = true
+			}
+		}
+
+		updateCounter := feedMeta.UpdateCounter
+
+		if err := put(feedMetas, parsedFeed.URL, feedMeta); err != nil {
+			return err
+		}
+
+		// Update information
+		if updateInfo {
+			feeds := tx.Bucket(feedsBucket)
+			feed := storage.Feed{}
+
+			if _, err := get(feeds, parsedFeed.URL, &feed); err != nil {
+				return err
+			}
+
+			if favIcon != nil && favIcon.URL != "" {
+				// Icons are only looked up every so often; keep the
+				// last one otherwise
+				feed.FavIconURL = favIcon.URL
+				feed.FavIcon = favIcon.Data
+			}
+
+			feed.URL = parsedFeed.URL
+			feed.Title = parsedFeed.Title
+			feed.Description = parsedFeed.Description
+			feed.Updated = parsedFeed.Updated
+			feed.Link = parsedFeed.WWWURL
+			feed.Format = parsedFeed.Format
+			feed.HubURL = parsedFeed.HubURL
+			feed.Topic = parsedFeed.Topic
+
+			if err := put(feeds, parsedFeed.URL, feed); err != nil {
+				return err
+			}
+		}
+
+		entries, err := bucket(tx, tx.Bucket(entriesBucket), parsedFeed.URL)
+		if err != nil {
+			return err
+		}
+
+		for _, parsedEntry := range parsedFeed.Entries {
+			entryGUID := parsedEntry.UniqueID()
+			if entryGUID == "" {
+				log.Printf("Missing GUID for an entry titled '%s'", parsedEntry.Title)
+				continue
+			}
+
+			entryDigest := parsedEntry.Digest()
+			entry := entryRecord{}
+
+			if found, err := get(entries, entryGUID, &entry); err != nil {
+				return err
+			} else if found && bytes.Equal(entry.InfoDigest, entryDigest) {
+				continue // No updates - skip
+			}
+
+			// At this point, metadata tells us the record needs updating, so we 
+			// just overwrite everything in the entry
+
+			entry = entryRecord {
+				Entry: storage.Entry {
+					Author: html.UnescapeString(parsedEntry.Author),
+					Title: html.UnescapeString(parsedEntry.Title),
+					Link: parsedEntry.WWWURL,
+					Summary: parsedEntry.Summary(),
+					Content: parsedEntry.Content,
+					Updated: parsedEntry.Updated,
+					ImageURL: parsedEntry.ImageURL,
+					HasMedia: len(parsedEntry.Media) > 0,
+				},
+				Fetched: fetched,
+				Published: parsedEntry.Published,
+				InfoDigest: entryDigest,
+				UpdateIndex: updateCounter,
+				LikeCount: entry.LikeCount,
+			}
+
+			for _, media := range parsedEntry.Media {
+				entry.Media = append(entry.Media, storage.EntryMedia {
+					URL: media.URL,
+					Type: media.Type,
+					Title: media.Title,
+					ThumbnailURL: media.ThumbnailURL,
+					Duration: int64(media.Duration.Seconds()),
+					Size: media.Size,
+				})
+			}
+
+			if err := put(entries, entryGUID, entry); err != nil {
+				return err
+			}
+
+			updateCounter++
+		}
+
+		return nil
+	})
+}
+
+// updateFeedMeta loads the metadata of a feed, applies a change and
+// writes it back
+func (store *Store)updateFeedMeta(url string, update func(feedMeta *storage.FeedMeta)) (*storage.FeedMeta, error) {
+	feedMeta := new(storage.FeedMeta)
+	err := store.db.Update(func(tx *bolt.Tx) error {
+		feedMetas := tx.Bucket(feedMetaBucket)
+		if _, err := get(feedMetas, url, feedMeta); err != nil {
+			return err
+		}
+
+		update(feedMeta)
+
+		return put(feedMetas, url, feedMeta)
+	})
+
+	return feedMeta, err
+}
+
+// MarkFeedUnchanged records a fetch that returned no new content
+// (e.g. HTTP 304) and schedules the next fetch based on the
+// previously computed update frequency
+func (store *Store)MarkFeedUnchanged(url string, fetched time.Time) error {
+	_, err := store.updateFeedMeta(url, func(feedMeta *storage.FeedMeta) {
+		durationBetweenUpdates := time.Duration(float64(feedMeta.HourlyUpdateFrequency) * float64(time.Hour))
+		if minFrequency := time.Duration(30) * time.Minute; durationBetweenUpdates < minFrequency {
+			durationBetweenUpdates = minFrequency
+		}
+
+		feedMeta.Fetched = fetched
+		feedMeta.NextFetch = fetched.Add(durationBetweenUpdates)
+		feedMeta.RecordSuccess(fetched, http.StatusNotModified)
+	})
+
+	return err
+}
+
+// RecordFeedFailure notes a failed attempt to fetch or parse a feed,
+// and backs off the next fetch accordingly. Feeds that fail
+// repeatedly are marked as dead
+func (store *Store)RecordFeedFailure(url string, fetched time.Time, statusCode int, fetchError error) error {
+	message := ""
+	if fetchError != nil {
+		message = fetchError.Error()
+	} else if statusCode != 0 {
+		message = fmt.Sprintf("HTTP %d: %s", statusCode, http.StatusText(statusCode))
+	}
+
+	feedMeta, err := store.updateFeedMeta(url, func(feedMeta *storage.FeedMeta) {
+		feedMeta.RecordFailure(fetched, statusCode, message)
+	})
+
+	if err != nil {
+		return err
+	}
+
+	if feedMeta.Dead {
+		log.Printf("Feed %s is dead (%d failures since %s): %s", url,
+			feedMeta.FailureCount, feedMeta.FailingSince, message)
+	}
+
+	return nil
+}
+
+// MigrateFeed moves a feed that has permanently relocated to its new
+// URL. The feed and its metadata are copied, subscriptions are
+// pointed at the new feed, and subscriber counts are carried over.
+// Entries stay in place, since existing articles refer to them
+func (store *Store)MigrateFeed(oldURL string, newURL string) error {
+	return store.db.Update(func(tx *bolt.Tx) error {
+		feeds := tx.Bucket(feedsBucket)
+		feedMetas := tx.Bucket(feedMetaBucket)
+
+		// Copy the feed, unless it already exists at the new location
+		if feeds.Get([]byte(newURL)) == nil {
+			feed := storage.Feed{}
+			if _, err := get(feeds, oldURL, &feed); err != nil {
+				return err
+			}
+
+			feed.URL = newURL
+			if err := put(feeds, newURL, feed); err != nil {
+				return err
+			}
+		}
+
+		if feedMetas.Get([]byte(newURL)) == nil {
+			feedMeta := storage.FeedMeta{}
+			if _, err := get(feedMetas, oldURL, &feedMeta); err != nil {
+				return err
+			}
+
+			// Entries under the new URL will continue from the old
+			// update counter. Cache validators are no longer valid
+			feedMeta.ETag = ""
+			feedMeta.LastModified = ""
+			feedMeta.NextFetch = time.Now()
+			feedMeta.RecordSuccess(feedMeta.Fetched, http.StatusMovedPermanently)
+
+			if err := put(feedMetas, newURL, feedMeta); err != nil {
+				return err
+			}
+		}
+
+		// Keep the feed's retention policy, unless the new location
+		// has one of its own
+		retention := tx.Bucket(feedRetentionBucket)
+		if retention.Get([]byte(newURL)) == nil {
+			policy := storage.RetentionPolicy{}
+			if found, err := get(retention, oldURL, &policy); err != nil {
+				return err
+			} else if found {
+				if err := put(retention, newURL, policy); err != nil {
+					return err
+				}
+			}
+		}
+
+		// Point subscriptions at the new feed. MaxUpdateIndex is reset,
+		// so all entries of the new feed are reconsidered; entries that
+		// already have articles (by GUID) keep their properties
+		subscriberCount := 0
+		err := tx.Bucket(userDataBucket).ForEach(func(userKey, v []byte) error {
+			userID := storage.UserID(userKey)
+			scope := storage.ArticleScope {
+				FolderRef: storage.FolderRef {
+					UserID: userID,
+				},
+			}
+
+			records, err := subscriptionsWithin(tx, scope)
+			if err != nil {
+				return err
+			}
+
+			for _, record := range records {
+				if record.FeedURL == oldURL {
+					record.FeedURL = newURL
+					record.MaxUpdateIndex = -1
+
+					if err := saveSubscription(tx, userID, record); err != nil {
+						return err
+					}
+				}
+
+				if record.FeedURL == newURL {
+					subscriberCount++
+				}
+			}
+
+			return nil
+		})
+
+		if err != nil {
+			return err
+		}
+
+		subscriberCounts := tx.Bucket(subscriberCountsBucket)
+		if err := put(subscriberCounts, newURL, subscriberCount); err != nil {
+			return err
+		}
+
+		// Finally, remove the old feed so that it's no longer fetched
+		for _, b := range []*bolt.Bucket { feeds, feedMetas, subscriberCounts } {
+			if err := b.Delete([]byte(oldURL)); err != nil {
+				return err
+			}
+		}
+
+		log.Printf("Migrated feed %s to %s (%d subscribers)", oldURL, newURL, subscriberCount)
+
+		return nil
+	})
+}
+
+// FeedsDue iterates over the feeds scheduled for an update before
+// the specified time, resuming from cursor, if specified
+func (store *Store)FeedsDue(before time.Time, cursor string) (storage.FeedMetaIterator, error) {
+	return store.feedsWhere(cursor, func(feedMeta *storage.FeedMeta) bool {
+		return feedMeta.NextFetch.Before(before)
+	})
+}
+
+// Feeds iterates over all feeds, resuming from cursor, if specified
+func (store *Store)Feeds(cursor string) (storage.FeedMetaIterator, error) {
+	return store.feedsWhere(cursor, func(feedMeta *storage.FeedMeta) bool {
+		return true
+	})
+}
+
+func (store *Store)feedsWhere(cursor string, include func(feedMeta *storage.FeedMeta) bool) (storage.FeedMetaIterator, error) {
+	it := &feedMetaIterator {
+		urls: make([]string, 0),
+		metas: make([]*storage.FeedMeta, 0),
+	}
+
+	err := store.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(feedMetaBucket).Cursor()
+		for k, v := c.Seek([]byte(cursor)); k != nil; k, v = c.Next() {
+			feedMeta := new(storage.FeedMeta)
+			if err := decode(v, feedMeta); err != nil {
+				return err
+			}
+
+			if include(feedMeta) {
+				it.urls = append(it.urls, string(k))
+				it.metas = append(it.metas, feedMeta)
+			}
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return it, nil
+}
+
+func adjustSubscriberCount(tx *bolt.Tx, feedURL string, delta int) error {
+	subscriberCounts := tx.Bucket(subscriberCountsBucket)
+
+	count := 0
+	if _, err := get(subscriberCounts, feedURL, &count); err != nil {
+		return err
+	}
+
+	if count += delta; count < 0 {
+		count = 0
+	}
+
+	return put(subscriberCounts, feedURL, count)
+}
+
+// SubscriberCount returns the number of users subscribed to a feed
+func (store *Store)SubscriberCount(feedURL string) (int, error) {
+	count := 0
+	err := store.db.View(func(tx *bolt.Tx) error {
+		_, err := get(tx.Bucket(subscriberCountsBucket), feedURL, &count)
+		return err
+	})
+
+	return count, err
+}
+
+func (store *Store)HubSubscriptionByURL(feedURL string) (*storage.HubSubscription, error) {
+	var hubSub *storage.HubSubscription
+	err := store.db.View(func(tx *bolt.Tx) error {
+		h := storage.NewHubSubscription(feedURL)
+		if found, err := get(tx.Bucket(hubSubscriptionsBucket), feedURL, &h); err != nil {
+			return err
+		} else if found {
+			hubSub = &h
+		}
+
+		return nil
+	})
+
+	return hubSub, err
+}
+
+// HubSubscriptionsExpiringBefore returns subscriptions whose lease
+// (or pending request) expires before the specified time
+func (store *Store)HubSubscriptionsExpiringBefore(before time.Time) ([]storage.HubSubscription, error) {
+	hubSubs := make([]storage.HubSubscription, 0)
+	err := store.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(hubSubscriptionsBucket).ForEach(func(k, v []byte) error {
+			hubSub := storage.HubSubscription{}
+			if err := decode(v, &hubSub); err != nil {
+				return err
+			} else if hubSub.LeaseExpires.Before(before) {
+				hubSubs = append(hubSubs, hubSub)
+			}
+
+			return nil
+		})
+	})
+
+	return hubSubs, err
+}
+
+func (store *Store)SaveHubSubscription(hubSub storage.HubSubscription) error {
+	return store.db.Update(func(tx *bolt.Tx) error {
+		return put(tx.Bucket(hubSubscriptionsBucket), hubSub.FeedURL, hubSub)
+	})
+}
+
+func (store *Store)DeleteHubSubscription(hubSub storage.HubSubscription) error {
+	return store.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(hubSubscriptionsBucket).Delete([]byte(hubSub.FeedURL))
+	})
+}
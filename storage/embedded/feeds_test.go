@@ -0,0 +1,72 @@
+/*****************************************************************************
+ **
+ ** Gofr
+ ** https://github.com/pokebyte/Gofr
+ ** Copyright (C) 2013-2017 Akop Karapetyan
+ **
+ ** This program is free software; you can redistribute it and/or modify
+ ** it under the terms of the GNU General Public License as published by
+ ** the Free Software Foundation; either version 2 of the License, or
+ ** (at your option) any later version.
+ **
+ ** This program is distributed in the hope that it will be useful,
+ ** but WITHOUT ANY WARRANTY; without even the implied warranty of
+ ** MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ ** GNU General Public License for more details.
+ **
+ ** You should have received a copy of the GNU General Public License
+ ** along with this program; if not, write to the Free Software
+ ** Foundation, Inc., 675 Mass Ave, Cambridge, MA 02139, USA.
+ **
+ ******************************************************************************
+ */
+ 
+package embedded
+
+import (
+	"storage"
+	"testing"
+	"time"
+)
+
+// testFavIcon returns the icon stored for the user's subscription
+// to the feed
+func testFavIcon(t *testing.T, store *Store, feedURL string) storage.FavIcon {
+	userSubscriptions, err := store.NewUserSubscriptions(testUserID)
+	if err != nil {
+		t.Fatalf("Error loading subscriptions: %s", err)
+	}
+
+	for _, subscription := range userSubscriptions.Subscriptions {
+		if subscription.FeedURL == feedURL {
+			return storage.FavIcon { URL: subscription.FavIconURL, Data: subscription.FavIcon }
+		}
+	}
+
+	t.Fatalf("Subscription to %s missing", feedURL)
+	return storage.FavIcon{}
+}
+
+func TestFavIcon(t *testing.T) {
+	store, done := openTestStore(t)
+	defer done()
+
+	feed := testFeed("http://example.com/feed", "a")
+	subscribeToTestFeed(t, store, storage.FolderRef { UserID: testUserID }, feed, time.Now().Add(-time.Minute))
+	if favIcon := testFavIcon(t, store, feed.URL); favIcon != (storage.FavIcon{}) {
+		t.Errorf("Expected no icon, got %+v", favIcon)
+	}
+
+	icon := storage.FavIcon {
+		URL: "http://example.com/favicon.ico",
+		Data: "image/png;base64,iVBORw0KGgo=",
+	}
+	for i, update := range []*storage.FavIcon { &icon, nil, &storage.FavIcon{} } {
+		// Kept unless another one's found
+		if err := store.UpdateFeed(feed, update, time.Now(), storage.FetchInfo { StatusCode: 200 }); err != nil {
+			t.Fatalf("Error updating feed: %s", err)
+		} else if favIcon := testFavIcon(t, store, feed.URL); favIcon != icon {
+			t.Errorf("Update %d: expected %+v, got %+v", i, icon, favIcon)
+		}
+	}
+}
@@ -0,0 +1,237 @@
+// +build !appengine
+
+/*****************************************************************************
+ **
+ ** Gofr
+ ** https://github.com/pokebyte/Gofr
+ ** Copyright (C) 2013-2017 Akop Karapetyan
+ **
+ ** This program is free software; you can redistribute it and/or modify
+ ** it under the terms of the GNU General Public License as published by
+ ** the Free Software Foundation; either version 2 of the License, or
+ ** (at your option) any later version.
+ **
+ ** This program is distributed in the hope that it will be useful,
+ ** but WITHOUT ANY WARRANTY; without even the implied warranty of
+ ** MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ ** GNU General Public License for more details.
+ **
+ ** You should have received a copy of the GNU General Public License
+ ** along with this program; if not, write to the Free Software
+ ** Foundation, Inc., 675 Mass Ave, Cambridge, MA 02139, USA.
+ **
+ ******************************************************************************
+ */
+ 
+package embedded
+
+import (
+	"github.com/boltdb/bolt"
+	"sort"
+	"storage"
+	"time"
+)
+
+const recentImportJobCount = 10
+
+// importJobsByStart sorts import jobs, most recent first
+type importJobsByStart []storage.ImportJob
+
+func (jobs importJobsByStart)Len() int {
+	return len(jobs)
+}
+
+func (jobs importJobsByStart)Swap(i, j int) {
+	jobs[i], jobs[j] = jobs[j], jobs[i]
+}
+
+func (jobs importJobsByStart)Less(i, j int) bool {
+	return jobs[i].Started.After(jobs[j].Started)
+}
+
+// importResultsByID sorts results in the order they were created
+type importResultsByID []storage.ImportResult
+
+func (results importResultsByID)Len() int {
+	return len(results)
+}
+
+func (results importResultsByID)Swap(i, j int) {
+	results[i], results[j] = results[j], results[i]
+}
+
+func (results importResultsByID)Less(i, j int) bool {
+	_, a, _ := storage.UnformatId(results[i].ID)
+	_, b, _ := storage.UnformatId(results[j].ID)
+	return a < b
+}
+
+func (store *Store)NewImportJob(userID storage.UserID) (*storage.ImportJob, error) {
+	job := storage.ImportJob {
+		UserID: userID,
+		Started: time.Now(),
+	}
+
+	err := store.db.Update(func(tx *bolt.Tx) error {
+		jobs, err := userBucket(tx, userID, importJobsBucket)
+		if err != nil {
+			return err
+		}
+
+		if job.ID, err = nextID(jobs, "import"); err != nil {
+			return err
+		}
+
+		return put(jobs, job.ID, job)
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &job, nil
+}
+
+func (store *Store)ImportJobByID(userID storage.UserID, jobID string) (*storage.ImportJob, error) {
+	var job *storage.ImportJob
+	err := store.db.View(func(tx *bolt.Tx) error {
+		jobs, err := userBucket(tx, userID, importJobsBucket)
+		if err != nil {
+			return err
+		}
+
+		j := storage.ImportJob{}
+		if found, err := get(jobs, jobID, &j); err != nil {
+			return err
+		} else if found {
+			j.ID = jobID
+			j.UserID = userID
+			job = &j
+		}
+
+		return nil
+	})
+
+	return job, err
+}
+
+// RecentImportJobs returns the user's latest imports, most
+// recent first
+func (store *Store)RecentImportJobs(userID storage.UserID) ([]storage.ImportJob, error) {
+	jobs := make([]storage.ImportJob, 0)
+	err := store.db.View(func(tx *bolt.Tx) error {
+		jobBucket, err := userBucket(tx, userID, importJobsBucket)
+		if err != nil || jobBucket == nil {
+			return err
+		}
+
+		return jobBucket.ForEach(func(k, v []byte) error {
+			job := storage.ImportJob{}
+			if err := decode(v, &job); err != nil {
+				return err
+			}
+
+			job.ID = string(k)
+			job.UserID = userID
+			jobs = append(jobs, job)
+
+			return nil
+		})
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Sort(importJobsByStart(jobs))
+	if len(jobs) > recentImportJobCount {
+		jobs = jobs[:recentImportJobCount]
+	}
+
+	return jobs, nil
+}
+
+func (store *Store)SaveImportJob(job storage.ImportJob) error {
+	return store.db.Update(func(tx *bolt.Tx) error {
+		jobs, err := userBucket(tx, job.UserID, importJobsBucket)
+		if err != nil {
+			return err
+		}
+
+		return put(jobs, job.ID, job)
+	})
+}
+
+// importResultBucket returns the bucket holding the results of an
+// import, keyed by result ID
+func importResultBucket(tx *bolt.Tx, job storage.ImportJob) (*bolt.Bucket, error) {
+	results, err := userBucket(tx, job.UserID, importResultsBucket)
+	if err != nil {
+		return nil, err
+	}
+
+	return bucket(tx, results, job.ID)
+}
+
+// ImportResults returns the outcome of each outline of the import
+func (store *Store)ImportResults(job storage.ImportJob) ([]storage.ImportResult, error) {
+	results := make([]storage.ImportResult, 0)
+	err := store.db.View(func(tx *bolt.Tx) error {
+		resultBucket, err := importResultBucket(tx, job)
+		if err != nil || resultBucket == nil {
+			return err
+		}
+
+		return resultBucket.ForEach(func(k, v []byte) error {
+			result := storage.ImportResult{}
+			if err := decode(v, &result); err != nil {
+				return err
+			}
+
+			result.ID = string(k)
+			results = append(results, result)
+
+			return nil
+		})
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Sort(importResultsByID(results))
+
+	return results, nil
+}
+
+// SaveImportResult writes the outcome of an outline, assigning it
+// an ID if it has not been written before
+func (store *Store)SaveImportResult(job storage.ImportJob, result *storage.ImportResult) error {
+	return store.SaveImportResults(job, []*storage.ImportResult { result })
+}
+
+// SaveImportResults writes the outcome of several outlines at
+// once, assigning IDs to those not written before
+func (store *Store)SaveImportResults(job storage.ImportJob, results []*storage.ImportResult) error {
+	return store.db.Update(func(tx *bolt.Tx) error {
+		resultBucket, err := importResultBucket(tx, job)
+		if err != nil {
+			return err
+		}
+
+		for _, result := range results {
+			if result.ID == "" {
+				if result.ID, err = nextID(resultBucket, "result"); err != nil {
+					return err
+				}
+			}
+
+			result.Updated = time.Now()
+			if err := put(resultBucket, result.ID, result); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
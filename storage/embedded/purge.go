@@ -0,0 +1,291 @@
+// +build !appengine
+
+/*****************************************************************************
+ **
+ ** Gofr
+ ** https://github.com/pokebyte/Gofr
+ ** Copyright (C) 2013-2017 Akop Karapetyan
+ **
+ ** This program is free software; you can redistribute it and/or modify
+ ** it under the terms of the GNU General Public License as published by
+ ** the Free Software Foundation; either version 2 of the License, or
+ ** (at your option) any later version.
+ **
+ ** This program is distributed in the hope that it will be useful,
+ ** but WITHOUT ANY WARRANTY; without even the implied warranty of
+ ** MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ ** GNU General Public License for more details.
+ **
+ ** You should have received a copy of the GNU General Public License
+ ** along with this program; if not, write to the Free Software
+ ** Foundation, Inc., 675 Mass Ave, Cambridge, MA 02139, USA.
+ **
+ ******************************************************************************
+ */
+ 
+ 
+package embedded
+
+import (
+	"github.com/boltdb/bolt"
+	"sort"
+	"storage"
+	"time"
+)
+
+// Expired entries purged from a feed in a single run, at most; the
+// rest are left for the next run
+const maxEntriesPurged = 500
+
+// entryAge is the fetch (and publication) time of an entry, by GUID
+type entryAge struct {
+	ID string
+	Fetched time.Time
+	Published time.Time
+}
+
+// entriesByAge sorts entries the way articles are sorted: most
+// recently fetched (then published) first
+type entriesByAge []entryAge
+
+func (entries entriesByAge)Len() int {
+	return len(entries)
+}
+
+func (entries entriesByAge)Swap(i, j int) {
+	entries[i], entries[j] = entries[j], entries[i]
+}
+
+func (entries entriesByAge)Less(i, j int) bool {
+	if !entries[i].Fetched.Equal(entries[j].Fetched) {
+		return entries[i].Fetched.After(entries[j].Fetched)
+	}
+
+	return entries[i].Published.After(entries[j].Published)
+}
+
+// feedSubscription is a subscription to the feed being purged.
+// Removed subscriptions are those pending undo
+type feedSubscription struct {
+	UserID storage.UserID
+	Record *subscriptionRecord
+	Removed bool
+}
+
+func (store *Store)FeedRetentionPolicy(url string) (*storage.RetentionPolicy, error) {
+	var policy *storage.RetentionPolicy
+	err := store.db.View(func(tx *bolt.Tx) error {
+		p := storage.RetentionPolicy{}
+		if found, err := get(tx.Bucket(feedRetentionBucket), url, &p); err != nil {
+			return err
+		} else if found {
+			policy = &p
+		}
+
+		return nil
+	})
+
+	return policy, err
+}
+
+func (store *Store)SetFeedRetentionPolicy(url string, policy *storage.RetentionPolicy) error {
+	return store.db.Update(func(tx *bolt.Tx) error {
+		if policy == nil {
+			return tx.Bucket(feedRetentionBucket).Delete([]byte(url))
+		}
+
+		return put(tx.Bucket(feedRetentionBucket), url, *policy)
+	})
+}
+
+// PurgeFeed deletes the articles of the feed's expired entries,
+// then the entries themselves. Entries with articles that are
+// retained are kept
+func (store *Store)PurgeFeed(url string, policy storage.RetentionPolicy) (storage.PurgeReport, error) {
+	report := storage.PurgeReport{}
+	if policy.MaxAge <= 0 {
+		return report, nil
+	}
+
+	cutoff := time.Now().Add(-policy.MaxAge)
+	err := store.db.Update(func(tx *bolt.Tx) error {
+		entries := tx.Bucket(entriesBucket).Bucket([]byte(url))
+		if entries == nil {
+			return nil
+		}
+
+		ages := make([]entryAge, 0)
+		err := entries.ForEach(func(k, v []byte) error {
+			entry := entryRecord{}
+			if err := decode(v, &entry); err != nil {
+				return err
+			}
+
+			ages = append(ages, entryAge { string(k), entry.Fetched, entry.Published })
+			return nil
+		})
+
+		if err != nil {
+			return err
+		}
+
+		// Newest first, skipping those kept regardless of age
+		sort.Sort(entriesByAge(ages))
+		if len(ages) <= policy.MinEntries {
+			return nil
+		}
+
+		subscriptions, err := feedSubscriptions(tx, url)
+		if err != nil {
+			return err
+		}
+
+		// Retained entries don't count towards the limit, so that
+		// they can't hold up the rest
+		uncounted := make(map[storage.UserID]storage.ArticleCountDeltas)
+		for i := policy.MinEntries; i < len(ages) && report.Entries < maxEntriesPurged; i++ {
+			if !ages[i].Fetched.Before(cutoff) {
+				continue
+			}
+
+			entryID := ages[i].ID
+			entry := entryRecord{}
+			if _, err := get(entries, entryID, &entry); err != nil {
+				return err
+			}
+
+			retained := false
+			for _, subscription := range subscriptions {
+				if deleted, kept, err := purgeArticle(tx, subscription, url, entryID, &entry.Entry); err != nil {
+					return err
+				} else if deleted != nil {
+					// Removed subscriptions' articles are already off
+					// the counters
+					if !subscription.Removed {
+						if _, ok := uncounted[subscription.UserID]; !ok {
+							uncounted[subscription.UserID] = storage.ArticleCountDeltas{}
+						}
+						uncounted[subscription.UserID].Remove(subscription.Record.FolderID, *deleted)
+					}
+					report.Articles++
+				} else if kept {
+					retained = true
+				}
+			}
+
+			if retained {
+				continue
+			}
+
+			if err := entries.Delete([]byte(entryID)); err != nil {
+				return err
+			}
+
+			report.Entries++
+			report.EntryMedia += len(entry.Media)
+		}
+
+		for userID, deltas := range uncounted {
+			if err := updateArticleCounts(tx, userID, deltas); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+
+	return report, err
+}
+
+// feedSubscriptions returns the subscriptions of all users to the
+// feed, including removed ones that can still be undone - their
+// articles would come back with them
+func feedSubscriptions(tx *bolt.Tx, url string) ([]feedSubscription, error) {
+	subscriptions := make([]feedSubscription, 0)
+	err := tx.Bucket(userDataBucket).ForEach(func(userKey, v []byte) error {
+		userID := storage.UserID(userKey)
+		scope := storage.ArticleScope {
+			FolderRef: storage.FolderRef {
+				UserID: userID,
+			},
+		}
+
+		records, err := subscriptionsWithin(tx, scope)
+		if err != nil {
+			return err
+		}
+
+		subscribed := make(map[string]bool)
+		for _, record := range records {
+			subscribed[record.ID] = true
+			if record.FeedURL == url {
+				subscriptions = append(subscriptions, feedSubscription { userID, record, false })
+			}
+		}
+
+		pending, err := undoRecords(tx, userID)
+		if err != nil {
+			return err
+		}
+
+		// Articles are keyed by subscription ID alone, so those of a
+		// subscription since added again are covered already
+		for _, undoRecord := range pending {
+			for _, subscription := range undoRecord.Subscriptions {
+				if subscription.FeedURL != url || subscribed[subscription.ID] {
+					continue
+				}
+
+				subscribed[subscription.ID] = true
+				record := &subscriptionRecord {
+					Subscription: subscription,
+					FolderID: undoRecord.FolderID,
+				}
+				if subscription.Parent != "" {
+					record.FolderID = subscription.Parent
+				}
+
+				subscriptions = append(subscriptions, feedSubscription { userID, record, true })
+			}
+		}
+
+		return nil
+	})
+
+	return subscriptions, err
+}
+
+// purgeArticle deletes the subscription's article of the entry,
+// returning it - unless it's retained, in which case kept is true
+func purgeArticle(tx *bolt.Tx, subscription feedSubscription, url string, entryID string, entry *storage.Entry) (deleted *storage.Article, kept bool, err error) {
+	articles, err := articleBucket(tx, subscription.UserID, subscription.Record.ID)
+	if err != nil {
+		return nil, false, err
+	}
+
+	article := articleRecord{}
+	if found, err := get(articles, entryID, &article); err != nil {
+		return nil, false, err
+	} else if !found || article.FeedURL != url {
+		return nil, false, nil
+	} else if article.IsRetained(subscription.Record.Tags) {
+		return nil, true, nil
+	}
+
+	if err := articles.Delete([]byte(entryID)); err != nil {
+		return nil, false, err
+	}
+
+	index, err := userBucket(tx, subscription.UserID, searchBucket)
+	if err != nil {
+		return nil, false, err
+	}
+
+	for _, term := range storage.EntrySearchTerms(entry) {
+		if err := index.Delete(searchKey(term, subscription.Record.ID, entryID)); err != nil {
+			return nil, false, err
+		}
+	}
+
+	return &article.Article, false, nil
+}
@@ -0,0 +1,147 @@
+/*****************************************************************************
+ **
+ ** Gofr
+ ** https://github.com/pokebyte/Gofr
+ ** Copyright (C) 2013-2017 Akop Karapetyan
+ **
+ ** This program is free software; you can redistribute it and/or modify
+ ** it under the terms of the GNU General Public License as published by
+ ** the Free Software Foundation; either version 2 of the License, or
+ ** (at your option) any later version.
+ **
+ ** This program is distributed in the hope that it will be useful,
+ ** but WITHOUT ANY WARRANTY; without even the implied warranty of
+ ** MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ ** GNU General Public License for more details.
+ **
+ ** You should have received a copy of the GNU General Public License
+ ** along with this program; if not, write to the Free Software
+ ** Foundation, Inc., 675 Mass Ave, Cambridge, MA 02139, USA.
+ **
+ ******************************************************************************
+ */
+ 
+package embedded
+
+import (
+	"fmt"
+	"storage"
+	"testing"
+	"time"
+)
+
+var testRetentionPolicy = storage.RetentionPolicy {
+	MaxAge: 24 * time.Hour,
+}
+
+func TestPurgeFeed(t *testing.T) {
+	store, done := openTestStore(t)
+	defer done()
+
+	feed := testFeed("http://example.com/feed", "a", "b", "c", "d")
+	fetched := time.Now().Add(-48 * time.Hour)
+	ref := subscribeToTestFeed(t, store, storage.FolderRef { UserID: testUserID }, feed, fetched)
+
+	if _, err := store.SetProperty(storage.ArticleRef { SubscriptionRef: ref, ArticleID: "a" }, "star", true); err != nil {
+		t.Fatalf("Error starring: %s", err)
+	}
+
+	// Another user's subscription, removed but not yet for good
+	otherUserID := storage.UserID("other")
+	otherRef := subscribeToTestFeed(t, store, storage.FolderRef { UserID: otherUserID }, feed, fetched)
+	if _, err := store.SetProperty(storage.ArticleRef { SubscriptionRef: otherRef, ArticleID: "b" }, "star", true); err != nil {
+		t.Fatalf("Error starring: %s", err)
+	}
+	if err := store.Unsubscribe(otherRef); err != nil {
+		t.Fatalf("Error unsubscribing: %s", err)
+	}
+
+	report, err := store.PurgeFeed(feed.URL, testRetentionPolicy)
+	if err != nil {
+		t.Fatalf("Error purging: %s", err)
+	}
+
+	// The entries of starred articles stay, including those of the
+	// removed subscription
+	if report.Entries != 2 || report.Articles != 6 {
+		t.Errorf("Unexpected report: %+v", report)
+	}
+
+	expectCounts(t, store, map[string]storage.ArticleCounts {
+		storage.UserCounter: { Unread: 1, Starred: 1 },
+	})
+
+	records, err := store.UndoRecords(otherUserID)
+	if err != nil || len(records) != 1 {
+		t.Fatalf("Expected an undo record, got %d (%v)", len(records), err)
+	} else if err := store.Undo(records[0]); err != nil {
+		t.Fatalf("Error undoing: %s", err)
+	}
+
+	articles, err := store.Articles([]storage.ArticleRef { { SubscriptionRef: otherRef, ArticleID: "b" } })
+	if err != nil {
+		t.Fatalf("Error loading articles: %s", err)
+	} else if len(articles) != 1 || !articles[0].IsStarred() || articles[0].Details == nil {
+		t.Errorf("Expected the starred article, with its entry, got %+v", articles)
+	}
+}
+
+func TestPurgeFeedPastRetainedEntries(t *testing.T) {
+	store, done := openTestStore(t)
+	defer done()
+
+	guids := make([]string, maxEntriesPurged + 1)
+	for i := range guids {
+		guids[i] = fmt.Sprintf("%04d", i)
+	}
+
+	feed := testFeed("http://example.com/feed", guids...)
+	ref := subscribeToTestFeed(t, store, storage.FolderRef { UserID: testUserID }, feed, time.Now().Add(-48 * time.Hour))
+
+	// All but the oldest are starred, and kept
+	for _, guid := range guids[:maxEntriesPurged] {
+		if _, err := store.SetProperty(storage.ArticleRef { SubscriptionRef: ref, ArticleID: guid }, "star", true); err != nil {
+			t.Fatalf("Error starring: %s", err)
+		}
+	}
+
+	report, err := store.PurgeFeed(feed.URL, testRetentionPolicy)
+	if err != nil {
+		t.Fatalf("Error purging: %s", err)
+	} else if report.Entries != 1 || report.Articles != 1 {
+		t.Errorf("Expected the oldest entry purged, got %+v", report)
+	}
+}
+
+func expectRetentionPolicy(t *testing.T, store *Store, url string, expected *storage.RetentionPolicy) {
+	if policy, err := store.FeedRetentionPolicy(url); err != nil {
+		t.Fatalf("Error loading retention policy: %s", err)
+	} else if (policy == nil) != (expected == nil) || (policy != nil && *policy != *expected) {
+		t.Errorf("%s: expected %+v, got %+v", url, expected, policy)
+	}
+}
+
+func TestFeedRetentionPolicy(t *testing.T) {
+	store, done := openTestStore(t)
+	defer done()
+
+	// Set before the feed is fetched
+	oldURL, newURL := "http://example.com/feed", "http://example.com/moved"
+	if err := store.SetFeedRetentionPolicy(oldURL, &testRetentionPolicy); err != nil {
+		t.Fatalf("Error setting retention policy: %s", err)
+	}
+	expectRetentionPolicy(t, store, oldURL, &testRetentionPolicy)
+	expectRetentionPolicy(t, store, newURL, nil)
+
+	// Kept when the feed moves
+	subscribeToTestFeed(t, store, storage.FolderRef { UserID: testUserID }, testFeed(oldURL, "a"), time.Now())
+	if err := store.MigrateFeed(oldURL, newURL); err != nil {
+		t.Fatalf("Error migrating feed: %s", err)
+	}
+	expectRetentionPolicy(t, store, newURL, &testRetentionPolicy)
+
+	if err := store.SetFeedRetentionPolicy(newURL, nil); err != nil {
+		t.Fatalf("Error removing retention policy: %s", err)
+	}
+	expectRetentionPolicy(t, store, newURL, nil)
+}
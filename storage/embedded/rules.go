@@ -0,0 +1,128 @@
+// +build !appengine
+
+/*****************************************************************************
+ **
+ ** Gofr
+ ** https://github.com/pokebyte/Gofr
+ ** Copyright (C) 2013-2017 Akop Karapetyan
+ **
+ ** This program is free software; you can redistribute it and/or modify
+ ** it under the terms of the GNU General Public License as published by
+ ** the Free Software Foundation; either version 2 of the License, or
+ ** (at your option) any later version.
+ **
+ ** This program is distributed in the hope that it will be useful,
+ ** but WITHOUT ANY WARRANTY; without even the implied warranty of
+ ** MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ ** GNU General Public License for more details.
+ **
+ ** You should have received a copy of the GNU General Public License
+ ** along with this program; if not, write to the Free Software
+ ** Foundation, Inc., 675 Mass Ave, Cambridge, MA 02139, USA.
+ **
+ ******************************************************************************
+ */
+ 
+ 
+package embedded
+
+import (
+	"github.com/boltdb/bolt"
+	"sort"
+	"storage"
+	"time"
+)
+
+// filterRulesByCreation sorts rules, oldest first
+type filterRulesByCreation []storage.FilterRule
+
+func (rules filterRulesByCreation)Len() int {
+	return len(rules)
+}
+
+func (rules filterRulesByCreation)Swap(i, j int) {
+	rules[i], rules[j] = rules[j], rules[i]
+}
+
+func (rules filterRulesByCreation)Less(i, j int) bool {
+	return rules[i].Created.Before(rules[j].Created)
+}
+
+// filterRules returns the rules of the user, oldest first
+func filterRules(tx *bolt.Tx, userID storage.UserID) ([]storage.FilterRule, error) {
+	rules := make([]storage.FilterRule, 0)
+	ruleBucket, err := userBucket(tx, userID, filterRulesBucket)
+	if err != nil || ruleBucket == nil {
+		return rules, err
+	}
+
+	err = ruleBucket.ForEach(func(k, v []byte) error {
+		rule := storage.FilterRule{}
+		if err := decode(v, &rule); err != nil {
+			return err
+		}
+
+		rule.ID = string(k)
+		rule.UserID = userID
+		rules = append(rules, rule)
+
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Sort(filterRulesByCreation(rules))
+
+	return rules, nil
+}
+
+func (store *Store)FilterRules(userID storage.UserID) ([]storage.FilterRule, error) {
+	var rules []storage.FilterRule
+	err := store.db.View(func(tx *bolt.Tx) error {
+		var err error
+		rules, err = filterRules(tx, userID)
+		return err
+	})
+
+	return rules, err
+}
+
+// SaveFilterRule creates the rule if it has no ID, or replaces it
+func (store *Store)SaveFilterRule(rule *storage.FilterRule) error {
+	return store.db.Update(func(tx *bolt.Tx) error {
+		rules, err := userBucket(tx, rule.UserID, filterRulesBucket)
+		if err != nil {
+			return err
+		}
+
+		if rule.ID == "" {
+			if rule.ID, err = nextID(rules, "rule"); err != nil {
+				return err
+			}
+			rule.Created = time.Now()
+		} else {
+			existing := storage.FilterRule{}
+			if found, err := get(rules, rule.ID, &existing); err != nil {
+				return err
+			} else if !found {
+				return errNotFound
+			}
+			rule.Created = existing.Created
+		}
+
+		return put(rules, rule.ID, rule)
+	})
+}
+
+func (store *Store)DeleteFilterRule(userID storage.UserID, ruleID string) error {
+	return store.db.Update(func(tx *bolt.Tx) error {
+		rules, err := userBucket(tx, userID, filterRulesBucket)
+		if err != nil {
+			return err
+		}
+
+		return rules.Delete([]byte(ruleID))
+	})
+}
@@ -0,0 +1,229 @@
+// +build !appengine
+
+/*****************************************************************************
+ **
+ ** Gofr
+ ** https://github.com/pokebyte/Gofr
+ ** Copyright (C) 2013-2017 Akop Karapetyan
+ **
+ ** This program is free software; you can redistribute it and/or modify
+ ** it under the terms of the GNU General Public License as published by
+ ** the Free Software Foundation; either version 2 of the License, or
+ ** (at your option) any later version.
+ **
+ ** This program is distributed in the hope that it will be useful,
+ ** but WITHOUT ANY WARRANTY; without even the implied warranty of
+ ** MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ ** GNU General Public License for more details.
+ **
+ ** You should have received a copy of the GNU General Public License
+ ** along with this program; if not, write to the Free Software
+ ** Foundation, Inc., 675 Mass Ave, Cambridge, MA 02139, USA.
+ **
+ ******************************************************************************
+ */
+ 
+package embedded
+
+import (
+	"bytes"
+	"github.com/boltdb/bolt"
+	"sort"
+	"storage"
+	"strconv"
+	"strings"
+)
+
+// Each user's search bucket holds a key for each term of each
+// article: the term, subscription ID and article ID, separated by
+// NULs. Keys aren't removed when an entry changes; matches are
+// checked against the entry, so stale keys do no harm
+
+func searchKey(term string, subscriptionID string, articleID string) []byte {
+	return []byte(term + "\x00" + subscriptionID + "\x00" + articleID)
+}
+
+func indexArticle(index *bolt.Bucket, subscriptionID string, articleID string, entry *storage.Entry) error {
+	for _, term := range storage.EntrySearchTerms(entry) {
+		if err := index.Put(searchKey(term, subscriptionID, articleID), []byte{}); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// unindexArticles removes the search keys of a subscription's
+// articles
+func unindexArticles(tx *bolt.Tx, userID storage.UserID, subscriptionID string) error {
+	index, err := userBucket(tx, userID, searchBucket)
+	if err != nil {
+		return err
+	}
+
+	articles, err := userBucket(tx, userID, articlesBucket)
+	if err != nil {
+		return err
+	}
+
+	subscriptionArticles := articles.Bucket([]byte(subscriptionID))
+	if subscriptionArticles == nil {
+		return nil
+	}
+
+	return subscriptionArticles.ForEach(func(k, v []byte) error {
+		article := articleRecord{}
+		if err := decode(v, &article); err != nil {
+			return err
+		}
+
+		entry := entryRecord{}
+		if found, err := get(tx.Bucket(entriesBucket).Bucket([]byte(article.FeedURL)), string(k), &entry); err != nil || !found {
+			return err
+		}
+
+		for _, term := range storage.EntrySearchTerms(&entry.Entry) {
+			if err := index.Delete(searchKey(term, subscriptionID, string(k))); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+func (store *Store)SearchArticles(query storage.SearchQuery, start string) (*storage.ArticlePage, error) {
+	offset := 0
+	if start != "" {
+		if o, err := strconv.Atoi(start); err != nil {
+			return nil, err
+		} else {
+			offset = o
+		}
+	}
+
+	matches := make([]storage.Article, 0)
+	feedURLs := make(map[string]string)
+	total := 0
+
+	err := store.db.View(func(tx *bolt.Tx) error {
+		articles, err := userBucket(tx, query.UserID, articlesBucket)
+		if err != nil || articles == nil {
+			return err
+		}
+
+		// consider adds the article to the matches, if it matches
+		ranges := readRanges{}
+		consider := func(subscriptionID string, articleID string) error {
+			article := articleRecord{}
+			if found, err := get(articles.Bucket([]byte(subscriptionID)), articleID, &article); err != nil || !found {
+				return err
+			}
+
+			article.Source = subscriptionID
+			if subscribed, err := ranges.apply(tx, query.UserID, subscriptionID, &article.Article); err != nil || !subscribed {
+				return err
+			} else if !query.MatchesArticle(article.Article) {
+				return nil
+			}
+
+			if query.HasText() {
+				if err := loadEntry(tx, &article.Article, article.FeedURL); err != nil {
+					return err
+				} else if !query.MatchesText(article.Details) {
+					return nil
+				}
+			}
+
+			feedURLs[subscriptionID + "\n" + articleID] = article.FeedURL
+			matches = append(matches, article.Article)
+
+			return nil
+		}
+
+		if query.HasText() {
+			index, err := userBucket(tx, query.UserID, searchBucket)
+			if err != nil || index == nil {
+				return err
+			}
+
+			// Look up articles containing a single term; consider
+			// checks for the rest
+			term := ""
+			if len(query.Words) > 0 {
+				term = query.Words[0]
+			} else {
+				term = query.Phrases[0][0]
+			}
+
+			prefix := []byte(term + "\x00")
+			c := index.Cursor()
+			for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Next() {
+				if parts := strings.SplitN(string(k[len(prefix):]), "\x00", 2); len(parts) == 2 {
+					if err := consider(parts[0], parts[1]); err != nil {
+						return err
+					}
+				}
+			}
+		} else {
+			records, err := subscriptionsWithin(tx, storage.ArticleScope { FolderRef: storage.FolderRef { UserID: query.UserID } })
+			if err != nil {
+				return err
+			}
+
+			for _, record := range records {
+				if query.SubscriptionID != "" && record.ID != query.SubscriptionID {
+					continue
+				}
+
+				subscriptionArticles := articles.Bucket([]byte(record.ID))
+				if subscriptionArticles == nil {
+					continue
+				}
+
+				err := subscriptionArticles.ForEach(func(k, v []byte) error {
+					return consider(record.ID, string(k))
+				})
+				if err != nil {
+					return err
+				}
+			}
+		}
+
+		sort.Sort(articlesByTime(matches))
+
+		total = len(matches)
+		if offset > len(matches) {
+			offset = len(matches)
+		}
+		matches = matches[offset:]
+		if len(matches) > articlePageSize {
+			matches = matches[:articlePageSize]
+		}
+
+		for i, _ := range matches {
+			article := &matches[i]
+			if article.Details == nil {
+				if err := loadEntry(tx, article, feedURLs[article.Source + "\n" + article.ID]); err != nil {
+					return err
+				}
+			}
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	page := storage.ArticlePage {
+		Articles: matches,
+	}
+
+	if offset + len(matches) < total {
+		page.Continue = strconv.Itoa(offset + len(matches))
+	}
+
+	return &page, nil
+}
@@ -0,0 +1,311 @@
+// +build !appengine
+
+/*****************************************************************************
+ **
+ ** Gofr
+ ** https://github.com/pokebyte/Gofr
+ ** Copyright (C) 2013-2017 Akop Karapetyan
+ **
+ ** This program is free software; you can redistribute it and/or modify
+ ** it under the terms of the GNU General Public License as published by
+ ** the Free Software Foundation; either version 2 of the License, or
+ ** (at your option) any later version.
+ **
+ ** This program is distributed in the hope that it will be useful,
+ ** but WITHOUT ANY WARRANTY; without even the implied warranty of
+ ** MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ ** GNU General Public License for more details.
+ **
+ ** You should have received a copy of the GNU General Public License
+ ** along with this program; if not, write to the Free Software
+ ** Foundation, Inc., 675 Mass Ave, Cambridge, MA 02139, USA.
+ **
+ ******************************************************************************
+ */
+ 
+// Package embedded implements storage.Repository on top of BoltDB,
+// for running Gofr as a standalone server. Everything is kept in a
+// single file; values are gob-encoded
+package embedded
+
+import (
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"github.com/boltdb/bolt"
+	"storage"
+	"time"
+)
+
+var (
+	usersBucket = []byte("users")
+	userDataBucket = []byte("userData")
+	feedsBucket = []byte("feeds")
+	feedMetaBucket = []byte("feedMeta")
+	entriesBucket = []byte("entries")
+	subscriberCountsBucket = []byte("subscriberCounts")
+	hubSubscriptionsBucket = []byte("hubSubscriptions")
+	identitiesBucket = []byte("identities")
+	localAccountsBucket = []byte("localAccounts")
+	sessionsBucket = []byte("sessions")
+	loginFailuresBucket = []byte("loginFailures")
+	feedRetentionBucket = []byte("feedRetention")
+
+	// Nested within each user's bucket in userData
+	foldersBucket = []byte("folders")
+	subscriptionsBucket = []byte("subscriptions")
+	articlesBucket = []byte("articles")
+	tagsBucket = []byte("tags")
+	importJobsBucket = []byte("importJobs")
+	importResultsBucket = []byte("importResults")
+	userIdentitiesBucket = []byte("identities")
+	itemAliasesBucket = []byte("itemAliases")
+	searchBucket = []byte("search")
+	filterRulesBucket = []byte("filterRules")
+	undoRecordsBucket = []byte("undoRecords")
+	articleCountsBucket = []byte("articleCounts")
+)
+
+var errNotFound = errors.New("embedded: no such entity")
+
+var topLevelBuckets = [][]byte {
+	usersBucket,
+	userDataBucket,
+	feedsBucket,
+	feedMetaBucket,
+	entriesBucket,
+	subscriberCountsBucket,
+	hubSubscriptionsBucket,
+	identitiesBucket,
+	localAccountsBucket,
+	sessionsBucket,
+	loginFailuresBucket,
+	feedRetentionBucket,
+}
+
+// Store is the embedded implementation of storage.Repository.
+// Unlike the Datastore, a single Store is shared by all requests.
+// Updates each run in a single Bolt transaction, and Bolt runs one
+// at a time, so there are no leases to take
+type Store struct {
+	db *bolt.DB
+}
+
+// subscriptionRecord is a Subscription, along with the folder it
+// belongs to. Subscriptions are keyed by ID alone, so moving one
+// between folders leaves its articles in place
+type subscriptionRecord struct {
+	storage.Subscription
+	FolderID string
+}
+
+// articleRecord is an Article, along with the feed its entry
+// belongs to (which may differ from the subscribed URL, if the
+// feed has since moved)
+type articleRecord struct {
+	storage.Article
+	FeedURL string
+}
+
+// entryRecord is an Entry along with its metadata, media and
+// like count. Keyed by GUID, under the feed URL
+type entryRecord struct {
+	storage.Entry
+	Fetched time.Time
+	Published time.Time
+	InfoDigest []byte
+	UpdateIndex int64
+	Media []storage.EntryMedia
+	LikeCount int
+}
+
+// Open opens (creating, if necessary) the database at path
+func Open(path string) (*Store, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options { Timeout: time.Duration(5) * time.Second })
+	if err != nil {
+		return nil, err
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range topLevelBuckets {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return &Store {
+		db: db,
+	}, nil
+}
+
+func (store *Store)Close() error {
+	return store.db.Close()
+}
+
+func encode(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(v); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+func decode(data []byte, v interface{}) error {
+	return gob.NewDecoder(bytes.NewReader(data)).Decode(v)
+}
+
+// get decodes the value stored under key into v. Returns false
+// if there's no such value
+func get(b *bolt.Bucket, key string, v interface{}) (bool, error) {
+	if b == nil {
+		return false, nil
+	}
+
+	data := b.Get([]byte(key))
+	if data == nil {
+		return false, nil
+	}
+
+	return true, decode(data, v)
+}
+
+func put(b *bolt.Bucket, key string, v interface{}) error {
+	if data, err := encode(v); err != nil {
+		return err
+	} else {
+		return b.Put([]byte(key), data)
+	}
+}
+
+// bucket returns a bucket nested within parent, creating it if the
+// transaction is writable. Returns nil if a read-only transaction
+// finds no such bucket
+func bucket(tx *bolt.Tx, parent *bolt.Bucket, name string) (*bolt.Bucket, error) {
+	if parent == nil {
+		return nil, nil
+	} else if tx.Writable() {
+		return parent.CreateBucketIfNotExists([]byte(name))
+	}
+
+	return parent.Bucket([]byte(name)), nil
+}
+
+// userBucket returns the bucket of the specified kind (e.g.
+// folders) belonging to the user
+func userBucket(tx *bolt.Tx, userID storage.UserID, name []byte) (*bolt.Bucket, error) {
+	if userID == "" {
+		return nil, errors.New("UserID is empty")
+	}
+
+	userData, err := bucket(tx, tx.Bucket(userDataBucket), string(userID))
+	if err != nil {
+		return nil, err
+	}
+
+	return bucket(tx, userData, string(name))
+}
+
+// nextID assigns an identifier of the specified kind using the
+// bucket's sequence
+func nextID(b *bolt.Bucket, kind string) (string, error) {
+	if seq, err := b.NextSequence(); err != nil {
+		return "", err
+	} else {
+		return storage.FormatId(kind, int64(seq)), nil
+	}
+}
+
+// feedMetaIterator walks feeds due for an update. The cursor is
+// the URL of the next feed, since feeds are sorted by URL
+type feedMetaIterator struct {
+	urls []string
+	metas []*storage.FeedMeta
+	pos int
+}
+
+func (it *feedMetaIterator)Next() (string, *storage.FeedMeta, error) {
+	if it.pos >= len(it.urls) {
+		return "", nil, storage.Done
+	}
+
+	it.pos++
+	return it.urls[it.pos - 1], it.metas[it.pos - 1], nil
+}
+
+func (it *feedMetaIterator)Cursor() (string, error) {
+	if it.pos < len(it.urls) {
+		return it.urls[it.pos], nil
+	} else if len(it.urls) > 0 {
+		// Past the last feed
+		return it.urls[len(it.urls) - 1] + "\x00", nil
+	}
+
+	return "", nil
+}
+
+// userIterator walks the IDs of all users. The cursor is the ID of
+// the next user
+type userIterator struct {
+	userIDs []storage.UserID
+	pos int
+}
+
+func (it *userIterator)Next() (storage.UserID, error) {
+	if it.pos >= len(it.userIDs) {
+		return "", storage.Done
+	}
+
+	it.pos++
+	return it.userIDs[it.pos - 1], nil
+}
+
+func (it *userIterator)Cursor() (string, error) {
+	if it.pos < len(it.userIDs) {
+		return string(it.userIDs[it.pos]), nil
+	} else if len(it.userIDs) > 0 {
+		// Past the last user
+		return string(it.userIDs[len(it.userIDs) - 1]) + "\x00", nil
+	}
+
+	return "", nil
+}
+
+// subscriptionIterator walks the subscriptions of all users. The
+// cursor is the user and subscription ID of the next subscription
+type subscriptionIterator struct {
+	refs []storage.SubscriptionRef
+	pos int
+}
+
+func (it *subscriptionIterator)Next() (storage.SubscriptionRef, error) {
+	if it.pos >= len(it.refs) {
+		return storage.SubscriptionRef{}, storage.Done
+	}
+
+	it.pos++
+	return it.refs[it.pos - 1], nil
+}
+
+func (it *subscriptionIterator)Cursor() (string, error) {
+	if it.pos < len(it.refs) {
+		return subscriptionCursor(it.refs[it.pos]), nil
+	} else if len(it.refs) > 0 {
+		// Past the last subscription
+		return subscriptionCursor(it.refs[len(it.refs) - 1]) + "\x00", nil
+	}
+
+	return "", nil
+}
+
+func subscriptionCursor(ref storage.SubscriptionRef) string {
+	return string(ref.UserID) + "\n" + ref.SubscriptionID
+}
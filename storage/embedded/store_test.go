@@ -0,0 +1,193 @@
+/*****************************************************************************
+ **
+ ** Gofr
+ ** https://github.com/pokebyte/Gofr
+ ** Copyright (C) 2013-2017 Akop Karapetyan
+ **
+ ** This program is free software; you can redistribute it and/or modify
+ ** it under the terms of the GNU General Public License as published by
+ ** the Free Software Foundation; either version 2 of the License, or
+ ** (at your option) any later version.
+ **
+ ** This program is distributed in the hope that it will be useful,
+ ** but WITHOUT ANY WARRANTY; without even the implied warranty of
+ ** MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ ** GNU General Public License for more details.
+ **
+ ** You should have received a copy of the GNU General Public License
+ ** along with this program; if not, write to the Free Software
+ ** Foundation, Inc., 675 Mass Ave, Cambridge, MA 02139, USA.
+ **
+ ******************************************************************************
+ */
+ 
+package embedded
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"rss"
+	"storage"
+	"testing"
+	"time"
+)
+
+const testUserID = storage.UserID("tester")
+
+// openTestStore opens a store in a temporary directory. The returned
+// function closes and removes it
+func openTestStore(t *testing.T) (*Store, func()) {
+	dir, err := ioutil.TempDir("", "gofr")
+	if err != nil {
+		t.Fatalf("Error creating directory: %s", err)
+	}
+
+	store, err := Open(filepath.Join(dir, "test.db"))
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatalf("Error opening store: %s", err)
+	}
+
+	return store, func() {
+		store.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+// testFeed returns a feed with an entry for each GUID, published an
+// hour apart (the first one most recently)
+func testFeed(url string, guids ...string) *rss.Feed {
+	feed := &rss.Feed {
+		URL: url,
+		Title: "Feed at " + url,
+		Format: "RSS",
+	}
+
+	published := time.Now().Add(-time.Hour).Truncate(time.Second)
+	for i, guid := range guids {
+		feed.Entries = append(feed.Entries, &rss.Entry {
+			GUID: guid,
+			Title: fmt.Sprintf("Entry %s", guid),
+			Content: "Content of " + guid,
+			Published: published.Add(-time.Duration(i) * time.Hour),
+		})
+	}
+
+	return feed
+}
+
+// subscribeToTestFeed writes the feed, as fetched at the specified
+// time, subscribes the user to it and delivers its articles
+func subscribeToTestFeed(t *testing.T, store *Store, folderRef storage.FolderRef, feed *rss.Feed, fetched time.Time) storage.SubscriptionRef {
+	if err := store.UpdateFeed(feed, nil, fetched, storage.FetchInfo { StatusCode: 200 }); err != nil {
+		t.Fatalf("Error updating feed: %s", err)
+	}
+
+	ref, err := store.Subscribe(folderRef, feed.URL, feed.Title)
+	if err != nil {
+		t.Fatalf("Error subscribing: %s", err)
+	}
+
+	if _, err := store.UpdateSubscription(feed.URL, ref); err != nil {
+		t.Fatalf("Error updating subscription: %s", err)
+	}
+
+	return ref
+}
+
+func createTestFolder(t *testing.T, store *Store, parent storage.FolderRef, title string) storage.FolderRef {
+	ref, err := store.CreateFolder(parent, title)
+	if err != nil {
+		t.Fatalf("Error creating folder %s: %s", title, err)
+	}
+
+	return ref
+}
+
+// testArticles returns the articles within the scope, by ID
+func testArticles(t *testing.T, store *Store, scope storage.ArticleScope) map[string]storage.Article {
+	page, err := store.NewArticlePage(storage.ArticleFilter { ArticleScope: scope }, "")
+	if err != nil {
+		t.Fatalf("Error loading articles: %s", err)
+	}
+
+	articles := make(map[string]storage.Article)
+	for _, article := range page.Articles {
+		articles[article.ID] = article
+	}
+
+	return articles
+}
+
+// testCounts returns the user's article counts: the user's own, and
+// those of each folder and tag, by counter
+func testCounts(t *testing.T, store *Store) map[string]storage.ArticleCounts {
+	userSubscriptions, err := store.NewUserSubscriptions(testUserID)
+	if err != nil {
+		t.Fatalf("Error loading subscriptions: %s", err)
+	}
+
+	counts := map[string]storage.ArticleCounts {
+		storage.UserCounter: userSubscriptions.ArticleCounts,
+	}
+	for _, folder := range userSubscriptions.Folders {
+		counts[storage.FolderCounter(folder.ID)] = folder.ArticleCounts
+	}
+	for _, tag := range userSubscriptions.Tags {
+		counts[storage.TagCounter(tag.Title)] = tag.ArticleCounts
+	}
+
+	return counts
+}
+
+// expectCounts checks the counters, and that they agree with a
+// recount
+func expectCounts(t *testing.T, store *Store, expected map[string]storage.ArticleCounts) {
+	counts := testCounts(t, store)
+	for counter, expectedCounts := range expected {
+		if counts[counter] != expectedCounts {
+			t.Errorf("Counter %s: expected %+v, got %+v", counter, expectedCounts, counts[counter])
+		}
+	}
+
+	if repaired, err := store.ReconcileArticleCounts(testUserID); err != nil {
+		t.Fatalf("Error reconciling counts: %s", err)
+	} else if repaired {
+		t.Errorf("Counters had drifted from the articles")
+	}
+}
+
+// latestUndoRecord returns the user's most recent undo record
+func latestUndoRecord(t *testing.T, store *Store) storage.UndoRecord {
+	records, err := store.UndoRecords(testUserID)
+	if err != nil {
+		t.Fatalf("Error loading undo records: %s", err)
+	} else if len(records) == 0 {
+		t.Fatalf("No undo records")
+	}
+
+	return records[0]
+}
+
+// folderParents returns the parent of each of the user's folders,
+// by title
+func folderParents(t *testing.T, store *Store) map[string]string {
+	userSubscriptions, err := store.NewUserSubscriptions(testUserID)
+	if err != nil {
+		t.Fatalf("Error loading subscriptions: %s", err)
+	}
+
+	titles := make(map[string]string)
+	for _, folder := range userSubscriptions.Folders {
+		titles[folder.ID] = folder.Title
+	}
+
+	parents := make(map[string]string)
+	for _, folder := range userSubscriptions.Folders {
+		parents[folder.Title] = titles[folder.Parent]
+	}
+
+	return parents
+}
@@ -0,0 +1,351 @@
+// +build !appengine
+
+/*****************************************************************************
+ **
+ ** Gofr
+ ** https://github.com/pokebyte/Gofr
+ ** Copyright (C) 2013-2017 Akop Karapetyan
+ **
+ ** This program is free software; you can redistribute it and/or modify
+ ** it under the terms of the GNU General Public License as published by
+ ** the Free Software Foundation; either version 2 of the License, or
+ ** (at your option) any later version.
+ **
+ ** This program is distributed in the hope that it will be useful,
+ ** but WITHOUT ANY WARRANTY; without even the implied warranty of
+ ** MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ ** GNU General Public License for more details.
+ **
+ ** You should have received a copy of the GNU General Public License
+ ** along with this program; if not, write to the Free Software
+ ** Foundation, Inc., 675 Mass Ave, Cambridge, MA 02139, USA.
+ **
+ ******************************************************************************
+ */
+ 
+package embedded
+
+import (
+	"github.com/boltdb/bolt"
+	"sort"
+	"storage"
+	"time"
+)
+
+// undoRecordsByCreation sorts records, newest first
+type undoRecordsByCreation []storage.UndoRecord
+
+func (records undoRecordsByCreation)Len() int {
+	return len(records)
+}
+
+func (records undoRecordsByCreation)Swap(i, j int) {
+	records[i], records[j] = records[j], records[i]
+}
+
+func (records undoRecordsByCreation)Less(i, j int) bool {
+	return records[i].Created.After(records[j].Created)
+}
+
+// undoRecordIterator walks the undo records of all users. The
+// cursor is the user and ID of the next record
+type undoRecordIterator struct {
+	records []storage.UndoRecord
+	pos int
+}
+
+func (it *undoRecordIterator)Next() (*storage.UndoRecord, error) {
+	if it.pos >= len(it.records) {
+		return nil, storage.Done
+	}
+
+	it.pos++
+	return &it.records[it.pos - 1], nil
+}
+
+func (it *undoRecordIterator)Cursor() (string, error) {
+	if it.pos < len(it.records) {
+		return undoRecordCursor(it.records[it.pos]), nil
+	} else if len(it.records) > 0 {
+		// Past the last record
+		return undoRecordCursor(it.records[len(it.records) - 1]) + "\x00", nil
+	}
+
+	return "", nil
+}
+
+func undoRecordCursor(record storage.UndoRecord) string {
+	return string(record.UserID) + "\n" + record.ID
+}
+
+// saveUndoRecord writes a new record
+func saveUndoRecord(tx *bolt.Tx, record *storage.UndoRecord) error {
+	records, err := userBucket(tx, record.UserID, undoRecordsBucket)
+	if err != nil {
+		return err
+	}
+
+	if record.ID, err = nextID(records, "undo"); err != nil {
+		return err
+	}
+	record.Created = time.Now()
+
+	return put(records, record.ID, record)
+}
+
+// undoRecords returns the records of the user, in no particular
+// order
+func undoRecords(tx *bolt.Tx, userID storage.UserID) ([]storage.UndoRecord, error) {
+	records := make([]storage.UndoRecord, 0)
+	recordBucket, err := userBucket(tx, userID, undoRecordsBucket)
+	if err != nil || recordBucket == nil {
+		return records, err
+	}
+
+	err = recordBucket.ForEach(func(k, v []byte) error {
+		record := storage.UndoRecord{}
+		if err := decode(v, &record); err != nil {
+			return err
+		}
+
+		record.ID = string(k)
+		record.UserID = userID
+		records = append(records, record)
+
+		return nil
+	})
+
+	return records, err
+}
+
+func deleteUndoRecord(tx *bolt.Tx, record storage.UndoRecord) error {
+	records, err := userBucket(tx, record.UserID, undoRecordsBucket)
+	if err != nil {
+		return err
+	}
+
+	return records.Delete([]byte(record.ID))
+}
+
+// revertReadRange marks unread the articles that the read range
+// marked read, drops the range if it's still pending, and recounts
+// unread articles. The record is not saved
+func revertReadRange(tx *bolt.Tx, userID storage.UserID, record *subscriptionRecord, marked time.Time) error {
+	if record.ReadRange.Marked.Equal(marked) {
+		record.ReadRange = storage.ReadRange{}
+	}
+
+	unread := 0
+	deltas := storage.ArticleCountDeltas{}
+	err := updateArticles(tx, userID, record.ID, func(article *articleRecord) bool {
+		reverted := false
+		if !article.IsUnread() && article.MarkedRead.Equal(marked) {
+			deltas.Remove(record.FolderID, article.Article)
+			article.SetProperty("read", false)
+			article.MarkedRead = time.Time{}
+			deltas.Add(record.FolderID, article.Article)
+			reverted = true
+		}
+
+		if article.IsUnread() && !record.ReadRange.Covers(article.Article) {
+			unread++
+		}
+
+		return reverted
+	})
+
+	if err != nil {
+		return err
+	}
+
+	record.UnreadCount = unread
+	return updateArticleCounts(tx, userID, deltas)
+}
+
+// restoreFolders puts back the folders removed with the record. The
+// removed folder goes to the top level if its parent is gone too
+func restoreFolders(tx *bolt.Tx, record storage.UndoRecord) error {
+	folders, err := userBucket(tx, record.UserID, foldersBucket)
+	if err != nil {
+		return err
+	}
+
+	removed := record.Folders
+	if len(removed) == 0 {
+		// Recorded before folders were kept
+		removed = []storage.Folder { { ID: record.FolderID, Title: record.Title } }
+	} else if parentID := removed[0].Parent; parentID != "" && folders.Get([]byte(parentID)) == nil {
+		removed[0].Parent = ""
+	}
+
+	for _, folder := range removed {
+		folderID := folder.ID
+		folder.ID = ""
+		if err := put(folders, folderID, folder); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (store *Store)UndoRecords(userID storage.UserID) ([]storage.UndoRecord, error) {
+	var records []storage.UndoRecord
+	err := store.db.View(func(tx *bolt.Tx) error {
+		var err error
+		records, err = undoRecords(tx, userID)
+		return err
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Sort(undoRecordsByCreation(records))
+
+	return records, nil
+}
+
+// Undo reverses the operation described by the record, and removes
+// the record. Subscriptions that were since added again are left
+// as they are
+func (store *Store)Undo(record storage.UndoRecord) error {
+	return store.db.Update(func(tx *bolt.Tx) error {
+		switch record.Action {
+		case storage.UndoUnsubscribe, storage.UndoRemoveFolder:
+			if record.Action == storage.UndoRemoveFolder {
+				if err := restoreFolders(tx, record); err != nil {
+					return err
+				}
+			}
+
+			subscriptions, err := userBucket(tx, record.UserID, subscriptionsBucket)
+			if err != nil {
+				return err
+			}
+
+			for _, subscription := range record.Subscriptions {
+				if subscriptions.Get([]byte(subscription.ID)) != nil {
+					continue // Subscribed again
+				}
+
+				restored := subscriptionRecord {
+					Subscription: subscription,
+					FolderID: record.FolderID,
+				}
+				if subscription.Parent != "" {
+					restored.FolderID = subscription.Parent
+				}
+				restored.Parent = ""
+				if err := put(subscriptions, subscription.ID, restored); err != nil {
+					return err
+				} else if err := adjustSubscriberCount(tx, subscription.FeedURL, 1); err != nil {
+					return err
+				}
+
+				// Back on the counters
+				deltas := storage.ArticleCountDeltas{}
+				if err := countArticles(tx, record.UserID, &restored, deltas.Add); err != nil {
+					return err
+				} else if err := updateArticleCounts(tx, record.UserID, deltas); err != nil {
+					return err
+				}
+			}
+		case storage.UndoRemoveTag:
+			if err := createMissingTags(tx, record.UserID, []string { record.Tag }); err != nil {
+				return err
+			}
+		case storage.UndoMarkAsRead:
+			scope := storage.ArticleScope {
+				FolderRef: storage.FolderRef {
+					UserID: record.UserID,
+					FolderID: record.FolderID,
+				},
+				SubscriptionID: record.SubscriptionID,
+			}
+
+			records, err := subscriptionsWithin(tx, scope)
+			if err != nil {
+				return err
+			}
+
+			for _, subscription := range records {
+				if err := revertReadRange(tx, record.UserID, subscription, record.Marked); err != nil {
+					return err
+				} else if err := saveSubscription(tx, record.UserID, subscription); err != nil {
+					return err
+				}
+			}
+		}
+
+		return deleteUndoRecord(tx, record)
+	})
+}
+
+// DiscardUndoRecord deletes whatever the operation described by the
+// record left behind, and removes the record
+func (store *Store)DiscardUndoRecord(record storage.UndoRecord) error {
+	return store.db.Update(func(tx *bolt.Tx) error {
+		switch record.Action {
+		case storage.UndoUnsubscribe, storage.UndoRemoveFolder:
+			subscriptions, err := userBucket(tx, record.UserID, subscriptionsBucket)
+			if err != nil {
+				return err
+			}
+
+			for _, subscription := range record.Subscriptions {
+				// Articles are keyed by subscription ID alone, so
+				// they're in use if subscribed again in any folder
+				if subscriptions.Get([]byte(subscription.ID)) != nil {
+					continue
+				}
+
+				if err := deleteArticles(tx, record.UserID, subscription.ID); err != nil {
+					return err
+				}
+			}
+		case storage.UndoRemoveTag:
+			tags, err := userBucket(tx, record.UserID, tagsBucket)
+			if err != nil {
+				return err
+			}
+
+			if tags.Get([]byte(record.Tag)) == nil {
+				if err := removeTag(tx, record.UserID, record.Tag); err != nil {
+					return err
+				}
+			}
+		}
+
+		return deleteUndoRecord(tx, record)
+	})
+}
+
+func (store *Store)UndoRecordsCreatedBefore(before time.Time, cursor string) (storage.UndoRecordIterator, error) {
+	it := &undoRecordIterator {
+		records: make([]storage.UndoRecord, 0),
+	}
+
+	err := store.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(userDataBucket).ForEach(func(userKey, v []byte) error {
+			records, err := undoRecords(tx, storage.UserID(userKey))
+			if err != nil {
+				return err
+			}
+
+			for _, record := range records {
+				if record.Created.Before(before) && undoRecordCursor(record) >= cursor {
+					it.records = append(it.records, record)
+				}
+			}
+
+			return nil
+		})
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return it, nil
+}
@@ -0,0 +1,109 @@
+/*****************************************************************************
+ **
+ ** Gofr
+ ** https://github.com/pokebyte/Gofr
+ ** Copyright (C) 2013-2017 Akop Karapetyan
+ **
+ ** This program is free software; you can redistribute it and/or modify
+ ** it under the terms of the GNU General Public License as published by
+ ** the Free Software Foundation; either version 2 of the License, or
+ ** (at your option) any later version.
+ **
+ ** This program is distributed in the hope that it will be useful,
+ ** but WITHOUT ANY WARRANTY; without even the implied warranty of
+ ** MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ ** GNU General Public License for more details.
+ **
+ ** You should have received a copy of the GNU General Public License
+ ** along with this program; if not, write to the Free Software
+ ** Foundation, Inc., 675 Mass Ave, Cambridge, MA 02139, USA.
+ **
+ ******************************************************************************
+ */
+ 
+package embedded
+
+import (
+	"storage"
+	"testing"
+	"time"
+)
+
+func TestUndoRemoveFolder(t *testing.T) {
+	store, done := openTestStore(t)
+	defer done()
+
+	top := storage.FolderRef { UserID: testUserID }
+	outer := createTestFolder(t, store, top, "Outer")
+	inner := createTestFolder(t, store, outer, "Inner")
+	subscribeToTestFeed(t, store, outer, testFeed("http://example.com/outer", "a"), time.Now())
+	innerRef := subscribeToTestFeed(t, store, inner, testFeed("http://example.com/inner", "b", "c"), time.Now())
+
+	if _, err := store.SetProperty(storage.ArticleRef { SubscriptionRef: innerRef, ArticleID: "b" }, "star", true); err != nil {
+		t.Fatalf("Error starring: %s", err)
+	}
+
+	if err := store.DeleteFolder(outer); err != nil {
+		t.Fatalf("Error removing folder: %s", err)
+	}
+
+	if parents := folderParents(t, store); len(parents) != 0 {
+		t.Errorf("Expected no folders, got %v", parents)
+	}
+	if articles := testArticles(t, store, storage.ArticleScope { FolderRef: top }); len(articles) != 0 {
+		t.Errorf("Expected no articles, got %d", len(articles))
+	}
+
+	record := latestUndoRecord(t, store)
+	if record.Action != storage.UndoRemoveFolder || record.Title != "Outer" {
+		t.Errorf("Unexpected undo record: %+v", record)
+	}
+
+	if err := store.Undo(record); err != nil {
+		t.Fatalf("Error undoing: %s", err)
+	}
+
+	// The folders come back nested as they were, with their
+	// subscriptions and articles
+	if parents := folderParents(t, store); len(parents) != 2 || parents["Inner"] != "Outer" || parents["Outer"] != "" {
+		t.Errorf("Unexpected folders: %v", parents)
+	}
+
+	articles := testArticles(t, store, storage.ArticleScope { FolderRef: inner })
+	if len(articles) != 2 || !articles["b"].IsStarred() {
+		t.Errorf("Unexpected articles: %+v", articles)
+	}
+
+	expectCounts(t, store, map[string]storage.ArticleCounts {
+		storage.UserCounter: { Unread: 3, Starred: 1 },
+		storage.FolderCounter(outer.FolderID): { Unread: 3, Starred: 1 },
+		storage.FolderCounter(inner.FolderID): { Unread: 2, Starred: 1 },
+	})
+
+	if records, err := store.UndoRecords(testUserID); err != nil || len(records) != 0 {
+		t.Errorf("Expected the record to be gone, got %d (%v)", len(records), err)
+	}
+}
+
+func TestDiscardUndoRecord(t *testing.T) {
+	store, done := openTestStore(t)
+	defer done()
+
+	top := storage.FolderRef { UserID: testUserID }
+	ref := subscribeToTestFeed(t, store, top, testFeed("http://example.com/feed", "a"), time.Now())
+
+	if err := store.Unsubscribe(ref); err != nil {
+		t.Fatalf("Error unsubscribing: %s", err)
+	}
+	if err := store.DiscardUndoRecord(latestUndoRecord(t, store)); err != nil {
+		t.Fatalf("Error discarding undo record: %s", err)
+	}
+
+	// Subscribing again starts afresh
+	if _, err := store.Subscribe(top, ref.SubscriptionID, "Again"); err != nil {
+		t.Fatalf("Error subscribing: %s", err)
+	}
+	if articles := testArticles(t, store, storage.ArticleScope { FolderRef: top }); len(articles) != 0 {
+		t.Errorf("Expected the old articles to be gone, got %d", len(articles))
+	}
+}
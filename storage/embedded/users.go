@@ -0,0 +1,1050 @@
+// +build !appengine
+
+/*****************************************************************************
+ **
+ ** Gofr
+ ** https://github.com/pokebyte/Gofr
+ ** Copyright (C) 2013-2017 Akop Karapetyan
+ **
+ ** This program is free software; you can redistribute it and/or modify
+ ** it under the terms of the GNU General Public License as published by
+ ** the Free Software Foundation; either version 2 of the License, or
+ ** (at your option) any later version.
+ **
+ ** This program is distributed in the hope that it will be useful,
+ ** but WITHOUT ANY WARRANTY; without even the implied warranty of
+ ** MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ ** GNU General Public License for more details.
+ **
+ ** You should have received a copy of the GNU General Public License
+ ** along with this program; if not, write to the Free Software
+ ** Foundation, Inc., 675 Mass Ave, Cambridge, MA 02139, USA.
+ **
+ ******************************************************************************
+ */
+ 
+package embedded
+
+import (
+	"errors"
+	"github.com/boltdb/bolt"
+	"rss"
+	"storage"
+	"time"
+)
+
+func (store *Store)UserByID(userID storage.UserID) (*storage.User, error) {
+	var user *storage.User
+	err := store.db.View(func(tx *bolt.Tx) error {
+		u := storage.User{}
+		if found, err := get(tx.Bucket(usersBucket), string(userID), &u); err != nil {
+			return err
+		} else if found {
+			user = &u
+		}
+
+		return nil
+	})
+
+	return user, err
+}
+
+func (store *Store)SaveUser(user storage.User) error {
+	if user.ID == "" {
+		return errors.New("User missing an ID")
+	}
+
+	return store.db.Update(func(tx *bolt.Tx) error {
+		return put(tx.Bucket(usersBucket), user.ID, user)
+	})
+}
+
+// Users iterates over the IDs of all users, resuming from cursor,
+// if specified
+func (store *Store)Users(cursor string) (storage.UserIterator, error) {
+	it := &userIterator {
+		userIDs: make([]storage.UserID, 0),
+	}
+
+	err := store.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(usersBucket).Cursor()
+		for k, _ := c.Seek([]byte(cursor)); k != nil; k, _ = c.Next() {
+			it.userIDs = append(it.userIDs, storage.UserID(k))
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return it, nil
+}
+
+// subscriptionsWithin returns the subscriptions falling within
+// scope: all of the user's, those in a folder (or its subfolders),
+// or a single one
+func subscriptionsWithin(tx *bolt.Tx, scope storage.ArticleScope) ([]*subscriptionRecord, error) {
+	subscriptions, err := userBucket(tx, scope.UserID, subscriptionsBucket)
+	if err != nil || subscriptions == nil {
+		return nil, err
+	}
+
+	within := map[string]bool{}
+	if scope.SubscriptionID == "" && scope.FolderID != "" {
+		folders, err := userFolders(tx, scope.UserID)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, folderID := range storage.FolderSubtree(folders, scope.FolderID) {
+			within[folderID] = true
+		}
+	}
+
+	records := make([]*subscriptionRecord, 0)
+	err = subscriptions.ForEach(func(k, v []byte) error {
+		record := new(subscriptionRecord)
+		if err := decode(v, record); err != nil {
+			return err
+		}
+
+		if scope.SubscriptionID != "" {
+			if record.ID != scope.SubscriptionID || record.FolderID != scope.FolderID {
+				return nil
+			}
+		} else if scope.FolderID != "" && !within[record.FolderID] {
+			return nil
+		}
+
+		records = append(records, record)
+		return nil
+	})
+
+	return records, err
+}
+
+// userFolders returns all of the user's folders
+func userFolders(tx *bolt.Tx, userID storage.UserID) ([]storage.Folder, error) {
+	folders := make([]storage.Folder, 0)
+	bucket, err := userBucket(tx, userID, foldersBucket)
+	if err != nil || bucket == nil {
+		return folders, err
+	}
+
+	err = bucket.ForEach(func(k, v []byte) error {
+		folder := storage.Folder{}
+		if err := decode(v, &folder); err != nil {
+			return err
+		}
+
+		folder.ID = string(k)
+		folders = append(folders, folder)
+		return nil
+	})
+
+	return folders, err
+}
+
+// loadSubscription returns the subscription, or nil if the user
+// isn't subscribed (or the subscription is in another folder)
+func loadSubscription(tx *bolt.Tx, ref storage.SubscriptionRef) (*subscriptionRecord, error) {
+	if ref.SubscriptionID == "" {
+		return nil, errors.New("SubscriptionRef is missing Subscription ID")
+	}
+
+	subscriptions, err := userBucket(tx, ref.UserID, subscriptionsBucket)
+	if err != nil {
+		return nil, err
+	}
+
+	record := new(subscriptionRecord)
+	if found, err := get(subscriptions, ref.SubscriptionID, record); err != nil {
+		return nil, err
+	} else if !found || record.FolderID != ref.FolderID {
+		return nil, nil
+	}
+
+	return record, nil
+}
+
+func saveSubscription(tx *bolt.Tx, userID storage.UserID, record *subscriptionRecord) error {
+	subscriptions, err := userBucket(tx, userID, subscriptionsBucket)
+	if err != nil {
+		return err
+	}
+
+	return put(subscriptions, record.ID, record)
+}
+
+// deleteSubscription removes the subscription, decrements the
+// subscriber count of the feed, and takes its articles off the
+// counters. The articles are kept until the undo record of the
+// removal is discarded
+func deleteSubscription(tx *bolt.Tx, userID storage.UserID, record *subscriptionRecord) error {
+	subscriptions, err := userBucket(tx, userID, subscriptionsBucket)
+	if err != nil {
+		return err
+	}
+
+	if err := subscriptions.Delete([]byte(record.ID)); err != nil {
+		return err
+	}
+
+	deltas := storage.ArticleCountDeltas{}
+	if err := countArticles(tx, userID, record, deltas.Remove); err != nil {
+		return err
+	} else if err := updateArticleCounts(tx, userID, deltas); err != nil {
+		return err
+	}
+
+	return adjustSubscriberCount(tx, record.FeedURL, -1)
+}
+
+func (store *Store)NewUserSubscriptions(userID storage.UserID) (*storage.UserSubscriptions, error) {
+	userSubscriptions := storage.UserSubscriptions {
+		Subscriptions: make([]storage.Subscription, 0),
+		Folders: make([]storage.Folder, 0),
+		Tags: make([]storage.Tag, 0),
+	}
+
+	err := store.db.View(func(tx *bolt.Tx) error {
+		scope := storage.ArticleScope {
+			FolderRef: storage.FolderRef {
+				UserID: userID,
+			},
+		}
+
+		records, err := subscriptionsWithin(tx, scope)
+		if err != nil {
+			return err
+		}
+
+		for _, record := range records {
+			subscription := record.Subscription
+			subscription.Parent = record.FolderID
+
+			feed := storage.Feed{}
+			if _, err := get(tx.Bucket(feedsBucket), subscription.FeedURL, &feed); err != nil {
+				return err
+			}
+
+			feedMeta := storage.FeedMeta{}
+			if _, err := get(tx.Bucket(feedMetaBucket), subscription.FeedURL, &feedMeta); err != nil {
+				return err
+			}
+
+			subscription.Link = feed.Link
+			subscription.FavIconURL = feed.FavIconURL
+			subscription.FavIcon = feed.FavIcon
+			subscription.Status = feedMeta.Status()
+
+			userSubscriptions.Subscriptions = append(userSubscriptions.Subscriptions, subscription)
+		}
+
+		if userSubscriptions.Folders, err = userFolders(tx, userID); err != nil {
+			return err
+		}
+
+		if tags, err := userBucket(tx, userID, tagsBucket); err != nil {
+			return err
+		} else if tags != nil {
+			err := tags.ForEach(func(k, v []byte) error {
+				tag := storage.Tag{}
+				if err := decode(v, &tag); err != nil {
+					return err
+				}
+
+				userSubscriptions.Tags = append(userSubscriptions.Tags, tag)
+				return nil
+			})
+
+			if err != nil {
+				return err
+			}
+		}
+
+		counts, err := articleCounts(tx, userID)
+		if err != nil {
+			return err
+		}
+
+		userSubscriptions.ArticleCounts = counts[storage.UserCounter]
+		for i, folder := range userSubscriptions.Folders {
+			userSubscriptions.Folders[i].ArticleCounts = counts[storage.FolderCounter(folder.ID)]
+		}
+		storage.RollUpFolderCounts(userSubscriptions.Folders)
+		for i, tag := range userSubscriptions.Tags {
+			userSubscriptions.Tags[i].ArticleCounts = counts[storage.TagCounter(tag.Title)]
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &userSubscriptions, nil
+}
+
+// IsFolderDuplicate returns true if the parent already holds
+// a folder with the title
+func (store *Store)IsFolderDuplicate(parent storage.FolderRef, title string) (bool, error) {
+	ref, err := store.FolderByTitle(parent, title)
+	return !ref.IsZero(), err
+}
+
+func (store *Store)IsSubscriptionDuplicate(userID storage.UserID, subscriptionURL string) (bool, error) {
+	duplicate := false
+	err := store.db.View(func(tx *bolt.Tx) error {
+		scope := storage.ArticleScope {
+			FolderRef: storage.FolderRef {
+				UserID: userID,
+			},
+		}
+
+		records, err := subscriptionsWithin(tx, scope)
+		for _, record := range records {
+			if record.FeedURL == subscriptionURL {
+				duplicate = true
+				break
+			}
+		}
+
+		return err
+	})
+
+	return duplicate, err
+}
+
+// FolderByTitle returns the folder with the title, directly within
+// the parent. The reference is zero if there's none
+func (store *Store)FolderByTitle(parent storage.FolderRef, title string) (storage.FolderRef, error) {
+	ref := storage.FolderRef{}
+	err := store.db.View(func(tx *bolt.Tx) error {
+		folders, err := userFolders(tx, parent.UserID)
+		for _, folder := range folders {
+			if folder.Title == title && folder.Parent == parent.FolderID {
+				ref.UserID = parent.UserID
+				ref.FolderID = folder.ID
+				break
+			}
+		}
+
+		return err
+	})
+
+	return ref, err
+}
+
+func (store *Store)FolderExists(ref storage.FolderRef) (bool, error) {
+	exists := false
+	err := store.db.View(func(tx *bolt.Tx) error {
+		folders, err := userBucket(tx, ref.UserID, foldersBucket)
+		if err == nil && folders != nil && ref.FolderID != "" {
+			exists = folders.Get([]byte(ref.FolderID)) != nil
+		}
+
+		return err
+	})
+
+	return exists, err
+}
+
+func (store *Store)SubscriptionExists(ref storage.SubscriptionRef) (bool, error) {
+	exists := false
+	err := store.db.View(func(tx *bolt.Tx) error {
+		record, err := loadSubscription(tx, ref)
+		exists = record != nil
+
+		return err
+	})
+
+	return exists, err
+}
+
+func (store *Store)CreateFolder(parent storage.FolderRef, title string) (storage.FolderRef, error) {
+	ref := storage.FolderRef{}
+	err := store.db.Update(func(tx *bolt.Tx) error {
+		folders, err := userBucket(tx, parent.UserID, foldersBucket)
+		if err != nil {
+			return err
+		}
+
+		folderID, err := nextID(folders, "folder")
+		if err != nil {
+			return err
+		}
+
+		folder := storage.Folder {
+			Title: title,
+			Parent: parent.FolderID,
+		}
+
+		if err := put(folders, folderID, folder); err != nil {
+			return err
+		}
+
+		ref.UserID = parent.UserID
+		ref.FolderID = folderID
+
+		return nil
+	})
+
+	return ref, err
+}
+
+func (store *Store)RenameFolder(ref storage.FolderRef, title string) error {
+	return store.db.Update(func(tx *bolt.Tx) error {
+		folders, err := userBucket(tx, ref.UserID, foldersBucket)
+		if err != nil {
+			return err
+		}
+
+		folder := storage.Folder{}
+		if found, err := get(folders, ref.FolderID, &folder); err != nil {
+			return err
+		} else if !found {
+			return errNotFound
+		}
+
+		folder.Title = title
+		return put(folders, ref.FolderID, folder)
+	})
+}
+
+// MoveFolder nests the folder within another, or moves it to the
+// top level if the destination has no folder ID
+func (store *Store)MoveFolder(ref storage.FolderRef, destRef storage.FolderRef) error {
+	return store.db.Update(func(tx *bolt.Tx) error {
+		all, err := userFolders(tx, ref.UserID)
+		if err != nil {
+			return err
+		}
+
+		for _, folderID := range storage.FolderSubtree(all, ref.FolderID) {
+			if folderID == destRef.FolderID {
+				return storage.ErrFolderCycle
+			}
+		}
+
+		folders, err := userBucket(tx, ref.UserID, foldersBucket)
+		if err != nil {
+			return err
+		}
+
+		folder := storage.Folder{}
+		if found, err := get(folders, ref.FolderID, &folder); err != nil {
+			return err
+		} else if !found {
+			return errNotFound
+		}
+
+		folder.Parent = destRef.FolderID
+		return put(folders, ref.FolderID, folder)
+	})
+}
+
+func (store *Store)DeleteFolder(ref storage.FolderRef) error {
+	return store.db.Update(func(tx *bolt.Tx) error {
+		folders, err := userBucket(tx, ref.UserID, foldersBucket)
+		if err != nil {
+			return err
+		}
+
+		folder := storage.Folder{}
+		if _, err := get(folders, ref.FolderID, &folder); err != nil {
+			return err
+		}
+		folder.ID = ref.FolderID
+
+		// Subfolders are removed along with the folder
+		all, err := userFolders(tx, ref.UserID)
+		if err != nil {
+			return err
+		}
+
+		removed := []storage.Folder { folder }
+		for _, folderID := range storage.FolderSubtree(all, ref.FolderID)[1:] {
+			for _, subfolder := range all {
+				if subfolder.ID == folderID {
+					removed = append(removed, subfolder)
+				}
+			}
+		}
+
+		records, err := subscriptionsWithin(tx, storage.ArticleScope { FolderRef: ref })
+		if err != nil {
+			return err
+		}
+
+		undoRecord := storage.UndoRecord {
+			UserID: ref.UserID,
+			Action: storage.UndoRemoveFolder,
+			Title: folder.Title,
+			FolderID: ref.FolderID,
+			Subscriptions: make([]storage.Subscription, len(records)),
+			Folders: removed,
+		}
+		for i, record := range records {
+			undoRecord.Subscriptions[i] = record.Subscription
+			undoRecord.Subscriptions[i].Parent = record.FolderID
+		}
+
+		if err := saveUndoRecord(tx, &undoRecord); err != nil {
+			return err
+		}
+
+		for _, removedFolder := range removed {
+			if err := folders.Delete([]byte(removedFolder.ID)); err != nil {
+				return err
+			}
+		}
+
+		for _, record := range records {
+			if err := deleteSubscription(tx, ref.UserID, record); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+func (store *Store)Subscribe(ref storage.FolderRef, url string, title string) (storage.SubscriptionRef, error) {
+	subscriptionRef := storage.SubscriptionRef {
+		FolderRef: ref,
+		SubscriptionID: url,
+	}
+
+	err := store.db.Update(func(tx *bolt.Tx) error {
+		subscriptions, err := userBucket(tx, ref.UserID, subscriptionsBucket)
+		if err != nil {
+			return err
+		}
+
+		if subscriptions.Get([]byte(url)) != nil {
+			return nil // Already subscribed
+		}
+
+		record := subscriptionRecord {
+			Subscription: storage.Subscription {
+				ID: url,
+				Subscribed: time.Now(),
+				FeedURL: url,
+				MaxUpdateIndex: -1,
+				Title: title,
+			},
+			FolderID: ref.FolderID,
+		}
+
+		if err := put(subscriptions, url, record); err != nil {
+			return err
+		}
+
+		return adjustSubscriberCount(tx, url, 1)
+	})
+
+	if err != nil {
+		return storage.SubscriptionRef{}, err
+	}
+
+	return subscriptionRef, nil
+}
+
+func (store *Store)Unsubscribe(ref storage.SubscriptionRef) error {
+	return store.db.Update(func(tx *bolt.Tx) error {
+		if record, err := loadSubscription(tx, ref); err != nil {
+			return err
+		} else if record == nil {
+			return errNotFound
+		} else {
+			undoRecord := storage.UndoRecord {
+				UserID: ref.UserID,
+				Action: storage.UndoUnsubscribe,
+				Title: record.Title,
+				FolderID: ref.FolderID,
+				SubscriptionID: ref.SubscriptionID,
+				Subscriptions: []storage.Subscription { record.Subscription },
+			}
+			if err := saveUndoRecord(tx, &undoRecord); err != nil {
+				return err
+			}
+
+			return deleteSubscription(tx, ref.UserID, record)
+		}
+	})
+}
+
+// updateSubscriptionRecord loads a subscription, applies a change
+// and writes it back
+func (store *Store)updateSubscriptionRecord(ref storage.SubscriptionRef, update func(tx *bolt.Tx, record *subscriptionRecord) error) error {
+	return store.db.Update(func(tx *bolt.Tx) error {
+		record, err := loadSubscription(tx, ref)
+		if err != nil {
+			return err
+		} else if record == nil {
+			return errNotFound
+		}
+
+		if err := update(tx, record); err != nil {
+			return err
+		}
+
+		return saveSubscription(tx, ref.UserID, record)
+	})
+}
+
+func (store *Store)RenameSubscription(ref storage.SubscriptionRef, title string) error {
+	return store.updateSubscriptionRecord(ref, func(tx *bolt.Tx, record *subscriptionRecord) error {
+		record.Title = title
+		return nil
+	})
+}
+
+// SetSubscriptionTags sets the tags applied to articles as they
+// arrive from the subscription
+func (store *Store)SetSubscriptionTags(ref storage.SubscriptionRef, tags []string) error {
+	return store.updateSubscriptionRecord(ref, func(tx *bolt.Tx, record *subscriptionRecord) error {
+		record.Tags = tags
+		return createMissingTags(tx, ref.UserID, tags)
+	})
+}
+
+func (store *Store)MoveSubscription(subRef storage.SubscriptionRef, destRef storage.FolderRef) error {
+	return store.updateSubscriptionRecord(subRef, func(tx *bolt.Tx, record *subscriptionRecord) error {
+		// The articles' folder counts move along
+		deltas := storage.ArticleCountDeltas{}
+		if err := countArticles(tx, subRef.UserID, record, deltas.Remove); err != nil {
+			return err
+		}
+
+		record.FolderID = destRef.FolderID
+
+		if err := countArticles(tx, subRef.UserID, record, deltas.Add); err != nil {
+			return err
+		}
+
+		return updateArticleCounts(tx, subRef.UserID, deltas)
+	})
+}
+
+// MoveArticles is a no-op; articles are keyed by subscription
+// alone, so they follow the subscription when it's moved
+func (store *Store)MoveArticles(subRef storage.SubscriptionRef, destRef storage.FolderRef) error {
+	return nil
+}
+
+func (store *Store)SubscriptionsAsOPML(userID storage.UserID) (*rss.OPML, error) {
+	userSubscriptions, err := store.NewUserSubscriptions(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	opml := rss.NewOPML()
+	opml.SetDateCreated(time.Now())
+
+	folderMap := storage.AddFolderOutlines(&opml, userSubscriptions.Folders)
+
+	for _, subscription := range userSubscriptions.Subscriptions {
+		opmlSub := rss.NewSubscription(subscription.Title, subscription.FeedURL, "")
+		categories := make([]string, 0, len(subscription.Tags) + 1)
+		if folder := folderMap[subscription.Parent]; folder != nil {
+			folder.Add(opmlSub)
+			categories = append(categories, folder.Text)
+		} else {
+			opml.Add(opmlSub)
+		}
+
+		opmlSub.SetCategories(append(categories, subscription.Tags...))
+
+		if feed, err := store.FeedByURL(subscription.FeedURL); err != nil {
+			return nil, err
+		} else if feed != nil {
+			// Text holds the (possibly renamed) title of the
+			// subscription; title is the one of the feed
+			if feed.Title != "" {
+				opmlSub.Title = feed.Title
+			}
+
+			opmlSub.WebURL = feed.Link
+			opmlSub.Description = feed.Description
+			opmlSub.Version = storage.OPMLVersion(feed.Format)
+		}
+	}
+
+	return &opml, nil
+}
+
+// updateSubscription creates (or updates) articles for entries
+// the subscription has not yet seen. Returns the number written
+func updateSubscription(tx *bolt.Tx, userID storage.UserID, record *subscriptionRecord) (int, error) {
+	entries := tx.Bucket(entriesBucket).Bucket([]byte(record.FeedURL))
+	if entries == nil {
+		return 0, nil // Not yet fetched
+	}
+
+	articles, err := articleBucket(tx, userID, record.ID)
+	if err != nil {
+		return 0, err
+	}
+
+	index, err := userBucket(tx, userID, searchBucket)
+	if err != nil {
+		return 0, err
+	}
+
+	largestUpdateIndexWritten := int64(-1)
+	unreadDelta := 0
+	written := 0
+	deleted := 0
+	deltas := storage.ArticleCountDeltas{}
+
+	// Rules are only loaded once there's a new article to run them on
+	var rules *storage.FilterRuleSet
+
+	err = entries.ForEach(func(k, v []byte) error {
+		entry := entryRecord{}
+		if err := decode(v, &entry); err != nil {
+			return err
+		} else if entry.UpdateIndex <= record.MaxUpdateIndex {
+			return nil
+		}
+
+		article := articleRecord{}
+		found, err := get(articles, string(k), &article)
+		if err != nil {
+			return err
+		} else if !found {
+			// New article
+			article.ID = string(k)
+			article.Properties = []string { "unread" }
+			article.Tags = append([]string(nil), record.Tags...)
+		}
+
+		if found {
+			// Refetching moves the article past the read range
+			previous := article.Article
+			if record.ReadRange.Apply(&article.Article) {
+				deltas.Remove(record.FolderID, previous)
+				deltas.Add(record.FolderID, article.Article)
+			}
+		}
+
+		article.FeedURL = record.FeedURL
+		article.UpdateIndex = entry.UpdateIndex
+		article.Fetched = entry.Fetched
+		article.Published = entry.Published
+
+		if entry.UpdateIndex > largestUpdateIndexWritten {
+			largestUpdateIndexWritten = entry.UpdateIndex
+		}
+
+		if !found {
+			if rules == nil {
+				all, err := filterRules(tx, userID)
+				if err != nil {
+					return err
+				}
+
+				// Rules on a folder cover its subfolders
+				folders, err := userFolders(tx, userID)
+				if err != nil {
+					return err
+				}
+
+				rules = storage.NewFilterRuleSet(all, folders).For(record.FolderID, record.ID)
+			}
+
+			media := make([]*storage.EntryMedia, len(entry.Media))
+			for i, _ := range entry.Media {
+				media[i] = &entry.Media[i]
+			}
+
+			if !rules.Apply(&article.Article, &entry.Entry, media) {
+				deleted++
+				return nil
+			} else if article.IsUnread() {
+				unreadDelta++
+			}
+			deltas.Add(record.FolderID, article.Article)
+		}
+
+		if err := indexArticle(index, record.ID, string(k), &entry.Entry); err != nil {
+			return err
+		}
+
+		written++
+		return put(articles, string(k), article)
+	})
+
+	if err != nil || (written == 0 && deleted == 0) {
+		return written, err
+	} else if err := updateArticleCounts(tx, userID, deltas); err != nil {
+		return written, err
+	}
+
+	record.Updated = time.Now()
+	record.MaxUpdateIndex = largestUpdateIndexWritten
+
+	if record.UnreadCount + unreadDelta >= 0 {
+		record.UnreadCount += unreadDelta
+	}
+
+	return written, saveSubscription(tx, userID, record)
+}
+
+func (store *Store)UpdateSubscription(url string, ref storage.SubscriptionRef) (int, error) {
+	written := 0
+	err := store.db.Update(func(tx *bolt.Tx) error {
+		record, err := loadSubscription(tx, ref)
+		if err != nil {
+			return err
+		} else if record == nil {
+			return errNotFound
+		}
+
+		written, err = updateSubscription(tx, ref.UserID, record)
+		return err
+	})
+
+	return written, err
+}
+
+func (store *Store)UpdateAllSubscriptions(userID storage.UserID) error {
+	return store.db.Update(func(tx *bolt.Tx) error {
+		scope := storage.ArticleScope {
+			FolderRef: storage.FolderRef {
+				UserID: userID,
+			},
+		}
+
+		records, err := subscriptionsWithin(tx, scope)
+		if err != nil {
+			return err
+		}
+
+		for _, record := range records {
+			if _, err := updateSubscription(tx, userID, record); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+func (store *Store)AreNewEntriesAvailable(subscriptions []storage.Subscription) (bool, error) {
+	available := false
+	err := store.db.View(func(tx *bolt.Tx) error {
+		for _, subscription := range subscriptions {
+			entries := tx.Bucket(entriesBucket).Bucket([]byte(subscription.FeedURL))
+			if entries == nil {
+				continue
+			}
+
+			err := entries.ForEach(func(k, v []byte) error {
+				entry := entryRecord{}
+				if err := decode(v, &entry); err != nil {
+					return err
+				} else if entry.UpdateIndex > subscription.MaxUpdateIndex {
+					available = true
+				}
+
+				return nil
+			})
+
+			if err != nil || available {
+				return err
+			}
+		}
+
+		return nil
+	})
+
+	return available, err
+}
+
+// Subscriptions iterates over the subscriptions of all users,
+// resuming from cursor, if specified
+func (store *Store)Subscriptions(cursor string) (storage.SubscriptionIterator, error) {
+	it := &subscriptionIterator {
+		refs: make([]storage.SubscriptionRef, 0),
+	}
+
+	err := store.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(userDataBucket).ForEach(func(userKey, v []byte) error {
+			userID := storage.UserID(userKey)
+			scope := storage.ArticleScope {
+				FolderRef: storage.FolderRef {
+					UserID: userID,
+				},
+			}
+
+			records, err := subscriptionsWithin(tx, scope)
+			if err != nil {
+				return err
+			}
+
+			for _, record := range records {
+				ref := storage.SubscriptionRef {
+					FolderRef: storage.FolderRef {
+						UserID: userID,
+						FolderID: record.FolderID,
+					},
+					SubscriptionID: record.ID,
+				}
+
+				if subscriptionCursor(ref) >= cursor {
+					it.refs = append(it.refs, ref)
+				}
+			}
+
+			return nil
+		})
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return it, nil
+}
+
+// UpdateUnreadCount recounts the unread articles of a subscription,
+// correcting the stored count if it has drifted
+func (store *Store)UpdateUnreadCount(ref storage.SubscriptionRef) error {
+	return store.updateSubscriptionRecord(ref, func(tx *bolt.Tx, record *subscriptionRecord) error {
+		articles, err := articleBucket(tx, ref.UserID, record.ID)
+		if err != nil {
+			return err
+		}
+
+		count := 0
+		err = articles.ForEach(func(k, v []byte) error {
+			article := articleRecord{}
+			if err := decode(v, &article); err != nil {
+				return err
+			} else if article.IsUnread() && !record.ReadRange.Covers(article.Article) {
+				count++
+			}
+
+			return nil
+		})
+
+		record.UnreadCount = count
+		return err
+	})
+}
+
+func createMissingTags(tx *bolt.Tx, userID storage.UserID, tags []string) error {
+	tagBucket, err := userBucket(tx, userID, tagsBucket)
+	if err != nil {
+		return err
+	}
+
+	for _, tagTitle := range tags {
+		if tagBucket.Get([]byte(tagTitle)) == nil {
+			tag := storage.Tag {
+				Title: tagTitle,
+				Created: time.Now(),
+			}
+
+			if err := put(tagBucket, tagTitle, tag); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func (store *Store)TagExists(userID storage.UserID, tagID string) (bool, error) {
+	exists := false
+	err := store.db.View(func(tx *bolt.Tx) error {
+		tags, err := userBucket(tx, userID, tagsBucket)
+		if err == nil && tags != nil {
+			exists = tags.Get([]byte(tagID)) != nil
+		}
+
+		return err
+	})
+
+	return exists, err
+}
+
+func (store *Store)DeleteTag(userID storage.UserID, tagID string) error {
+	return store.db.Update(func(tx *bolt.Tx) error {
+		tags, err := userBucket(tx, userID, tagsBucket)
+		if err != nil {
+			return err
+		}
+
+		// Articles keep the tag until the record is discarded
+		undoRecord := storage.UndoRecord {
+			UserID: userID,
+			Action: storage.UndoRemoveTag,
+			Title: tagID,
+			Tag: tagID,
+		}
+		if err := saveUndoRecord(tx, &undoRecord); err != nil {
+			return err
+		}
+
+		return tags.Delete([]byte(tagID))
+	})
+}
+
+// RemoveTag strips the tag from all of the user's articles, and
+// stops subscriptions from applying it to new ones
+func (store *Store)RemoveTag(userID storage.UserID, tag string) error {
+	return store.db.Update(func(tx *bolt.Tx) error {
+		return removeTag(tx, userID, tag)
+	})
+}
+
+func removeTag(tx *bolt.Tx, userID storage.UserID, tag string) error {
+	scope := storage.ArticleScope {
+		FolderRef: storage.FolderRef {
+			UserID: userID,
+		},
+	}
+
+	records, err := subscriptionsWithin(tx, scope)
+	if err != nil {
+		return err
+	}
+
+	for _, record := range records {
+		err := updateArticles(tx, userID, record.ID, func(article *articleRecord) bool {
+			if !containsTag(article.Tags, tag) {
+				return false
+			}
+
+			article.SetTag(tag, false)
+			return true
+		})
+
+		if err != nil {
+			return err
+		}
+
+		tags := make([]string, 0, len(record.Tags))
+		for _, subscriptionTag := range record.Tags {
+			if subscriptionTag != tag {
+				tags = append(tags, subscriptionTag)
+			}
+		}
+
+		if len(tags) != len(record.Tags) {
+			record.Tags = tags
+			if err := saveSubscription(tx, userID, record); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,82 @@
+/*****************************************************************************
+ **
+ ** Gofr
+ ** https://github.com/pokebyte/Gofr
+ ** Copyright (C) 2013-2017 Akop Karapetyan
+ **
+ ** This program is free software; you can redistribute it and/or modify
+ ** it under the terms of the GNU General Public License as published by
+ ** the Free Software Foundation; either version 2 of the License, or
+ ** (at your option) any later version.
+ **
+ ** This program is distributed in the hope that it will be useful,
+ ** but WITHOUT ANY WARRANTY; without even the implied warranty of
+ ** MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ ** GNU General Public License for more details.
+ **
+ ** You should have received a copy of the GNU General Public License
+ ** along with this program; if not, write to the Free Software
+ ** Foundation, Inc., 675 Mass Ave, Cambridge, MA 02139, USA.
+ **
+ ******************************************************************************
+ */
+ 
+package embedded
+
+import (
+	"storage"
+	"testing"
+)
+
+func TestMoveFolder(t *testing.T) {
+	store, done := openTestStore(t)
+	defer done()
+
+	top := storage.FolderRef { UserID: testUserID }
+	a := createTestFolder(t, store, top, "A")
+	b := createTestFolder(t, store, a, "B")
+	c := createTestFolder(t, store, b, "C")
+	d := createTestFolder(t, store, top, "D")
+
+	for _, dest := range []storage.FolderRef { a, b, c } {
+		if err := store.MoveFolder(a, dest); err != storage.ErrFolderCycle {
+			t.Errorf("Moving A into %s: expected a cycle error, got %v", dest.FolderID, err)
+		}
+	}
+
+	if err := store.MoveFolder(b, d); err != nil {
+		t.Fatalf("Error moving folder: %s", err)
+	}
+	if err := store.MoveFolder(a, c); err != nil {
+		t.Fatalf("Error moving folder: %s", err)
+	}
+
+	expected := map[string]string { "A": "C", "B": "D", "C": "B", "D": "" }
+	parents := folderParents(t, store)
+	for title, parent := range expected {
+		if parents[title] != parent {
+			t.Errorf("Expected %s in %q, got %q", title, parent, parents[title])
+		}
+	}
+}
+
+func TestFolderTitles(t *testing.T) {
+	store, done := openTestStore(t)
+	defer done()
+
+	top := storage.FolderRef { UserID: testUserID }
+	a := createTestFolder(t, store, top, "A")
+	createTestFolder(t, store, a, "Nested")
+
+	// Titles are unique within a parent only
+	if duplicate, err := store.IsFolderDuplicate(a, "Nested"); err != nil || !duplicate {
+		t.Errorf("Expected a duplicate in A (%v)", err)
+	}
+	if duplicate, err := store.IsFolderDuplicate(top, "Nested"); err != nil || duplicate {
+		t.Errorf("Expected no duplicate at the top level (%v)", err)
+	}
+
+	if ref, err := store.FolderByTitle(top, "Nested"); err != nil || !ref.IsZero() {
+		t.Errorf("Expected no folder at the top level, got %+v (%v)", ref, err)
+	}
+}
@@ -0,0 +1,195 @@
+// +build appengine
+
+/*****************************************************************************
+ **
+ ** Gofr
+ ** https://github.com/pokebyte/Gofr
+ ** Copyright (C) 2013-2017 Akop Karapetyan
+ **
+ ** This program is free software; you can redistribute it and/or modify
+ ** it under the terms of the GNU General Public License as published by
+ ** the Free Software Foundation; either version 2 of the License, or
+ ** (at your option) any later version.
+ **
+ ** This program is distributed in the hope that it will be useful,
+ ** but WITHOUT ANY WARRANTY; without even the implied warranty of
+ ** MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ ** GNU General Public License for more details.
+ **
+ ** You should have received a copy of the GNU General Public License
+ ** along with this program; if not, write to the Free Software
+ ** Foundation, Inc., 675 Mass Ave, Cambridge, MA 02139, USA.
+ **
+ ******************************************************************************
+ */
+ 
+package storage
+
+import (
+	"appengine/datastore"
+	"time"
+)
+
+const (
+	likeCountShards = 40
+	subscriberCountShards = 40
+	articleCountShards = 10
+)
+
+// The following wrap the storage objects with the keys that
+// Datastore uses to relate them
+
+type feedMetaEntity struct {
+	FeedMeta
+	Feed *datastore.Key
+}
+
+type subscriptionEntity struct {
+	Subscription
+	Feed *datastore.Key
+}
+
+type articleEntity struct {
+	Article
+	Entry *datastore.Key
+}
+
+type entryMediaEntity struct {
+	EntryMedia
+	Entry *datastore.Key
+}
+
+type hubSubscriptionEntity struct {
+	HubSubscription
+	Feed *datastore.Key
+}
+
+type FeedSubscriber struct {
+	Feed *datastore.Key
+	Count int
+}
+
+type FeedUsage struct {
+	UpdateCount int64
+	LastSubscriptionUpdate time.Time
+	Feed *datastore.Key
+}
+
+type EntryMeta struct {
+	Fetched time.Time
+	Published time.Time
+	InfoDigest []byte
+	UpdateIndex int64
+	Entry *datastore.Key
+}
+
+type likeCountShard struct {
+	Entry *datastore.Key
+	LikeCount int
+}
+
+type subscriberCountShard struct {
+	Feed *datastore.Key
+	SubscriberCount int
+}
+
+type articleCountShard struct {
+	User *datastore.Key
+	Counter string
+	Unread int
+	Starred int
+}
+
+func (entity *subscriptionEntity)subscription() Subscription {
+	subscription := entity.Subscription
+	if entity.Feed != nil {
+		subscription.FeedURL = entity.Feed.StringID()
+	}
+
+	return subscription
+}
+
+func (entity *articleEntity)article() Article {
+	article := entity.Article
+	if entity.Entry != nil {
+		article.ID = entity.Entry.StringID()
+	}
+
+	return article
+}
+
+func (entity *hubSubscriptionEntity)hubSubscription() HubSubscription {
+	hubSub := entity.HubSubscription
+	if entity.Feed != nil {
+		hubSub.FeedURL = entity.Feed.StringID()
+	}
+
+	return hubSub
+}
+
+type feedMetaIterator struct {
+	t *datastore.Iterator
+}
+
+func (it *feedMetaIterator)Next() (string, *FeedMeta, error) {
+	entity := new(feedMetaEntity)
+	if key, err := it.t.Next(entity); err == datastore.Done {
+		return "", nil, Done
+	} else if err == nil || IsFieldMismatch(err) {
+		return key.StringID(), &entity.FeedMeta, nil
+	} else {
+		return "", nil, err
+	}
+}
+
+func (it *feedMetaIterator)Cursor() (string, error) {
+	if cursor, err := it.t.Cursor(); err != nil {
+		return "", err
+	} else {
+		return cursor.String(), nil
+	}
+}
+
+type userIterator struct {
+	t *datastore.Iterator
+}
+
+func (it *userIterator)Next() (UserID, error) {
+	if key, err := it.t.Next(nil); err == datastore.Done {
+		return "", Done
+	} else if err != nil {
+		return "", err
+	} else {
+		return UserID(key.StringID()), nil
+	}
+}
+
+func (it *userIterator)Cursor() (string, error) {
+	if cursor, err := it.t.Cursor(); err != nil {
+		return "", err
+	} else {
+		return cursor.String(), nil
+	}
+}
+
+type subscriptionIterator struct {
+	t *datastore.Iterator
+}
+
+func (it *subscriptionIterator)Next() (SubscriptionRef, error) {
+	if key, err := it.t.Next(nil); err == datastore.Done {
+		return SubscriptionRef{}, Done
+	} else if err != nil {
+		return SubscriptionRef{}, err
+	} else {
+		return newSubscriptionRef(key), nil
+	}
+}
+
+func (it *subscriptionIterator)Cursor() (string, error) {
+	if cursor, err := it.t.Cursor(); err != nil {
+		return "", err
+	} else {
+		return cursor.String(), nil
+	}
+}
@@ -0,0 +1,229 @@
+// +build appengine
+
+/*****************************************************************************
+ **
+ ** Gofr
+ ** https://github.com/pokebyte/Gofr
+ ** Copyright (C) 2013-2017 Akop Karapetyan
+ **
+ ** This program is free software; you can redistribute it and/or modify
+ ** it under the terms of the GNU General Public License as published by
+ ** the Free Software Foundation; either version 2 of the License, or
+ ** (at your option) any later version.
+ **
+ ** This program is distributed in the hope that it will be useful,
+ ** but WITHOUT ANY WARRANTY; without even the implied warranty of
+ ** MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ ** GNU General Public License for more details.
+ **
+ ** You should have received a copy of the GNU General Public License
+ ** along with this program; if not, write to the Free Software
+ ** Foundation, Inc., 675 Mass Ave, Cambridge, MA 02139, USA.
+ **
+ ******************************************************************************
+ */
+ 
+package storage
+
+import (
+	"appengine"
+	"appengine/datastore"
+	"errors"
+	"time"
+)
+
+const recentImportJobCount = 10
+
+func (job ImportJob)key(c appengine.Context) (*datastore.Key, error) {
+	userKey, err := job.UserID.key(c)
+	if err != nil {
+		return nil, err
+	}
+
+	if kind, id, err := UnformatId(job.ID); err != nil {
+		return nil, err
+	} else if kind != "import" {
+		return nil, errors.New("Expecting import ID; found: " + kind)
+	} else {
+		return datastore.NewKey(c, "ImportJob", "", id, userKey), nil
+	}
+}
+
+func (ds *Datastore)NewImportJob(userID UserID) (*ImportJob, error) {
+	c := ds.c
+	userKey, err := userID.key(c)
+	if err != nil {
+		return nil, err
+	}
+
+	job := ImportJob {
+		UserID: userID,
+		Started: time.Now(),
+	}
+
+	jobKey := datastore.NewIncompleteKey(c, "ImportJob", userKey)
+	if completeKey, err := datastore.Put(c, jobKey, &job); err != nil {
+		return nil, err
+	} else {
+		job.ID = FormatId("import", completeKey.IntID())
+	}
+
+	return &job, nil
+}
+
+func (ds *Datastore)ImportJobByID(userID UserID, jobID string) (*ImportJob, error) {
+	c := ds.c
+	job := ImportJob {
+		ID: jobID,
+		UserID: userID,
+	}
+
+	jobKey, err := job.key(c)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := datastore.Get(c, jobKey, &job); err == nil || IsFieldMismatch(err) {
+		return &job, nil
+	} else if err != datastore.ErrNoSuchEntity {
+		return nil, err
+	}
+
+	return nil, nil
+}
+
+// RecentImportJobs returns the user's latest imports, most
+// recent first
+func (ds *Datastore)RecentImportJobs(userID UserID) ([]ImportJob, error) {
+	c := ds.c
+	userKey, err := userID.key(c)
+	if err != nil {
+		return nil, err
+	}
+
+	var jobs []ImportJob
+
+	q := datastore.NewQuery("ImportJob").Ancestor(userKey).Order("-Started").Limit(recentImportJobCount)
+	if jobKeys, err := q.GetAll(c, &jobs); err != nil && !IsFieldMismatch(err) {
+		return nil, err
+	} else {
+		for i, jobKey := range jobKeys {
+			jobs[i].ID = FormatId("import", jobKey.IntID())
+			jobs[i].UserID = userID
+		}
+	}
+
+	return jobs, nil
+}
+
+func (ds *Datastore)SaveImportJob(job ImportJob) error {
+	c := ds.c
+	jobKey, err := job.key(c)
+	if err != nil {
+		return err
+	}
+
+	if _, err := datastore.Put(c, jobKey, &job); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// ImportResults returns the outcome of each outline of the import
+func (ds *Datastore)ImportResults(job ImportJob) ([]ImportResult, error) {
+	c := ds.c
+	jobKey, err := job.key(c)
+	if err != nil {
+		return nil, err
+	}
+
+	var results []ImportResult
+
+	q := datastore.NewQuery("ImportResult").Ancestor(jobKey)
+	if resultKeys, err := q.GetAll(c, &results); err != nil && !IsFieldMismatch(err) {
+		return nil, err
+	} else {
+		for i, resultKey := range resultKeys {
+			results[i].ID = FormatId("result", resultKey.IntID())
+		}
+	}
+
+	return results, nil
+}
+
+// SaveImportResult writes the outcome of an outline, assigning it
+// an ID if it has not been written before
+func (ds *Datastore)SaveImportResult(job ImportJob, result *ImportResult) error {
+	c := ds.c
+	jobKey, err := job.key(c)
+	if err != nil {
+		return err
+	}
+
+	var resultKey *datastore.Key
+	if result.ID == "" {
+		resultKey = datastore.NewIncompleteKey(c, "ImportResult", jobKey)
+	} else if kind, id, err := UnformatId(result.ID); err != nil {
+		return err
+	} else if kind != "result" {
+		return errors.New("Expecting result ID; found: " + kind)
+	} else {
+		resultKey = datastore.NewKey(c, "ImportResult", "", id, jobKey)
+	}
+
+	result.Updated = time.Now()
+
+	if completeKey, err := datastore.Put(c, resultKey, result); err != nil {
+		return err
+	} else {
+		result.ID = FormatId("result", completeKey.IntID())
+	}
+
+	return nil
+}
+
+// SaveImportResults writes the outcome of several outlines at
+// once, assigning IDs to those not written before
+func (ds *Datastore)SaveImportResults(job ImportJob, results []*ImportResult) error {
+	c := ds.c
+	jobKey, err := job.key(c)
+	if err != nil {
+		return err
+	}
+
+	for start := 0; start < len(results); start += defaultBatchSize {
+		end := start + defaultBatchSize
+		if end > len(results) {
+			end = len(results)
+		}
+
+		batch := results[start:end]
+		keys := make([]*datastore.Key, len(batch))
+
+		for i, result := range batch {
+			if result.ID == "" {
+				keys[i] = datastore.NewIncompleteKey(c, "ImportResult", jobKey)
+			} else if kind, id, err := UnformatId(result.ID); err != nil {
+				return err
+			} else if kind != "result" {
+				return errors.New("Expecting result ID; found: " + kind)
+			} else {
+				keys[i] = datastore.NewKey(c, "ImportResult", "", id, jobKey)
+			}
+
+			result.Updated = time.Now()
+		}
+
+		completeKeys, err := datastore.PutMulti(c, keys, batch)
+		if err != nil {
+			return err
+		}
+
+		for i, completeKey := range completeKeys {
+			batch[i].ID = FormatId("result", completeKey.IntID())
+		}
+	}
+
+	return nil
+}
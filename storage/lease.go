@@ -0,0 +1,239 @@
+// +build appengine
+
+/*****************************************************************************
+ **
+ ** Gofr
+ ** https://github.com/pokebyte/Gofr
+ ** Copyright (C) 2013-2017 Akop Karapetyan
+ **
+ ** This program is free software; you can redistribute it and/or modify
+ ** it under the terms of the GNU General Public License as published by
+ ** the Free Software Foundation; either version 2 of the License, or
+ ** (at your option) any later version.
+ **
+ ** This program is distributed in the hope that it will be useful,
+ ** but WITHOUT ANY WARRANTY; without even the implied warranty of
+ ** MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ ** GNU General Public License for more details.
+ **
+ ** You should have received a copy of the GNU General Public License
+ ** along with this program; if not, write to the Free Software
+ ** Foundation, Inc., 675 Mass Ave, Cambridge, MA 02139, USA.
+ **
+ ******************************************************************************
+ */
+ 
+package storage
+
+import (
+	"appengine"
+	"appengine/datastore"
+	"time"
+)
+
+const (
+	leaseDuration = 2 * time.Minute
+	leaseWait = 30 * time.Second
+	leaseRetryInterval = 250 * time.Millisecond
+)
+
+// Lease is a lock on a feed, or on the subscriptions of a user, held
+// until it's released or it expires. Holders renew it as they go
+// (see checkLease and renewLease). Each lease on a resource has a
+// larger Token than the last, so writes made by a holder whose lease
+// has expired (and perhaps been taken over) can be refused
+type Lease struct {
+	Resource string
+	Token int64
+	Expires time.Time
+}
+
+type leaseEntity struct {
+	Token int64
+	Expires time.Time
+}
+
+func feedLeaseResource(url string) string {
+	return "feed:" + url
+}
+
+func userLeaseResource(userID UserID) string {
+	return "user:" + string(userID)
+}
+
+func leaseKey(c appengine.Context, resource string) *datastore.Key {
+	return datastore.NewKey(c, "Lease", resource, 0, nil)
+}
+
+// acquireLease leases the resource for the specified duration, or
+// returns ErrLeaseHeld if someone else holds it
+func acquireLease(c appengine.Context, resource string, duration time.Duration) (*Lease, error) {
+	key := leaseKey(c, resource)
+	lease := &Lease { Resource: resource }
+
+	err := datastore.RunInTransaction(c, func(c appengine.Context) error {
+		entity := leaseEntity{}
+		if err := datastore.Get(c, key, &entity); err != nil && err != datastore.ErrNoSuchEntity && !IsFieldMismatch(err) {
+			return err
+		}
+
+		now := time.Now()
+		if entity.Expires.After(now) {
+			return ErrLeaseHeld
+		}
+
+		entity.Token++
+		entity.Expires = now.Add(duration)
+
+		if _, err := datastore.Put(c, key, &entity); err != nil {
+			return err
+		}
+
+		lease.Token, lease.Expires = entity.Token, entity.Expires
+		return nil
+	}, nil)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return lease, nil
+}
+
+// waitForLease acquires a lease on the resource, retrying for up
+// to leaseWait while someone else holds it
+func waitForLease(c appengine.Context, resource string) (*Lease, error) {
+	deadline := time.Now().Add(leaseWait)
+	for {
+		lease, err := acquireLease(c, resource, leaseDuration)
+		if err != ErrLeaseHeld && err != datastore.ErrConcurrentTransaction {
+			return lease, err
+		} else if time.Now().After(deadline) {
+			return nil, ErrLeaseHeld
+		}
+
+		time.Sleep(leaseRetryInterval)
+	}
+}
+
+// releaseLease frees the resource, unless the lease has since been
+// taken over. The token is kept, so the next one is larger
+func releaseLease(c appengine.Context, lease Lease) error {
+	key := leaseKey(c, lease.Resource)
+
+	return datastore.RunInTransaction(c, func(c appengine.Context) error {
+		entity := leaseEntity{}
+		if err := datastore.Get(c, key, &entity); err == datastore.ErrNoSuchEntity {
+			return nil
+		} else if err != nil && !IsFieldMismatch(err) {
+			return err
+		}
+
+		if entity.Token != lease.Token {
+			return nil
+		}
+
+		entity.Expires = time.Time{}
+
+		_, err := datastore.Put(c, key, &entity)
+		return err
+	}, nil)
+}
+
+// checkLease returns ErrLeaseExpired unless the lease is still the
+// current one. Checked within the (cross-group) transaction that
+// writes what the lease protects, it fences off expired holders.
+// Once half of the lease has run, it's extended as part of the same
+// transaction, so a holder that keeps writing keeps its lease
+func checkLease(c appengine.Context, lease Lease) error {
+	_, err := extendLease(c, lease)
+	return err
+}
+
+// extendLease extends the lease by leaseDuration from now, if half
+// of it has run. It returns when the lease now expires, or
+// ErrLeaseExpired if it's been lost
+func extendLease(c appengine.Context, lease Lease) (time.Time, error) {
+	key := leaseKey(c, lease.Resource)
+
+	entity := leaseEntity{}
+	if err := datastore.Get(c, key, &entity); err == datastore.ErrNoSuchEntity {
+		return time.Time{}, ErrLeaseExpired
+	} else if err != nil && !IsFieldMismatch(err) {
+		return time.Time{}, err
+	}
+
+	now := time.Now()
+	if entity.Token != lease.Token || !entity.Expires.After(now) {
+		return time.Time{}, ErrLeaseExpired
+	} else if entity.Expires.Sub(now) > leaseDuration / 2 {
+		return entity.Expires, nil
+	}
+
+	entity.Expires = now.Add(leaseDuration)
+	if _, err := datastore.Put(c, key, &entity); err != nil {
+		return time.Time{}, err
+	}
+
+	return entity.Expires, nil
+}
+
+// renewLease extends the lease once half of it has run, or returns
+// ErrLeaseExpired if it's been lost. It keeps the lease of a holder
+// that goes a while between writes - reading, or waiting
+func renewLease(c appengine.Context, lease *Lease) error {
+	if lease.Expires.Sub(time.Now()) > leaseDuration / 2 {
+		return nil
+	}
+
+	var expires time.Time
+	err := datastore.RunInTransaction(c, func(c appengine.Context) error {
+		var err error
+		expires, err = extendLease(c, *lease)
+		return err
+	}, nil)
+
+	if err != nil {
+		return err
+	}
+
+	lease.Expires = expires
+	return nil
+}
+
+// withLease runs fn while holding a lease on the resource, waiting
+// for up to leaseWait for the current holder to finish
+func withLease(c appengine.Context, resource string, fn func(lease Lease) error) error {
+	lease, err := waitForLease(c, resource)
+	if err != nil {
+		c.Warningf("Error leasing %s: %s", resource, err)
+		return err
+	}
+
+	return runWithLease(c, *lease, fn)
+}
+
+// tryWithLease runs fn while holding a lease on the resource, or
+// returns ErrLeaseHeld right away if someone else holds it
+func tryWithLease(c appengine.Context, resource string, fn func(lease Lease) error) error {
+	lease, err := acquireLease(c, resource, leaseDuration)
+	if err == datastore.ErrConcurrentTransaction {
+		// Contended - someone else is taking it
+		return ErrLeaseHeld
+	} else if err != nil {
+		return err
+	}
+
+	return runWithLease(c, *lease, fn)
+}
+
+func runWithLease(c appengine.Context, lease Lease, fn func(lease Lease) error) error {
+	resource := lease.Resource
+	defer func() {
+		if err := releaseLease(c, lease); err != nil {
+			c.Warningf("Error releasing lease on %s: %s", resource, err)
+		}
+	}()
+
+	return fn(lease)
+}
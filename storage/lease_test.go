@@ -0,0 +1,153 @@
+// +build appengine
+
+/*****************************************************************************
+ **
+ ** Gofr
+ ** https://github.com/pokebyte/Gofr
+ ** Copyright (C) 2013-2017 Akop Karapetyan
+ **
+ ** This program is free software; you can redistribute it and/or modify
+ ** it under the terms of the GNU General Public License as published by
+ ** the Free Software Foundation; either version 2 of the License, or
+ ** (at your option) any later version.
+ **
+ ** This program is distributed in the hope that it will be useful,
+ ** but WITHOUT ANY WARRANTY; without even the implied warranty of
+ ** MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ ** GNU General Public License for more details.
+ **
+ ** You should have received a copy of the GNU General Public License
+ ** along with this program; if not, write to the Free Software
+ ** Foundation, Inc., 675 Mass Ave, Cambridge, MA 02139, USA.
+ **
+ ******************************************************************************
+ */
+ 
+package storage
+
+import (
+	"appengine"
+	"appengine/aetest"
+	"appengine/datastore"
+	"testing"
+	"time"
+)
+
+// newTestContext returns a context backed by a development
+// Datastore, consistent so that queries see the latest writes
+func newTestContext(t *testing.T) aetest.Context {
+	c, err := aetest.NewContext(&aetest.Options { StronglyConsistentDatastore: true })
+	if err != nil {
+		t.Fatalf("Error creating context: %s", err)
+	}
+
+	return c
+}
+
+func checkLeaseInTransaction(c appengine.Context, lease Lease) error {
+	return datastore.RunInTransaction(c, func(c appengine.Context) error {
+		return checkLease(c, lease)
+	}, nil)
+}
+
+func TestLease(t *testing.T) {
+	c := newTestContext(t)
+	defer c.Close()
+
+	resource := userLeaseResource("tester")
+	lease, err := acquireLease(c, resource, leaseDuration)
+	if err != nil {
+		t.Fatalf("Error leasing: %s", err)
+	} else if _, err := acquireLease(c, resource, leaseDuration); err != ErrLeaseHeld {
+		t.Errorf("Expected ErrLeaseHeld, got %v", err)
+	} else if err := checkLeaseInTransaction(c, *lease); err != nil {
+		t.Errorf("Expected the lease current, got %s", err)
+	}
+
+	if err := releaseLease(c, *lease); err != nil {
+		t.Fatalf("Error releasing: %s", err)
+	} else if err := checkLeaseInTransaction(c, *lease); err != ErrLeaseExpired {
+		t.Errorf("Expected a released lease expired, got %v", err)
+	}
+
+	next, err := acquireLease(c, resource, leaseDuration)
+	if err != nil {
+		t.Fatalf("Error leasing again: %s", err)
+	} else if next.Token <= lease.Token {
+		t.Errorf("Expected a larger token than %d, got %d", lease.Token, next.Token)
+	}
+}
+
+func TestLeaseFencing(t *testing.T) {
+	c := newTestContext(t)
+	defer c.Close()
+
+	resource := feedLeaseResource("http://example.com/feed")
+	expired, err := acquireLease(c, resource, time.Millisecond)
+	if err != nil {
+		t.Fatalf("Error leasing: %s", err)
+	}
+
+	time.Sleep(10 * time.Millisecond)
+
+	// Taken over once expired; the first holder's writes are
+	// refused, and it can't renew
+	current, err := acquireLease(c, resource, leaseDuration)
+	if err != nil {
+		t.Fatalf("Error taking over the lease: %s", err)
+	} else if err := checkLeaseInTransaction(c, *expired); err != ErrLeaseExpired {
+		t.Errorf("Expected ErrLeaseExpired, got %v", err)
+	} else if err := renewLease(c, expired); err != ErrLeaseExpired {
+		t.Errorf("Expected ErrLeaseExpired renewing, got %v", err)
+	}
+
+	// Releasing an expired lease leaves the current one be
+	if err := releaseLease(c, *expired); err != nil {
+		t.Fatalf("Error releasing: %s", err)
+	} else if err := checkLeaseInTransaction(c, *current); err != nil {
+		t.Errorf("Expected the current lease kept, got %s", err)
+	}
+}
+
+func TestLeaseRenewal(t *testing.T) {
+	c := newTestContext(t)
+	defer c.Close()
+
+	resource := userLeaseResource("tester")
+
+	// Less than half of it left
+	lease, err := acquireLease(c, resource, leaseDuration / 4)
+	if err != nil {
+		t.Fatalf("Error leasing: %s", err)
+	}
+
+	original := lease.Expires
+	if err := renewLease(c, lease); err != nil {
+		t.Fatalf("Error renewing: %s", err)
+	} else if !lease.Expires.After(original) {
+		t.Errorf("Expected the lease extended past %s, got %s", original, lease.Expires)
+	}
+
+	// Not renewed again until half of it has run
+	renewed := lease.Expires
+	if err := renewLease(c, lease); err != nil {
+		t.Fatalf("Error renewing: %s", err)
+	} else if !lease.Expires.Equal(renewed) {
+		t.Errorf("Expected the lease left as it was, got %s", lease.Expires)
+	}
+
+	// Checks extend the lease, too
+	short, err := acquireLease(c, feedLeaseResource("http://example.com/feed"), leaseDuration / 4)
+	if err != nil {
+		t.Fatalf("Error leasing: %s", err)
+	} else if err := checkLeaseInTransaction(c, *short); err != nil {
+		t.Fatalf("Error checking lease: %s", err)
+	}
+
+	entity := leaseEntity{}
+	if err := datastore.Get(c, leaseKey(c, short.Resource), &entity); err != nil {
+		t.Fatalf("Error reading lease: %s", err)
+	} else if !entity.Expires.After(short.Expires) {
+		t.Errorf("Expected the lease extended past %s, got %s", short.Expires, entity.Expires)
+	}
+}
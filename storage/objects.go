@@ -24,34 +24,183 @@
 package storage
 
 import (
-	"appengine/datastore"
 	"encoding/json"
+	"errors"
+	"rss"
+	"strconv"
+	"strings"
 	"time"
 )
 
 const (
-	likeCountShards = 40
-	subscriberCountShards = 40
+	// Consecutive failures before a feed is considered dead
+	deadFeedFailureThreshold = 10
 )
 
 type User struct {
 	ID string
 	EmailAddress string
 	LastSubscriptionUpdate time.Time
+	// Session standing in for the user's Fever API key, if any
+	FeverSessionID string `datastore:",noindex"`
+	// Session standing in for the user's Google Reader API
+	// password, if any
+	GReaderPasswordID string `datastore:",noindex"`
+}
+
+// LoginIdentity ties an identity at a login provider to a User.
+// A user may have any number of them
+type LoginIdentity struct {
+	Provider string    `datastore:"-"`
+	Subject string     `datastore:"-"`
+	UserID UserID
+	Email string       `datastore:",noindex"`
+	Linked time.Time   `datastore:",noindex"`
+}
+
+// LocalAccount holds the credentials for signing in with a
+// username and password. Usernames are case-insensitive
+type LocalAccount struct {
+	Username string     `datastore:"-"`
+	PasswordHash []byte `datastore:",noindex"`
+	Created time.Time   `datastore:",noindex"`
+}
+
+// Session is a signed-in browser session. Its ID is a digest of
+// the token held by the browser. Sessions of API clients record the
+// session of the password they signed in with, in IssuedBy
+type Session struct {
+	ID string          `datastore:"-"`
+	UserID UserID      `datastore:",noindex"`
+	Provider string    `datastore:",noindex"`
+	Expires time.Time  `datastore:",noindex"`
+	IssuedBy string    `datastore:",noindex"`
+}
+
+// LoginFailures counts the failed attempts to sign in to an account
+// (by its case-insensitive name), since the first one of the current
+// window
+type LoginFailures struct {
+	Account string     `datastore:"-"`
+	Count int          `datastore:",noindex"`
+	Since time.Time    `datastore:",noindex"`
+}
+
+// Record counts a failure at the time. Once the window has passed
+// since the first failure counted, counting starts over
+func (failures *LoginFailures)Record(at time.Time, window time.Duration) {
+	if failures.Count == 0 || at.Sub(failures.Since) >= window {
+		failures.Count, failures.Since = 0, at
+	}
+	failures.Count++
+}
+
+// Exceeded returns true if there have been at least max failures
+// since the start of the window, as of the time
+func (failures *LoginFailures)Exceeded(at time.Time, max int, window time.Duration) bool {
+	return failures.Count >= max && at.Sub(failures.Since) < window
+}
+
+// ItemAlias maps the numeric item ID handed out to API clients
+// back to the article it stands for
+type ItemAlias struct {
+	ID int64                `datastore:"-"`
+	SubscriptionID string   `datastore:",noindex"`
+	ArticleID string        `datastore:",noindex"`
 }
 
 type FeedMeta struct {
-	Feed *datastore.Key
 	InfoDigest []byte
 	Fetched time.Time
 	NextFetch time.Time
 	UpdateCounter int64
 	HourlyUpdateFrequency float32
+	ETag string          `datastore:",noindex"`
+	LastModified string  `datastore:",noindex"`
+
+	FailureCount int
+	FailingSince time.Time `datastore:",noindex"`
+	LastError string       `datastore:",noindex"`
+	LastStatusCode int     `datastore:",noindex"`
+	LastSuccess time.Time  `datastore:",noindex"`
+	Dead bool
+
+	FavIconChecked time.Time `datastore:",noindex"`
+}
+
+// FeedStatus reports the health of a feed that's failing to update
+type FeedStatus struct {
+	Dead bool              `json:"dead,omitempty"`
+	FailureCount int       `json:"failures"`
+	FailingSince time.Time `json:"failingSince"`
+	LastError string       `json:"lastError,omitempty"`
+	LastStatusCode int     `json:"lastStatus,omitempty"`
+	LastSuccess time.Time  `json:"lastSuccess"`
+}
+
+// FetchInfo carries the HTTP cache validators returned by the
+// server when a feed was fetched. They're sent back on subsequent
+// fetches to make the request conditional
+type FetchInfo struct {
+	ETag string
+	LastModified string
+	StatusCode int
+}
+
+// HubSubscription tracks a WebSub (PubSubHubbub) subscription to
+// a feed's hub. Keyed by feed URL
+type HubSubscription struct {
+	FeedURL string       `datastore:"-"`
+	HubURL string         `datastore:",noindex"`
+	Topic string          `datastore:",noindex"`
+	Secret string         `datastore:",noindex"`
+	PendingSecret string  `datastore:",noindex"` // Replaces Secret once verified
+	CallbackToken string  `datastore:",noindex"`
+	Mode string           `datastore:",noindex"` // "subscribe" or "unsubscribe"
+	Verified bool         `datastore:",noindex"`
+	Requested time.Time   `datastore:",noindex"`
+	LeaseExpires time.Time
+}
+
+// Possible outcomes of importing an outline
+const (
+	ImportPending = "pending"
+	ImportSubscribed = "subscribed"
+	ImportDuplicate = "duplicate"
+	ImportRedirected = "redirected"
+	ImportSkipped = "skipped"
+	ImportDownloadError = "downloadError"
+	ImportParseError = "parseError"
+	ImportError = "error"
+)
+
+// ImportJob tracks the progress of an OPML import. Child of User
+type ImportJob struct {
+	ID string         `datastore:"-" json:"id"`
+	UserID UserID     `datastore:"-" json:"-"`
+
+	Started time.Time  `json:"started"`
+	Finished time.Time `json:"finished"`
+	Done bool          `json:"done"`
+	Total int          `json:"total" datastore:",noindex"`
+	Completed int      `json:"completed" datastore:",noindex"`
+	Failed int         `json:"failed" datastore:",noindex"`
 }
 
-type FeedSubscriber struct {
-	Feed *datastore.Key
-	Count int
+// ImportResult is the outcome of importing a single outline.
+// Child of ImportJob
+type ImportResult struct {
+	ID string              `datastore:"-" json:"id"`
+
+	Title string           `json:"title" datastore:",noindex"`
+	FeedURL string         `json:"url,omitempty" datastore:",noindex"`
+	Folder string          `json:"folder,omitempty" datastore:",noindex"`
+	FolderPath []string    `json:"folderPath,omitempty" datastore:",noindex"` // enclosing Folder, outermost first
+	Tags []string          `json:"tags,omitempty" datastore:",noindex"`
+	Outcome string         `json:"outcome"`
+	Message string         `json:"message,omitempty" datastore:",noindex"`
+	RedirectedTo string    `json:"redirectedTo,omitempty" datastore:",noindex"`
+	Updated time.Time      `json:"updated"`
 }
 
 type Feed struct {
@@ -63,21 +212,17 @@ type Feed struct {
 	Topic string
 	HubURL string
 	FavIconURL string  `datastore:",noindex"`
+	FavIcon string     `datastore:",noindex"`
 	Updated time.Time
 }
 
-type FeedUsage struct {
-	UpdateCount int64
-	LastSubscriptionUpdate time.Time
-	Feed *datastore.Key
-}
-
-type EntryMeta struct {
-	Fetched time.Time
-	Published time.Time
-	InfoDigest []byte
-	UpdateIndex int64
-	Entry *datastore.Key
+// FavIcon is the icon of a feed's site, as located when the feed is
+// fetched. Data is the icon itself, encoded as a data URI without
+// the "data:" prefix (e.g. "image/png;base64,..."). An empty URL
+// means the site has no icon
+type FavIcon struct {
+	URL string
+	Data string
 }
 
 type Entry struct {
@@ -86,6 +231,7 @@ type Entry struct {
 	Link string         `json:"link"`
 	HasMedia bool       `json:"-"`
 	Updated time.Time   `json:"-"`
+	ImageURL string     `json:"image,omitempty" datastore:",noindex"`
 
 	Content string      `json:"content" datastore:",noindex"`
 	Summary string      `json:"summary" datastore:",noindex"`
@@ -94,26 +240,42 @@ type Entry struct {
 type EntryMedia struct {
 	URL string           `json:"url"`
 	Type string          `json:"type"`
-	Title string         `json:"-"`
-	Entry *datastore.Key `json:"-"`
-}
-
-type likeCountShard struct {
-	Entry *datastore.Key
-	LikeCount int
-}
-
-type subscriberCountShard struct {
-	Feed *datastore.Key
-	SubscriberCount int
+	Title string         `json:"title,omitempty"`
+	ThumbnailURL string  `json:"thumbnail,omitempty" datastore:",noindex"`
+	Duration int64       `json:"duration,omitempty" datastore:",noindex"` // seconds
+	Size int64           `json:"size,omitempty" datastore:",noindex"`
 }
 
 type UserSubscriptions struct {
 	Subscriptions  []Subscription  `json:"subscriptions"`
 	Folders        []Folder        `json:"folders"`
 	Tags           []Tag           `json:"tags"`
+	ArticleCounts
+}
+
+// ArticleCounts are the unread and starred articles of a user, or of
+// one of their folders or tags
+type ArticleCounts struct {
+	Unread int  `json:"unread"`
+	Starred int `json:"starred"`
 }
 
+// UserCounter is the counter of all of a user's articles
+const UserCounter = "user"
+
+// FolderCounter names the counter of the articles in a folder
+func FolderCounter(folderID string) string {
+	return "folder:" + folderID
+}
+
+// TagCounter names the counter of the articles with a tag
+func TagCounter(tag string) string {
+	return "tag:" + tag
+}
+
+// ArticleCountDeltas collects changes to article counts, by counter
+type ArticleCountDeltas map[string]ArticleCounts
+
 type UserID string
 
 type FolderRef struct {
@@ -157,14 +319,117 @@ func ArticleFilterFromJSON(userID UserID, filterAsJSON string) (ArticleFilter, e
 	return filter, nil
 }
 
+// RequiredProperties returns the properties an article must have
+func (filter ArticleFilter)RequiredProperties() []string {
+	if filter.Property != "" {
+		return append([]string { filter.Property }, filter.Properties...)
+	}
+
+	return filter.Properties
+}
+
+// RequiredTags returns the tags an article must have
+func (filter ArticleFilter)RequiredTags() []string {
+	if filter.Tag != "" {
+		return append([]string { filter.Tag }, filter.Tags...)
+	}
+
+	return filter.Tags
+}
+
+// Matches reports whether the article meets every condition of the
+// filter, except for the author, which is part of the entry
+func (filter ArticleFilter)Matches(article Article) bool {
+	for _, property := range filter.RequiredProperties() {
+		if !article.HasProperty(property) {
+			return false
+		}
+	}
+	for _, property := range filter.ExcludedProperties {
+		if article.HasProperty(property) {
+			return false
+		}
+	}
+
+RequiredTags:
+	for _, tag := range filter.RequiredTags() {
+		for _, articleTag := range article.Tags {
+			if articleTag == tag {
+				continue RequiredTags
+			}
+		}
+		return false
+	}
+
+	if !filter.PublishedAfter.IsZero() && article.Published.Before(filter.PublishedAfter) {
+		return false
+	} else if !filter.PublishedBefore.IsZero() && !article.Published.Before(filter.PublishedBefore) {
+		return false
+	} else if !filter.FetchedAfter.IsZero() && article.Fetched.Before(filter.FetchedAfter) {
+		return false
+	} else if !filter.FetchedBefore.IsZero() && !article.Fetched.Before(filter.FetchedBefore) {
+		return false
+	}
+
+	return true
+}
+
+// MatchesEntry reports whether the entry was written by the
+// filter's author (case-insensitively, in part or in full)
+func (filter ArticleFilter)MatchesEntry(entry *Entry) bool {
+	if filter.Author == "" {
+		return true
+	} else if entry == nil {
+		return false
+	}
+
+	return strings.Contains(strings.ToLower(entry.Author), strings.ToLower(filter.Author))
+}
+
+func (ref FolderRef)IsZero() bool {
+	return ref.UserID == "" && ref.FolderID == ""
+}
+
 func (ref SubscriptionRef)IsSubscriptionExplicit() bool {
 	return ref.SubscriptionID != ""
 }
 
+// Article orders. Articles are newest first by default; "magic"
+// ranks the most recent articles by the number of likes
+const (
+	OrderNewest = "newest"
+	OrderOldest = "oldest"
+	OrderPublishedNewest = "published"
+	OrderPublishedOldest = "published-oldest"
+	OrderByFeed = "feed"
+	OrderMagic = "magic"
+)
+
+const (
+	UndoUnsubscribe = "unsubscribe"
+	UndoRemoveFolder = "removeFolder"
+	UndoRemoveTag = "removeTag"
+	UndoMarkAsRead = "markAsRead"
+)
+
+// ArticleFilter selects articles within a scope. All of the
+// conditions that are set must hold. Date ranges include their
+// start, but not their end
 type ArticleFilter struct {
 	ArticleScope
 	Property string `json:"p,omitempty"`
 	Tag string      `json:"t,omitempty"`
+
+	Properties []string         `json:"ps,omitempty"`
+	ExcludedProperties []string `json:"xps,omitempty"`
+	Tags []string               `json:"ts,omitempty"`
+	PublishedAfter time.Time    `json:"pa,omitempty"`
+	PublishedBefore time.Time   `json:"pb,omitempty"`
+	FetchedAfter time.Time      `json:"fa,omitempty"`
+	FetchedBefore time.Time     `json:"fb,omitempty"`
+	Author string               `json:"a,omitempty"`
+
+	Order string `json:"-"`
 }
 
 type ArticleRef struct {
@@ -176,15 +441,39 @@ type Subscription struct {
 	ID string         `datastore:"-" json:"id"`
 	Link string       `datastore:"-" json:"link"`
 	FavIconURL string `datastore:"-" json:"favIconUrl"`
+	FavIcon string    `datastore:"-" json:"-"`
 	Parent string     `datastore:"-" json:"parent,omitempty"`
+	Status *FeedStatus `datastore:"-" json:"status,omitempty"`
 
 	Updated time.Time    `json:"-"`
 	Subscribed time.Time `json:"-"`
-	Feed *datastore.Key  `json:"-"`
+	FeedURL string       `datastore:"-" json:"-"`
 	MaxUpdateIndex int64 `json:"-"`
 
 	Title string         `json:"title"`
 	UnreadCount int      `json:"unread"`
+	Tags []string        `json:"tags,omitempty"`
+
+	ReadRange ReadRange  `json:"-"`
+}
+
+// ArticlePosition is the place of an article in the default order:
+// by fetch, then publication time
+type ArticlePosition struct {
+	Fetched time.Time
+	Published time.Time
+}
+
+// ReadRange is a range of a subscription's articles, marked read
+// at once. The articles are rewritten in the background; until
+// then, they're read wherever they're loaded. An article is covered
+// if it was fetched before the range was marked, hasn't been changed
+// since, and is positioned after After and before Before (zero
+// positions are unbounded)
+type ReadRange struct {
+	Marked time.Time
+	After ArticlePosition
+	Before ArticlePosition
 }
 
 type ArticlePage struct {
@@ -202,24 +491,150 @@ type Article struct {
 	UpdateIndex int64     `json:"-"`
 	Fetched time.Time     `json:"time"`
 	Published time.Time   `json:"published"`
-	Entry *datastore.Key  `json:"-"`
 
 	Properties []string   `json:"properties"`
 	Tags []string         `json:"tags"`
+	Changed time.Time     `json:"-" datastore:",noindex"` // Properties last set by the user
+	MarkedRead time.Time  `json:"-" datastore:",noindex"` // Marking of the read range that read it
 }
 
 type Tag struct {
 	Title string      `json:"title"`
 	Created time.Time `json:"-"`
+	ArticleCounts     `datastore:"-"`
 }
 
 type StorageInfo struct {
 	Version int
 }
 
+// Folder holds subscriptions, and other folders. Folders at the
+// top level have no Parent. Counts include those of subfolders
 type Folder struct {
-	ID string    `json:"id" datastore:"-"`
-	Title string `json:"title"`
+	ID string     `json:"id" datastore:"-"`
+	Title string  `json:"title"`
+	Parent string `json:"parent,omitempty" datastore:",noindex"`
+	ArticleCounts `datastore:"-"`
+}
+
+// RetentionPolicy decides how long the entries of a feed are kept.
+// Entries fetched longer than MaxAge ago are purged, except for the
+// newest MinEntries of the feed; zero MaxAge keeps entries forever.
+// Articles that are starred or tagged are never purged. Policies of
+// individual feeds are stored by feed URL
+type RetentionPolicy struct {
+	MaxAge time.Duration `datastore:",noindex"`
+	MinEntries int       `datastore:",noindex"`
+}
+
+// PurgeReport counts the records removed by a purge
+type PurgeReport struct {
+	Articles int
+	Entries int
+	EntryMetas int
+	EntryMedia int
+}
+
+// UndoRecord describes a destructive operation, along with what's
+// needed to reverse it. Whatever the operation left behind (the
+// articles of removed subscriptions, or a removed tag on articles)
+// is only deleted once the record is discarded. Child of User
+type UndoRecord struct {
+	ID string                    `datastore:"-" json:"id"`
+	UserID UserID                `datastore:"-" json:"-"`
+	Action string                `json:"action"`
+	Title string                 `json:"title,omitempty" datastore:",noindex"`
+	Created time.Time            `json:"created"`
+
+	FolderID string              `json:"-" datastore:",noindex"`
+	SubscriptionID string        `json:"-" datastore:",noindex"`
+	Tag string                   `json:"-" datastore:",noindex"`
+	Marked time.Time             `json:"-" datastore:",noindex"`
+	Subscriptions []Subscription `json:"-" datastore:"-"`
+	Folders []Folder             `json:"-" datastore:"-"` // removed folder first, then its subfolders
+}
+
+// FilterRule acts on new articles as they arrive. A rule covers
+// a subscription, a folder, or (if neither is set) every article
+// of the user. Conditions that are set must all hold. Child of User
+type FilterRule struct {
+	ID string             `datastore:"-" json:"id"`
+	UserID UserID         `datastore:"-" json:"-"`
+	Title string          `json:"title" datastore:",noindex"`
+	Created time.Time     `json:"created"`
+
+	FolderID string       `json:"folder,omitempty" datastore:",noindex"`
+	SubscriptionID string `json:"subscription,omitempty" datastore:",noindex"`
+
+	Field string          `json:"field,omitempty" datastore:",noindex"` // title, content or author; empty for any
+	Keyword string        `json:"keyword,omitempty" datastore:",noindex"`
+	Pattern string        `json:"pattern,omitempty" datastore:",noindex"` // regular expression
+	MediaType string      `json:"mediaType,omitempty" datastore:",noindex"` // e.g. "audio/" or "video/mp4"
+
+	MarkRead bool         `json:"markRead,omitempty" datastore:",noindex"`
+	Star bool             `json:"star,omitempty" datastore:",noindex"`
+	Tags []string         `json:"tags,omitempty" datastore:",noindex"`
+	Delete bool           `json:"delete,omitempty" datastore:",noindex"`
+}
+
+func (feedMeta *FeedMeta)RecordSuccess(fetched time.Time, statusCode int) {
+	feedMeta.FailureCount = 0
+	feedMeta.FailingSince = time.Time {}
+	feedMeta.LastError = ""
+	feedMeta.LastStatusCode = statusCode
+	feedMeta.LastSuccess = fetched
+	feedMeta.Dead = false
+}
+
+func (feedMeta *FeedMeta)RecordFailure(fetched time.Time, statusCode int, message string) {
+	if feedMeta.FailureCount == 0 {
+		feedMeta.FailingSince = fetched
+	}
+
+	feedMeta.FailureCount++
+	feedMeta.LastError = message
+	feedMeta.LastStatusCode = statusCode
+	feedMeta.Fetched = fetched
+	feedMeta.Dead = feedMeta.FailureCount >= deadFeedFailureThreshold
+
+	// Exponential backoff: 30 minutes, doubling with each consecutive
+	// failure, up to a day. Dead feeds are only retried once a week
+	backoff := time.Duration(7 * 24) * time.Hour
+	if !feedMeta.Dead {
+		backoff = time.Duration(30) * time.Minute
+		maxBackoff := time.Duration(24) * time.Hour
+		for i := 1; i < feedMeta.FailureCount && backoff < maxBackoff; i++ {
+			backoff *= 2
+		}
+		if backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+	}
+
+	feedMeta.NextFetch = fetched.Add(backoff)
+}
+
+// Status returns the health of the feed, or nil if the most
+// recent fetch was successful
+func (feedMeta FeedMeta)Status() *FeedStatus {
+	if feedMeta.FailureCount == 0 {
+		return nil
+	}
+
+	return &FeedStatus {
+		Dead: feedMeta.Dead,
+		FailureCount: feedMeta.FailureCount,
+		FailingSince: feedMeta.FailingSince,
+		LastError: feedMeta.LastError,
+		LastStatusCode: feedMeta.LastStatusCode,
+		LastSuccess: feedMeta.LastSuccess,
+	}
+}
+
+func (result ImportResult)IsFailure() bool {
+	return result.Outcome == ImportDownloadError ||
+		result.Outcome == ImportParseError ||
+		result.Outcome == ImportError
 }
 
 func (article Article)IsUnread() bool {
@@ -230,6 +645,10 @@ func (article Article)IsLiked() bool {
 	return article.HasProperty("like")
 }
 
+func (article Article)IsStarred() bool {
+	return article.HasProperty("star")
+}
+
 func (article Article)HasProperty(propName string) bool {
 	for _, property := range article.Properties {
 		if property == propName {
@@ -295,3 +714,254 @@ func (article *Article)SetTag(tagName string, set bool) {
 		i++
 	}
 }
+
+func (article Article)Position() ArticlePosition {
+	return ArticlePosition {
+		Fetched: article.Fetched,
+		Published: article.Published,
+	}
+}
+
+func (position ArticlePosition)IsZero() bool {
+	return position.Fetched.IsZero() && position.Published.IsZero()
+}
+
+// Precedes returns true if the position comes before the other,
+// oldest first
+func (position ArticlePosition)Precedes(other ArticlePosition) bool {
+	if !position.Fetched.Equal(other.Fetched) {
+		return position.Fetched.Before(other.Fetched)
+	}
+
+	return position.Published.Before(other.Published)
+}
+
+func (readRange ReadRange)IsZero() bool {
+	return readRange.Marked.IsZero()
+}
+
+// IsUnbounded returns true if the range covers every article
+// fetched before it was marked
+func (readRange ReadRange)IsUnbounded() bool {
+	return readRange.After.IsZero() && readRange.Before.IsZero()
+}
+
+// Covers returns true if the article is unread, but marked read by
+// the range
+func (readRange ReadRange)Covers(article Article) bool {
+	if readRange.IsZero() || !article.IsUnread() {
+		return false
+	} else if !article.Fetched.Before(readRange.Marked) || !article.Changed.Before(readRange.Marked) {
+		return false
+	}
+
+	position := article.Position()
+	if !readRange.After.IsZero() && !readRange.After.Precedes(position) {
+		return false
+	} else if !readRange.Before.IsZero() && !position.Precedes(readRange.Before) {
+		return false
+	}
+
+	return true
+}
+
+// Apply marks the article read, if covered by the range. It returns
+// true if the article was changed
+func (readRange ReadRange)Apply(article *Article) bool {
+	if !readRange.Covers(*article) {
+		return false
+	}
+
+	article.SetProperty("read", true)
+	article.MarkedRead = readRange.Marked
+	return true
+}
+
+func (report *PurgeReport)Add(other PurgeReport) {
+	report.Articles += other.Articles
+	report.Entries += other.Entries
+	report.EntryMetas += other.EntryMetas
+	report.EntryMedia += other.EntryMedia
+}
+
+// IsRetained returns true if the article must outlive its entry's
+// retention period: it's starred, or has tags other than those it
+// inherited from its subscription
+func (article Article)IsRetained(subscriptionTags []string) bool {
+	if article.HasProperty("star") {
+		return true
+	}
+
+	inherited := make(map[string]bool)
+	for _, tag := range subscriptionTags {
+		inherited[tag] = true
+	}
+	for _, tag := range article.Tags {
+		if !inherited[tag] {
+			return true
+		}
+	}
+
+	return false
+}
+
+func NewHubSubscription(feedURL string) HubSubscription {
+	return HubSubscription {
+		FeedURL: feedURL,
+	}
+}
+
+// IsPending returns true if the last request (a subscription, a
+// renewal or an unsubscription) is yet to be verified by the hub
+func (hubSub HubSubscription)IsPending() bool {
+	return !hubSub.Verified || hubSub.PendingSecret != ""
+}
+
+// IsActive returns true if the subscription is verified and
+// current, or if a subscription request is still pending
+func (hubSub HubSubscription)IsActive(pendingTimeout time.Duration) bool {
+	if hubSub.Mode != "subscribe" {
+		return false
+	} else if hubSub.Verified && hubSub.LeaseExpires.After(time.Now()) {
+		return true
+	}
+
+	return hubSub.IsPending() && time.Since(hubSub.Requested) < pendingTimeout
+}
+
+// OPMLVersion maps a feed format to the value of the OPML
+// version attribute, which is only defined for RSS feeds
+func OPMLVersion(format string) string {
+	if format == "RSS1" || format == "RSS2" {
+		return format
+	}
+
+	return ""
+}
+
+// AddFolderOutlines adds an outline for each folder to the OPML,
+// nested as the folders are. Folders whose parent is missing are
+// added at the top level. It returns the outlines, by folder ID
+func AddFolderOutlines(opml *rss.OPML, folders []Folder) map[string]*rss.Outline {
+	outlines := make(map[string]*rss.Outline)
+	for _, folder := range folders {
+		outlines[folder.ID] = rss.NewFolder(folder.Title)
+	}
+
+	for _, folder := range folders {
+		if parent := outlines[folder.Parent]; parent != nil && folder.Parent != folder.ID {
+			parent.Add(outlines[folder.ID])
+		} else {
+			opml.Add(outlines[folder.ID])
+		}
+	}
+
+	return outlines
+}
+
+// FormatId formats a numeric identifier of a particular kind
+// (e.g. a folder) as a string
+func FormatId(kind string, intId int64) string {
+	return kind + "://" + strconv.FormatInt(intId, 36)
+}
+
+// UnformatId is the inverse of FormatId
+func UnformatId(formattedId string) (string, int64, error) {
+	if parts := strings.SplitN(formattedId, "://", 2); len(parts) == 2 {
+		if id, err := strconv.ParseInt(parts[1], 36, 64); err == nil {
+			return parts[0], id, nil
+		} else {
+			return parts[0], 0, nil
+		}
+	}
+
+	return "", 0, errors.New("Missing valid identifier")
+}
+
+func (counts ArticleCounts)IsZero() bool {
+	return counts.Unread == 0 && counts.Starred == 0
+}
+
+// Add counts the article, in the folder, towards its counters: the
+// user's, the folder's and those of its tags
+func (deltas ArticleCountDeltas)Add(folderID string, article Article) {
+	deltas.adjust(folderID, article, 1)
+}
+
+// Remove takes the article, in the folder, off its counters
+func (deltas ArticleCountDeltas)Remove(folderID string, article Article) {
+	deltas.adjust(folderID, article, -1)
+}
+
+func (deltas ArticleCountDeltas)adjust(folderID string, article Article, sign int) {
+	delta := ArticleCounts{}
+	if article.IsUnread() {
+		delta.Unread = sign
+	}
+	if article.IsStarred() {
+		delta.Starred = sign
+	}
+
+	if delta.IsZero() {
+		return
+	}
+
+	counters := []string { UserCounter }
+	if folderID != "" {
+		counters = append(counters, FolderCounter(folderID))
+	}
+	for _, tag := range article.Tags {
+		counters = append(counters, TagCounter(tag))
+	}
+
+	for _, counter := range counters {
+		counts := deltas[counter]
+		counts.Unread += delta.Unread
+		counts.Starred += delta.Starred
+		deltas[counter] = counts
+	}
+}
+
+// FolderSubtree returns the IDs of the folder and of the folders
+// nested in it, at any depth
+func FolderSubtree(folders []Folder, folderID string) []string {
+	subtree := []string { folderID }
+	within := map[string]bool { folderID: true }
+
+	for i := 0; i < len(subtree); i++ {
+		for _, folder := range folders {
+			if folder.Parent == subtree[i] && !within[folder.ID] {
+				within[folder.ID] = true
+				subtree = append(subtree, folder.ID)
+			}
+		}
+	}
+
+	return subtree
+}
+
+// RollUpFolderCounts adds the counts of each folder to those of
+// the folders enclosing it
+func RollUpFolderCounts(folders []Folder) {
+	byID := make(map[string]int)
+	counts := make([]ArticleCounts, len(folders))
+	for i, folder := range folders {
+		byID[folder.ID] = i
+		counts[i] = folder.ArticleCounts
+	}
+
+	for i, folder := range folders {
+		visited := map[string]bool { folder.ID: true }
+		for parentID := folder.Parent; !visited[parentID]; {
+			j, ok := byID[parentID]
+			if !ok {
+				break
+			}
+
+			folders[j].Unread += counts[i].Unread
+			folders[j].Starred += counts[i].Starred
+			visited[parentID] = true
+			parentID = folders[j].Parent
+		}
+	}
+}
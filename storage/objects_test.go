@@ -0,0 +1,80 @@
+/*****************************************************************************
+ **
+ ** Gofr
+ ** https://github.com/pokebyte/Gofr
+ ** Copyright (C) 2013-2017 Akop Karapetyan
+ **
+ ** This program is free software; you can redistribute it and/or modify
+ ** it under the terms of the GNU General Public License as published by
+ ** the Free Software Foundation; either version 2 of the License, or
+ ** (at your option) any later version.
+ **
+ ** This program is distributed in the hope that it will be useful,
+ ** but WITHOUT ANY WARRANTY; without even the implied warranty of
+ ** MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ ** GNU General Public License for more details.
+ **
+ ** You should have received a copy of the GNU General Public License
+ ** along with this program; if not, write to the Free Software
+ ** Foundation, Inc., 675 Mass Ave, Cambridge, MA 02139, USA.
+ **
+ ******************************************************************************
+ */
+ 
+package storage
+
+import (
+	"testing"
+)
+
+func expectDeltas(t *testing.T, deltas ArticleCountDeltas, expected map[string]ArticleCounts) {
+	for counter, delta := range deltas {
+		if delta != expected[counter] {
+			t.Errorf("Counter %s: expected %+v, got %+v", counter, expected[counter], delta)
+		}
+	}
+	for counter, counts := range expected {
+		if _, ok := deltas[counter]; !ok && !counts.IsZero() {
+			t.Errorf("Counter %s: expected %+v, got nothing", counter, counts)
+		}
+	}
+}
+
+func TestArticleCountDeltas(t *testing.T) {
+	starred := Article {
+		Properties: []string { "unread", "star" },
+		Tags: []string { "later" },
+	}
+	read := Article {}
+
+	deltas := ArticleCountDeltas{}
+	deltas.Add("folder://1", starred)
+	deltas.Add("folder://1", read)
+
+	expectDeltas(t, deltas, map[string]ArticleCounts {
+		UserCounter: { Unread: 1, Starred: 1 },
+		FolderCounter("folder://1"): { Unread: 1, Starred: 1 },
+		TagCounter("later"): { Unread: 1, Starred: 1 },
+	})
+
+	// Moved to another folder, only the folder counts change
+	deltas = ArticleCountDeltas{}
+	deltas.Remove("folder://1", starred)
+	deltas.Add("folder://2", starred)
+
+	expectDeltas(t, deltas, map[string]ArticleCounts {
+		UserCounter: {},
+		FolderCounter("folder://1"): { Unread: -1, Starred: -1 },
+		FolderCounter("folder://2"): { Unread: 1, Starred: 1 },
+		TagCounter("later"): {},
+	})
+
+	// Articles at the top level have no folder to count towards
+	deltas = ArticleCountDeltas{}
+	deltas.Add("", starred)
+
+	expectDeltas(t, deltas, map[string]ArticleCounts {
+		UserCounter: { Unread: 1, Starred: 1 },
+		TagCounter("later"): { Unread: 1, Starred: 1 },
+	})
+}
@@ -0,0 +1,246 @@
+// +build appengine
+
+/*****************************************************************************
+ **
+ ** Gofr
+ ** https://github.com/pokebyte/Gofr
+ ** Copyright (C) 2013-2017 Akop Karapetyan
+ **
+ ** This program is free software; you can redistribute it and/or modify
+ ** it under the terms of the GNU General Public License as published by
+ ** the Free Software Foundation; either version 2 of the License, or
+ ** (at your option) any later version.
+ **
+ ** This program is distributed in the hope that it will be useful,
+ ** but WITHOUT ANY WARRANTY; without even the implied warranty of
+ ** MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ ** GNU General Public License for more details.
+ **
+ ** You should have received a copy of the GNU General Public License
+ ** along with this program; if not, write to the Free Software
+ ** Foundation, Inc., 675 Mass Ave, Cambridge, MA 02139, USA.
+ **
+ ******************************************************************************
+ */
+ 
+ 
+package storage
+
+import (
+	"appengine"
+	"appengine/datastore"
+	"time"
+)
+
+// Expired entries purged from a feed in a single run, at most; the
+// rest are left for the next run
+const maxEntriesPurged = 500
+
+// Feeds iterates over all feeds, resuming from cursor, if specified
+func (ds *Datastore)Feeds(cursor string) (FeedMetaIterator, error) {
+	c := ds.c
+	q := datastore.NewQuery("FeedMeta")
+	if cursor != "" {
+		if decoded, err := datastore.DecodeCursor(cursor); err != nil {
+			return nil, err
+		} else {
+			q = q.Start(decoded)
+		}
+	}
+
+	return &feedMetaIterator {
+		t: q.Run(c),
+	}, nil
+}
+
+func feedRetentionKey(c appengine.Context, url string) *datastore.Key {
+	return datastore.NewKey(c, "FeedRetention", url, 0, nil)
+}
+
+// FeedRetentionPolicy returns the feed's own retention policy, if
+// it has one
+func (ds *Datastore)FeedRetentionPolicy(url string) (*RetentionPolicy, error) {
+	c := ds.c
+	policy := RetentionPolicy{}
+	if err := datastore.Get(c, feedRetentionKey(c, url), &policy); err == nil || IsFieldMismatch(err) {
+		return &policy, nil
+	} else if err != datastore.ErrNoSuchEntity {
+		return nil, err
+	}
+
+	return nil, nil
+}
+
+// SetFeedRetentionPolicy overrides the default retention policy for
+// the feed, whether or not it's been fetched yet. A nil policy
+// removes the override
+func (ds *Datastore)SetFeedRetentionPolicy(url string, policy *RetentionPolicy) error {
+	c := ds.c
+	key := feedRetentionKey(c, url)
+	if policy == nil {
+		if err := datastore.Delete(c, key); err != nil && err != datastore.ErrNoSuchEntity {
+			return err
+		}
+	} else if _, err := datastore.Put(c, key, policy); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// PurgeFeed deletes the articles of the feed's expired entries,
+// then the entries themselves (along with their metadata and
+// media). Entries with articles that are retained are kept
+func (ds *Datastore)PurgeFeed(url string, policy RetentionPolicy) (PurgeReport, error) {
+	c := ds.c
+	report := PurgeReport{}
+	if policy.MaxAge <= 0 {
+		return report, nil
+	}
+
+	feedKey := datastore.NewKey(c, "Feed", url, 0, nil)
+	cutoff := time.Now().Add(-policy.MaxAge)
+
+	articleDeleter := NewBatchWriter(c, BatchDelete)
+	entryDeleter := NewBatchWriter(c, BatchDelete)
+	unindexed := make(map[UserID][]*datastore.Key)
+	uncounted := make(map[UserID]ArticleCountDeltas)
+	subscriptions := make(map[string]*subscriptionEntity)
+
+	// Newest first, skipping those kept regardless of age. Retained
+	// entries don't count towards the limit, so that they can't hold
+	// up the rest
+	q := datastore.NewQuery("EntryMeta").Ancestor(feedKey).Order("-Fetched").Order("-Published").Offset(policy.MinEntries)
+	for t := q.Run(c); report.Entries < maxEntriesPurged; {
+		entryMeta := EntryMeta{}
+		entryMetaKey, err := t.Next(&entryMeta)
+
+		if err == datastore.Done {
+			break
+		} else if IsFieldMismatch(err) {
+			// Ignore - migration issue
+		} else if err != nil {
+			return report, err
+		}
+
+		if !entryMeta.Fetched.Before(cutoff) || entryMeta.Entry == nil {
+			continue
+		}
+
+		entryKey := entryMeta.Entry
+		retained := false
+
+		q := datastore.NewQuery("Article").Filter("Entry =", entryKey)
+		for t := q.Run(c); ; {
+			article := articleEntity{}
+			articleKey, err := t.Next(&article)
+
+			if err == datastore.Done {
+				break
+			} else if IsFieldMismatch(err) {
+				// Ignore - migration issue
+			} else if err != nil {
+				return report, err
+			}
+
+			subscription, err := subscriptionOf(c, articleKey.Parent(), subscriptions)
+			if err != nil {
+				return report, err
+			}
+
+			var tags []string
+			if subscription != nil {
+				tags = subscription.Tags
+			}
+
+			if article.IsRetained(tags) {
+				retained = true
+				continue
+			}
+
+			if err := articleDeleter.EnqueueKey(articleKey); err != nil {
+				c.Errorf("Error queueing article for batch delete: %s", err)
+				return report, err
+			}
+
+			ref := newSubscriptionRef(articleKey.Parent())
+			unindexed[ref.UserID] = append(unindexed[ref.UserID], articleKey)
+
+			// Removed subscriptions' articles are already off the
+			// counters
+			if subscription != nil {
+				if _, ok := uncounted[ref.UserID]; !ok {
+					uncounted[ref.UserID] = ArticleCountDeltas{}
+				}
+				uncounted[ref.UserID].Remove(ref.FolderID, article.Article)
+			}
+		}
+
+		if retained {
+			continue
+		}
+
+		mediaKeys, err := datastore.NewQuery("EntryMedia").Filter("Entry =", entryKey).KeysOnly().GetAll(c, nil)
+		if err != nil {
+			return report, err
+		}
+
+		for _, key := range append(mediaKeys, entryKey, entryMetaKey) {
+			if err := entryDeleter.EnqueueKey(key); err != nil {
+				c.Errorf("Error queueing entry for batch delete: %s", err)
+				return report, err
+			}
+		}
+
+		report.Entries++
+		report.EntryMetas++
+		report.EntryMedia += len(mediaKeys)
+	}
+
+	// Articles go first, so that none outlives its entry
+	if err := articleDeleter.Flush(); err != nil {
+		c.Errorf("Error flushing batch queue: %s", err)
+		return report, err
+	}
+	report.Articles = articleDeleter.Written()
+
+	if err := entryDeleter.Flush(); err != nil {
+		c.Errorf("Error flushing batch queue: %s", err)
+		return report, err
+	}
+
+	for userID, deltas := range uncounted {
+		if userKey, err := userID.key(c); err != nil {
+			return report, err
+		} else if err := updateArticleCounts(c, userKey, deltas); err != nil {
+			c.Warningf("Error updating article counts: %s", err)
+		}
+	}
+
+	for userID, articleKeys := range unindexed {
+		if err := unindexArticles(c, userID, articleKeys); err != nil {
+			c.Warningf("Error removing articles from search index: %s", err)
+		}
+	}
+
+	return report, nil
+}
+
+// subscriptionOf returns the subscription (nil, if it's been
+// removed), caching it by key
+func subscriptionOf(c appengine.Context, subscriptionKey *datastore.Key, cache map[string]*subscriptionEntity) (*subscriptionEntity, error) {
+	encoded := subscriptionKey.Encode()
+	if subscription, ok := cache[encoded]; ok {
+		return subscription, nil
+	}
+
+	subscription := new(subscriptionEntity)
+	if err := datastore.Get(c, subscriptionKey, subscription); err == datastore.ErrNoSuchEntity {
+		subscription = nil
+	} else if err != nil && !IsFieldMismatch(err) {
+		return nil, err
+	}
+
+	cache[encoded] = subscription
+	return subscription, nil
+}
@@ -0,0 +1,279 @@
+/*****************************************************************************
+ **
+ ** Gofr
+ ** https://github.com/pokebyte/Gofr
+ ** Copyright (C) 2013-2017 Akop Karapetyan
+ **
+ ** This program is free software; you can redistribute it and/or modify
+ ** it under the terms of the GNU General Public License as published by
+ ** the Free Software Foundation; either version 2 of the License, or
+ ** (at your option) any later version.
+ **
+ ** This program is distributed in the hope that it will be useful,
+ ** but WITHOUT ANY WARRANTY; without even the implied warranty of
+ ** MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ ** GNU General Public License for more details.
+ **
+ ** You should have received a copy of the GNU General Public License
+ ** along with this program; if not, write to the Free Software
+ ** Foundation, Inc., 675 Mass Ave, Cambridge, MA 02139, USA.
+ **
+ ******************************************************************************
+ */
+ 
+package storage
+
+import (
+	"errors"
+	"html"
+	"regexp"
+	"strings"
+	"time"
+	"unicode"
+)
+
+const (
+	searchDateFormat = "2006-01-02"
+	// Longer terms aren't indexed
+	maxSearchTermLength = 64
+)
+
+var htmlTagRe = regexp.MustCompile(`<[^>]*>`)
+
+// searchStates maps is: values to article properties
+var searchStates = map[string]string {
+	"unread": "unread",
+	"read": "read",
+	"starred": "star",
+	"star": "star",
+	"liked": "like",
+	"like": "like",
+}
+
+// SearchQuery is a parsed search. Every word and phrase must appear
+// in an article's title, author, summary or content, and every
+// other field that is set must match
+type SearchQuery struct {
+	UserID UserID
+	Words []string
+	Phrases [][]string
+
+	SubscriptionID string // feed:
+	Tag string            // tag:
+	Property string       // is:
+	Before time.Time      // before: (published before the date)
+	After time.Time       // after: (published on or after the date)
+}
+
+// ParseSearchQuery parses a search, e.g.
+// `"go generics" feed:https://blog.golang.org/feed.atom is:unread after:2017-01-01`.
+// Values containing spaces may be quoted
+func ParseSearchQuery(userID UserID, query string) (SearchQuery, error) {
+	q := SearchQuery {
+		UserID: userID,
+	}
+
+	for _, token := range splitSearchQuery(query) {
+		operator, value := "", token
+		if index := strings.Index(token, ":"); index > 0 {
+			switch token[:index] {
+			case "feed", "tag", "is", "before", "after":
+				operator, value = token[:index], token[index + 1:]
+			}
+		}
+
+		quoted := len(value) >= 2 && strings.HasPrefix(value, `"`) && strings.HasSuffix(value, `"`)
+		if quoted {
+			value = value[1:len(value) - 1]
+		} else {
+			value = strings.Trim(value, `"`)
+		}
+
+		switch operator {
+		case "feed":
+			q.SubscriptionID = value
+		case "tag":
+			q.Tag = value
+		case "is":
+			if property, ok := searchStates[strings.ToLower(value)]; ok {
+				q.Property = property
+			} else {
+				return q, errors.New("is: must be one of unread, read, starred or liked")
+			}
+		case "before", "after":
+			date, err := time.Parse(searchDateFormat, value)
+			if err != nil {
+				return q, errors.New(operator + ": dates are written as YYYY-MM-DD")
+			}
+			if operator == "before" {
+				q.Before = date
+			} else {
+				q.After = date
+			}
+		default:
+			// A quoted string, or a word that tokenizes into several
+			// (e.g. "e-mail"), is a phrase
+			if terms := SearchTerms(value); len(terms) == 1 {
+				q.Words = append(q.Words, terms[0])
+			} else if len(terms) > 1 {
+				q.Phrases = append(q.Phrases, terms)
+			}
+		}
+	}
+
+	if q.IsEmpty() {
+		return q, errors.New("Nothing to search for")
+	}
+
+	return q, nil
+}
+
+// splitSearchQuery splits a query on whitespace outside of quotes
+func splitSearchQuery(query string) []string {
+	tokens := make([]string, 0)
+	token := make([]rune, 0)
+	inQuotes := false
+
+	for _, r := range query {
+		if r == '"' {
+			inQuotes = !inQuotes
+		} else if unicode.IsSpace(r) && !inQuotes {
+			if len(token) > 0 {
+				tokens = append(tokens, string(token))
+				token = token[:0]
+			}
+			continue
+		}
+		token = append(token, r)
+	}
+
+	if len(token) > 0 {
+		tokens = append(tokens, string(token))
+	}
+
+	return tokens
+}
+
+// SearchTerms breaks text (which may be HTML) into lowercase
+// words, in order
+func SearchTerms(text string) []string {
+	text = html.UnescapeString(htmlTagRe.ReplaceAllString(text, " "))
+	terms := strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+
+	kept := terms[:0]
+	for _, term := range terms {
+		if len(term) <= maxSearchTermLength {
+			kept = append(kept, term)
+		}
+	}
+
+	return kept
+}
+
+// EntrySearchTerms returns the distinct terms of the entry's
+// searchable fields
+func EntrySearchTerms(entry *Entry) []string {
+	seen := make(map[string]bool)
+	terms := make([]string, 0)
+	for _, field := range []string { entry.Title, entry.Author, entry.Summary, entry.Content } {
+		for _, term := range SearchTerms(field) {
+			if !seen[term] {
+				seen[term] = true
+				terms = append(terms, term)
+			}
+		}
+	}
+
+	return terms
+}
+
+func (q SearchQuery)IsEmpty() bool {
+	return len(q.Words) == 0 && len(q.Phrases) == 0 && q.SubscriptionID == "" &&
+		q.Tag == "" && q.Property == "" && q.Before.IsZero() && q.After.IsZero()
+}
+
+// HasText reports whether the query has words or phrases
+func (q SearchQuery)HasText() bool {
+	return len(q.Words) > 0 || len(q.Phrases) > 0
+}
+
+// MatchesArticle reports whether the article matches the query's
+// feed, tag, state and dates
+func (q SearchQuery)MatchesArticle(article Article) bool {
+	if q.SubscriptionID != "" && article.Source != q.SubscriptionID {
+		return false
+	} else if q.Property != "" && !article.HasProperty(q.Property) {
+		return false
+	} else if !q.Before.IsZero() && !article.Published.Before(q.Before) {
+		return false
+	} else if !q.After.IsZero() && article.Published.Before(q.After) {
+		return false
+	}
+
+	if q.Tag != "" {
+		for _, tag := range article.Tags {
+			if strings.EqualFold(tag, q.Tag) {
+				return true
+			}
+		}
+		return false
+	}
+
+	return true
+}
+
+// MatchesText reports whether every word and phrase of the query
+// appears in the entry. Phrases don't span fields
+func (q SearchQuery)MatchesText(entry *Entry) bool {
+	if entry == nil {
+		return !q.HasText()
+	}
+
+	fields := [][]string {
+		SearchTerms(entry.Title),
+		SearchTerms(entry.Author),
+		SearchTerms(entry.Summary),
+		SearchTerms(entry.Content),
+	}
+
+	words := make(map[string]bool)
+	for _, terms := range fields {
+		for _, term := range terms {
+			words[term] = true
+		}
+	}
+
+	for _, word := range q.Words {
+		if !words[word] {
+			return false
+		}
+	}
+
+NextPhrase:
+	for _, phrase := range q.Phrases {
+		for _, terms := range fields {
+			if containsPhrase(terms, phrase) {
+				continue NextPhrase
+			}
+		}
+		return false
+	}
+
+	return true
+}
+
+func containsPhrase(terms []string, phrase []string) bool {
+NextStart:
+	for i := 0; i + len(phrase) <= len(terms); i++ {
+		for j, word := range phrase {
+			if terms[i + j] != word {
+				continue NextStart
+			}
+		}
+		return true
+	}
+
+	return false
+}
@@ -0,0 +1,201 @@
+/*****************************************************************************
+ **
+ ** Gofr
+ ** https://github.com/pokebyte/Gofr
+ ** Copyright (C) 2013-2017 Akop Karapetyan
+ **
+ ** This program is free software; you can redistribute it and/or modify
+ ** it under the terms of the GNU General Public License as published by
+ ** the Free Software Foundation; either version 2 of the License, or
+ ** (at your option) any later version.
+ **
+ ** This program is distributed in the hope that it will be useful,
+ ** but WITHOUT ANY WARRANTY; without even the implied warranty of
+ ** MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ ** GNU General Public License for more details.
+ **
+ ** You should have received a copy of the GNU General Public License
+ ** along with this program; if not, write to the Free Software
+ ** Foundation, Inc., 675 Mass Ave, Cambridge, MA 02139, USA.
+ **
+ ******************************************************************************
+ */
+ 
+package storage
+
+import (
+	"errors"
+	"rss"
+	"time"
+)
+
+// Done is returned by iterators once all results have been read
+var Done = errors.New("storage: no more items in iterator")
+
+// ErrDuplicate is returned when creating something that already exists
+var ErrDuplicate = errors.New("storage: entry already exists")
+
+// ErrLeaseHeld is returned when a feed or a user's subscriptions
+// can't be updated, because another update is still in progress
+var ErrLeaseHeld = errors.New("storage: update already in progress")
+
+// ErrLeaseExpired is returned when an update ran past its lease, and
+// its remaining writes were refused
+var ErrLeaseExpired = errors.New("storage: lease expired")
+
+// ErrFolderCycle is returned when moving a folder into itself, or
+// into one of its subfolders
+var ErrFolderCycle = errors.New("storage: folder can't be nested in itself")
+
+// Repository is the interface to a storage backend. The App Engine
+// Datastore is one; the embedded store, used when Gofr runs as a
+// standalone server, is another. A Repository is bound to the
+// request that created it
+type Repository interface {
+	// Users
+
+	UserByID(userID UserID) (*User, error)
+	SaveUser(user User) error
+	Users(cursor string) (UserIterator, error)
+
+	// Sign-in
+
+	IdentityByLogin(provider string, subject string) (*LoginIdentity, error)
+	IdentitiesForUser(userID UserID) ([]LoginIdentity, error)
+	SaveIdentity(identity LoginIdentity) error
+	DeleteIdentity(identity LoginIdentity) error
+	LocalAccountByUsername(username string) (*LocalAccount, error)
+	CreateLocalAccount(account LocalAccount) error
+	SessionByID(sessionID string) (*Session, error)
+	SaveSession(session Session) error
+	DeleteSession(sessionID string) error
+	LoginFailures(account string) (*LoginFailures, error)
+	RecordLoginFailure(account string, window time.Duration) (*LoginFailures, error)
+	ClearLoginFailures(account string) error
+
+	// Subscriptions and folders
+
+	NewUserSubscriptions(userID UserID) (*UserSubscriptions, error)
+	IsFolderDuplicate(parent FolderRef, title string) (bool, error)
+	IsSubscriptionDuplicate(userID UserID, subscriptionURL string) (bool, error)
+	FolderByTitle(parent FolderRef, title string) (FolderRef, error)
+	FolderExists(ref FolderRef) (bool, error)
+	SubscriptionExists(ref SubscriptionRef) (bool, error)
+	CreateFolder(parent FolderRef, title string) (FolderRef, error)
+	RenameFolder(ref FolderRef, title string) error
+	MoveFolder(ref FolderRef, destRef FolderRef) error
+	DeleteFolder(ref FolderRef) error
+	Subscribe(ref FolderRef, url string, title string) (SubscriptionRef, error)
+	Unsubscribe(ref SubscriptionRef) error
+	RenameSubscription(ref SubscriptionRef, title string) error
+	SetSubscriptionTags(ref SubscriptionRef, tags []string) error
+	MoveSubscription(subRef SubscriptionRef, destRef FolderRef) error
+	MoveArticles(subRef SubscriptionRef, destRef FolderRef) error
+	SubscriptionsAsOPML(userID UserID) (*rss.OPML, error)
+	UpdateSubscription(url string, ref SubscriptionRef) (int, error)
+	UpdateAllSubscriptions(userID UserID) error
+	AreNewEntriesAvailable(subscriptions []Subscription) (bool, error)
+	Subscriptions(cursor string) (SubscriptionIterator, error)
+	UpdateUnreadCount(ref SubscriptionRef) error
+
+	// Tags
+
+	TagExists(userID UserID, tagID string) (bool, error)
+	DeleteTag(userID UserID, tagID string) error
+	RemoveTag(userID UserID, tag string) error
+
+	// Articles
+
+	NewArticlePage(filter ArticleFilter, start string) (*ArticlePage, error)
+	SetProperty(ref ArticleRef, propertyName string, propertyValue bool) ([]string, error)
+	SetTags(ref ArticleRef, tags []string) ([]string, error)
+	MarkAsRead(scope ArticleScope, readRange ReadRange) error
+	ApplyReadRanges(scope ArticleScope) (int, error)
+	DeleteArticlesWithinScope(scope ArticleScope) error
+	LoadArticleExtras(ref ArticleRef) (ArticleExtras, error)
+	Articles(refs []ArticleRef) ([]Article, error)
+	ItemAliases(userID UserID, ids []int64) ([]ItemAlias, error)
+	SaveItemAliases(userID UserID, aliases []ItemAlias) error
+
+	// Article counts
+
+	ReconcileArticleCounts(userID UserID) (bool, error)
+
+	// Filter rules
+
+	FilterRules(userID UserID) ([]FilterRule, error)
+	SaveFilterRule(rule *FilterRule) error
+	DeleteFilterRule(userID UserID, ruleID string) error
+
+	// Undo
+
+	UndoRecords(userID UserID) ([]UndoRecord, error)
+	Undo(record UndoRecord) error
+	DiscardUndoRecord(record UndoRecord) error
+	UndoRecordsCreatedBefore(before time.Time, cursor string) (UndoRecordIterator, error)
+
+	// Search
+
+	SearchArticles(query SearchQuery, start string) (*ArticlePage, error)
+
+	// Feeds
+
+	FeedByURL(url string) (*Feed, error)
+	IsFeedAvailable(url string) (bool, error)
+	WebToFeedURL(url string, title *string) (string, error)
+	UpdateFeed(parsedFeed *rss.Feed, favIcon *FavIcon, fetched time.Time, fetchInfo FetchInfo) error
+	MarkFeedUnchanged(url string, fetched time.Time) error
+	RecordFeedFailure(url string, fetched time.Time, statusCode int, fetchError error) error
+	MigrateFeed(oldURL string, newURL string) error
+	FeedsDue(before time.Time, cursor string) (FeedMetaIterator, error)
+	Feeds(cursor string) (FeedMetaIterator, error)
+	PurgeFeed(url string, policy RetentionPolicy) (PurgeReport, error)
+	FeedRetentionPolicy(url string) (*RetentionPolicy, error)
+	SetFeedRetentionPolicy(url string, policy *RetentionPolicy) error
+	SubscriberCount(feedURL string) (int, error)
+
+	// WebSub
+
+	HubSubscriptionByURL(feedURL string) (*HubSubscription, error)
+	HubSubscriptionsExpiringBefore(before time.Time) ([]HubSubscription, error)
+	SaveHubSubscription(hubSub HubSubscription) error
+	DeleteHubSubscription(hubSub HubSubscription) error
+
+	// Imports
+
+	NewImportJob(userID UserID) (*ImportJob, error)
+	ImportJobByID(userID UserID, jobID string) (*ImportJob, error)
+	RecentImportJobs(userID UserID) ([]ImportJob, error)
+	SaveImportJob(job ImportJob) error
+	ImportResults(job ImportJob) ([]ImportResult, error)
+	SaveImportResult(job ImportJob, result *ImportResult) error
+	SaveImportResults(job ImportJob, results []*ImportResult) error
+}
+
+// FeedMetaIterator walks the metadata of feeds due for an update.
+// Next returns Done once there are no more feeds
+type FeedMetaIterator interface {
+	Next() (string, *FeedMeta, error)
+	Cursor() (string, error)
+}
+
+// UserIterator walks the IDs of all users. Next returns Done once
+// there are no more users
+type UserIterator interface {
+	Next() (UserID, error)
+	Cursor() (string, error)
+}
+
+// SubscriptionIterator walks the subscriptions of all users.
+// Next returns Done once there are no more subscriptions
+type SubscriptionIterator interface {
+	Next() (SubscriptionRef, error)
+	Cursor() (string, error)
+}
+
+// UndoRecordIterator walks the undo records of all users.
+// Next returns Done once there are no more records
+type UndoRecordIterator interface {
+	Next() (*UndoRecord, error)
+	Cursor() (string, error)
+}
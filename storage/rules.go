@@ -0,0 +1,231 @@
+/*****************************************************************************
+ **
+ ** Gofr
+ ** https://github.com/pokebyte/Gofr
+ ** Copyright (C) 2013-2017 Akop Karapetyan
+ **
+ ** This program is free software; you can redistribute it and/or modify
+ ** it under the terms of the GNU General Public License as published by
+ ** the Free Software Foundation; either version 2 of the License, or
+ ** (at your option) any later version.
+ **
+ ** This program is distributed in the hope that it will be useful,
+ ** but WITHOUT ANY WARRANTY; without even the implied warranty of
+ ** MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ ** GNU General Public License for more details.
+ **
+ ** You should have received a copy of the GNU General Public License
+ ** along with this program; if not, write to the Free Software
+ ** Foundation, Inc., 675 Mass Ave, Cambridge, MA 02139, USA.
+ **
+ ******************************************************************************
+ */
+ 
+ 
+package storage
+
+import (
+	"errors"
+	"html"
+	"regexp"
+	"strings"
+)
+
+// Fields a rule's keyword or pattern may be matched against
+var filterRuleFields = map[string]bool {
+	"": true,
+	"title": true,
+	"content": true,
+	"author": true,
+}
+
+// Validate returns an error describing the first problem with the
+// rule, if any
+func (rule FilterRule)Validate() error {
+	if !filterRuleFields[rule.Field] {
+		return errors.New("field must be one of title, content or author")
+	} else if rule.Pattern != "" {
+		if _, err := regexp.Compile(rule.Pattern); err != nil {
+			return err
+		}
+	}
+
+	if !rule.MarkRead && !rule.Star && len(rule.Tags) == 0 && !rule.Delete {
+		return errors.New("rule has no actions")
+	}
+
+	return nil
+}
+
+// FilterRuleSet is a set of rules, with their patterns compiled
+type FilterRuleSet struct {
+	rules []FilterRule
+	patterns []*regexp.Regexp
+	folders []map[string]bool
+}
+
+// NewFilterRuleSet compiles the rules. Rules with patterns that
+// don't compile are left out. A rule on a folder covers the folders
+// nested in it as well, which are looked up in folders (the user's)
+func NewFilterRuleSet(rules []FilterRule, folders []Folder) *FilterRuleSet {
+	set := &FilterRuleSet {
+		rules: make([]FilterRule, 0, len(rules)),
+		patterns: make([]*regexp.Regexp, 0, len(rules)),
+		folders: make([]map[string]bool, 0, len(rules)),
+	}
+
+	for _, rule := range rules {
+		var pattern *regexp.Regexp
+		if rule.Pattern != "" {
+			var err error
+			if pattern, err = regexp.Compile("(?i)" + rule.Pattern); err != nil {
+				continue
+			}
+		}
+
+		var within map[string]bool
+		if rule.FolderID != "" {
+			within = make(map[string]bool)
+			for _, folderID := range FolderSubtree(folders, rule.FolderID) {
+				within[folderID] = true
+			}
+		}
+
+		set.rules = append(set.rules, rule)
+		set.patterns = append(set.patterns, pattern)
+		set.folders = append(set.folders, within)
+	}
+
+	return set
+}
+
+// covers returns true if the i-th rule covers the subscription, in
+// the folder
+func (set *FilterRuleSet)covers(i int, folderID string, subscriptionID string) bool {
+	if rule := set.rules[i]; rule.SubscriptionID != "" {
+		return rule.SubscriptionID == subscriptionID
+	} else if rule.FolderID != "" {
+		return set.folders[i][folderID]
+	}
+
+	return true
+}
+
+// Covers returns true if any of the rules cover the subscription,
+// in the folder
+func (set *FilterRuleSet)Covers(folderID string, subscriptionID string) bool {
+	for i, _ := range set.rules {
+		if set.covers(i, folderID, subscriptionID) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// For returns the rules that cover the subscription, in the folder
+func (set *FilterRuleSet)For(folderID string, subscriptionID string) *FilterRuleSet {
+	subset := &FilterRuleSet{}
+	for i, rule := range set.rules {
+		if set.covers(i, folderID, subscriptionID) {
+			subset.rules = append(subset.rules, rule)
+			subset.patterns = append(subset.patterns, set.patterns[i])
+			subset.folders = append(subset.folders, set.folders[i])
+		}
+	}
+
+	return subset
+}
+
+func (set *FilterRuleSet)IsEmpty() bool {
+	return len(set.rules) == 0
+}
+
+// NeedsMedia returns true if a rule matches on the media of
+// articles, which are otherwise not needed to run the rules
+func (set *FilterRuleSet)NeedsMedia() bool {
+	for _, rule := range set.rules {
+		if rule.MediaType != "" {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Matching returns the rules that match the entry and its media.
+// The rules are assumed to cover the entry's subscription
+func (set *FilterRuleSet)Matching(entry *Entry, media []*EntryMedia) []FilterRule {
+	matching := make([]FilterRule, 0)
+	for i, rule := range set.rules {
+		if rule.matches(set.patterns[i], entry, media) {
+			matching = append(matching, rule)
+		}
+	}
+
+	return matching
+}
+
+// Apply runs the matching rules against a new article, returning
+// false if one of them deleted it
+func (set *FilterRuleSet)Apply(article *Article, entry *Entry, media []*EntryMedia) bool {
+	for _, rule := range set.Matching(entry, media) {
+		if rule.Delete {
+			return false
+		}
+		if rule.MarkRead {
+			article.SetProperty("read", true)
+		}
+		if rule.Star {
+			article.SetProperty("star", true)
+		}
+		for _, tag := range rule.Tags {
+			article.SetTag(tag, true)
+		}
+	}
+
+	return true
+}
+
+func (rule FilterRule)matches(pattern *regexp.Regexp, entry *Entry, media []*EntryMedia) bool {
+	if rule.MediaType != "" {
+		found := false
+		for _, m := range media {
+			if strings.HasPrefix(strings.ToLower(m.Type), strings.ToLower(rule.MediaType)) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+
+	if rule.Keyword == "" && pattern == nil {
+		return true
+	}
+
+	texts := make([]string, 0, 3)
+	if rule.Field == "" || rule.Field == "title" {
+		texts = append(texts, entry.Title)
+	}
+	if rule.Field == "" || rule.Field == "content" {
+		texts = append(texts, entry.Summary + " " + entry.Content)
+	}
+	if rule.Field == "" || rule.Field == "author" {
+		texts = append(texts, entry.Author)
+	}
+
+	keyword := SearchTerms(rule.Keyword)
+	for _, text := range texts {
+		if len(keyword) > 0 && !containsPhrase(SearchTerms(text), keyword) {
+			continue
+		} else if pattern != nil && !pattern.MatchString(html.UnescapeString(htmlTagRe.ReplaceAllString(text, " "))) {
+			continue
+		}
+
+		return true
+	}
+
+	return false
+}
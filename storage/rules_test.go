@@ -0,0 +1,65 @@
+/*****************************************************************************
+ **
+ ** Gofr
+ ** https://github.com/pokebyte/Gofr
+ ** Copyright (C) 2013-2017 Akop Karapetyan
+ **
+ ** This program is free software; you can redistribute it and/or modify
+ ** it under the terms of the GNU General Public License as published by
+ ** the Free Software Foundation; either version 2 of the License, or
+ ** (at your option) any later version.
+ **
+ ** This program is distributed in the hope that it will be useful,
+ ** but WITHOUT ANY WARRANTY; without even the implied warranty of
+ ** MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ ** GNU General Public License for more details.
+ **
+ ** You should have received a copy of the GNU General Public License
+ ** along with this program; if not, write to the Free Software
+ ** Foundation, Inc., 675 Mass Ave, Cambridge, MA 02139, USA.
+ **
+ ******************************************************************************
+ */
+ 
+package storage
+
+import (
+	"testing"
+)
+
+func TestFilterRuleSetFolders(t *testing.T) {
+	folders := []Folder {
+		Folder { ID: "news" },
+		Folder { ID: "local", Parent: "news" },
+		Folder { ID: "city", Parent: "local" },
+		Folder { ID: "comics" },
+	}
+	rules := NewFilterRuleSet([]FilterRule {
+		FilterRule { ID: "1", FolderID: "local", Pattern: "weather" },
+		FilterRule { ID: "2", SubscriptionID: "sub" },
+	}, folders)
+
+	for _, test := range []struct {
+		folderID string
+		subscriptionID string
+		expected int
+	} {
+		{ "local", "a", 1 },
+		{ "city", "a", 1 },
+		{ "news", "a", 0 },
+		{ "comics", "a", 0 },
+		{ "", "a", 0 },
+		{ "comics", "sub", 1 },
+		{ "city", "sub", 2 },
+	} {
+		subset := rules.For(test.folderID, test.subscriptionID)
+		if len(subset.rules) != test.expected {
+			t.Errorf("%s/%s: expected %d rules, got %d", test.folderID, test.subscriptionID,
+				test.expected, len(subset.rules))
+		}
+		if covers := rules.Covers(test.folderID, test.subscriptionID); covers != (test.expected > 0) {
+			t.Errorf("%s/%s: expected coverage %v, got %v", test.folderID, test.subscriptionID,
+				test.expected > 0, covers)
+		}
+	}
+}
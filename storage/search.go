@@ -0,0 +1,242 @@
+// +build appengine
+
+/*****************************************************************************
+ **
+ ** Gofr
+ ** https://github.com/pokebyte/Gofr
+ ** Copyright (C) 2013-2017 Akop Karapetyan
+ **
+ ** This program is free software; you can redistribute it and/or modify
+ ** it under the terms of the GNU General Public License as published by
+ ** the Free Software Foundation; either version 2 of the License, or
+ ** (at your option) any later version.
+ **
+ ** This program is distributed in the hope that it will be useful,
+ ** but WITHOUT ANY WARRANTY; without even the implied warranty of
+ ** MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ ** GNU General Public License for more details.
+ **
+ ** You should have received a copy of the GNU General Public License
+ ** along with this program; if not, write to the Free Software
+ ** Foundation, Inc., 675 Mass Ave, Cambridge, MA 02139, USA.
+ **
+ ******************************************************************************
+ */
+ 
+package storage
+
+import (
+	"appengine"
+	"appengine/datastore"
+	"appengine/search"
+	"crypto/sha1"
+	"encoding/hex"
+	"strings"
+	"time"
+)
+
+// searchDocument is an article, as indexed by the Search API.
+// Each user has an index of their own. Properties and tags change
+// too often to index; they're checked once articles are loaded
+type searchDocument struct {
+	SubscriptionID search.Atom
+	ArticleID search.Atom
+	Title string
+	Author string
+	Summary search.HTML
+	Content search.HTML
+	Published time.Time
+}
+
+func searchIndex(userID UserID) (*search.Index, error) {
+	return search.Open("articles." + string(userID))
+}
+
+func searchDocumentID(subscriptionID string, articleID string) string {
+	sum := sha1.Sum([]byte(subscriptionID + "\x00" + articleID))
+	return hex.EncodeToString(sum[:])
+}
+
+// indexArticles adds the articles of a subscription to the user's
+// search index, replacing any earlier versions
+func indexArticles(c appengine.Context, subscriptionKey *datastore.Key, articleKeys []*datastore.Key, articles []articleEntity) error {
+	ref := newSubscriptionRef(subscriptionKey)
+	index, err := searchIndex(ref.UserID)
+	if err != nil {
+		return err
+	}
+
+	entryKeys := make([]*datastore.Key, len(articles))
+	for i, article := range articles {
+		entryKeys[i] = article.Entry
+	}
+
+	entries := make([]Entry, len(articles))
+	var multiError appengine.MultiError
+	if err := datastore.GetMulti(c, entryKeys, entries); err != nil {
+		if me, ok := err.(appengine.MultiError); ok {
+			multiError = me
+		} else {
+			return err
+		}
+	}
+
+	for i, entry := range entries {
+		if multiError != nil && multiError[i] != nil && !IsFieldMismatch(multiError[i]) {
+			continue
+		}
+
+		doc := searchDocument {
+			SubscriptionID: search.Atom(ref.SubscriptionID),
+			ArticleID: search.Atom(articleKeys[i].StringID()),
+			Title: entry.Title,
+			Author: entry.Author,
+			Summary: search.HTML(entry.Summary),
+			Content: search.HTML(entry.Content),
+			Published: articles[i].Published,
+		}
+
+		if _, err := index.Put(c, searchDocumentID(ref.SubscriptionID, articleKeys[i].StringID()), &doc); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// unindexArticles removes articles from the user's search index
+func unindexArticles(c appengine.Context, userID UserID, articleKeys []*datastore.Key) error {
+	index, err := searchIndex(userID)
+	if err != nil {
+		return err
+	}
+
+	for _, articleKey := range articleKeys {
+		docID := searchDocumentID(articleKey.Parent().StringID(), articleKey.StringID())
+		if err := index.Delete(c, docID); err != nil && err != search.ErrNoSuchDocument {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// searchString writes the query in the Search API's syntax
+func (q SearchQuery)searchString() string {
+	clauses := make([]string, 0)
+	for _, word := range q.Words {
+		clauses = append(clauses, `"` + word + `"`)
+	}
+	for _, phrase := range q.Phrases {
+		clauses = append(clauses, `"` + strings.Join(phrase, " ") + `"`)
+	}
+	if q.SubscriptionID != "" {
+		clauses = append(clauses, `SubscriptionID:"` + strings.Replace(q.SubscriptionID, `"`, "", -1) + `"`)
+	}
+	if !q.Before.IsZero() {
+		clauses = append(clauses, "Published < " + q.Before.Format(searchDateFormat))
+	}
+	if !q.After.IsZero() {
+		clauses = append(clauses, "Published >= " + q.After.Format(searchDateFormat))
+	}
+
+	return strings.Join(clauses, " ")
+}
+
+func (ds *Datastore)SearchArticles(query SearchQuery, start string) (*ArticlePage, error) {
+	c := ds.c
+	userKey, err := query.UserID.key(c)
+	if err != nil {
+		return nil, err
+	}
+
+	index, err := searchIndex(query.UserID)
+	if err != nil {
+		return nil, err
+	}
+
+	// Subscriptions, by ID; articles of those the user has since
+	// left are skipped
+	subscriptionKeys := make(map[string]*datastore.Key)
+	if keys, err := datastore.NewQuery("Subscription").Ancestor(userKey).KeysOnly().GetAll(c, nil); err != nil {
+		return nil, err
+	} else {
+		for _, key := range keys {
+			subscriptionKeys[key.StringID()] = key
+		}
+	}
+
+	options := &search.SearchOptions {
+		Limit: articlePageSize,
+		Cursor: search.Cursor(start),
+	}
+
+	articleKeys := make([]*datastore.Key, 0, articlePageSize)
+	found := 0
+	t := index.Search(c, query.searchString(), options)
+	for {
+		doc := searchDocument{}
+		if _, err := t.Next(&doc); err == search.Done {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+
+		found++
+		if subscriptionKey, ok := subscriptionKeys[string(doc.SubscriptionID)]; ok {
+			articleKeys = append(articleKeys, datastore.NewKey(c, "Article", string(doc.ArticleID), 0, subscriptionKey))
+		}
+	}
+
+	continueFrom := ""
+	if found >= articlePageSize {
+		continueFrom = string(t.Cursor())
+	}
+
+	entities := make([]articleEntity, len(articleKeys))
+	var multiError appengine.MultiError
+	if err := datastore.GetMulti(c, articleKeys, entities); err != nil {
+		if me, ok := err.(appengine.MultiError); ok {
+			multiError = me
+		} else {
+			return nil, err
+		}
+	}
+
+	articles := make([]Article, 0, len(articleKeys))
+	entryKeys := make([]*datastore.Key, 0, len(articleKeys))
+	ranges := readRanges{}
+	for i, entity := range entities {
+		if multiError != nil && multiError[i] != nil {
+			if multiError[i] == datastore.ErrNoSuchEntity {
+				continue
+			} else if !IsFieldMismatch(multiError[i]) {
+				return nil, multiError[i]
+			}
+		}
+
+		article := entity.article()
+		article.Source = articleKeys[i].Parent().StringID()
+		if subscribed, err := ranges.apply(c, articleKeys[i].Parent(), &article); err != nil {
+			return nil, err
+		} else if !subscribed {
+			continue
+		}
+
+		if query.MatchesArticle(article) {
+			articles = append(articles, article)
+			entryKeys = append(entryKeys, entity.Entry)
+		}
+	}
+
+	if err := loadEntries(c, articles, entryKeys); err != nil {
+		return nil, err
+	}
+
+	page := ArticlePage {
+		Articles: articles,
+		Continue: continueFrom,
+	}
+
+	return &page, nil
+}
@@ -0,0 +1,528 @@
+// +build appengine
+
+/*****************************************************************************
+ **
+ ** Gofr
+ ** https://github.com/pokebyte/Gofr
+ ** Copyright (C) 2013-2017 Akop Karapetyan
+ **
+ ** This program is free software; you can redistribute it and/or modify
+ ** it under the terms of the GNU General Public License as published by
+ ** the Free Software Foundation; either version 2 of the License, or
+ ** (at your option) any later version.
+ **
+ ** This program is distributed in the hope that it will be useful,
+ ** but WITHOUT ANY WARRANTY; without even the implied warranty of
+ ** MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ ** GNU General Public License for more details.
+ **
+ ** You should have received a copy of the GNU General Public License
+ ** along with this program; if not, write to the Free Software
+ ** Foundation, Inc., 675 Mass Ave, Cambridge, MA 02139, USA.
+ **
+ ******************************************************************************
+ */
+ 
+package storage
+
+import (
+	"appengine"
+	"appengine/datastore"
+	"errors"
+	"time"
+)
+
+type undoRecordIterator struct {
+	c appengine.Context
+	t *datastore.Iterator
+}
+
+func (it *undoRecordIterator)Next() (*UndoRecord, error) {
+	record := new(UndoRecord)
+	recordKey, err := it.t.Next(record)
+	if err == datastore.Done {
+		return nil, Done
+	} else if err != nil && !IsFieldMismatch(err) {
+		return nil, err
+	}
+
+	if err := loadUndoRecord(it.c, recordKey, record); err != nil {
+		return nil, err
+	}
+
+	return record, nil
+}
+
+func (it *undoRecordIterator)Cursor() (string, error) {
+	if cursor, err := it.t.Cursor(); err != nil {
+		return "", err
+	} else {
+		return cursor.String(), nil
+	}
+}
+
+func (record UndoRecord)key(c appengine.Context) (*datastore.Key, error) {
+	userKey, err := record.UserID.key(c)
+	if err != nil {
+		return nil, err
+	}
+
+	if kind, id, err := UnformatId(record.ID); err != nil {
+		return nil, err
+	} else if kind != "undo" {
+		return nil, errors.New("Expecting undo record ID; found: " + kind)
+	} else {
+		return datastore.NewKey(c, "UndoRecord", "", id, userKey), nil
+	}
+}
+
+// saveUndoRecord writes a new record, keeping the folders and the
+// subscriptions it removes as DeletedFolders and DeletedSubscriptions
+// under it. Subscriptions of removed folders are kept under theirs
+func saveUndoRecord(c appengine.Context, record *UndoRecord, subscriptionKeys []*datastore.Key, subscriptions []*subscriptionEntity) error {
+	userKey, err := record.UserID.key(c)
+	if err != nil {
+		return err
+	}
+
+	record.Created = time.Now()
+	recordKey, err := datastore.Put(c, datastore.NewIncompleteKey(c, "UndoRecord", userKey), record)
+	if err != nil {
+		return err
+	}
+
+	record.ID = FormatId("undo", recordKey.IntID())
+	if len(record.Folders) > 0 {
+		folderKeys := make([]*datastore.Key, len(record.Folders))
+		for i, folder := range record.Folders {
+			if _, id, err := UnformatId(folder.ID); err != nil {
+				return err
+			} else {
+				folderKeys[i] = datastore.NewKey(c, "DeletedFolder", "", id, recordKey)
+			}
+		}
+
+		if _, err := datastore.PutMulti(c, folderKeys, record.Folders); err != nil {
+			return err
+		}
+	}
+
+	if len(subscriptionKeys) == 0 {
+		return nil
+	}
+
+	deletedKeys := make([]*datastore.Key, len(subscriptionKeys))
+	for i, subscriptionKey := range subscriptionKeys {
+		parentKey := recordKey
+		if len(record.Folders) > 0 && subscriptionKey.Parent().Kind() == "Folder" {
+			parentKey = datastore.NewKey(c, "DeletedFolder", "", subscriptionKey.Parent().IntID(), recordKey)
+		}
+		deletedKeys[i] = datastore.NewKey(c, "DeletedSubscription", subscriptionKey.StringID(), 0, parentKey)
+	}
+
+	_, err = datastore.PutMulti(c, deletedKeys, subscriptions)
+	return err
+}
+
+// loadUndoRecord fills in the identity, the folders and the
+// subscriptions of a record read from the Datastore
+func loadUndoRecord(c appengine.Context, recordKey *datastore.Key, record *UndoRecord) error {
+	record.ID = FormatId("undo", recordKey.IntID())
+	record.UserID = UserID(recordKey.Parent().StringID())
+
+	folders, err := deletedFolders(c, recordKey, record.FolderID)
+	if err != nil {
+		return err
+	}
+	record.Folders = folders
+
+	deletedKeys, subscriptions, err := deletedSubscriptions(c, recordKey)
+	if err != nil {
+		return err
+	}
+
+	record.Subscriptions = make([]Subscription, len(subscriptions))
+	for i, subscription := range subscriptions {
+		record.Subscriptions[i] = subscription.Subscription
+		record.Subscriptions[i].Parent = deletedFolderID(*record, deletedKeys[i])
+		if subscription.Feed != nil {
+			record.Subscriptions[i].FeedURL = subscription.Feed.StringID()
+		}
+	}
+
+	return nil
+}
+
+// deletedSubscriptions returns the subscriptions removed by the
+// operation the record describes
+func deletedSubscriptions(c appengine.Context, recordKey *datastore.Key) ([]*datastore.Key, []*subscriptionEntity, error) {
+	var subscriptions []*subscriptionEntity
+	q := datastore.NewQuery("DeletedSubscription").Ancestor(recordKey)
+	deletedKeys, err := q.GetAll(c, &subscriptions)
+	if err != nil && !IsFieldMismatch(err) {
+		return nil, nil, err
+	}
+
+	for i, deletedKey := range deletedKeys {
+		subscriptions[i].ID = deletedKey.StringID()
+	}
+
+	return deletedKeys, subscriptions, nil
+}
+
+// deletedFolders returns the folders removed by the operation the
+// record describes, the removed folder (folderID) first
+func deletedFolders(c appengine.Context, recordKey *datastore.Key, folderID string) ([]Folder, error) {
+	var folders []Folder
+	q := datastore.NewQuery("DeletedFolder").Ancestor(recordKey)
+	deletedKeys, err := q.GetAll(c, &folders)
+	if err != nil && !IsFieldMismatch(err) {
+		return nil, err
+	}
+
+	for i, deletedKey := range deletedKeys {
+		folders[i].ID = FormatId("folder", deletedKey.IntID())
+		if folders[i].ID == folderID {
+			folders[0], folders[i] = folders[i], folders[0]
+		}
+	}
+
+	return folders, nil
+}
+
+// deletedFolderID returns the ID of the folder that a subscription
+// kept under the record was removed from
+func deletedFolderID(record UndoRecord, deletedKey *datastore.Key) string {
+	if deletedKey.Parent().Kind() == "DeletedFolder" {
+		return FormatId("folder", deletedKey.Parent().IntID())
+	}
+
+	return record.FolderID
+}
+
+// restoredSubscriptionKey returns the key of a subscription kept
+// under the record, in the folder it was removed from
+func restoredSubscriptionKey(c appengine.Context, record UndoRecord, deletedKey *datastore.Key) (*datastore.Key, error) {
+	ref := SubscriptionRef {
+		FolderRef: FolderRef {
+			UserID: record.UserID,
+			FolderID: deletedFolderID(record, deletedKey),
+		},
+		SubscriptionID: deletedKey.StringID(),
+	}
+
+	return ref.key(c)
+}
+
+// deleteUndoRecord removes the record, along with the folders and
+// subscriptions kept under it
+func deleteUndoRecord(c appengine.Context, recordKey *datastore.Key) error {
+	q := datastore.NewQuery("").Ancestor(recordKey).KeysOnly()
+	keys, err := q.GetAll(c, nil)
+	if err != nil {
+		return err
+	}
+
+	// Includes the record itself
+	return datastore.DeleteMulti(c, keys)
+}
+
+// revertReadRange marks unread the articles that the read range
+// marked read, and drops the range if it's still pending
+func revertReadRange(c appengine.Context, lease Lease, subscriptionKey *datastore.Key, marked time.Time) error {
+	writer := newArticleWriter(c, lease, userKeyOf(subscriptionKey))
+	folderID := newSubscriptionRef(subscriptionKey).FolderID
+
+	q := datastore.NewQuery("Article").Ancestor(subscriptionKey).Filter("Properties =", "read")
+	for t := q.Run(c); ; {
+		entity := new(articleEntity)
+		articleKey, err := t.Next(entity)
+
+		if err == datastore.Done {
+			break
+		} else if IsFieldMismatch(err) {
+			// Ignore - migration issue
+		} else if err != nil {
+			c.Errorf("Error reading Article: %s", err)
+			return err
+		}
+
+		if !entity.MarkedRead.Equal(marked) {
+			continue
+		}
+
+		writer.Deltas.Remove(folderID, entity.Article)
+		entity.SetProperty("read", false)
+		entity.MarkedRead = time.Time{}
+		writer.Deltas.Add(folderID, entity.Article)
+
+		if err := writer.Enqueue(articleKey, entity); err != nil {
+			c.Errorf("Error writing articles: %s", err)
+			return err
+		}
+	}
+
+	if err := writer.Flush(); err != nil {
+		c.Errorf("Error writing articles: %s", err)
+		return err
+	}
+
+	return datastore.RunInTransaction(c, func(c appengine.Context) error {
+		if err := checkLease(c, lease); err != nil {
+			return err
+		}
+
+		subscription := subscriptionEntity{}
+		if err := datastore.Get(c, subscriptionKey, &subscription); err != nil && !IsFieldMismatch(err) {
+			return err
+		}
+
+		if subscription.ReadRange.Marked.Equal(marked) {
+			subscription.ReadRange = ReadRange{}
+		}
+
+		if count, err := unreadCount(c, subscriptionKey, subscription.ReadRange); err != nil {
+			return err
+		} else {
+			subscription.UnreadCount = count
+		}
+
+		_, err := datastore.Put(c, subscriptionKey, &subscription)
+		return err
+	}, &datastore.TransactionOptions { XG: true })
+}
+
+// UndoRecords returns the records of the user, newest first
+func (ds *Datastore)UndoRecords(userID UserID) ([]UndoRecord, error) {
+	c := ds.c
+	userKey, err := userID.key(c)
+	if err != nil {
+		return nil, err
+	}
+
+	var records []UndoRecord
+	q := datastore.NewQuery("UndoRecord").Ancestor(userKey).Order("-Created")
+	recordKeys, err := q.GetAll(c, &records)
+	if err != nil && !IsFieldMismatch(err) {
+		return nil, err
+	}
+
+	for i, recordKey := range recordKeys {
+		if err := loadUndoRecord(c, recordKey, &records[i]); err != nil {
+			return nil, err
+		}
+	}
+
+	return records, nil
+}
+
+// Undo reverses the operation described by the record, and removes
+// the record. Subscriptions that were since added again are left
+// as they are
+func (ds *Datastore)Undo(record UndoRecord) error {
+	c := ds.c
+	recordKey, err := record.key(c)
+	if err != nil {
+		return err
+	}
+
+	folderRef := FolderRef {
+		UserID: record.UserID,
+		FolderID: record.FolderID,
+	}
+
+	switch record.Action {
+	case UndoUnsubscribe, UndoRemoveFolder:
+		if record.Action == UndoRemoveFolder {
+			if err := ds.restoreFolders(record, recordKey); err != nil {
+				c.Errorf("Error restoring folders: %s", err)
+				return err
+			}
+		}
+
+		deletedKeys, subscriptions, err := deletedSubscriptions(c, recordKey)
+		if err != nil {
+			return err
+		}
+
+		deltas := ArticleCountDeltas{}
+		for i, deletedKey := range deletedKeys {
+			subscriptionKey, err := restoredSubscriptionKey(c, record, deletedKey)
+			if err != nil {
+				return err
+			}
+
+			if err := datastore.Get(c, subscriptionKey, &subscriptionEntity{}); err == nil || IsFieldMismatch(err) {
+				continue // Subscribed again
+			} else if err != datastore.ErrNoSuchEntity {
+				return err
+			}
+
+			if _, err := datastore.Put(c, subscriptionKey, subscriptions[i]); err != nil {
+				c.Errorf("Error restoring subscription: %s", err)
+				return err
+			}
+
+			// DeleteFolder leaves subscriber counts as they were
+			if record.Action == UndoUnsubscribe && subscriptions[i].Feed != nil {
+				if err := updateSubscriberCount(c, subscriptions[i].Feed.StringID(), 1); err != nil {
+					c.Warningf("Error incrementing subscriber count: %s", err)
+				}
+			}
+
+			// Back on the counters
+			if err := countArticles(c, subscriptionKey, deltas.Add); err != nil {
+				c.Errorf("Error counting articles: %s", err)
+				return err
+			}
+		}
+
+		if userKey, err := record.UserID.key(c); err != nil {
+			return err
+		} else if err := updateArticleCounts(c, userKey, deltas); err != nil {
+			c.Warningf("Error updating article counts: %s", err)
+		}
+	case UndoRemoveTag:
+		if err := createMissingTags(c, record.UserID, []string { record.Tag }); err != nil {
+			return err
+		}
+	case UndoMarkAsRead:
+		scope := ArticleScope {
+			FolderRef: folderRef,
+			SubscriptionID: record.SubscriptionID,
+		}
+
+		scopeKey, err := scope.key(c)
+		if err != nil {
+			return err
+		}
+
+		err = withLease(c, userLeaseResource(record.UserID), func(lease Lease) error {
+			subscriptionKeys, _, err := subscriptionsWithin(c, scopeKey)
+			if err != nil {
+				return err
+			}
+
+			for _, subscriptionKey := range subscriptionKeys {
+				if err := revertReadRange(c, lease, subscriptionKey, record.Marked); err != nil {
+					c.Errorf("Error reverting read range: %s", err)
+					return err
+				}
+			}
+
+			return nil
+		})
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return deleteUndoRecord(c, recordKey)
+}
+
+// restoreFolders puts back the folders removed with the record. The
+// removed folder goes to the top level if its parent is gone too
+func (ds *Datastore)restoreFolders(record UndoRecord, recordKey *datastore.Key) error {
+	c := ds.c
+	folders, err := deletedFolders(c, recordKey, record.FolderID)
+	if err != nil {
+		return err
+	}
+
+	if len(folders) == 0 {
+		// Recorded before folders were kept
+		folders = []Folder { { ID: record.FolderID, Title: record.Title } }
+	} else if folders[0].Parent != "" {
+		parentRef := FolderRef {
+			UserID: record.UserID,
+			FolderID: folders[0].Parent,
+		}
+		if exists, err := ds.FolderExists(parentRef); err != nil {
+			return err
+		} else if !exists {
+			folders[0].Parent = ""
+		}
+	}
+
+	folderKeys := make([]*datastore.Key, len(folders))
+	for i, folder := range folders {
+		ref := FolderRef {
+			UserID: record.UserID,
+			FolderID: folder.ID,
+		}
+		if folderKeys[i], err = ref.key(c); err != nil {
+			return err
+		}
+	}
+
+	_, err = datastore.PutMulti(c, folderKeys, folders)
+	return err
+}
+
+// DiscardUndoRecord deletes whatever the operation described by the
+// record left behind, and removes the record
+func (ds *Datastore)DiscardUndoRecord(record UndoRecord) error {
+	c := ds.c
+	recordKey, err := record.key(c)
+	if err != nil {
+		return err
+	}
+
+	switch record.Action {
+	case UndoUnsubscribe, UndoRemoveFolder:
+		deletedKeys, _, err := deletedSubscriptions(c, recordKey)
+		if err != nil {
+			return err
+		}
+
+		for _, deletedKey := range deletedKeys {
+			subscriptionKey, err := restoredSubscriptionKey(c, record, deletedKey)
+			if err != nil {
+				return err
+			}
+
+			if err := datastore.Get(c, subscriptionKey, &subscriptionEntity{}); err == nil || IsFieldMismatch(err) {
+				continue // Subscribed again; the articles are in use
+			} else if err != datastore.ErrNoSuchEntity {
+				return err
+			}
+
+			if err := deleteArticles(c, record.UserID, subscriptionKey); err != nil {
+				c.Errorf("Error deleting articles: %s", err)
+				return err
+			}
+		}
+	case UndoRemoveTag:
+		if exists, err := ds.TagExists(record.UserID, record.Tag); err != nil {
+			return err
+		} else if !exists {
+			if err := ds.RemoveTag(record.UserID, record.Tag); err != nil {
+				c.Errorf("Error removing tag: %s", err)
+				return err
+			}
+		}
+	}
+
+	return deleteUndoRecord(c, recordKey)
+}
+
+// UndoRecordsCreatedBefore iterates over the records of all users
+// created before the specified time, resuming from cursor, if
+// specified
+func (ds *Datastore)UndoRecordsCreatedBefore(before time.Time, cursor string) (UndoRecordIterator, error) {
+	c := ds.c
+	q := datastore.NewQuery("UndoRecord").Filter("Created <", before)
+	if cursor != "" {
+		if decoded, err := datastore.DecodeCursor(cursor); err != nil {
+			return nil, err
+		} else {
+			q = q.Start(decoded)
+		}
+	}
+
+	return &undoRecordIterator {
+		c: c,
+		t: q.Run(c),
+	}, nil
+}
@@ -1,3 +1,5 @@
+// +build appengine
+
 /*****************************************************************************
  **
  ** Gofr
@@ -26,46 +28,54 @@ package storage
 import (
 	"appengine"
 	"appengine/datastore"
-	"errors"
-	"strconv"
-	"strings"
 	"time"
 )
 
-func formatId(kind string, intId int64) string {
-	return kind + "://" + strconv.FormatInt(intId, 36)
-}
+func newFolderRef(userID UserID, key *datastore.Key) (FolderRef) {
+	ref := FolderRef {
+		UserID: userID,
+	}
 
-func unformatId(formattedId string) (string, int64, error) {
-	if parts := strings.SplitN(formattedId, "://", 2); len(parts) == 2 {
-		if id, err := strconv.ParseInt(parts[1], 36, 64); err == nil {
-			return parts[0], id, nil
-		} else {
-			return parts[0], 0, nil
-		}
+	if key != nil {
+		ref.FolderID = FormatId("folder", key.IntID())
 	}
 
-	return "", 0, errors.New("Missing valid identifier")
+	return ref
 }
 
-func newFolderRef(userID UserID, key *datastore.Key) (FolderRef) {
-	ref := FolderRef {
-		UserID: userID,
+func newSubscriptionRef(key *datastore.Key) SubscriptionRef {
+	parentKey := key.Parent()
+	ref := SubscriptionRef {
+		SubscriptionID: key.StringID(),
 	}
 
-	if key != nil {
-		ref.FolderID = formatId("folder", key.IntID())
+	if parentKey.Kind() == "Folder" {
+		ref.FolderRef = newFolderRef(UserID(parentKey.Parent().StringID()), parentKey)
+	} else {
+		ref.FolderRef = newFolderRef(UserID(parentKey.StringID()), nil)
 	}
 
 	return ref
 }
 
-func updateSubscriptionByKey(c appengine.Context, subscriptionKey *datastore.Key, subscription Subscription) (int, error) {
+// updateSubscriptionByKey writes the articles of new entries. The
+// lease, on the subscription's owner, must be held until it returns
+func updateSubscriptionByKey(c appengine.Context, lease Lease, subscriptionKey *datastore.Key, subscription subscriptionEntity) (int, error) {
 	feedKey := subscription.Feed
 	largestUpdateIndexWritten := int64(-1)
 	unreadDelta := 0
 
-	batchWriter := NewBatchWriter(c, BatchPut)
+	// Articles are written along with their share of the article
+	// counts, provided the lease is still held
+	writer := newArticleWriter(c, lease, userKeyOf(subscriptionKey))
+	articleKeys := make([]*datastore.Key, 0)
+	articles := make([]articleEntity, 0)
+	deleted := 0
+
+	// Rules are only loaded once there's a new article to run them on
+	var rules *FilterRuleSet
+
+	folderID := newSubscriptionRef(subscriptionKey).FolderID
 
 	q := datastore.NewQuery("EntryMeta").Ancestor(feedKey).Filter("UpdateIndex >", subscription.MaxUpdateIndex)
 	for t := q.Run(c); ; {
@@ -78,17 +88,19 @@ func updateSubscriptionByKey(c appengine.Context, subscriptionKey *datastore.Key
 			// Ignore
 		} else if err != nil {
 			c.Errorf("Error reading Entry: %s", err)
-			return batchWriter.Written(), err
+			return writer.Written(), err
 		}
 
 		articleKey := datastore.NewKey(c, "Article", entryMeta.Entry.StringID(), 0, subscriptionKey)
-		article := Article{}
+		article := articleEntity{}
 
+		isNew := false
 		if err := datastore.Get(c, articleKey, &article); err == datastore.ErrNoSuchEntity {
 			// New article
 			article.Entry = entryMeta.Entry
 			article.Properties = []string { "unread" }
-			unreadDelta++
+			article.Tags = append([]string(nil), subscription.Tags...)
+			isNew = true
 		} else if IsFieldMismatch(err) {
 			// Ignore - migration
 		} else if err != nil {
@@ -96,6 +108,15 @@ func updateSubscriptionByKey(c appengine.Context, subscriptionKey *datastore.Key
 			continue
 		}
 
+		if !isNew {
+			// Refetching moves the article past the read range
+			previous := article.Article
+			if subscription.ReadRange.Apply(&article.Article) {
+				writer.Deltas.Remove(folderID, previous)
+				writer.Deltas.Add(folderID, article.Article)
+			}
+		}
+
 		article.UpdateIndex = entryMeta.UpdateIndex
 		article.Fetched = entryMeta.Fetched
 		article.Published = entryMeta.Published
@@ -104,33 +125,84 @@ func updateSubscriptionByKey(c appengine.Context, subscriptionKey *datastore.Key
 			largestUpdateIndexWritten = entryMeta.UpdateIndex
 		}
 
-		if err := batchWriter.Enqueue(articleKey, &article); err != nil {
-			c.Errorf("Error queueing article for batch write: %s", err)
-			return batchWriter.Written(), err
+		if isNew {
+			if rules == nil {
+				var err error
+				if rules, err = subscriptionFilterRules(c, subscriptionKey); err != nil {
+					c.Errorf("Error reading filter rules: %s", err)
+					return writer.Written(), err
+				}
+			}
+
+			if !rules.IsEmpty() {
+				if kept, err := applyFilterRules(c, rules, &article); err != nil {
+					c.Errorf("Error running filter rules: %s", err)
+					return writer.Written(), err
+				} else if !kept {
+					deleted++
+					continue
+				}
+			}
+
+			if article.IsUnread() {
+				unreadDelta++
+			}
+			writer.Deltas.Add(folderID, article.Article)
 		}
+
+		if err := writer.Enqueue(articleKey, &article); err != nil {
+			c.Errorf("Error writing articles: %s", err)
+			return writer.Written(), err
+		}
+
+		articleKeys = append(articleKeys, articleKey)
+		articles = append(articles, article)
 	}
 
-	if err := batchWriter.Flush(); err != nil {
-		c.Errorf("Error flushing batch queue: %s", err)
-		return batchWriter.Written(), err
+	if err := writer.Flush(); err != nil {
+		c.Errorf("Error writing articles: %s", err)
+		return writer.Written(), err
 	}
 
-	if batchWriter.Written() > 0 {
+	// Search is secondary; articles are readable either way
+	if err := indexArticles(c, subscriptionKey, articleKeys, articles); err != nil {
+		c.Warningf("Error indexing articles of %s: %s", subscriptionKey.StringID(), err)
+	}
+
+	if writer.Written() > 0 || deleted > 0 {
 		if appengine.IsDevAppServer() {
-			c.Debugf("Completed %s: %d records", subscriptionKey.StringID(), batchWriter.Written())
+			c.Debugf("Completed %s: %d records", subscriptionKey.StringID(), writer.Written())
 		}
 
-		// Write the subscription
-		subscription.Updated = time.Now()
-		subscription.MaxUpdateIndex = largestUpdateIndexWritten
+		// Write the subscription, as it is now - articles may have
+		// been marked read since it was loaded
+		err := datastore.RunInTransaction(c, func(c appengine.Context) error {
+			if err := checkLease(c, lease); err != nil {
+				return err
+			}
 
-		if subscription.UnreadCount + unreadDelta >= 0 {
-			subscription.UnreadCount += unreadDelta
-		}
+			current := subscriptionEntity{}
+			if err := datastore.Get(c, subscriptionKey, &current); err == datastore.ErrNoSuchEntity {
+				// Unsubscribed in the meantime
+				return nil
+			} else if err != nil && !IsFieldMismatch(err) {
+				return err
+			}
+
+			current.Updated = time.Now()
+			current.MaxUpdateIndex = largestUpdateIndexWritten
 
-		if _, err := datastore.Put(c, subscriptionKey, &subscription); err != nil {
+			if current.UnreadCount + unreadDelta >= 0 {
+				current.UnreadCount += unreadDelta
+			}
+
+			_, err := datastore.Put(c, subscriptionKey, &current)
+			return err
+		}, &datastore.TransactionOptions { XG: true })
+
+		if err != nil {
 			c.Errorf("Error writing subscription: %s", err)
-			return batchWriter.Written(), err
+			return writer.Written(), err
 		}
 
 		// Update usage index (rough way to track feed popularity)
@@ -154,11 +226,59 @@ func updateSubscriptionByKey(c appengine.Context, subscriptionKey *datastore.Key
 		}
 	}
 
-	return batchWriter.Written(), nil
+	return writer.Written(), nil
+}
+
+// subscriptionFilterRules returns the rules of the subscription's
+// owner that cover the subscription
+func subscriptionFilterRules(c appengine.Context, subscriptionKey *datastore.Key) (*FilterRuleSet, error) {
+	userKey := subscriptionKey
+	for userKey.Parent() != nil {
+		userKey = userKey.Parent()
+	}
+
+	rules, err := filterRules(c, userKey)
+	if err != nil {
+		return nil, err
+	} else if len(rules) == 0 {
+		return NewFilterRuleSet(nil, nil), nil
+	}
+
+	// Rules on a folder cover its subfolders
+	folders, err := userFolders(c, userKey)
+	if err != nil {
+		return nil, err
+	}
+
+	folderID := ""
+	if parentKey := subscriptionKey.Parent(); parentKey.Kind() == "Folder" {
+		folderID = FormatId("folder", parentKey.IntID())
+	}
+
+	return NewFilterRuleSet(rules, folders).For(folderID, subscriptionKey.StringID()), nil
+}
+
+// applyFilterRules runs the rules against a new article, returning
+// false if one of them deleted it
+func applyFilterRules(c appengine.Context, rules *FilterRuleSet, article *articleEntity) (bool, error) {
+	entry := Entry{}
+	if err := datastore.Get(c, article.Entry, &entry); err != nil && !IsFieldMismatch(err) {
+		return false, err
+	}
+
+	var media []*EntryMedia
+	if entry.HasMedia && rules.NeedsMedia() {
+		var err error
+		if media, err = mediaForEntry(c, article.Entry); err != nil {
+			return false, err
+		}
+	}
+
+	return rules.Apply(&article.Article, &entry, media), nil
 }
 
-func updateSubscriptionAsync(c appengine.Context, subscriptionKey *datastore.Key, subscription Subscription, ch chan<- Subscription) {
-	if _, err := updateSubscriptionByKey(c, subscriptionKey, subscription); err != nil {
+func updateSubscriptionAsync(c appengine.Context, lease Lease, subscriptionKey *datastore.Key, subscription subscriptionEntity, ch chan<- subscriptionEntity) {
+	if _, err := updateSubscriptionByKey(c, lease, subscriptionKey, subscription); err != nil {
 		c.Errorf("Error updating subscription %s: %s", subscription.Title, err)
 	}
 
@@ -0,0 +1,99 @@
+// +build appengine
+
+/*****************************************************************************
+ **
+ ** Gofr
+ ** https://github.com/pokebyte/Gofr
+ ** Copyright (C) 2013-2017 Akop Karapetyan
+ **
+ ** This program is free software; you can redistribute it and/or modify
+ ** it under the terms of the GNU General Public License as published by
+ ** the Free Software Foundation; either version 2 of the License, or
+ ** (at your option) any later version.
+ **
+ ** This program is distributed in the hope that it will be useful,
+ ** but WITHOUT ANY WARRANTY; without even the implied warranty of
+ ** MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ ** GNU General Public License for more details.
+ **
+ ** You should have received a copy of the GNU General Public License
+ ** along with this program; if not, write to the Free Software
+ ** Foundation, Inc., 675 Mass Ave, Cambridge, MA 02139, USA.
+ **
+ ******************************************************************************
+ */
+ 
+package storage
+
+import (
+	"appengine"
+	"appengine/datastore"
+	"time"
+)
+
+func (hubSub HubSubscription)key(c appengine.Context) *datastore.Key {
+	return datastore.NewKey(c, "HubSubscription", hubSub.FeedURL, 0, nil)
+}
+
+func (hubSub HubSubscription)entity(c appengine.Context) *hubSubscriptionEntity {
+	return &hubSubscriptionEntity {
+		HubSubscription: hubSub,
+		Feed: datastore.NewKey(c, "Feed", hubSub.FeedURL, 0, nil),
+	}
+}
+
+func (ds *Datastore)HubSubscriptionByURL(feedURL string) (*HubSubscription, error) {
+	c := ds.c
+	entity := NewHubSubscription(feedURL).entity(c)
+	if err := datastore.Get(c, entity.key(c), entity); err == nil || IsFieldMismatch(err) {
+		hubSub := entity.hubSubscription()
+		return &hubSub, nil
+	} else if err != datastore.ErrNoSuchEntity {
+		return nil, err
+	}
+
+	return nil, nil
+}
+
+func (ds *Datastore)SaveHubSubscription(hubSub HubSubscription) error {
+	c := ds.c
+	if _, err := datastore.Put(c, hubSub.key(c), hubSub.entity(c)); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (ds *Datastore)DeleteHubSubscription(hubSub HubSubscription) error {
+	c := ds.c
+	if err := datastore.Delete(c, hubSub.key(c)); err != nil && err != datastore.ErrNoSuchEntity {
+		return err
+	}
+
+	return nil
+}
+
+// HubSubscriptionsExpiringBefore returns subscriptions whose lease
+// (or pending request) expires before the specified time
+func (ds *Datastore)HubSubscriptionsExpiringBefore(before time.Time) ([]HubSubscription, error) {
+	c := ds.c
+	var entities []hubSubscriptionEntity
+
+	q := datastore.NewQuery("HubSubscription").Filter("LeaseExpires <", before).Limit(defaultBatchSize)
+	if _, err := q.GetAll(c, &entities); err != nil && !IsFieldMismatch(err) {
+		return nil, err
+	}
+
+	hubSubs := make([]HubSubscription, len(entities))
+	for i, _ := range entities {
+		hubSubs[i] = entities[i].hubSubscription()
+	}
+
+	return hubSubs, nil
+}
+
+// SubscriberCount returns the number of users subscribed to a feed
+func (ds *Datastore)SubscriberCount(feedURL string) (int, error) {
+	c := ds.c
+	return consolidatedSubscriberCount(c, datastore.NewKey(c, "Feed", feedURL, 0, nil))
+}
@@ -24,27 +24,31 @@
 package gofr
 
 import (
-	"appengine"
-	"appengine/blobstore"
-	"appengine/taskqueue"
 	"errors"
 	"net/url"
 	"rss"
 	"storage"
+	"strings"
 	"time"
 )
 
 type taskParams map[string]string
 
+const (
+	// Minimum interval between import progress updates
+	importProgressInterval = time.Second
+
+	importWorkers = 10
+	importWorkersPerHost = 2
+)
+
 func registerTasks() {
 	RegisterTaskRoute("/tasks/subscribe",     subscribeTask)
 	RegisterTaskRoute("/tasks/import",        importOPMLTask)
-	RegisterTaskRoute("/tasks/unsubscribe",   unsubscribeTask)
+	RegisterTaskRoute("/tasks/retryImport",   retryImportTask)
 	RegisterTaskRoute("/tasks/markAllAsRead", markAllAsReadTask)
 	RegisterTaskRoute("/tasks/moveSubscription", moveSubscriptionTask)
 	RegisterTaskRoute("/tasks/syncFeeds",     syncFeedsTask)
-	RegisterTaskRoute("/tasks/removeFolder",  removeFolderTask)
-	RegisterTaskRoute("/tasks/removeTag",     removeTagTask)
 }
 
 func startTask(pfc *PFContext, taskName string, params taskParams, queueName string) error {
@@ -57,147 +61,470 @@ func startTask(pfc *PFContext, taskName string, params taskParams, queueName str
 		taskValues.Add(k, v)
 	}
 
-	task := taskqueue.NewPOSTTask("/tasks/" + taskName, taskValues)
-	if _, err := taskqueue.Add(pfc.C, task, queueName); err != nil {
-		return err
-	}
-
-	return nil
+	return pfc.Platform.AddTask("/tasks/" + taskName, taskValues, queueName)
 }
 
-func importSubscription(pfc *PFContext, ch chan<- *rss.Outline, userID storage.UserID, folderRef storage.FolderRef, outline *rss.Outline) {
+func importSubscription(pfc *PFContext, ch chan<- *storage.ImportResult, userID storage.UserID, folderRef storage.FolderRef, result *storage.ImportResult) {
 	c := pfc.C
-	subscriptionURL := outline.FeedURL
+	subscriptionURL := result.FeedURL
 
-	if subscribed, err := storage.IsSubscriptionDuplicate(pfc.C, userID, subscriptionURL); err != nil {
+	if subscribed, err := pfc.Storage.IsSubscriptionDuplicate(userID, subscriptionURL); err != nil {
 		c.Errorf("Cannot determine if '%s' is duplicate: %s", subscriptionURL, err)
+		result.Outcome, result.Message = storage.ImportError, err.Error()
 		goto done
 	} else if subscribed {
 		c.Infof("Already subscribed to %s", subscriptionURL)
+		result.Outcome = storage.ImportDuplicate
 		goto done // Already subscribed
 	}
 
-	if feed, err := storage.FeedByURL(pfc.C, subscriptionURL); err != nil {
+	if feed, err := pfc.Storage.FeedByURL(subscriptionURL); err != nil {
 		c.Errorf("Error locating feed %s: %s", subscriptionURL, err.Error())
+		result.Outcome, result.Message = storage.ImportError, err.Error()
 		goto done
 	} else if feed == nil {
 		// Feed not available locally - fetch it
-		client := createHttpClient(pfc.C)
+		client := createHttpClient(pfc)
+		tracker := redirectTracker{}
+		client.CheckRedirect = tracker.checkRedirect
+
 		if response, err := client.Get(subscriptionURL); err != nil {
 			c.Errorf("Error downloading feed %s: %s", subscriptionURL, err)
+			result.Outcome, result.Message = storage.ImportDownloadError, err.Error()
 			goto done
 		} else {
 			defer response.Body.Close()
+
+			if response.StatusCode < 200 || response.StatusCode > 299 {
+				c.Errorf("Error downloading feed %s: HTTP %d", subscriptionURL, response.StatusCode)
+				result.Outcome, result.Message = storage.ImportDownloadError, response.Status
+				goto done
+			}
+
+			if tracker.PermanentURL != "" && tracker.PermanentURL != subscriptionURL {
+				// Feed has moved - subscribe to the new location
+				subscriptionURL = tracker.PermanentURL
+				result.RedirectedTo = subscriptionURL
+
+				if subscribed, err := pfc.Storage.IsSubscriptionDuplicate(userID, subscriptionURL); err != nil {
+					c.Errorf("Cannot determine if '%s' is duplicate: %s", subscriptionURL, err)
+					result.Outcome, result.Message = storage.ImportError, err.Error()
+					goto done
+				} else if subscribed {
+					result.Outcome = storage.ImportDuplicate
+					goto done
+				}
+			}
+
 			if parsedFeed, err := rss.UnmarshalStream(subscriptionURL, response.Body); err != nil {
 				c.Errorf("Error reading RSS content (%s): %s", subscriptionURL, err)
+				result.Outcome, result.Message = storage.ImportParseError, err.Error()
 				goto done
 			} else {
-				favIconURL := ""
+				var favIcon *storage.FavIcon
 				if parsedFeed.WWWURL != "" {
-					if url, err := locateFavIconURL(pfc.C, parsedFeed.WWWURL); err != nil {
+					if icon, err := locateFavIcon(pfc, parsedFeed.WWWURL); err != nil {
 						// Not critical
 						pfc.C.Warningf("FavIcon retrieval error: %s", err)
-					} else if url != "" {
-						favIconURL = url
+					} else {
+						favIcon = icon
 					}
 				}
 
-				if err := storage.UpdateFeed(pfc.C, parsedFeed, favIconURL, time.Now()); err != nil {
+				if err := pfc.Storage.UpdateFeed(parsedFeed, favIcon, time.Now(), fetchInfoFromResponse(response)); err == storage.ErrLeaseHeld {
+					// Being updated elsewhere, with the same entries
+					c.Infof("Feed %s already being updated", subscriptionURL)
+				} else if err != nil {
 					c.Errorf("Error updating feed: %s", err)
+					result.Outcome, result.Message = storage.ImportError, err.Error()
 					goto done
 				}
 			}
 		}
 	}
 
-	if subscriptionRef, err := storage.Subscribe(pfc.C, folderRef, subscriptionURL, outline.Title); err != nil {
+	if subscriptionRef, err := pfc.Storage.Subscribe(folderRef, subscriptionURL, result.Title); err != nil {
 		c.Errorf("Error subscribing to feed %s: %s", subscriptionURL, err)
+		result.Outcome, result.Message = storage.ImportError, err.Error()
 		goto done
 	} else {
-		if _, err := storage.UpdateSubscription(pfc.C, subscriptionURL, subscriptionRef); err != nil {
+		if len(result.Tags) > 0 {
+			if err := pfc.Storage.SetSubscriptionTags(subscriptionRef, result.Tags); err != nil {
+				c.Warningf("Error tagging subscription %s: %s", subscriptionURL, err)
+			}
+		}
+
+		if _, err := pfc.Storage.UpdateSubscription(subscriptionURL, subscriptionRef); err != nil {
 			c.Errorf("Error updating subscription %s: %s", subscriptionURL, err)
+			result.Outcome, result.Message = storage.ImportError, err.Error()
 			goto done
 		}
+
+		if err := subscribeToHub(pfc, subscriptionURL); err != nil {
+			c.Warningf("Error subscribing to hub for %s: %s", subscriptionURL, err)
+		}
+	}
+
+	if result.RedirectedTo != "" {
+		result.Outcome = storage.ImportRedirected
+	} else {
+		result.Outcome = storage.ImportSubscribed
 	}
+	result.Message = ""
 
 done:
-	ch<- outline
+	ch<- result
 }
 
-func importSubscriptions(pfc *PFContext, ch chan<- *rss.Outline, userID storage.UserID, parentRef storage.FolderRef, outlines []*rss.Outline) int {
-	c := pfc.C
+// pendingImports flattens the outlines into the list of
+// subscriptions to import, along with their folders and tags.
+// The path holds the titles of the enclosing folders, outermost
+// first
+func pendingImports(path []string, outlines []*rss.Outline) []*storage.ImportResult {
+	results := make([]*storage.ImportResult, 0, len(outlines))
+	parentTitle := ""
+	if len(path) > 0 {
+		parentTitle = path[len(path) - 1]
+	}
 
-	count := 0
 	for _, outline := range outlines {
 		if outline.IsSubscription() {
-			go importSubscription(pfc, ch, userID, parentRef, outline)
-			count++
+			result := &storage.ImportResult {
+				Title: outline.DisplayTitle(),
+				FeedURL: outline.FeedURL,
+				Folder: parentTitle,
+				Tags: outline.Categories(),
+				Outcome: storage.ImportPending,
+			}
+			if len(path) > 1 {
+				result.FolderPath = append([]string{}, path[:len(path) - 1]...)
+			}
+
+			if parentTitle == "" && len(result.Tags) > 0 {
+				// Not nested in a folder - use the first
+				// category as one
+				result.Folder = result.Tags[0]
+				result.Tags = result.Tags[1:]
+			} else if parentTitle != "" {
+				// Enclosing folder is usually one of the categories
+				result.Tags = withoutCategory(result.Tags, parentTitle)
+			}
+
+			results = append(results, result)
 		} else if outline.IsFolder() {
-			folderRef, err := storage.FolderByTitle(pfc.C, userID, outline.Title)
-			if err != nil {
+			nested := append(append([]string{}, path...), outline.DisplayTitle())
+			results = append(results, pendingImports(nested, outline.Outlines)...)
+		}
+	}
+
+	return results
+}
+
+// findOrCreateFolder locates a folder by its path (the titles of
+// the folders leading to it, outermost first), creating folders
+// as necessary. Folders created during the import are cached, by
+// path, since queries may not see them right away
+func findOrCreateFolder(pfc *PFContext, userID storage.UserID, path []string, folders map[string]storage.FolderRef) (storage.FolderRef, error) {
+	folderRef := storage.FolderRef {
+		UserID: userID,
+	}
+
+	for i, title := range path {
+		cacheKey := strings.Join(path[:i + 1], "\n")
+		if ref, ok := folders[cacheKey]; ok {
+			folderRef = ref
+			continue
+		}
+
+		ref, err := pfc.Storage.FolderByTitle(folderRef, title)
+		if err != nil {
+			return storage.FolderRef{}, err
+		} else if ref.IsZero() {
+			if ref, err = pfc.Storage.CreateFolder(folderRef, title); err != nil {
+				return storage.FolderRef{}, err
+			}
+		}
+
+		folders[cacheKey] = ref
+		folderRef = ref
+	}
+
+	return folderRef, nil
+}
+
+func withoutCategory(categories []string, category string) []string {
+	filtered := make([]string, 0, len(categories))
+	for _, item := range categories {
+		if item != category {
+			filtered = append(filtered, item)
+		}
+	}
+
+	return filtered
+}
+
+// collectImportResults waits for the outcome of each of the
+// subscriptions being imported, records it, and keeps the client
+// posted on the progress of the import
+func collectImportResults(pfc *PFContext, job *storage.ImportJob, ch <-chan *storage.ImportResult) {
+	c := pfc.C
+	lastReported := time.Now()
+
+	for result := range ch {
+		c.Infof("Completed %s: %s", result.Title, result.Outcome)
+
+		if err := pfc.Storage.SaveImportResult(*job, result); err != nil {
+			c.Warningf("Error saving import result for %s: %s", result.FeedURL, err)
+		}
+
+		job.Completed++
+		if result.IsFailure() {
+			job.Failed++
+		}
+
+		if time.Since(lastReported) >= importProgressInterval {
+			if err := pfc.Storage.SaveImportJob(*job); err != nil {
+				c.Warningf("Error saving import job: %s", err)
+			}
+
+			sendChannelMessage(pfc, TaskMessage {
+				Message: _l("Importing: %d of %d done", job.Completed, job.Total),
+				Progress: job,
+			})
+			lastReported = time.Now()
+		}
+	}
+}
+
+// runImport imports the pending subscriptions on a pool of workers.
+// If the request runs out of time, the remaining subscriptions are
+// imported by a continuation task, and false is returned
+func runImport(pfc *PFContext, job *storage.ImportJob, results []*storage.ImportResult) (bool, error) {
+	c := pfc.C
+	pool := newWorkPool(c, importWorkers, importWorkersPerHost, time.Now())
+	doneChannel := make(chan *storage.ImportResult, importWorkers)
+	collected := make(chan bool)
+	folders := map[string]storage.FolderRef{}
+	finished := true
+
+	go func() {
+		collectImportResults(pfc, job, doneChannel)
+		collected<- true
+	}()
+
+	for _, result := range results {
+		folderRef := storage.FolderRef {
+			UserID: pfc.UserID,
+		}
+		if result.Folder != "" {
+			path := append(append([]string{}, result.FolderPath...), result.Folder)
+			if ref, err := findOrCreateFolder(pfc, pfc.UserID, path, folders); err != nil {
 				c.Warningf("Error locating folder: %s", err)
-				continue
-			} else if folderRef.IsZero() {
-				if folderRef, err = storage.CreateFolder(pfc.C, userID, outline.Title); err != nil {
-					c.Warningf("Error locating folder: %s", err)
-					continue
-				}
+			} else {
+				folderRef = ref
 			}
+		}
+
+		result := result
+		if !pool.Submit(hostOf(result.FeedURL), func() { importSubscription(pfc, doneChannel, pfc.UserID, folderRef, result) }) {
+			finished = false
+			break
+		}
+	}
 
-			count += importSubscriptions(pfc, ch, userID, folderRef, outline.Outlines)
+	if !pool.Wait() {
+		// Queued, but out of time before they could start
+		finished = false
+	}
+	close(doneChannel)
+	<-collected
+
+	if !finished {
+		// Out of time - import the rest in a separate task
+		params := taskParams {
+			"jobID": job.ID,
+			"pending": "true",
+		}
+		if err := startTask(pfc, "retryImport", params, importQueue); err != nil {
+			return false, err
 		}
+	} else {
+		job.Done = true
+		job.Finished = time.Now()
+	}
+
+	if err := pfc.Storage.SaveImportJob(*job); err != nil {
+		c.Warningf("Error saving import job: %s", err)
 	}
 
-	return count
+	return finished, nil
+}
+
+func importCompletedMessage(job *storage.ImportJob, finished bool) TaskMessage {
+	if !finished {
+		return TaskMessage {
+			Message: _l("Importing: %d of %d done", job.Completed, job.Total),
+			Progress: job,
+		}
+	}
+
+	message := _l("Subscriptions imported successfully")
+	if job.Failed > 0 {
+		message = _l("Import complete; %d of %d subscriptions could not be imported", job.Failed, job.Total)
+	}
+
+	return TaskMessage {
+		Message: message,
+		Refresh: true,
+		Progress: job,
+	}
 }
 
 func importOPMLTask(pfc *PFContext) (TaskMessage, error) {
 	c := pfc.C
 
-	var blobKey appengine.BlobKey
-	if blobKeyString := pfc.R.PostFormValue("opmlBlobKey"); blobKeyString == "" {
-		return TaskMessage{}, errors.New("Missing blob key")
+	uploadKey := pfc.R.PostFormValue("opmlBlobKey")
+	if uploadKey == "" {
+		return TaskMessage{}, errors.New("Missing upload key")
+	}
+
+	var job *storage.ImportJob
+	if jobID := pfc.R.PostFormValue("jobID"); jobID == "" {
+		return TaskMessage{}, errors.New("Missing import job ID")
+	} else if j, err := pfc.Storage.ImportJobByID(pfc.UserID, jobID); err != nil {
+		return TaskMessage{}, err
+	} else if j == nil {
+		return TaskMessage{}, errors.New("Import job not found: " + jobID)
 	} else {
-		blobKey = appengine.BlobKey(blobKeyString)
+		job = j
+	}
+
+	parseMode := rss.ParseLenient
+	if pfc.R.PostFormValue("strict") == "true" {
+		parseMode = rss.ParseStrict
+	}
+
+	reader, err := pfc.Platform.OpenUpload(uploadKey)
+	if err != nil {
+		return TaskMessage{}, err
 	}
 
-	reader := blobstore.NewReader(c, blobKey)
+	opml, skipped, err := rss.ParseOPMLWithMode(reader, parseMode)
+	reader.Close()
 
-	opml, err := rss.ParseOPML(reader)
 	if err != nil {
-		// Remove the blob
-		if err := blobstore.Delete(c, blobKey); err != nil {
-			c.Warningf("Error deleting blob (key %s): %s", blobKey, err)
+		// Remove the upload
+		if err := pfc.Platform.DeleteUpload(uploadKey); err != nil {
+			c.Warningf("Error deleting upload (key %s): %s", uploadKey, err)
+		}
+
+		job.Done = true
+		job.Finished = time.Now()
+		if err := pfc.Storage.SaveImportJob(*job); err != nil {
+			c.Warningf("Error saving import job: %s", err)
 		}
 
 		return TaskMessage{}, err
 	}
 	
-	// Remove the blob
-	if err := blobstore.Delete(c, blobKey); err != nil {
-		c.Warningf("Error deleting blob (key %s): %s", blobKey, err)
+	// Remove the upload
+	if err := pfc.Platform.DeleteUpload(uploadKey); err != nil {
+		c.Warningf("Error deleting upload (key %s): %s", uploadKey, err)
 	}
 
 	importStarted := time.Now()
 
-	parentRef := storage.FolderRef {
-		UserID: pfc.UserID,
+	results := pendingImports(nil, opml.Outlines())
+	job.Total = len(results)
+
+	// Record everything up front, so that the import can be
+	// resumed if it runs out of time
+	for _, outline := range skipped {
+		results = append(results, &storage.ImportResult {
+			Title: outline.Title,
+			FeedURL: outline.FeedURL,
+			Outcome: storage.ImportSkipped,
+			Message: outline.Reason,
+		})
 	}
 
-	doneChannel := make(chan *rss.Outline)
-	importing := importSubscriptions(pfc, doneChannel, pfc.UserID, parentRef, opml.Outlines())
+	if err := pfc.Storage.SaveImportResults(*job, results); err != nil {
+		return TaskMessage{}, err
+	}
 
-	for i := 0; i < importing; i++ {
-		subscription := <-doneChannel;
-		c.Infof("Completed %s", subscription.Title)
+	finished, err := runImport(pfc, job, results[:job.Total])
+	if err != nil {
+		return TaskMessage{}, err
 	}
 
-	c.Infof("All completed in %s", time.Since(importStarted))
+	c.Infof("Import ran for %s", time.Since(importStarted))
 
-	return TaskMessage{
-		Message: _l("Subscriptions imported successfully"),
-		Refresh: true,
+	return importCompletedMessage(job, finished), nil
+}
+
+// retryImportTask re-imports the subscriptions that failed to
+// import, or a single one, if a result ID is specified. Also
+// resumes imports that ran out of time
+func retryImportTask(pfc *PFContext) (TaskMessage, error) {
+	c := pfc.C
+	resultID := pfc.R.PostFormValue("resultID")
+	resuming := pfc.R.PostFormValue("pending") == "true"
+
+	var job *storage.ImportJob
+	if jobID := pfc.R.PostFormValue("jobID"); jobID == "" {
+		return TaskMessage{}, errors.New("Missing import job ID")
+	} else if j, err := pfc.Storage.ImportJobByID(pfc.UserID, jobID); err != nil {
+		return TaskMessage{}, err
+	} else if j == nil {
+		return TaskMessage{}, errors.New("Import job not found: " + jobID)
+	} else {
+		job = j
+	}
+
+	results, err := pfc.Storage.ImportResults(*job)
+	if err != nil {
+		return TaskMessage{}, err
+	}
+
+	importStarted := time.Now()
+	importing := make([]*storage.ImportResult, 0, len(results))
+
+	for i := range results {
+		result := &results[i]
+		if resuming {
+			if result.Outcome != storage.ImportPending {
+				continue
+			}
+		} else if !result.IsFailure() || (resultID != "" && result.ID != resultID) {
+			continue
+		} else {
+			// Re-counted as they complete
+			job.Completed--
+			job.Failed--
+		}
+
+		importing = append(importing, result)
+	}
+
+	if len(importing) < 1 {
+		return TaskMessage {
+			Message: _l("Nothing to retry"),
 		}, nil
+	}
+
+	job.Done = false
+	if err := pfc.Storage.SaveImportJob(*job); err != nil {
+		c.Warningf("Error saving import job: %s", err)
+	}
+
+	finished, err := runImport(pfc, job, importing)
+	if err != nil {
+		return TaskMessage{}, err
+	}
+
+	c.Infof("Imported %d subscriptions in %s", len(importing), time.Since(importStarted))
+
+	return importCompletedMessage(job, finished), nil
 }
 
 func subscribeTask(pfc *PFContext) (TaskMessage, error) {
@@ -216,18 +543,18 @@ func subscribeTask(pfc *PFContext) (TaskMessage, error) {
 		SubscriptionID: subscriptionURL,
 	}
 
-	if exists, err := storage.SubscriptionExists(pfc.C, subscriptionRef); err != nil {
+	if exists, err := pfc.Storage.SubscriptionExists(subscriptionRef); err != nil {
 		return TaskMessage{}, err
 	} else if !exists {
 		pfc.C.Warningf("No longer subscribed to %s", subscriptionURL, err)
 		return TaskMessage{}, nil
 	}
 
-	if feed, err := storage.FeedByURL(pfc.C, subscriptionURL); err != nil {
+	if feed, err := pfc.Storage.FeedByURL(subscriptionURL); err != nil {
 		return TaskMessage{}, err
 	} else if feed == nil {
 		// Feed not available locally - fetch it
-		client := createHttpClient(pfc.C)
+		client := createHttpClient(pfc)
 		if response, err := client.Get(subscriptionURL); err != nil {
 			pfc.C.Errorf("Error downloading feed (%s): %s", subscriptionURL, err)
 			return TaskMessage{}, NewReadableError(_l("An error occurred while downloading the feed"), &err)
@@ -237,55 +564,57 @@ func subscribeTask(pfc *PFContext) (TaskMessage, error) {
 				pfc.C.Errorf("Error reading RSS content (%s): %s", subscriptionURL, err)
 				return TaskMessage{}, NewReadableError(_l("Error reading RSS content"), &err)
 			} else {
-				favIconURL := ""
+				var favIcon *storage.FavIcon
 				if parsedFeed.WWWURL != "" {
-					if url, err := locateFavIconURL(pfc.C, parsedFeed.WWWURL); err != nil {
+					if icon, err := locateFavIcon(pfc, parsedFeed.WWWURL); err != nil {
 						// Not critical
 						pfc.C.Warningf("FavIcon retrieval error: %s", err)
-					} else if url != "" {
-						favIconURL = url
+					} else {
+						favIcon = icon
 					}
 				}
 
-				if err := storage.UpdateFeed(pfc.C, parsedFeed, favIconURL, time.Now()); err != nil {
+				if err := pfc.Storage.UpdateFeed(parsedFeed, favIcon, time.Now(), fetchInfoFromResponse(response)); err == storage.ErrLeaseHeld {
+					// Being updated elsewhere, with the same entries
+					pfc.C.Infof("Feed %s already being updated", subscriptionURL)
+				} else if err != nil {
 					return TaskMessage{}, err
 				}
 			}
 		}
 	}
 
-	if _, err := storage.UpdateSubscription(pfc.C, subscriptionURL, subscriptionRef); err != nil {
+	if _, err := pfc.Storage.UpdateSubscription(subscriptionURL, subscriptionRef); err != nil {
 		return TaskMessage{}, err
 	}
 
+	if err := subscribeToHub(pfc, subscriptionURL); err != nil {
+		pfc.C.Warningf("Error subscribing to hub for %s: %s", subscriptionURL, err)
+	}
+
 	return TaskMessage{
 		Refresh: true,
 	}, nil
 }
 
-func unsubscribeTask(pfc *PFContext) (TaskMessage, error) {
-	folderID := pfc.R.PostFormValue("folderID")
-	subscriptionID := pfc.R.PostFormValue("subscriptionID")
-
-	if subscriptionID == "" {
-		return TaskMessage{}, errors.New("Missing subscription ID")
+// markAsRead marks the articles within the scope read, by setting
+// the read range of its subscriptions, then queues their rewrite
+func markAsRead(pfc *PFContext, scope storage.ArticleScope, readRange storage.ReadRange) error {
+	if err := pfc.Storage.MarkAsRead(scope, readRange); err != nil {
+		return NewReadableError(_l("Error marking articles as read"), &err)
 	}
 
-	ref := storage.ArticleScope {
-		FolderRef: storage.FolderRef {
-			UserID: pfc.UserID,
-			FolderID: folderID,
-		},
-		SubscriptionID: subscriptionID,
+	params := taskParams {
+		"subscriptionID": scope.SubscriptionID,
+		"folderID":       scope.FolderID,
 	}
-
-	if err := storage.DeleteArticlesWithinScope(pfc.C, ref); err != nil {
-		return TaskMessage{}, err
+	if err := startTask(pfc, "markAllAsRead", params, modificationQueue); err != nil {
+		// Not critical - articles are read regardless, and the
+		// ranges are applied next time
+		pfc.C.Warningf("Error queueing read range rewrite: %s", err)
 	}
 
-	return TaskMessage{
-		Refresh: false,
-	}, nil
+	return nil
 }
 
 func markAllAsReadTask(pfc *PFContext) (TaskMessage, error) {
@@ -300,14 +629,9 @@ func markAllAsReadTask(pfc *PFContext) (TaskMessage, error) {
 		SubscriptionID: subscriptionID,
 	}
 
-	if marked, err := storage.MarkAllAsRead(pfc.C, ref); err != nil {
-		return TaskMessage{}, err
-	} else {
-		return TaskMessage {
-			Message: _l("%d items marked as read", marked),
-			Refresh: true,
-		}, nil
-	}
+	// The articles were already shown as read
+	_, err := pfc.Storage.ApplyReadRanges(ref)
+	return TaskMessage { Silent: true }, err
 }
 
 func moveSubscriptionTask(pfc *PFContext) (TaskMessage, error) {
@@ -330,7 +654,7 @@ func moveSubscriptionTask(pfc *PFContext) (TaskMessage, error) {
 		FolderID: destinationID,
 	}
 
-	if err := storage.MoveArticles(pfc.C, subscription, destination); err != nil {
+	if err := pfc.Storage.MoveArticles(subscription, destination); err != nil {
 		return TaskMessage{}, err
 	}
 	
@@ -338,11 +662,11 @@ func moveSubscriptionTask(pfc *PFContext) (TaskMessage, error) {
 }
 
 func syncFeedsTask(pfc *PFContext) (TaskMessage, error) {
-	if err := storage.UpdateAllSubscriptions(pfc.C, pfc.UserID); err != nil {
+	if err := pfc.Storage.UpdateAllSubscriptions(pfc.UserID); err != nil {
 		return TaskMessage{}, err
 	}
 
-	userSubscriptions, err := storage.NewUserSubscriptions(pfc.C, pfc.UserID)
+	userSubscriptions, err := pfc.Storage.NewUserSubscriptions(pfc.UserID)
 	if err != nil {
 		return TaskMessage{}, err
 	}
@@ -352,28 +676,3 @@ func syncFeedsTask(pfc *PFContext) (TaskMessage, error) {
 		Subscriptions: userSubscriptions,
 	}, nil
 }
-
-func removeFolderTask(pfc *PFContext) (TaskMessage, error) {
-	folderID := pfc.R.PostFormValue("folderID")
-	ref := storage.ArticleScope {
-		FolderRef: storage.FolderRef {
-			UserID: pfc.UserID,
-			FolderID: folderID,
-		},
-	}
-
-	if err := storage.DeleteArticlesWithinScope(pfc.C, ref); err != nil {
-		return TaskMessage{}, err
-	}
-
-	return TaskMessage{}, nil
-}
-
-func removeTagTask(pfc *PFContext) (TaskMessage, error) {
-	tagID := pfc.R.PostFormValue("tagID")
-	if err := storage.RemoveTag(pfc.C, pfc.UserID, tagID); err != nil {
-		return TaskMessage{}, err
-	}
-
-	return TaskMessage{}, nil
-}
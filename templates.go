@@ -41,7 +41,7 @@ const introTemplateHTML = `
 					<h1>Gofr</h1>
 					<h3>An open source RSS reader for the cloud.</h3>
 
-					<button class="sign-in" onclick="window.location='/reader';">Sign in with Google</button>
+					<button class="sign-in" onclick="window.location='/reader';">Sign in</button>
 					<div style="clear: both;"></div>
 				</div>
 			</div>
@@ -143,12 +143,32 @@ const readerTemplateHTML = `
 					<input name="opml" type="file" />
 					<input name="client" type="hidden" value="" />
 				</div>
+				<div class="import-options">
+					<label><input name="strict" type="checkbox" value="true" /> <span class="_l">Stop if any entry cannot be read</span></label>
+				</div>
 			</form>
 			<div class="buttons">
 				<button class="modal-cancel _l">Cancel</button>
 				<button class="modal-ok _l">Upload</button>
 			</div>
 		</div>
+		<div id="import-report" class="modal">
+			<h1 class="_l">Import report</h1>
+			<p class="import-summary"></p>
+			<ul class="import-results"></ul>
+			<div class="buttons">
+				<button class="modal-cancel _l">Close</button>
+				<button class="modal-ok _l">Retry failed</button>
+			</div>
+		</div>
+		<div id="choose-feed" class="modal">
+			<h1 class="_l">Choose a feed</h1>
+			<ul class="feed-candidates"></ul>
+			<div class="buttons">
+				<button class="modal-cancel _l">Cancel</button>
+				<button class="modal-ok _l">Subscribe</button>
+			</div>
+		</div>
 		<div id="about" class="modal">
 			<p><b>Gofr</b> is an open source Feed Reader 
 			(Google Reader clone) for 
@@ -167,3 +187,137 @@ const readerTemplateHTML = `
 	</body>
 </html>
 `
+const loginTemplateHTML = `
+<!DOCTYPE html>
+<html lang="en-US">
+	<head>
+		<meta http-equiv="Content-Type" content="text/html; charset=UTF-8"/>
+		<meta name="viewport" content="width=device-width, initial-scale=1, maximum-scale=1">
+		<link href="/content/auth.css" type="text/css" rel="stylesheet"/>
+		<title>Sign in - Gofr</title>
+	</head>
+	<body>
+		<div class="auth">
+			<h1>Gofr</h1>
+			{{if .Error}}<p class="error">{{.Error}}</p>{{end}}
+			<p>Sign in with:</p>
+			<ul class="providers">
+				{{range .Authenticators}}
+				<li><a href="/auth/{{.Name}}?continue={{$.Continue}}">{{.Title}}</a></li>
+				{{end}}
+			</ul>
+		</div>
+	</body>
+</html>
+`
+const accountTemplateHTML = `
+<!DOCTYPE html>
+<html lang="en-US">
+	<head>
+		<meta http-equiv="Content-Type" content="text/html; charset=UTF-8"/>
+		<meta name="viewport" content="width=device-width, initial-scale=1, maximum-scale=1">
+		<link href="/content/auth.css" type="text/css" rel="stylesheet"/>
+		<title>Linked logins - Gofr</title>
+	</head>
+	<body>
+		<div class="auth">
+			<h1>Gofr</h1>
+			<p>Signed in as {{.UserEmail}}. <a href="/reader">Back to the reader</a> | <a href="{{.LogOutURL}}">Sign out</a></p>
+			<h2>Linked logins</h2>
+			<p>You can sign in with any of these:</p>
+			<ul class="identities">
+				{{range .Identities}}
+				<li>
+					<span class="provider">{{.Title}}</span>
+					<span class="subject">{{if .Email}}{{.Email}}{{else}}{{.Subject}}{{end}}</span>
+					{{if $.CanUnlink}}
+					<form method="post" action="/account/unlink">
+						<input type="hidden" name="provider" value="{{.Provider}}">
+						<input type="hidden" name="subject" value="{{.Subject}}">
+						<input type="hidden" name="token" value="{{$.CSRFToken}}">
+						<button type="submit">Remove</button>
+					</form>
+					{{end}}
+				</li>
+				{{end}}
+			</ul>
+			<h2>Link another login</h2>
+			<p>Your subscriptions are kept, whichever login you use.</p>
+			<ul class="providers">
+				{{range .Authenticators}}
+				<li><a href="/auth/{{.Name}}?continue=/account">{{.Title}}</a></li>
+				{{end}}
+			</ul>
+			<h2>Fever API</h2>
+			<p>Clients that use the Fever API sign in with an email address and password of your choosing.{{if .FeverEnabled}} A password is currently set.{{end}}</p>
+			<form method="post" action="/account/fever">
+				<input type="hidden" name="token" value="{{.CSRFToken}}">
+				<label>Email address <input type="text" name="email" value="{{.UserEmail}}" required></label>
+				<label>Password <input type="password" name="password" required></label>
+				<label>Confirm password <input type="password" name="confirm" required></label>
+				<button type="submit">Set password</button>
+			</form>
+			{{if .FeverEnabled}}
+			<form method="post" action="/account/fever">
+				<input type="hidden" name="token" value="{{.CSRFToken}}">
+				<button type="submit">Disable Fever API</button>
+			</form>
+			{{end}}
+			<h2>Google Reader API</h2>
+			<p>Clients that use the Google Reader API sign in with {{.UserEmail}} and a password generated here.{{if .GReaderEnabled}} A password is currently set; generating another one replaces it, and signs out the clients using it.{{end}}</p>
+			{{if .GReaderPassword}}
+			<p>Your new password is <code>{{.GReaderPassword}}</code>. Make a note of it - it won't be shown again.</p>
+			{{end}}
+			<form method="post" action="/account/greader">
+				<input type="hidden" name="token" value="{{.CSRFToken}}">
+				<input type="hidden" name="generate" value="true">
+				<button type="submit">Generate password</button>
+			</form>
+			{{if .GReaderEnabled}}
+			<form method="post" action="/account/greader">
+				<input type="hidden" name="token" value="{{.CSRFToken}}">
+				<button type="submit">Disable Google Reader API</button>
+			</form>
+			{{end}}
+		</div>
+	</body>
+</html>
+`
+const localLoginTemplateHTML = `
+<!DOCTYPE html>
+<html lang="en-US">
+	<head>
+		<meta http-equiv="Content-Type" content="text/html; charset=UTF-8"/>
+		<meta name="viewport" content="width=device-width, initial-scale=1, maximum-scale=1">
+		<link href="/content/auth.css" type="text/css" rel="stylesheet"/>
+		<title>Sign in - Gofr</title>
+	</head>
+	<body>
+		<div class="auth">
+			<h1>Gofr</h1>
+			{{if .Error}}<p class="error">{{.Error}}</p>{{end}}
+			{{if not .Linking}}
+			<h2>Sign in</h2>
+			<form method="post" action="{{.Action}}">
+				<input type="hidden" name="action" value="signin">
+				<label>Username <input type="text" name="username" required autofocus></label>
+				<label>Password <input type="password" name="password" required></label>
+				<button type="submit">Sign in</button>
+			</form>
+			{{end}}
+			{{if .CanCreate}}
+			<h2>{{if .Linking}}Choose a username and password{{else}}Create an account{{end}}</h2>
+			<form method="post" action="{{.Action}}">
+				<input type="hidden" name="action" value="create">
+				{{if .Linking}}<input type="hidden" name="token" value="{{.CSRFToken}}">{{end}}
+				<label>Username <input type="text" name="username" required></label>
+				{{if not .Linking}}<label>Email address (optional) <input type="email" name="email"></label>{{end}}
+				<label>Password <input type="password" name="password" required></label>
+				<label>Confirm password <input type="password" name="confirm" required></label>
+				<button type="submit">{{if .Linking}}Link{{else}}Create account{{end}}</button>
+			</form>
+			{{end}}
+		</div>
+	</body>
+</html>
+`
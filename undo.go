@@ -0,0 +1,186 @@
+/*****************************************************************************
+ **
+ ** Gofr
+ ** https://github.com/pokebyte/Gofr
+ ** Copyright (C) 2013-2017 Akop Karapetyan
+ **
+ ** This program is free software; you can redistribute it and/or modify
+ ** it under the terms of the GNU General Public License as published by
+ ** the Free Software Foundation; either version 2 of the License, or
+ ** (at your option) any later version.
+ **
+ ** This program is distributed in the hope that it will be useful,
+ ** but WITHOUT ANY WARRANTY; without even the implied warranty of
+ ** MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ ** GNU General Public License for more details.
+ **
+ ** You should have received a copy of the GNU General Public License
+ ** along with this program; if not, write to the Free Software
+ ** Foundation, Inc., 675 Mass Ave, Cambridge, MA 02139, USA.
+ **
+ ******************************************************************************
+ */
+ 
+package gofr
+
+import (
+	"net/url"
+	"storage"
+	"time"
+)
+
+const (
+	undoSweepWorkers = 5
+)
+
+// UndoWindow is how long unsubscribing, removing a folder or a tag,
+// and marking articles as read can be undone. What those leave behind
+// is deleted once the window expires
+var UndoWindow = 24 * time.Hour
+
+func registerUndo() {
+	RegisterJSONRoute("/undoRecords", undoRecords)
+	RegisterJSONRoute("/undo",        undo)
+
+	RegisterCronRoute("/cron/sweepUndoRecords", sweepUndoRecordsJob)
+	RegisterTaskRoute("/tasks/sweepUndoRecords", sweepUndoRecordsTask)
+}
+
+// undoableRecords returns the records of the user that can still be
+// undone, newest first
+func undoableRecords(pfc *PFContext) ([]storage.UndoRecord, error) {
+	records, err := pfc.Storage.UndoRecords(pfc.UserID)
+	if err != nil {
+		return nil, err
+	}
+
+	cutoff := time.Now().Add(-UndoWindow)
+	undoable := make([]storage.UndoRecord, 0, len(records))
+	for _, record := range records {
+		if record.Created.After(cutoff) {
+			undoable = append(undoable, record)
+		}
+	}
+
+	return undoable, nil
+}
+
+func undoRecords(pfc *PFContext) (interface{}, error) {
+	return undoableRecords(pfc)
+}
+
+// undo reverses the operation with the specified ID, or the most
+// recent one if none is specified
+func undo(pfc *PFContext) (interface{}, error) {
+	recordID := pfc.R.PostFormValue("id")
+
+	records, err := undoableRecords(pfc)
+	if err != nil {
+		return nil, err
+	}
+
+	var record *storage.UndoRecord
+	for i, undoable := range records {
+		if recordID == "" || undoable.ID == recordID {
+			record = &records[i]
+			break
+		}
+	}
+
+	if record == nil {
+		return nil, NewReadableError(_l("Nothing to undo"), nil)
+	}
+
+	if err := pfc.Storage.Undo(*record); err != nil {
+		return nil, NewReadableError(_l("An error occurred while undoing the change"), &err)
+	}
+
+	return pfc.Storage.NewUserSubscriptions(pfc.UserID)
+}
+
+func discardUndoRecord(pfc *PFContext, ch chan<- bool, record *storage.UndoRecord) {
+	if err := pfc.Storage.DiscardUndoRecord(*record); err != nil {
+		pfc.C.Errorf("Error discarding undo record %s: %s", record.ID, err)
+		ch<- false
+		return
+	}
+
+	// Stop receiving pushes if nobody else is subscribed
+	for _, subscription := range record.Subscriptions {
+		if err := unsubscribeFromHub(pfc, subscription.FeedURL); err != nil {
+			pfc.C.Warningf("Error unsubscribing from hub for %s: %s", subscription.FeedURL, err)
+		}
+	}
+
+	ch<- true
+}
+
+func sweepUndoRecordsJob(pfc *PFContext) error {
+	return sweepUndoRecords(pfc, "")
+}
+
+func sweepUndoRecordsTask(pfc *PFContext) (TaskMessage, error) {
+	return TaskMessage { Silent: true }, sweepUndoRecords(pfc, pfc.R.PostFormValue("cursor"))
+}
+
+// sweepUndoRecords discards the undo records of all users once they
+// can no longer be undone
+func sweepUndoRecords(pfc *PFContext, cursor string) error {
+	c := pfc.C
+	started := time.Now()
+	doneChannel := make(chan bool, undoSweepWorkers)
+	pool := newWorkPool(c, undoSweepWorkers, 0, started)
+	var jobError error
+
+	discarded := 0
+	drained := make(chan bool)
+	go func() {
+		// Tally completions as they arrive
+		for ok := range doneChannel {
+			if ok {
+				discarded++
+			}
+		}
+		close(drained)
+	}()
+
+	t, err := pfc.Storage.UndoRecordsCreatedBefore(started.Add(-UndoWindow), cursor)
+	if err != nil {
+		return err
+	}
+
+	for {
+		if pool.Expired() {
+			// Out of time - continue in a separate task
+			if next, err := t.Cursor(); err != nil {
+				c.Errorf("Error reading cursor: %s", err)
+				jobError = err
+			} else if err := enqueueContinuation(pfc, "/tasks/sweepUndoRecords", url.Values { "cursor": { next } }, refreshQueue); err != nil {
+				c.Errorf("Error queueing continuation: %s", err)
+				jobError = err
+			}
+			break
+		}
+
+		record, err := t.Next()
+		if err == storage.Done {
+			break
+		} else if err != nil {
+			c.Errorf("Error fetching undo record: %s", err)
+			jobError = err
+			break
+		}
+
+		if !pool.Submit("", func() { discardUndoRecord(pfc, doneChannel, record) }) {
+			continue // Discarded on the next scheduled run
+		}
+	}
+
+	pool.Wait()
+	close(doneChannel)
+	<-drained
+
+	c.Infof("%d undo records discarded in %s", discarded, time.Since(started))
+
+	return jobError
+}
@@ -24,11 +24,9 @@
 package gofr
 
 import (
-	"appengine/user"
 	"encoding/xml"
 	"html/template"
 	"net/http"
-	"storage"
 )
 
 func registerWeb() {
@@ -56,9 +54,7 @@ func intro(pfc *PFContext) {
 func reader(pfc *PFContext) {
 	content := map[string]string {
 		"UserEmail": pfc.User.EmailAddress,
-	}
-	if logoutURL, err := user.LogoutURL(pfc.C, "/"); err == nil {
-		content["LogOutURL"] = logoutURL
+		"LogOutURL": logoutURL("/"),
 	}
 
 	if err := readerTemplate.Execute(pfc.W, content); err != nil {
@@ -70,12 +66,13 @@ func exportOPML(pfc *PFContext) {
 	c := pfc.C
 	w := pfc.W
 
-	if opml, err := storage.SubscriptionsAsOPML(c, pfc.UserID); err != nil {
+	if opml, err := pfc.Storage.SubscriptionsAsOPML(pfc.UserID); err != nil {
 		c.Errorf("Error retrieving list of subscriptions: %s", err)
 		http.Error(w, _l("Error retrieving list of subscriptions"), http.StatusInternalServerError)
 		return
 	} else {
 		opml.SetTitle(_l("Gofr subscriptions for %s", pfc.User.EmailAddress))
+		opml.SetOwner("", pfc.User.EmailAddress)
 
 		if output, err := xml.MarshalIndent(opml, "", "    "); err != nil {
 			c.Errorf("Error generating XML: %s", err)
@@ -0,0 +1,442 @@
+/*****************************************************************************
+ **
+ ** Gofr
+ ** https://github.com/pokebyte/Gofr
+ ** Copyright (C) 2013-2017 Akop Karapetyan
+ **
+ ** This program is free software; you can redistribute it and/or modify
+ ** it under the terms of the GNU General Public License as published by
+ ** the Free Software Foundation; either version 2 of the License, or
+ ** (at your option) any later version.
+ **
+ ** This program is distributed in the hope that it will be useful,
+ ** but WITHOUT ANY WARRANTY; without even the implied warranty of
+ ** MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ ** GNU General Public License for more details.
+ **
+ ** You should have received a copy of the GNU General Public License
+ ** along with this program; if not, write to the Free Software
+ ** Foundation, Inc., 675 Mass Ave, Cambridge, MA 02139, USA.
+ **
+ ******************************************************************************
+ */
+ 
+package gofr
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"rss"
+	"storage"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// WebSub (formerly PubSubHubbub) subscriber
+// See https://www.w3.org/TR/websub/
+
+const (
+	hubCallbackPath = "/websub/callback"
+
+	hubLeaseSeconds = 10 * 24 * 60 * 60
+	hubPendingTimeout = time.Duration(24) * time.Hour
+	hubRenewalWindow = time.Duration(24) * time.Hour
+	hubMaxContentLength = 4 << 20
+)
+
+func registerWebSub() {
+	RegisterAnonHTMLRoute(hubCallbackPath, hubCallback)
+	RegisterCronRoute("/cron/renewHubSubscriptions", renewHubSubscriptionsJob)
+}
+
+// hubCallbackURL returns the URL the hub calls back. It carries the
+// subscription's token, so only the hub can verify or deny requests,
+// or deliver content
+func hubCallbackURL(pfc *PFContext, hubSub *storage.HubSubscription) string {
+	return fmt.Sprintf("%s%s?feed=%s&token=%s", pfc.Platform.BaseURL(),
+		hubCallbackPath, url.QueryEscape(hubSub.FeedURL), url.QueryEscape(hubSub.CallbackToken))
+}
+
+func generateHubSecret() (string, error) {
+	secret := make([]byte, 20)
+	if _, err := rand.Read(secret); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(secret), nil
+}
+
+// requestHubSubscription sends a subscription (or unsubscription)
+// request to the hub. The hub then verifies the intent of the
+// request asynchronously, via hubCallback
+func requestHubSubscription(pfc *PFContext, hubSub *storage.HubSubscription, mode string) error {
+	// The token (and so the callback URL) is kept across renewals -
+	// hubs tell subscriptions apart by callback
+	if hubSub.CallbackToken == "" {
+		if token, err := generateHubSecret(); err != nil {
+			return err
+		} else {
+			hubSub.CallbackToken = token
+		}
+	}
+
+	if mode == "subscribe" {
+		// A subscription being renewed stays as it is until the hub
+		// verifies the renewal; content may be signed with either
+		// secret until then
+		if secret, err := generateHubSecret(); err != nil {
+			return err
+		} else {
+			hubSub.PendingSecret = secret
+		}
+
+		if hubSub.Mode != mode {
+			hubSub.Verified = false
+		}
+	} else {
+		hubSub.PendingSecret = ""
+		hubSub.Verified = false
+	}
+
+	hubSub.Mode = mode
+	hubSub.Requested = time.Now()
+	if !hubSub.Verified {
+		hubSub.LeaseExpires = hubSub.Requested.Add(hubPendingTimeout) // retry if never verified
+	}
+
+	// Save before contacting the hub - verification may arrive
+	// before the request returns
+	if err := pfc.Storage.SaveHubSubscription(*hubSub); err != nil {
+		return err
+	}
+
+	params := url.Values {
+		"hub.callback": { hubCallbackURL(pfc, hubSub) },
+		"hub.mode": { mode },
+		"hub.topic": { hubSub.Topic },
+	}
+	if mode == "subscribe" {
+		params.Set("hub.lease_seconds", strconv.Itoa(hubLeaseSeconds))
+		params.Set("hub.secret", hubSub.PendingSecret)
+	}
+
+	client := createHttpClient(pfc)
+	if response, err := client.PostForm(hubSub.HubURL, params); err != nil {
+		return err
+	} else {
+		defer response.Body.Close()
+		if response.StatusCode < 200 || response.StatusCode > 299 {
+			body, _ := ioutil.ReadAll(response.Body)
+			return fmt.Errorf("Hub %s rejected %s request (HTTP %d): %s", hubSub.HubURL,
+				mode, response.StatusCode, strings.TrimSpace(string(body)))
+		}
+	}
+
+	return nil
+}
+
+// subscribeToHub subscribes to the feed's hub, if it has one and
+// isn't already subscribed
+func subscribeToHub(pfc *PFContext, feedURL string) error {
+	feed, err := pfc.Storage.FeedByURL(feedURL)
+	if err != nil {
+		return err
+	} else if feed == nil || feed.HubURL == "" {
+		return nil // No hub
+	}
+
+	hubSub, err := pfc.Storage.HubSubscriptionByURL(feedURL)
+	if err != nil {
+		return err
+	} else if hubSub == nil {
+		newHubSub := storage.NewHubSubscription(feedURL)
+		hubSub = &newHubSub
+	} else if hubSub.HubURL == feed.HubURL && hubSub.IsActive(hubPendingTimeout) {
+		return nil // Already subscribed
+	}
+
+	hubSub.HubURL = feed.HubURL
+	hubSub.Topic = feed.Topic
+	if hubSub.Topic == "" {
+		hubSub.Topic = feedURL
+	}
+
+	return requestHubSubscription(pfc, hubSub, "subscribe")
+}
+
+func hubCallback(pfc *PFContext) {
+	c := pfc.C
+	r := pfc.R
+	w := pfc.W
+
+	feedURL := r.URL.Query().Get("feed")
+	if feedURL == "" {
+		http.Error(w, "Missing feed", http.StatusNotFound)
+		return
+	}
+
+	hubSub, err := pfc.Storage.HubSubscriptionByURL(feedURL)
+	if err != nil {
+		c.Errorf("Error loading hub subscription for %s: %s", feedURL, err)
+		http.Error(w, "Unexpected error", http.StatusInternalServerError)
+		return
+	} else if hubSub == nil || !isHubCallbackTokenValid(hubSub, r.URL.Query().Get("token")) {
+		http.Error(w, "Not subscribed", http.StatusNotFound)
+		return
+	}
+
+	if r.Method == "GET" {
+		verifyHubSubscription(pfc, hubSub)
+	} else if r.Method == "POST" {
+		receiveHubContent(pfc, hubSub)
+	} else {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func isHubCallbackTokenValid(hubSub *storage.HubSubscription, token string) bool {
+	return hubSub.CallbackToken != "" &&
+		subtle.ConstantTimeCompare([]byte(hubSub.CallbackToken), []byte(token)) == 1
+}
+
+func verifyHubSubscription(pfc *PFContext, hubSub *storage.HubSubscription) {
+	c := pfc.C
+	w := pfc.W
+	query := pfc.R.URL.Query()
+
+	mode := query.Get("hub.mode")
+	topic := query.Get("hub.topic")
+
+	if mode == "denied" {
+		// Only a pending subscription request can be denied
+		if hubSub.Mode != "subscribe" || !hubSub.IsPending() || topic != hubSub.Topic {
+			c.Warningf("Unexpected denial for %s", topic)
+			http.Error(w, "Not found", http.StatusNotFound)
+			return
+		}
+
+		c.Warningf("Hub denied subscription to %s: %s", hubSub.Topic, query.Get("hub.reason"))
+
+		var err error
+		if hubSub.Verified {
+			// A renewal - the current subscription lasts until its
+			// lease runs out
+			hubSub.PendingSecret = ""
+			err = pfc.Storage.SaveHubSubscription(*hubSub)
+		} else {
+			err = pfc.Storage.DeleteHubSubscription(*hubSub)
+		}
+
+		if err != nil {
+			c.Errorf("Error updating denied hub subscription: %s", err)
+		}
+		return
+	}
+
+	if mode != hubSub.Mode || topic != hubSub.Topic {
+		c.Warningf("Unexpected %s verification for %s", mode, topic)
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+
+	if mode == "unsubscribe" {
+		if err := pfc.Storage.DeleteHubSubscription(*hubSub); err != nil {
+			c.Errorf("Error removing hub subscription: %s", err)
+			http.Error(w, "Unexpected error", http.StatusInternalServerError)
+			return
+		}
+	} else {
+		leaseSeconds, err := strconv.Atoi(query.Get("hub.lease_seconds"))
+		if err != nil || leaseSeconds <= 0 {
+			leaseSeconds = hubLeaseSeconds
+		}
+
+		hubSub.Verified = true
+		if hubSub.PendingSecret != "" {
+			hubSub.Secret, hubSub.PendingSecret = hubSub.PendingSecret, ""
+		}
+		hubSub.LeaseExpires = time.Now().Add(time.Duration(leaseSeconds) * time.Second)
+
+		if err := pfc.Storage.SaveHubSubscription(*hubSub); err != nil {
+			c.Errorf("Error saving hub subscription: %s", err)
+			http.Error(w, "Unexpected error", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	w.Header().Set("Content-type", "text/plain; charset=utf-8")
+	w.Write([]byte(query.Get("hub.challenge")))
+}
+
+// isHubSignatureValid checks the X-Hub-Signature header
+// ("method=signature") against the HMAC of the content
+func isHubSignatureValid(secret string, signature string, content []byte) bool {
+	parts := strings.SplitN(signature, "=", 2)
+	if len(parts) != 2 {
+		return false
+	}
+
+	var hasher func() hash.Hash
+	switch strings.ToLower(parts[0]) {
+	case "sha1":
+		hasher = sha1.New
+	case "sha256":
+		hasher = sha256.New
+	case "sha384":
+		hasher = sha512.New384
+	case "sha512":
+		hasher = sha512.New
+	default:
+		return false
+	}
+
+	expected, err := hex.DecodeString(parts[1])
+	if err != nil {
+		return false
+	}
+
+	mac := hmac.New(hasher, []byte(secret))
+	mac.Write(content)
+
+	return hmac.Equal(mac.Sum(nil), expected)
+}
+
+// isHubContentSigned checks the signature of the content against
+// the subscription's secret, and that of a renewal pending
+// verification
+func isHubContentSigned(hubSub *storage.HubSubscription, signature string, content []byte) bool {
+	if hubSub.Secret == "" && hubSub.PendingSecret == "" {
+		return true
+	}
+
+	for _, secret := range []string { hubSub.Secret, hubSub.PendingSecret } {
+		if secret != "" && isHubSignatureValid(secret, signature, content) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func receiveHubContent(pfc *PFContext, hubSub *storage.HubSubscription) {
+	c := pfc.C
+	r := pfc.R
+
+	content, err := ioutil.ReadAll(http.MaxBytesReader(pfc.W, r.Body, hubMaxContentLength))
+	if err != nil {
+		c.Errorf("Error reading hub content for %s: %s", hubSub.FeedURL, err)
+		http.Error(pfc.W, "Error reading content", http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	// Per spec, acknowledge content with an invalid signature,
+	// but otherwise ignore it
+	if !hubSub.Verified || hubSub.Mode != "subscribe" {
+		c.Warningf("Ignoring hub content for inactive subscription %s", hubSub.FeedURL)
+		return
+	} else if !isHubContentSigned(hubSub, r.Header.Get("X-Hub-Signature"), content) {
+		c.Warningf("Ignoring hub content for %s: invalid signature", hubSub.FeedURL)
+		return
+	}
+
+	if err := updateFeedFromHub(pfc, hubSub.FeedURL, content); err != nil {
+		c.Errorf("Error updating %s from hub: %s", hubSub.FeedURL, err)
+		http.Error(pfc.W, "Unexpected error", http.StatusInternalServerError)
+	}
+}
+
+func updateFeedFromHub(pfc *PFContext, feedURL string, content []byte) error {
+	parsedFeed, err := rss.UnmarshalStream(feedURL, bytes.NewReader(content))
+	if err != nil {
+		return err
+	}
+
+	fetchInfo := storage.FetchInfo {
+		StatusCode: http.StatusOK,
+	}
+
+	return pfc.Storage.UpdateFeed(parsedFeed, nil, time.Now(), fetchInfo)
+}
+
+func renewHubSubscriptionsJob(pfc *PFContext) error {
+	c := pfc.C
+	started := time.Now()
+
+	hubSubs, err := pfc.Storage.HubSubscriptionsExpiringBefore(time.Now().Add(hubRenewalWindow))
+	if err != nil {
+		return err
+	}
+
+	var jobError error
+	renewed, unsubscribed := 0, 0
+
+	for i, _ := range hubSubs {
+		hubSub := &hubSubs[i]
+		feedURL := hubSub.FeedURL
+
+		if hubSub.IsPending() && time.Since(hubSub.Requested) < hubPendingTimeout {
+			continue // Still waiting on the hub
+		} else if hubSub.Mode == "unsubscribe" {
+			// Unsubscription was never verified; don't bother
+			// the hub again
+			if err := pfc.Storage.DeleteHubSubscription(*hubSub); err != nil {
+				jobError = err
+			}
+			continue
+		}
+
+		subscriberCount, err := pfc.Storage.SubscriberCount(feedURL)
+		if err != nil {
+			c.Errorf("Error reading subscriber count for %s: %s", feedURL, err)
+			jobError = err
+			continue
+		}
+
+		mode := "subscribe"
+		if subscriberCount < 1 {
+			mode = "unsubscribe"
+			unsubscribed++
+		} else {
+			renewed++
+		}
+
+		if err := requestHubSubscription(pfc, hubSub, mode); err != nil {
+			c.Errorf("Error renewing hub subscription for %s: %s", feedURL, err)
+		}
+	}
+
+	c.Infof("%d hub subscriptions renewed, %d unsubscribed in %s", renewed, unsubscribed, time.Since(started))
+
+	return jobError
+}
+
+// unsubscribeFromHub cancels the hub subscription for a feed once
+// it no longer has any subscribers
+func unsubscribeFromHub(pfc *PFContext, feedURL string) error {
+	if subscriberCount, err := pfc.Storage.SubscriberCount(feedURL); err != nil {
+		return err
+	} else if subscriberCount > 0 {
+		return nil
+	}
+
+	hubSub, err := pfc.Storage.HubSubscriptionByURL(feedURL)
+	if err != nil {
+		return err
+	} else if hubSub == nil || hubSub.Mode != "subscribe" {
+		return nil
+	}
+
+	return requestHubSubscription(pfc, hubSub, "unsubscribe")
+}
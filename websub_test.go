@@ -0,0 +1,239 @@
+// +build !appengine
+
+/*****************************************************************************
+ **
+ ** Gofr
+ ** https://github.com/pokebyte/Gofr
+ ** Copyright (C) 2013-2017 Akop Karapetyan
+ **
+ ** This program is free software; you can redistribute it and/or modify
+ ** it under the terms of the GNU General Public License as published by
+ ** the Free Software Foundation; either version 2 of the License, or
+ ** (at your option) any later version.
+ **
+ ** This program is distributed in the hope that it will be useful,
+ ** but WITHOUT ANY WARRANTY; without even the implied warranty of
+ ** MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ ** GNU General Public License for more details.
+ **
+ ** You should have received a copy of the GNU General Public License
+ ** along with this program; if not, write to the Free Software
+ ** Foundation, Inc., 675 Mass Ave, Cambridge, MA 02139, USA.
+ **
+ ******************************************************************************
+ */
+ 
+package gofr
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/hex"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"storage"
+	"storage/embedded"
+	"strings"
+	"testing"
+)
+
+// openTestServer starts a standalone server on an embedded store in
+// a temporary directory. The returned function shuts it down
+func openTestServer(t *testing.T) (*Server, func()) {
+	dir, err := ioutil.TempDir("", "gofr")
+	if err != nil {
+		t.Fatalf("Error creating directory: %s", err)
+	}
+
+	store, err := embedded.Open(filepath.Join(dir, "test.db"))
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatalf("Error opening store: %s", err)
+	}
+
+	server := NewServer(ServerConfig {
+		Storage: store,
+		BaseURL: "http://reader.example.com",
+		UploadDir: dir,
+		Logger: log.New(ioutil.Discard, "", 0),
+	})
+
+	return server, func() {
+		store.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+// testPFContext returns the context the server would handle the
+// request in
+func testPFContext(server *Server, w http.ResponseWriter, r *http.Request) *PFContext {
+	return &PFContext {
+		R: r,
+		C: serverContext { server.config.Logger },
+		W: w,
+		Platform: &standalonePlatform { server: server, r: r },
+		Storage: server.config.Storage,
+	}
+}
+
+const testHubFeedURL = "http://example.com/feed"
+
+func testHubContent(title string) string {
+	return `<?xml version="1.0"?><rss version="2.0"><channel><title>` + title +
+		`</title><link>http://example.com/</link><item><guid>a</guid><title>A</title></item></channel></rss>`
+}
+
+func signHubContent(secret string, content string) string {
+	mac := hmac.New(sha1.New, []byte(secret))
+	mac.Write([]byte(content))
+
+	return "sha1=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func TestHubCallback(t *testing.T) {
+	server, done := openTestServer(t)
+	defer done()
+
+	var hubRequests []url.Values
+	hub := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		hubRequests = append(hubRequests, r.PostForm)
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer hub.Close()
+
+	store := server.config.Storage
+	loadHubSub := func() *storage.HubSubscription {
+		hubSub, err := store.HubSubscriptionByURL(testHubFeedURL)
+		if err != nil {
+			t.Fatalf("Error loading hub subscription: %s", err)
+		}
+		return hubSub
+	}
+	request := func() {
+		hubSub := loadHubSub()
+		if hubSub == nil {
+			newHubSub := storage.NewHubSubscription(testHubFeedURL)
+			newHubSub.HubURL, newHubSub.Topic = hub.URL, testHubFeedURL
+			hubSub = &newHubSub
+		}
+
+		r := httptest.NewRequest("GET", "/", nil)
+		if err := requestHubSubscription(testPFContext(server, httptest.NewRecorder(), r), hubSub, "subscribe"); err != nil {
+			t.Fatalf("Error requesting hub subscription: %s", err)
+		}
+	}
+	callback := func(method string, query url.Values, signature string, content string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, hubCallbackPath + "?" + query.Encode(), strings.NewReader(content))
+		if signature != "" {
+			r.Header.Set("X-Hub-Signature", signature)
+		}
+
+		w := httptest.NewRecorder()
+		server.ServeHTTP(w, r)
+		return w
+	}
+
+	request()
+	hubSub := loadHubSub()
+	if len(hubRequests) != 1 {
+		t.Fatalf("Expected a request to the hub, got %d", len(hubRequests))
+	} else if hubRequests[0].Get("hub.secret") != hubSub.PendingSecret {
+		t.Errorf("Expected the pending secret to be sent")
+	}
+
+	callbackURL, _ := url.Parse(hubRequests[0].Get("hub.callback"))
+	token := callbackURL.Query().Get("token")
+	if token == "" || token != hubSub.CallbackToken {
+		t.Fatalf("Expected the callback token in %s", callbackURL)
+	}
+
+	// Denials without the token, or for another topic, are refused
+	denial := url.Values {
+		"feed": { testHubFeedURL },
+		"hub.mode": { "denied" },
+		"hub.topic": { testHubFeedURL },
+	}
+	if w := callback("GET", denial, "", ""); w.Code != http.StatusNotFound {
+		t.Errorf("Expected a denial without a token refused, got %d", w.Code)
+	}
+	denial.Set("token", token)
+	denial.Set("hub.topic", "http://example.com/other")
+	if w := callback("GET", denial, "", ""); w.Code != http.StatusNotFound {
+		t.Errorf("Expected a denial of another topic refused, got %d", w.Code)
+	} else if loadHubSub() == nil {
+		t.Fatalf("Hub subscription removed")
+	}
+
+	verification := url.Values {
+		"feed": { testHubFeedURL },
+		"token": { token },
+		"hub.mode": { "subscribe" },
+		"hub.topic": { testHubFeedURL },
+		"hub.challenge": { "challenge" },
+	}
+	if w := callback("GET", verification, "", ""); w.Code != http.StatusOK || w.Body.String() != "challenge" {
+		t.Fatalf("Unexpected response to verification: %d %q", w.Code, w.Body.String())
+	}
+
+	hubSub = loadHubSub()
+	secret := hubSub.Secret
+	if !hubSub.Verified || secret != hubRequests[0].Get("hub.secret") || hubSub.PendingSecret != "" {
+		t.Fatalf("Expected a verified subscription, got %+v", hubSub)
+	}
+
+	// A verified subscription can't be denied
+	denial.Set("hub.topic", testHubFeedURL)
+	if w := callback("GET", denial, "", ""); w.Code != http.StatusNotFound {
+		t.Errorf("Expected a denial of a verified subscription refused, got %d", w.Code)
+	}
+
+	// Renewing keeps the subscription, its secret and its callback
+	// until the hub verifies the renewal
+	request()
+	hubSub = loadHubSub()
+	if len(hubRequests) != 2 {
+		t.Fatalf("Expected a renewal request to the hub")
+	} else if hubRequests[1].Get("hub.callback") != callbackURL.String() {
+		t.Errorf("Expected the callback kept, got %s", hubRequests[1].Get("hub.callback"))
+	} else if !hubSub.Verified || hubSub.Secret != secret || hubSub.PendingSecret != hubRequests[1].Get("hub.secret") {
+		t.Errorf("Unexpected renewed subscription: %+v", hubSub)
+	}
+
+	// Content signed with either secret is accepted
+	for _, push := range []struct {
+		Secret string
+		Title string
+		Token string
+	} {
+		{ secret, "Signed with the current secret", token },
+		{ hubSub.PendingSecret, "Signed with the pending secret", token },
+		{ "bogus", "Signed with another secret", token },
+		{ secret, "Sent without the token", "" },
+	} {
+		content := testHubContent(push.Title)
+		query := url.Values { "feed": { testHubFeedURL } }
+		if push.Token != "" {
+			query.Set("token", push.Token)
+		}
+		callback("POST", query, signHubContent(push.Secret, content), content)
+	}
+
+	if feed, err := store.FeedByURL(testHubFeedURL); err != nil {
+		t.Fatalf("Error loading feed: %s", err)
+	} else if feed == nil || feed.Title != "Signed with the pending secret" {
+		t.Errorf("Expected content signed with either secret, got %+v", feed)
+	}
+
+	// Denying the renewal leaves the subscription as it was
+	if w := callback("GET", denial, "", ""); w.Code != http.StatusOK {
+		t.Errorf("Expected the renewal denied, got %d", w.Code)
+	} else if hubSub = loadHubSub(); hubSub == nil || !hubSub.Verified || hubSub.Secret != secret || hubSub.PendingSecret != "" {
+		t.Errorf("Unexpected subscription after denial: %+v", hubSub)
+	}
+}